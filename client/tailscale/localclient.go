@@ -1376,6 +1376,16 @@ func (lc *LocalClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, er
 	return sc, nil
 }
 
+// ServeStats returns the traffic counters of the serve web handlers that
+// have served requests since tailscaled started.
+func (lc *LocalClient) ServeStats(ctx context.Context) ([]ipn.ServeHandlerStats, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/serve-stats")
+	if err != nil {
+		return nil, fmt.Errorf("getting serve stats: %w", err)
+	}
+	return decodeJSON[[]ipn.ServeHandlerStats](body)
+}
+
 func getServeConfigFromJSON(body []byte) (sc *ipn.ServeConfig, err error) {
 	if err := json.Unmarshal(body, &sc); err != nil {
 		return nil, err
@@ -51,10 +51,11 @@ func newFunnelCommand(e *serveEnv) *ffcli.Command {
 			{
 				Name:       "status",
 				Exec:       e.runServeStatus,
-				ShortUsage: "tailscale funnel status [--json]",
+				ShortUsage: "tailscale funnel status [--json] [--check-cert]",
 				ShortHelp:  "Show current serve/funnel status",
 				FlagSet: e.newFlags("funnel-status", func(fs *flag.FlagSet) {
 					fs.BoolVar(&e.json, "json", false, "output JSON")
+					fs.BoolVar(&e.checkCert, "check-cert", false, "also show when the TLS certificate of each https port expires")
 				}),
 			},
 		},
@@ -111,6 +112,11 @@ func (e *serveEnv) runFunnel(ctx context.Context, args []string) error {
 		// Nothing to do.
 		return nil
 	}
+	if on {
+		if err := checkFunnelWebDAV(sc, hp); err != nil {
+			return err
+		}
+	}
 	sc.SetFunnel(dnsName, port, on)
 
 	if err := e.lc.SetServeConfig(ctx, sc); err != nil {
@@ -4,30 +4,37 @@
 package cli
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
-	"reflect"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
-	"tailscale.com/version"
 )
 
 var serveCmd = func() *ffcli.Command {
@@ -46,9 +53,48 @@ func newServeLegacyCommand(e *serveEnv) *ffcli.Command {
 		ShortUsage: strings.Join([]string{
 			"tailscale serve http:<port> <mount-point> <source> [off]",
 			"tailscale serve https:<port> <mount-point> <source> [off]",
+			"tailscale serve --replace (http|https):<port> <mount-point> <source>",
+			"tailscale serve --if-not-exists (http|https):<port> <mount-point> <source>",
+			"tailscale serve --no-http2 (http|https):<port> <mount-point> <proxy-target>",
+			"tailscale serve --proxy-host <host> (http|https):<port> <mount-point> <proxy-target>",
+			"tailscale serve --grpc-web (http|https):<port> <mount-point> <proxy-target>",
+			"tailscale serve --backend-keepalive <duration> (http|https):<port> <mount-point> <proxy-target>",
+			"tailscale serve [--connect-timeout <duration>] [--response-header-timeout <duration>] (http|https):<port> <mount-point> <proxy-target>",
+			"tailscale serve --request-id-header <header> (http|https):<port> <mount-point> <proxy-target>",
+			"tailscale serve --canary <proxy-target>=<percent>% (http|https):<port> <mount-point> <proxy-target>",
+			"tailscale serve --allow-methods <methods> (http|https):<port> <mount-point> <source>",
+			"tailscale serve --aggregate-backends (http|https):<port> <mount-point>",
+			"tailscale serve --label <label> <serve-args>",
+			"tailscale serve --log-level (error|info|debug) (http|https):<port> <mount-point> <source>",
+			"tailscale serve --require-tag <tag> (http|https):<port> <mount-point> <source>",
+			"tailscale serve --allow-cidr <cidr> [--allow-cidr <cidr>...] (http|https):<port> <mount-point> <source>",
+			"tailscale serve (--basic-auth <user>:<password>|--basic-auth-file <htpasswd-file>) (http|https):<port> <mount-point> <source>",
+			"tailscale serve --cache-control <policy> (http|https):<port> <mount-point> <path>",
+			"tailscale serve --spa-fallback (http|https):<port> <mount-point> <directory>",
+			"tailscale serve --webdav [--webdav-read-only] (http|https):<port> <mount-point> <directory>",
+			"tailscale serve --serve-dotfiles (http|https):<port> <mount-point> <directory>",
+			"tailscale serve --compress (http|https):<port> <mount-point> <source>",
+			"tailscale serve --drain <duration> (http|https):<port> <mount-point> (<source>|off)",
+			"tailscale serve --wait <duration> (http|https):<port> <mount-point> off",
+			"tailscale serve --service svc:<name> (http|https):<port> <mount-point> (<source>|off)",
+			"tailscale serve --virtual-host <name> (http|https):<port> <mount-point> (<source>|off)",
+			"tailscale serve (http|https):<port> <mount-point> archive:<zip-or-tar-file>",
+			"tailscale serve (http|https):<port> <mount-point> pac:<pac-file>",
+			"tailscale serve (http|https):<port> <mount-point> pipe:<pipe-name>",
+			"tailscale serve http:<port> <mount-point> redirect-to-https",
+			"tailscale serve --tls-min-version (1.2|1.3) (https:<port> <mount-point> <source>|tls-terminated-tcp:<port> <target>)",
 			"tailscale serve tcp:<port> tcp://localhost:<local-port> [off]",
+			"tailscale serve --max-conns <n> (tcp|tls-terminated-tcp):<port> tcp://localhost:<local-port>",
+			"tailscale serve --backlog <n> (tcp|tls-terminated-tcp):<port> tcp://localhost:<local-port>",
 			"tailscale serve tls-terminated-tcp:<port> tcp://localhost:<local-port> [off]",
-			"tailscale serve status [--json]",
+			"tailscale serve --sni <name>=localhost:<port> tls-terminated-tcp:<port> tcp://localhost:<local-port>",
+			"tailscale serve status [--json|--watch] [--check-cert] [--family (v4|v6)]",
+			"tailscale serve stats [--json]",
+			"tailscale serve watch-file <path>",
+			"tailscale serve validate <path>",
+			"tailscale serve maintenance [--page <html-file>] (on|off)",
+			"tailscale serve --from-env",
+			"tailscale serve edit --interactive",
 			"tailscale serve reset",
 		}, "\n"),
 		LongHelp: strings.TrimSpace(`
@@ -74,6 +120,116 @@ func newServeLegacyCommand(e *serveEnv) *ffcli.Command {
     $ tailscale serve https / /home/alice/blog/index.html
     $ tailscale serve https /images/ /home/alice/blog/images
 
+  - To serve a static site straight out of a zip or tar file:
+    $ tailscale serve https / archive:/home/alice/site.zip
+
+  - To serve a proxy auto-config (PAC) file for clients using the tailnet as a proxy:
+    $ tailscale serve https /proxy.pac pac:/etc/tailscale/proxy.pac
+
+  - On Windows, to proxy requests to a web server listening on the local
+    named pipe \\.\pipe\myapp:
+    $ tailscale serve https / pipe:myapp
+
+  - To replace all existing handlers on port 443 with a single proxy:
+    $ tailscale serve --replace https:443 / http://127.0.0.1:3000
+
+  - To add a handler only if the mount point doesn't have one yet, such as
+    in a provisioning script that may run more than once:
+    $ tailscale serve --if-not-exists https / http://127.0.0.1:3000
+
+  - To proxy to a backend that only works over HTTP/1.1:
+    $ tailscale serve --no-http2 https:443 / https://127.0.0.1:8443
+
+  - To proxy to a virtual-hosted backend that expects a specific Host header:
+    $ tailscale serve --proxy-host backend.internal https / http://127.0.0.1:8080
+
+  - To let browsers call a gRPC server using gRPC-Web:
+    $ tailscale serve --grpc-web https / http://127.0.0.1:50051
+
+  - To stop reusing connections to a backend once they've been idle for
+    30 seconds, for a backend that closes idle connections after a minute:
+    $ tailscale serve --backend-keepalive 30s https / http://127.0.0.1:3000
+
+  - To give up on a backend that doesn't accept the connection within 5
+    seconds, while letting it take up to 2 minutes to start responding:
+    $ tailscale serve --connect-timeout 5s --response-header-timeout 2m https / http://127.0.0.1:3000
+
+  - To tag each proxied request with an X-Request-Id header, unless it
+    already has one, for finding it in the backend's logs:
+    $ tailscale serve --request-id-header X-Request-Id https / http://127.0.0.1:3000
+
+  - To try a new version of a backend on a random 10% of requests, before
+    switching all of them over to it:
+    $ tailscale serve --canary http://127.0.0.1:3001=10% https / http://127.0.0.1:3000
+
+  - To serve a directory read-only, rejecting other HTTP methods with 405:
+    $ tailscale serve --allow-methods GET,HEAD https / /home/alice/blog
+
+  - To add a health endpoint that returns 200 only if all proxy backends
+    are reachable (and 503 otherwise):
+    $ tailscale serve --aggregate-backends https /healthz
+
+  - To describe what a handler is for in 'tailscale serve status':
+    $ tailscale serve --label "internal dashboard" https /grafana http://127.0.0.1:3000
+
+  - To log each request to one proxy, with its headers, while debugging it:
+    $ tailscale serve --log-level debug https /api http://127.0.0.1:8080
+
+  - To serve a mount only to tailnet nodes tagged tag:admin:
+    $ tailscale serve --require-tag tag:admin https /admin http://127.0.0.1:3000
+
+  - To serve a mount only to clients in an office subnet reached through a subnet router:
+    $ tailscale serve --allow-cidr 192.168.10.0/24 https /intranet http://127.0.0.1:3000
+
+  - To require a user name and password (HTTP Basic auth) for a mount, with
+    users from an htpasswd file of bcrypt hashes (htpasswd -B):
+    $ tailscale serve --basic-auth-file /etc/tailscale/htpasswd https /admin http://127.0.0.1:9000
+
+  - To serve a directory of static assets with an explicit cache policy:
+    $ tailscale serve --cache-control "public, max-age=3600" https /static/ /home/alice/blog/static
+
+  - To serve a single-page app, whose client-side routes are all answered
+    with its index.html:
+    $ tailscale serve --spa-fallback https / /home/alice/app/dist
+
+  - To share a directory over WebDAV, for clients to mount and sync files
+    with, or only to read them with --webdav-read-only:
+    $ tailscale serve --webdav https /files/ /srv/files
+
+  - To serve a directory including its dotfiles, such as .well-known,
+    which are otherwise hidden so that ones like .git and .env don't leak:
+    $ tailscale serve --serve-dotfiles https / /home/alice/site
+
+  - To gzip a backend's responses for clients that accept it, such as
+    one on a slow link:
+    $ tailscale serve --compress https / http://127.0.0.1:3000
+
+  - To serve a base site merged with environment-specific files, which
+    win over the base site's (use ; instead of : on Windows):
+    $ tailscale serve https / /srv/base:/srv/override
+
+  - To switch a mount to a new backend, letting connections that are
+    already open finish with the old one for up to 30 seconds:
+    $ tailscale serve --drain 30s https / http://127.0.0.1:3001
+
+  - To remove a mount, such as in a deploy script, and only succeed once
+    tailscaled confirms it no longer serves it, waiting up to 10 seconds:
+    $ tailscale serve --wait 10s https /old off
+
+  - To serve a web server as the service svc:wiki, and advertise this node
+    as one of its hosts:
+    $ tailscale serve --service svc:wiki https:443 / http://127.0.0.1:3000
+
+  - To serve different content to requests for another of the node's DNS
+    names, such as a custom domain pointed at it, by their Host header:
+    $ tailscale serve --virtual-host wiki.example.com http / http://127.0.0.1:3001
+
+  - To permanently redirect plain HTTP requests to HTTPS:
+    $ tailscale serve http:80 / redirect-to-https
+
+  - To only accept TLS 1.3 connections on port 443:
+    $ tailscale serve --tls-min-version 1.3 https / http://127.0.0.1:3000
+
   - To serve simple static text:
     $ tailscale serve https:8080 / text:"Hello, world!"
 
@@ -87,11 +243,58 @@ func newServeLegacyCommand(e *serveEnv) *ffcli.Command {
     port 22 (e.g. to run OpenSSH in parallel with Tailscale SSH):
     $ tailscale serve tcp:2222 tcp://localhost:22
 
+  - To forward at most 16 TCP connections at a time to a local game server,
+    closing any more as soon as they're accepted:
+    $ tailscale serve --max-conns 16 tcp:25565 tcp://localhost:25565
+
+  - To listen with a longer queue of connections waiting to be accepted, for
+    a busy service:
+    $ tailscale serve --backlog 4096 tcp:5432 tcp://localhost:5432
+
   - To accept TCP TLS connections (terminated within tailscaled) proxied to a
     local plaintext server on port 80:
     $ tailscale serve tls-terminated-tcp:443 tcp://localhost:80
+
+  - To also route TLS connections for another name (which tailscaled must be
+    able to get a certificate for) to a different local server:
+    $ tailscale serve --sni svc.example.ts.net=localhost:8080 tls-terminated-tcp:443 tcp://localhost:80
+
+  - To replace the whole serve config with one described by environment
+    variables, such as in a container's entrypoint:
+    $ TS_SERVE_443='/=http://127.0.0.1:3000;/static/=/srv/static' tailscale serve --from-env
+
+  - To go through the current handlers, deleting them or turning Funnel on
+    and off by number:
+    $ tailscale serve edit --interactive
+
+  - To keep the serve config in sync with a JSON file managed elsewhere,
+    such as checked out from a git repository:
+    $ tailscale serve watch-file /etc/tailscale/serve.json
+
+  - To answer all web requests with a maintenance page while the backends
+    are down, and to go back to serving them afterwards:
+    $ tailscale serve maintenance --page /srv/maintenance.html on
+    $ tailscale serve maintenance off
+
+ENVIRONMENT
+  With --from-env, each of the following variables configures one port;
+  other variables, including other TS_SERVE_* ones, are ignored:
+
+  TS_SERVE_<port>=<mount-point>=<source>[;<mount-point>=<source>...]
+      Serve over HTTPS on the port. Sources are as for https:<port>.
+  TS_SERVE_HTTP_<port>=<mount-point>=<source>[;<mount-point>=<source>...]
+      Serve over HTTP on the port.
+  TS_SERVE_TCP_<port>=tcp://localhost:<local-port>
+      Forward TCP connections to the port, as for tcp:<port>.
+
+  The resulting config replaces the current one in a single change. Other
+  flags, such as --label, don't apply to it.
 `),
 		Exec: e.runServe,
+		FlagSet: e.newFlags("serve", func(fs *flag.FlagSet) {
+			e.addServeFlags(fs)
+			fs.BoolVar(&e.fromEnv, "from-env", false, "replace the serve config with one built from TS_SERVE_* environment variables (see ENVIRONMENT)")
+		}),
 		Subcommands: []*ffcli.Command{
 			{
 				Name:      "status",
@@ -99,6 +302,25 @@ func newServeLegacyCommand(e *serveEnv) *ffcli.Command {
 				ShortHelp: "Show current serve/funnel status",
 				FlagSet: e.newFlags("serve-status", func(fs *flag.FlagSet) {
 					fs.BoolVar(&e.json, "json", false, "output JSON")
+					fs.BoolVar(&e.watch, "watch", false, "keep running, and show the status again whenever the serve config changes")
+					fs.BoolVar(&e.checkCert, "check-cert", false, "also show when the TLS certificate of each https port expires")
+					fs.StringVar(&e.family, "family", "", "only show the node's addresses of this IP family, v4 or v6, that each port is served on")
+				}),
+			},
+			{
+				Name:      "stats",
+				Exec:      e.runServeStats,
+				ShortHelp: "Show request and byte counts of each web handler",
+				FlagSet: e.newFlags("serve-stats", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.json, "json", false, "output JSON")
+				}),
+			},
+			{
+				Name:      "edit",
+				Exec:      e.runServeEdit,
+				ShortHelp: "List handlers and delete them or toggle Funnel by number",
+				FlagSet: e.newFlags("serve-edit", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.interactive, "interactive", false, "show a numbered menu of handlers and read commands from stdin (required)")
 				}),
 			},
 			{
@@ -107,6 +329,32 @@ func newServeLegacyCommand(e *serveEnv) *ffcli.Command {
 				ShortHelp: "Reset current serve/funnel config",
 				FlagSet:   e.newFlags("serve-reset", nil),
 			},
+			{
+				Name:       "watch-file",
+				Exec:       e.runServeWatchFile,
+				ShortUsage: "tailscale serve watch-file <path>",
+				ShortHelp:  "Set the serve config from a JSON file, and again whenever it changes",
+				LongHelp:   serveWatchFileHelp,
+				FlagSet:    e.newFlags("serve-watch-file", nil),
+			},
+			{
+				Name:       "validate",
+				Exec:       e.runServeValidate,
+				ShortUsage: "tailscale serve validate <path>",
+				ShortHelp:  "Check a serve config JSON file without applying it",
+				LongHelp:   serveValidateHelp,
+				FlagSet:    e.newFlags("serve-validate", nil),
+			},
+			{
+				Name:       "maintenance",
+				Exec:       e.runServeMaintenance,
+				ShortUsage: "tailscale serve maintenance [--page <html-file>] (on|off)",
+				ShortHelp:  "Turn maintenance mode on or off",
+				LongHelp:   serveMaintenanceHelp,
+				FlagSet: e.newFlags("serve-maintenance", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.maintenancePage, "page", "", "absolute path of an HTML file to serve as the maintenance page (on only)")
+				}),
+			},
 		},
 	}
 }
@@ -138,8 +386,12 @@ type localServeClient interface {
 	GetServeConfig(context.Context) (*ipn.ServeConfig, error)
 	SetServeConfig(context.Context, *ipn.ServeConfig) error
 	QueryFeature(ctx context.Context, feature string) (*tailcfg.QueryFeatureResponse, error)
+	CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error)
 	WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*tailscale.IPNBusWatcher, error)
 	IncrementCounter(ctx context.Context, name string, delta int) error
+	GetPrefs(ctx context.Context) (*ipn.Prefs, error)
+	EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error)
+	ServeStats(ctx context.Context) ([]ipn.ServeHandlerStats, error)
 }
 
 // serveEnv is the environment the serve command runs within. All I/O should be
@@ -150,7 +402,52 @@ type localServeClient interface {
 // It also contains the flags, as registered with newServeCommand.
 type serveEnv struct {
 	// v1 flags
-	json bool // output JSON (status only for now)
+	json              bool   // output JSON (status and stats only)
+	watch             bool   // re-render status on config changes
+	checkCert         bool   // show TLS cert expiry (status only)
+	family            string // "v4" or "v6" to show only that family's addresses (status only)
+	replace           bool   // replace all web handlers on the port
+	force             bool   // serve on a port that tailscaled also uses
+	fromEnv           bool   // build the whole config from TS_SERVE_* environment variables
+	ifNotExists       bool   // leave an existing web handler at the mount point alone
+	noHTTP2           bool   // proxy to the backend over HTTP/1.1 only
+	proxyHost         string // Host header to send to the proxy backend
+	grpcWeb           bool   // translate gRPC-Web to gRPC for the proxy backend
+	backendKeepalive  string // how long idle connections to the proxy backend are kept
+	requestIDHeader   string // header to send a generated request ID to the proxy backend in
+	canary            string // <proxy-target>=<percent>% of a canary proxy backend
+	allowMethods      string // comma-separated HTTP methods to allow; empty means all
+	aggregateBackends bool   // serve a health check of all proxy backends
+	label             string // description of the handler
+	logLevel          string // how much to log about the handler's requests
+	requireTag        string // ACL tag required of requesting peers
+	allowCIDRs        cidrList
+	basicAuth         string // user:password for HTTP Basic auth
+	basicAuthFile     string // htpasswd file of users for HTTP Basic auth
+	cacheControl      string // Cache-Control header for path handlers
+	spaFallback       bool   // serve index.html for unknown paths under a directory
+	webDAV            bool   // serve a directory over WebDAV
+	webDAVReadOnly    bool   // reject WebDAV requests that change files
+	serveDotfiles     bool   // serve dotfiles in a directory instead of hiding them
+	compress          bool   // gzip responses for clients that accept it
+	maxConns          int    // maximum concurrent forwarded TCP connections
+	backlog           int    // listen backlog for TCP ports; 0 means the OS default
+	sniRoutes         sniRoutes
+	tlsMinVersion     string // minimum TLS version for the port
+	service           string // service to serve for, such as "svc:wiki"; empty means the node itself
+	virtualHost       string // host name to serve for instead of the node's own; empty means the node's
+	drain             string // how long existing connections keep the old config
+	interactive       bool   // run "serve edit" as a menu (edit only)
+	maintenancePage   string // HTML file to serve in maintenance mode (maintenance only)
+
+	// wait is how long to wait, when removing a handler, for tailscaled to
+	// confirm that it's gone.
+	wait time.Duration
+
+	// connectTimeout and responseHeaderTimeout are how long the proxy waits
+	// to connect to the backend and for its response headers.
+	connectTimeout        string
+	responseHeaderTimeout string
 
 	// v2 specific flags
 	bg               bool      // background mode
@@ -168,6 +465,8 @@ type serveEnv struct {
 	testFlagOut io.Writer
 	testStdout  io.Writer
 	testStderr  io.Writer
+	testStdin   io.Reader
+	testEnviron []string // if non-nil, used instead of os.Environ
 }
 
 // getSelfDNSName returns the DNS name of the current node.
@@ -214,6 +513,12 @@ func (e *serveEnv) getLocalClientStatusWithoutPeers(ctx context.Context) (*ipnst
 // - tailscale serve tcp:2222 tcp://localhost:22
 // - tailscale serve tls-terminated-tcp:443 tcp://localhost:80
 func (e *serveEnv) runServe(ctx context.Context, args []string) error {
+	if e.fromEnv {
+		if len(args) > 0 {
+			return errors.New("--from-env doesn't take arguments")
+		}
+		return e.runServeFromEnv(ctx)
+	}
 	if len(args) == 0 {
 		return flag.ErrHelp
 	}
@@ -225,9 +530,9 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 		if err != nil {
 			return err
 		}
-		sc := new(ipn.ServeConfig)
-		if err := json.Unmarshal(valb, sc); err != nil {
-			return fmt.Errorf("invalid JSON: %w", err)
+		sc, err := parseServeConfigJSON(valb)
+		if err != nil {
+			return err
 		}
 		return e.lc.SetServeConfig(ctx, sc)
 	}
@@ -247,7 +552,15 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 
 	turnOff := "off" == args[len(args)-1]
 
-	if len(args) < 2 || ((srcType == "https" || srcType == "http") && !turnOff && len(args) < 3) {
+	wantWebArgs := 3 // <port> <mount-point> <source>
+	if e.aggregateBackends {
+		wantWebArgs = 2 // no source
+		if len(args) > 2 && !turnOff {
+			fmt.Fprintf(Stderr, "error: --aggregate-backends does not take a source\n\n")
+			return errHelp
+		}
+	}
+	if len(args) < 2 || ((srcType == "https" || srcType == "http") && !turnOff && len(args) < wantWebArgs) {
 		fmt.Fprintf(Stderr, "error: invalid number of arguments\n\n")
 		return errHelp
 	}
@@ -269,6 +582,45 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 	if err != nil {
 		return fmt.Errorf("invalid port %q: %w", srcPortStr, err)
 	}
+	if e.service != "" {
+		if err := tailcfg.CheckServiceName(e.service); err != nil {
+			return fmt.Errorf("invalid --service %q: %w", e.service, err)
+		}
+		if srcType != "https" && srcType != "http" {
+			return errors.New("--service is only supported for http and https")
+		}
+	}
+	if e.virtualHost != "" {
+		if err := e.checkVirtualHost(ctx, srcType); err != nil {
+			return err
+		}
+	}
+	if e.maxConns != 0 && (srcType == "https" || srcType == "http") {
+		return errors.New("--max-conns is only supported for tcp and tls-terminated-tcp")
+	}
+	if e.backlog != 0 && (srcType == "https" || srcType == "http") {
+		return errors.New("--backlog is only supported for tcp and tls-terminated-tcp")
+	}
+	if e.wait != 0 {
+		if !turnOff || (srcType != "https" && srcType != "http") {
+			return errors.New("--wait is only supported for removing http and https handlers, with off")
+		}
+		if e.wait < 0 {
+			return fmt.Errorf("invalid --wait %v; must be positive", e.wait)
+		}
+	}
+	if !turnOff && e.service == "" {
+		use, err := e.reservedPortUse(ctx, srcPort)
+		if err != nil {
+			return err
+		}
+		if use != "" {
+			if !e.force {
+				return fmt.Errorf("port %d is used by %s, which handles connections to it before serve does; use another port, or --force to serve on it anyway", srcPort, use)
+			}
+			fmt.Fprintf(Stderr, "warning: port %d is used by %s; serve won't get its connections while that's on\n", srcPort, use)
+		}
+	}
 
 	switch srcType {
 	case "https", "http":
@@ -280,7 +632,11 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 			return e.handleWebServeRemove(ctx, srcPort, mount)
 		}
 		useTLS := srcType == "https"
-		return e.handleWebServe(ctx, srcPort, useTLS, mount, args[2])
+		var source string
+		if !e.aggregateBackends {
+			source = args[2]
+		}
+		return e.handleWebServe(ctx, srcPort, useTLS, mount, source)
 	case "tcp", "tls-terminated-tcp":
 		if turnOff {
 			return e.handleTCPServeRemove(ctx, srcPort)
@@ -301,44 +657,26 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 //   - tailscale serve https / http://localhost:3000
 //   - tailscale serve https:8443 /files/ /home/alice/shared-files/
 //   - tailscale serve https:10000 /motd.txt text:"Hello, world!"
+//   - tailscale serve https /docs/ archive:/srv/docs.tar
+//   - tailscale serve https /proxy.pac pac:/etc/tailscale/proxy.pac
+//   - tailscale serve https / pipe:myapp
+//   - tailscale serve --service svc:wiki https / http://localhost:3000
 func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bool, mount, source string) error {
+	if e.replace && e.ifNotExists {
+		return errors.New("--replace and --if-not-exists can't be used together")
+	}
 	h := new(ipn.HTTPHandler)
-
-	ts, _, _ := strings.Cut(source, ":")
-	switch {
-	case ts == "text":
-		text := strings.TrimPrefix(source, "text:")
-		if text == "" {
-			return errors.New("unable to serve; text cannot be an empty string")
-		}
-		h.Text = text
-	case isProxyTarget(source):
-		t, err := expandProxyTarget(source)
+	if e.aggregateBackends {
+		h.AggregateBackends = true
+	} else {
+		var err error
+		h, mount, err = webSourceHandler(source, mount, useTLS)
 		if err != nil {
 			return err
 		}
-		h.Proxy = t
-	default: // assume path
-		if version.IsSandboxedMacOS() {
-			// don't allow path serving for now on macOS (2022-11-15)
-			return fmt.Errorf("path serving is not supported if sandboxed on macOS")
-		}
-		if !filepath.IsAbs(source) {
-			fmt.Fprintf(Stderr, "error: path must be absolute\n\n")
-			return errHelp
-		}
-		source = filepath.Clean(source)
-		fi, err := os.Stat(source)
-		if err != nil {
-			fmt.Fprintf(Stderr, "error: invalid path: %v\n\n", err)
-			return errHelp
-		}
-		if fi.IsDir() && !strings.HasSuffix(mount, "/") {
-			// dir mount points must end in /
-			// for relative file links to work
-			mount += "/"
-		}
-		h.Path = source
+	}
+	if err := e.applyWebHandlerFlags(h, useTLS); err != nil {
+		return err
 	}
 
 	cursc, err := e.lc.GetServeConfig(ctx)
@@ -353,24 +691,49 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, useTLS bo
 	if err != nil {
 		return err
 	}
-	if sc.IsTCPForwardingOnPort(srvPort) {
+	web, host, saveWeb := e.webServeTarget(sc, dnsName)
+	if web.IsTCPForwardingOnPort(srvPort) {
 		fmt.Fprintf(Stderr, "error: cannot serve web; already serving TCP\n")
 		return errHelp
 	}
+	if e.ifNotExists && web.WebHandlerExists(ipn.HostPort(net.JoinHostPort(host, strconv.Itoa(int(srvPort)))), mount) {
+		fmt.Fprintf(Stderr, "%s already has a handler on port %d; leaving it as is\n", mount, srvPort)
+		return e.setServeConfigIfChanged(ctx, cursc, cursc)
+	}
 
-	sc.SetWebHandler(h, dnsName, srvPort, mount, useTLS)
-
-	if !reflect.DeepEqual(cursc, sc) {
-		if err := e.lc.SetServeConfig(ctx, sc); err != nil {
-			return err
-		}
+	if e.replace {
+		// Drop all handlers for this host:port so the new handler is the
+		// only one once the config is set. Other ports and the Funnel
+		// setting for this port are left alone.
+		hp := ipn.HostPort(net.JoinHostPort(host, strconv.Itoa(int(srvPort))))
+		delete(web.Web, hp)
+	}
+	e.setWebHandler(web, h, host, srvPort, mount, useTLS)
+	if h.AggregateBackends && !hasProxyBackend(web) {
+		return errors.New("--aggregate-backends requires at least one proxy backend to be configured")
+	}
+	if h.RedirectToHTTPS && !web.IsServingHTTPS(443) {
+		fmt.Fprintf(Stderr, "warning: redirecting to https, but nothing is served over https on port 443 yet\n")
+	}
+	saveWeb()
+	if err := e.setDrain(sc); err != nil {
+		return err
 	}
 
+	if err := e.setServeConfigIfChanged(ctx, cursc, sc); err != nil {
+		return err
+	}
+	if e.service != "" {
+		return e.setServiceAdvertised(ctx, e.service, true)
+	}
 	return nil
 }
 
 // isProxyTarget reports whether source is a valid proxy target.
 func isProxyTarget(source string) bool {
+	if strings.HasPrefix(source, "pipe:") || ipn.IsNamedPipeProxy(source) {
+		return true
+	}
 	if strings.HasPrefix(source, "http://") ||
 		strings.HasPrefix(source, "https://") ||
 		strings.HasPrefix(source, "https+insecure://") {
@@ -384,6 +747,40 @@ func isProxyTarget(source string) bool {
 	return false
 }
 
+// checkServeArchive reports an error if name isn't a zip or tar file
+// that tailscaled will be able to serve.
+func checkServeArchive(name string) error {
+	format := ipn.ArchiveFormat(name)
+	if format == "" {
+		return fmt.Errorf("%s is not a .zip or .tar file", name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	switch format {
+	case "zip":
+		_, err = zip.NewReader(f, fi.Size())
+	case "tar":
+		// An empty tar file is fine; there's just nothing to serve.
+		if _, err = tar.NewReader(f).Next(); err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
 // allNumeric reports whether s only comprises of digits
 // and has at least one digit.
 func allNumeric(s string) bool {
@@ -410,20 +807,36 @@ func (e *serveEnv) handleWebServeRemove(ctx context.Context, srvPort uint16, mou
 	if err != nil {
 		return err
 	}
-	if sc.IsTCPForwardingOnPort(srvPort) {
+	web, host, saveWeb := e.webServeTarget(sc, dnsName)
+	if web.IsTCPForwardingOnPort(srvPort) {
 		return errors.New("cannot remove web handler; currently serving TCP")
 	}
-	hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(srvPort))))
-	if !sc.WebHandlerExists(hp, mount) {
+	hp := ipn.HostPort(net.JoinHostPort(host, strconv.Itoa(int(srvPort))))
+	if !web.WebHandlerExists(hp, mount) {
 		return errors.New("error: handler does not exist")
 	}
-	sc.RemoveWebHandler(dnsName, srvPort, []string{mount}, false)
+	web.RemoveWebHandler(host, srvPort, []string{mount}, false)
+	saveWeb()
+	if err := e.setDrain(sc); err != nil {
+		return err
+	}
 	if err := e.lc.SetServeConfig(ctx, sc); err != nil {
 		return err
 	}
+	if e.wait > 0 {
+		if err := e.waitWebHandlerRemoved(ctx, dnsName, hp, mount); err != nil {
+			return err
+		}
+	}
+	if _, ok := sc.Services[e.service]; e.service != "" && !ok {
+		// That was the service's last handler.
+		return e.setServiceAdvertised(ctx, e.service, false)
+	}
 	return nil
 }
 
+// cleanMountPoint ensures the mount point is clean and has a leading "/".
+// The bare wildcard "*" (or "/*") is normalized to ipn.WildcardMountPoint.
 func cleanMountPoint(mount string) (string, error) {
 	if mount == "" {
 		return "", errors.New("mount point cannot be empty")
@@ -432,6 +845,12 @@ func cleanMountPoint(mount string) (string, error) {
 	if !strings.HasPrefix(mount, "/") {
 		mount = "/" + mount
 	}
+	if mount == ipn.WildcardMountPoint {
+		return mount, nil
+	}
+	if strings.Contains(mount, "*") {
+		return "", fmt.Errorf("invalid mount point %q; wildcards are only supported as %q", mount, ipn.WildcardMountPoint)
+	}
 	c := path.Clean(mount)
 	if mount == c || mount == c+"/" {
 		return mount, nil
@@ -460,6 +879,15 @@ func cleanMinGWPathConversionIfNeeded(path string) string {
 }
 
 func expandProxyTarget(source string) (string, error) {
+	if name, ok := pipeProxyName(source); ok {
+		if runtime.GOOS != "windows" {
+			return "", errors.New("named pipe proxies are only supported on Windows")
+		}
+		if err := ipn.CheckPipeName(name); err != nil {
+			return "", err
+		}
+		return ipn.NamedPipePrefix + name, nil
+	}
 	if !strings.Contains(source, "://") {
 		source = "http://" + source
 	}
@@ -494,6 +922,39 @@ func expandProxyTarget(source string) (string, error) {
 	return url, nil
 }
 
+// parseCanary parses the value of the --canary flag, a proxy target and
+// the percentage of requests to send to it, as <proxy-target>=<percent>%.
+// The % sign is optional.
+func parseCanary(s string) (target string, percent int, err error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid --canary %q: want <proxy-target>=<percent>%%", s)
+	}
+	target, pct := s[:i], strings.TrimSuffix(s[i+1:], "%")
+	percent, err = strconv.Atoi(pct)
+	if err != nil || percent < 0 || percent > 100 {
+		return "", 0, fmt.Errorf("invalid --canary percentage %q: must be a whole number from 0 to 100", s[i+1:])
+	}
+	target, err = expandProxyTarget(target)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid --canary target: %w", err)
+	}
+	return target, percent, nil
+}
+
+// pipeProxyName returns the name of the local Windows named pipe that
+// source refers to, either as "pipe:name" or as a `\\.\pipe\name` path,
+// and whether it refers to one at all.
+func pipeProxyName(source string) (name string, ok bool) {
+	if name, ok := strings.CutPrefix(source, "pipe:"); ok {
+		return name, true
+	}
+	if ipn.IsNamedPipeProxy(source) {
+		return source[len(ipn.NamedPipePrefix):], true
+	}
+	return "", false
+}
+
 // handleTCPServe handles the "tailscale serve tls-terminated-tcp:..." subcommand.
 // It configures the serve config to forward TCP connections to the
 // given source.
@@ -512,29 +973,9 @@ func (e *serveEnv) handleTCPServe(ctx context.Context, srcType string, srcPort u
 		fmt.Fprintf(Stderr, "error: invalid TCP source %q\n\n", dest)
 		return errHelp
 	}
-
-	dstURL, err := url.Parse(dest)
+	fwdAddr, err := tcpForwardAddr(dest)
 	if err != nil {
-		fmt.Fprintf(Stderr, "error: invalid TCP source %q: %v\n\n", dest, err)
-		return errHelp
-	}
-	host, dstPortStr, err := net.SplitHostPort(dstURL.Host)
-	if err != nil {
-		fmt.Fprintf(Stderr, "error: invalid TCP source %q: %v\n\n", dest, err)
-		return errHelp
-	}
-
-	switch host {
-	case "localhost", "127.0.0.1":
-		// ok
-	default:
-		fmt.Fprintf(Stderr, "error: invalid TCP source %q\n", dest)
-		fmt.Fprint(Stderr, "must be one of: localhost or 127.0.0.1\n\n", dest)
-		return errHelp
-	}
-
-	if p, err := strconv.ParseUint(dstPortStr, 10, 16); p == 0 || err != nil {
-		fmt.Fprintf(Stderr, "error: invalid port %q\n\n", dstPortStr)
+		fmt.Fprintf(Stderr, "error: %v\n\n", err)
 		return errHelp
 	}
 
@@ -547,8 +988,6 @@ func (e *serveEnv) handleTCPServe(ctx context.Context, srcType string, srcPort u
 		sc = new(ipn.ServeConfig)
 	}
 
-	fwdAddr := "127.0.0.1:" + dstPortStr
-
 	if sc.IsServingWeb(srcPort) {
 		return fmt.Errorf("cannot serve TCP; already serving web on %d", srcPort)
 	}
@@ -559,14 +998,34 @@ func (e *serveEnv) handleTCPServe(ctx context.Context, srcType string, srcPort u
 	}
 
 	sc.SetTCPForwarding(srcPort, fwdAddr, terminateTLS, dnsName)
-
-	if !reflect.DeepEqual(cursc, sc) {
-		if err := e.lc.SetServeConfig(ctx, sc); err != nil {
-			return err
-		}
+	if err := e.applyTCPHandlerFlags(sc.TCP[srcPort]); err != nil {
+		return err
 	}
 
-	return nil
+	return e.setServeConfigIfChanged(ctx, cursc, sc)
+}
+
+// tcpForwardAddr returns the address to forward TCP connections to for
+// dest, a "tailscale serve" TCP target such as tcp://localhost:22.
+func tcpForwardAddr(dest string) (string, error) {
+	dstURL, err := url.Parse(dest)
+	if err != nil {
+		return "", fmt.Errorf("invalid TCP source %q: %v", dest, err)
+	}
+	host, dstPortStr, err := net.SplitHostPort(dstURL.Host)
+	if err != nil {
+		return "", fmt.Errorf("invalid TCP source %q: %v", dest, err)
+	}
+	switch host {
+	case "localhost", "127.0.0.1":
+		// ok
+	default:
+		return "", fmt.Errorf("invalid TCP source %q; must be one of: localhost or 127.0.0.1", dest)
+	}
+	if p, err := strconv.ParseUint(dstPortStr, 10, 16); p == 0 || err != nil {
+		return "", fmt.Errorf("invalid port %q", dstPortStr)
+	}
+	return "127.0.0.1:" + dstPortStr, nil
 }
 
 // handleTCPServeRemove removes the TCP forwarding configuration for the
@@ -596,10 +1055,32 @@ func (e *serveEnv) handleTCPServeRemove(ctx context.Context, src uint16) error {
 // Examples:
 //   - tailscale status
 //   - tailscale status --json
+//   - tailscale status --watch
+//   - tailscale status --check-cert
+//   - tailscale status --family v6
 //
 // TODO(tyler,marwan,sonia): `status` should also report foreground configs,
 // currently only reports background config.
 func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
+	if e.checkCert && (e.json || e.watch) {
+		return errors.New("--check-cert can't be used with --json or --watch")
+	}
+	switch e.family {
+	case "", "v4", "v6":
+	default:
+		return fmt.Errorf("invalid --family %q; must be v4 or v6", e.family)
+	}
+	if e.family != "" && e.json {
+		return errors.New("--family can't be used with --json")
+	}
+	if e.watch {
+		if e.json {
+			return errors.New("--watch and --json can't be used together")
+		}
+		ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+		defer cancel()
+		return e.watchServeStatus(ctx)
+	}
 	sc, err := e.lc.GetServeConfig(ctx)
 	if err != nil {
 		return err
@@ -614,7 +1095,137 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		return nil
 	}
 	printFunnelStatus(ctx)
-	if sc == nil || (len(sc.TCP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
+	if err := e.printServeStatus(ctx, sc); err != nil {
+		return err
+	}
+	if e.checkCert {
+		return e.printCertStatus(ctx, sc)
+	}
+	return nil
+}
+
+// certExpiryWarning is how close to expiry a TLS certificate has to be for
+// "serve status --check-cert" to warn about it. tailscaled renews
+// certificates well before this, so a certificate this close to expiry
+// suggests renewal is failing.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// printCertStatus prints when the TLS certificate served on each of sc's
+// HTTPS ports expires, for "serve status --check-cert".
+func (e *serveEnv) printCertStatus(ctx context.Context, sc *ipn.ServeConfig) error {
+	if sc == nil {
+		return nil
+	}
+	var ports []uint16
+	for port, th := range sc.TCP {
+		if th.HTTPS {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+	slices.Sort(ports)
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	// All the HTTPS ports serve the node's certificate, so only get it once.
+	notAfter, certErr := e.certNotAfter(ctx, dnsName)
+	for _, port := range ports {
+		if certErr != nil {
+			printf("https:%d %s: error getting certificate: %v\n", port, dnsName, certErr)
+			continue
+		}
+		printf("https:%d %s: certificate expires %s (%s)\n", port, dnsName, notAfter.UTC().Format(time.RFC3339), certDaysLeft(notAfter, time.Now()))
+	}
+	return nil
+}
+
+// certNotAfter returns the expiry time of the node's TLS certificate for
+// domain.
+func (e *serveEnv) certNotAfter(ctx context.Context, domain string) (time.Time, error) {
+	certPEM, _, err := e.lc.CertPair(ctx, domain)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, errors.New("no certificate in PEM data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// certDaysLeft describes how long is left until notAfter, in whole days.
+func certDaysLeft(notAfter, now time.Time) string {
+	left := notAfter.Sub(now)
+	days := int(left / (24 * time.Hour))
+	switch {
+	case left <= 0:
+		return "EXPIRED"
+	case left < certExpiryWarning:
+		return fmt.Sprintf("%d days left; WARNING: renewal may be failing", days)
+	default:
+		return fmt.Sprintf("%d days left", days)
+	}
+}
+
+// clearScreen is the terminal escape sequence to clear the screen and move
+// the cursor to the top left.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// watchServeStatus prints the serve status each time the serve config
+// changes, clearing the screen first, until ctx is done. When tailscaled
+// obtains a new TLS certificate, such as on renewal, the status is printed
+// again with the latest such change at the end.
+func (e *serveEnv) watchServeStatus(ctx context.Context) error {
+	watcher, err := e.lc.WatchIPNBus(ctx, ipn.NotifyInitialServeConfig)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	var (
+		sc       *ipn.ServeConfig
+		haveSC   bool
+		lastCert *ipn.CertChange
+		certSeen time.Time
+	)
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				// Interrupted; not an error.
+				return nil
+			}
+			return err
+		}
+		if n.ServeConfig != nil {
+			sc, haveSC = n.ServeConfig.AsStruct(), true
+		}
+		if n.CertChange != nil {
+			lastCert, certSeen = n.CertChange, time.Now()
+		}
+		if n.ServeConfig == nil && n.CertChange == nil || !haveSC {
+			continue
+		}
+		printf("%s", clearScreen)
+		if err := e.printServeStatus(ctx, sc); err != nil {
+			return err
+		}
+		if lastCert != nil {
+			printf("\nTLS certificate for %s rotated at %s; valid until %s\n",
+				lastCert.Domain, certSeen.Format(time.TimeOnly), lastCert.NotAfter.UTC().Format(time.DateOnly))
+		}
+	}
+}
+
+// printServeStatus prints the status tree for sc.
+func (e *serveEnv) printServeStatus(ctx context.Context, sc *ipn.ServeConfig) error {
+	if sc == nil || (len(sc.TCP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0 && len(sc.Services) == 0) {
 		printf("No serve config\n")
 		return nil
 	}
@@ -622,24 +1233,75 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
+	if sc.MaintenanceMode {
+		page := "a default maintenance page"
+		if sc.MaintenancePage != "" {
+			page = sc.MaintenancePage
+		}
+		printf("Maintenance mode is on: web handlers respond with %s (503)\n\n", page)
+	}
 	if sc.IsTCPForwardingAny() {
-		if err := printTCPStatusTree(ctx, sc, st); err != nil {
+		if err := e.printTCPStatusTree(ctx, sc, st); err != nil {
 			return err
 		}
 		printf("\n")
 	}
-	for hp := range sc.Web {
-		err := e.printWebStatusTree(sc, hp)
+	ips := e.statusAddrs(st)
+	selfDNSName := strings.TrimSuffix(st.Self.DNSName, ".")
+	for _, hp := range slices.Sorted(maps.Keys(sc.Web)) {
+		err := e.printWebStatusTree(sc, hp, ips, selfDNSName)
 		if err != nil {
 			return err
 		}
 		printf("\n")
 	}
+	for _, name := range slices.Sorted(maps.Keys(sc.Services)) {
+		svc := sc.Services[name]
+		printf("Service %s:\n", name)
+		if svc.Tun {
+			printf("|-- all traffic (tun mode)\n")
+		}
+		web := &ipn.ServeConfig{TCP: svc.TCP, Web: svc.Web}
+		for _, hp := range slices.Sorted(maps.Keys(web.Web)) {
+			if err := e.printWebStatusTree(web, hp, nil, selfDNSName); err != nil {
+				return err
+			}
+		}
+		printf("\n")
+	}
 	printFunnelWarning(sc)
+	printf("Config version: %s\n", sc.Hash())
 	return nil
 }
 
-func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.Status) error {
+// statusAddrs returns the node's Tailscale IPs from st to show in the
+// status, limited to those of the family chosen with --family, if any.
+func (e *serveEnv) statusAddrs(st *ipnstate.Status) []netip.Addr {
+	var ips []netip.Addr
+	for _, a := range st.TailscaleIPs {
+		if e.family == "v4" && !a.Is4() || e.family == "v6" && !a.Is6() {
+			continue
+		}
+		ips = append(ips, a)
+	}
+	return ips
+}
+
+// printAddrsTree prints the addresses in ips that port is served on,
+// each labeled with its IP family, to show whether the port is reachable
+// over IPv4, IPv6 or both. Each address is preceded by prefix, such as
+// "tcp://".
+func printAddrsTree(prefix string, ips []netip.Addr, port uint16) {
+	for _, a := range ips {
+		family := "IPv4"
+		if a.Is6() {
+			family = "IPv6"
+		}
+		printf("|-- %s%s (%s)\n", prefix, netip.AddrPortFrom(a, port), family)
+	}
+}
+
+func (e *serveEnv) printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.Status) error {
 	dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
 	for p, h := range sc.TCP {
 		if h.TCPForward == "" {
@@ -650,21 +1312,34 @@ func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.S
 		if h.TerminateTLS != "" {
 			tlsStatus = "TLS terminated"
 		}
+		if h.TLSMinVersion != "" {
+			tlsStatus += ", TLS " + h.TLSMinVersion + "+"
+		}
 		fStatus := "tailnet only"
 		if sc.AllowFunnel[hp] {
 			fStatus = "Funnel on"
 		}
+		if h.MaxConns > 0 {
+			fStatus += fmt.Sprintf(", max %d connections", h.MaxConns)
+		}
+		if h.Backlog > 0 {
+			fStatus += fmt.Sprintf(", backlog %d", h.Backlog)
+		}
 		printf("|-- tcp://%s (%s, %s)\n", hp, tlsStatus, fStatus)
-		for _, a := range st.TailscaleIPs {
-			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(p)))
-			printf("|-- tcp://%s\n", ipp)
+		printAddrsTree("tcp://", e.statusAddrs(st), p)
+		printf("|--> tcp://%s%s\n", h.TCPForward, labelSuffix(h.Label))
+		for _, name := range slices.Sorted(maps.Keys(h.SNIRoutes)) {
+			printf("|--> tcp://%s (SNI %s)\n", h.SNIRoutes[name], name)
 		}
-		printf("|--> tcp://%s\n", h.TCPForward)
 	}
 	return nil
 }
 
-func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) error {
+// printWebStatusTree prints the status of the web server at hp in sc,
+// including which of the addresses in ips it's reachable at. The node's
+// MagicDNS name, selfDNSName, is used to tell whether hp's host is in the
+// tailnet's domain or is a virtual host.
+func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort, ips []netip.Addr, selfDNSName string) error {
 	// No-op if no serve config
 	if sc == nil {
 		return nil
@@ -685,27 +1360,25 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 		scheme = "http"
 	}
 
+	if th := sc.TCP[port]; th != nil && th.TLSMinVersion != "" {
+		fStatus += ", TLS " + th.TLSMinVersion + "+"
+	}
+
 	portPart := ":" + portStr
 	if scheme == "http" && portStr == "80" ||
 		scheme == "https" && portStr == "443" {
 		portPart = ""
 	}
-	if scheme == "http" {
+	_, domain, _ := strings.Cut(selfDNSName, ".")
+	virtual := host != selfDNSName && !strings.HasSuffix(host, "."+domain)
+	if virtual {
+		fStatus += ", virtual host"
+	} else if scheme == "http" {
 		hostname, _, _ := strings.Cut(host, ".")
 		printf("%s://%s%s (%s)\n", scheme, hostname, portPart, fStatus)
 	}
 	printf("%s://%s%s (%s)\n", scheme, host, portPart, fStatus)
-	srvTypeAndDesc := func(h *ipn.HTTPHandler) (string, string) {
-		switch {
-		case h.Path != "":
-			return "path", h.Path
-		case h.Proxy != "":
-			return "proxy", h.Proxy
-		case h.Text != "":
-			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
-		}
-		return "", ""
-	}
+	printAddrsTree("", ips, port)
 
 	var mounts []string
 	for k := range sc.Web[hp].Handlers {
@@ -718,13 +1391,22 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 
 	for _, m := range mounts {
 		h := sc.Web[hp].Handlers[m]
-		t, d := srvTypeAndDesc(h)
+		t, d := webHandlerTypeAndDesc(h)
 		printf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d)
 	}
 
 	return nil
 }
 
+// labelSuffix returns the handler label to append to a status line,
+// or the empty string if there's no label.
+func labelSuffix(label string) string {
+	if label == "" {
+		return ""
+	}
+	return "  # " + label
+}
+
 func elipticallyTruncate(s string, max int) string {
 	if len(s) <= max {
 		return s
@@ -744,6 +1426,14 @@ func (e *serveEnv) runServeReset(ctx context.Context, args []string) error {
 	return e.lc.SetServeConfig(ctx, sc)
 }
 
+// stdin returns the reader "serve edit" reads commands from.
+func (e *serveEnv) stdin() io.Reader {
+	if e.testStdin != nil {
+		return e.testStdin
+	}
+	return os.Stdin
+}
+
 // parseServePort parses a port number from a string and returns it as a
 // uint16. It returns an error if the port number is invalid or zero.
 func parseServePort(s string) (uint16, error) {
@@ -4,26 +4,43 @@
 package cli
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/big"
+	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/crypto/bcrypt"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/memnet"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/ptr"
 )
 
 func TestCleanMountPoint(t *testing.T) {
@@ -38,6 +55,10 @@ func TestCleanMountPoint(t *testing.T) {
 		{"/foo//", "", true},                // too many slashes
 		{"", "", true},                      // empty
 		{"https://tailscale.com", "", true}, // not a path
+		{"/*", "/*", false},                 // wildcard
+		{"*", "/*", false},                  // bare wildcard
+		{"/foo/*", "", true},                // wildcard not at root
+		{"/*/", "", true},                   // wildcard with trailing slash
 	}
 	for _, tt := range tests {
 		mp, err := cleanMountPoint(tt.mount)
@@ -655,26 +676,47 @@ type step struct {
 		},
 	})
 
-	// error states
+	// wildcard mount alongside a specific one
 	add(step{reset: true})
-	add(step{ // tcp forward 5432 on serve port 443
-		command: cmd("tls-terminated-tcp:443 tcp://localhost:5432"),
+	add(step{
+		command: cmd("https:443 /* http://127.0.0.1:3000"),
 		want: &ipn.ServeConfig{
-			TCP: map[uint16]*ipn.TCPPortHandler{
-				443: {
-					TCPForward:   "127.0.0.1:5432",
-					TerminateTLS: "foo.test.ts.net",
-				},
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/*": {Proxy: "http://127.0.0.1:3000"},
+				}},
 			},
 		},
 	})
-	add(step{ // try to start a web handler on the same port
-		command: cmd("https:443 / localhost:3000"),
-		wantErr: exactErr(errHelp, "errHelp"),
+	add(step{
+		command: cmd("https:443 /static/ http://127.0.0.1:3001"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/*":       {Proxy: "http://127.0.0.1:3000"},
+					"/static/": {Proxy: "http://127.0.0.1:3001"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("https:443 /* off"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/static/": {Proxy: "http://127.0.0.1:3001"},
+				}},
+			},
+		},
 	})
+
+	// --replace swaps all handlers on one port and leaves others alone
 	add(step{reset: true})
-	add(step{ // start a web handler on port 443
-		command: cmd("https:443 / localhost:3000"),
+	add(step{
+		command: cmd("https:443 / http://127.0.0.1:3000"),
 		want: &ipn.ServeConfig{
 			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
 			Web: map[ipn.HostPort]*ipn.WebServerConfig{
@@ -684,259 +726,2806 @@ type step struct {
 			},
 		},
 	})
-	add(step{ // try to start a tcp forwarder on the same serve port
-		command: cmd("tls-terminated-tcp:443 tcp://localhost:5432"),
+	add(step{
+		command: cmd("https:443 /api http://127.0.0.1:3001"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/api": {Proxy: "http://127.0.0.1:3001"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("https:8443 / http://127.0.0.1:4000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 8443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/api": {Proxy: "http://127.0.0.1:3001"},
+				}},
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:4000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("funnel 443 on"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 8443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/api": {Proxy: "http://127.0.0.1:3001"},
+				}},
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:4000"},
+				}},
+			},
+			AllowFunnel: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+	})
+	add(step{
+		command: cmd("--replace https:443 /v2 http://127.0.0.1:3002"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 8443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/v2": {Proxy: "http://127.0.0.1:3002"},
+				}},
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:4000"},
+				}},
+			},
+			AllowFunnel: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+	})
+	add(step{ // replacing with the same config is a no-op
+		command: cmd("--replace https:443 /v2 http://127.0.0.1:3002"),
+		want:    nil, // nothing to save
+	})
+
+	// --no-http2 is stored on proxy handlers only
+	add(step{reset: true})
+	add(step{
+		command: cmd("--no-http2 https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", NoHTTP2: true},
+				}},
+			},
+		},
+	})
+	add(step{ // same backend without the flag on another mount
+		command: cmd("https:443 /h2 http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":   {Proxy: "http://127.0.0.1:3000", NoHTTP2: true},
+					"/h2": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{ // not a proxy
+		command: cmd("--no-http2 https:443 /text text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a proxy
+		command: cmd("--no-http2 https:443 /files " + filepath.Join(td, "foo")),
 		wantErr: anyErr(),
 	})
 
-	lc := &fakeLocalServeClient{}
-	// And now run the steps above.
-	for i, st := range steps {
-		if st.debugBreak != nil {
-			st.debugBreak()
-		}
-		if st.reset {
-			t.Logf("Executing step #%d, line %v: [reset]", i, st.line)
-			lc.config = nil
-		}
-		if st.command == nil {
-			continue
-		}
-		t.Logf("Executing step #%d, line %v: %q ... ", i, st.line, st.command)
+	// --allow-methods
+	add(step{reset: true})
+	add(step{
+		command: cmd("--allow-methods get,HEAD https:443 / " + filepath.Join(td, "foo")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Path: filepath.Join(td, "foo"), AllowMethods: []string{"GET", "HEAD"}},
+				}},
+			},
+		},
+	})
+	add(step{ // no flag means all methods
+		command: cmd("https:443 /api http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Path: filepath.Join(td, "foo"), AllowMethods: []string{"GET", "HEAD"}},
+					"/api": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{ // unknown method
+		command: cmd("--allow-methods GET,FETCH https:443 /api http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // empty method
+		command: cmd("--allow-methods GET, https:443 /api http://localhost:3000"),
+		wantErr: anyErr(),
+	})
 
-		var stdout bytes.Buffer
-		var flagOut bytes.Buffer
-		e := &serveEnv{
-			lc:          lc,
-			testFlagOut: &flagOut,
-			testStdout:  &stdout,
-			testStderr:  io.Discard,
+	// --aggregate-backends
+	add(step{reset: true})
+	add(step{ // nothing to aggregate yet
+		command: cmd("--aggregate-backends https /healthz"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("https:443 / text:hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{ // text handlers aren't backends
+		command: cmd("--aggregate-backends https /healthz"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("https:8443 /api http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 8443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi"},
+				}},
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/api": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{ // backends on other ports count
+		command: cmd("--aggregate-backends https /healthz"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 8443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":        {Text: "hi"},
+					"/healthz": {AggregateBackends: true},
+				}},
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/api": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{ // no source allowed
+		command: cmd("--aggregate-backends https /healthz http://localhost:3000"),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+
+	// --require-tag
+	add(step{reset: true})
+	add(step{
+		command: cmd("--require-tag tag:admin https:443 /admin http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/admin": {Proxy: "http://127.0.0.1:3000", RequireTag: "tag:admin"},
+				}},
+			},
+		},
+	})
+	add(step{ // missing tag: prefix
+		command: cmd("--require-tag admin https:443 /admin http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // empty tag name
+		command: cmd("--require-tag tag: https:443 /admin http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // invalid characters
+		command: cmd("--require-tag tag:ad_min https:443 /admin http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --log-level
+	add(step{reset: true})
+	add(step{
+		command: cmd("--log-level debug https:443 /api http://localhost:8080"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/api": {Proxy: "http://127.0.0.1:8080", LogLevel: ipn.LogLevelDebug},
+				}},
+			},
+		},
+	})
+	add(step{ // unknown level
+		command: cmd("--log-level verbose https:443 /api http://localhost:8080"),
+		wantErr: anyErr(),
+	})
+
+	// --allow-cidr
+	add(step{reset: true})
+	add(step{
+		command: cmd("--allow-cidr 192.168.10.7/24 --allow-cidr fd7a:115c:a1e0::/48 https:443 /intranet http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/intranet": {Proxy: "http://127.0.0.1:3000", AllowCIDRs: []netip.Prefix{
+						netip.MustParsePrefix("192.168.10.0/24"),
+						netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+					}},
+				}},
+			},
+		},
+	})
+	add(step{ // not a CIDR
+		command: cmd("--allow-cidr 192.168.10.7 https:443 /intranet http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not for TCP
+		command: cmd("--allow-cidr 192.168.10.0/24 tcp:5432 tcp://localhost:5432"),
+		wantErr: anyErr(),
+	})
+
+	// --cache-control
+	add(step{reset: true})
+	add(step{
+		command: cmd("--cache-control max-age=3600 https:443 / " + filepath.Join(td, "foo")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Path: filepath.Join(td, "foo"), CacheControl: "max-age=3600"},
+				}},
+			},
+		},
+	})
+	add(step{ // only valid for paths
+		command: cmd("--cache-control max-age=3600 https:443 /api http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // header injection
+		command: []string{"--cache-control", "max-age=3600\r\nX-Evil: 1", "https:443", "/", filepath.Join(td, "foo")},
+		wantErr: anyErr(),
+	})
+
+	// merged directories
+	add(step{reset: true})
+	os.MkdirAll(filepath.Join(td, "override"), 0700)
+	mergedDirs := func(dirs ...string) string {
+		for i, d := range dirs {
+			dirs[i] = filepath.Join(td, d)
 		}
-		lastCount := lc.setCount
-		var cmd *ffcli.Command
-		var args []string
-		if st.command[0] == "funnel" {
-			cmd = newFunnelCommand(e)
+		return strings.Join(dirs, string(filepath.ListSeparator))
+	}
+	add(step{
+		command: cmd("https:443 /site " + mergedDirs("subdir", "override")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/site/": {Path: filepath.Join(td, "subdir"), OverlayPaths: []string{filepath.Join(td, "override")}},
+				}},
+			},
+		},
+	})
+	add(step{ // missing directory
+		command: cmd("https:443 / " + mergedDirs("subdir", "missing")),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+	add(step{ // not a directory
+		command: cmd("https:443 / " + mergedDirs("subdir", "foo")),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+
+	// --spa-fallback
+	add(step{reset: true})
+	add(step{
+		command: cmd("--spa-fallback https:443 /app " + filepath.Join(td, "subdir")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/app/": {Path: filepath.Join(td, "subdir"), SPAFallback: true},
+				}},
+			},
+		},
+	})
+	add(step{ // not a directory
+		command: cmd("--spa-fallback https:443 / " + filepath.Join(td, "foo")),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a path
+		command: cmd("--spa-fallback https:443 /api http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --webdav
+	add(step{reset: true})
+	add(step{
+		command: cmd("--webdav https:443 /files " + filepath.Join(td, "subdir")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/files/": {Path: filepath.Join(td, "subdir"), WebDAV: true},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--webdav --webdav-read-only http:80 /files/ " + filepath.Join(td, "subdir")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 80: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/files/": {Path: filepath.Join(td, "subdir"), WebDAV: true},
+				}},
+				"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+					"/files/": {Path: filepath.Join(td, "subdir"), WebDAV: true, WebDAVReadOnly: true},
+				}},
+			},
+		},
+	})
+	add(step{ // not a directory
+		command: cmd("--webdav https:443 /foo " + filepath.Join(td, "foo")),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a path
+		command: cmd("--webdav https:443 /api http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // merged directories
+		command: cmd("--webdav https:443 /merged " + mergedDirs("subdir", "subdir")),
+		wantErr: anyErr(),
+	})
+	add(step{ // read-only without --webdav
+		command: cmd("--webdav-read-only https:443 /ro " + filepath.Join(td, "subdir")),
+		wantErr: anyErr(),
+	})
+	add(step{ // with --spa-fallback
+		command: cmd("--webdav --spa-fallback https:443 /app " + filepath.Join(td, "subdir")),
+		wantErr: anyErr(),
+	})
+	add(step{ // tcp
+		command: cmd("--webdav tcp:5432 tcp://localhost:5432"),
+		wantErr: anyErr(),
+	})
+
+	// --serve-dotfiles
+	add(step{reset: true})
+	add(step{
+		command: cmd("--serve-dotfiles https:443 /site " + filepath.Join(td, "subdir")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/site/": {Path: filepath.Join(td, "subdir"), ServeDotfiles: true},
+				}},
+			},
+		},
+	})
+	add(step{ // not a directory
+		command: cmd("--serve-dotfiles https:443 /foo " + filepath.Join(td, "foo")),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a path
+		command: cmd("--serve-dotfiles https:443 /api http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // with --webdav
+		command: cmd("--serve-dotfiles --webdav https:443 /files " + filepath.Join(td, "subdir")),
+		wantErr: anyErr(),
+	})
+	add(step{ // tcp
+		command: cmd("--serve-dotfiles tcp:5432 tcp://localhost:5432"),
+		wantErr: anyErr(),
+	})
+
+	// --compress
+	add(step{reset: true})
+	add(step{
+		command: cmd("--compress https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", Compress: true},
+				}},
+			},
+		},
+	})
+	add(step{ // not a path, archive or proxy
+		command: cmd("--compress https:443 /hello text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not http or https
+		command: cmd("--compress tcp:5432 tcp://localhost:5432"),
+		wantErr: anyErr(),
+	})
+
+	// archive
+	add(step{reset: true})
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	if w, err := zw.Create("index.html"); err != nil {
+		t.Fatal(err)
+	} else {
+		io.WriteString(w, "<h1>hi</h1>")
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("site.zip", zipBuf.String())
+	writeFile("site.txt", "not an archive")
+	writeFile("bad.zip", "not a zip")
+	add(step{
+		command: cmd("--cache-control max-age=60 https:443 /docs archive:" + filepath.Join(td, "site.zip")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/docs/": {Archive: filepath.Join(td, "site.zip"), CacheControl: "max-age=60"},
+				}},
+			},
+		},
+	})
+	add(step{ // missing archive
+		command: cmd("https:443 / archive:" + filepath.Join(td, "missing.zip")),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+	add(step{ // not a zip or tar file
+		command: cmd("https:443 / archive:" + filepath.Join(td, "site.txt")),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+	add(step{ // corrupt zip
+		command: cmd("https:443 / archive:" + filepath.Join(td, "bad.zip")),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+	add(step{ // relative path
+		command: cmd("https:443 / archive:site.zip"),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+
+	// pac
+	add(step{reset: true})
+	writeFile("proxy.pac", `function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	add(step{
+		command: cmd("https:443 /proxy.pac pac:" + filepath.Join(td, "proxy.pac")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/proxy.pac": {Path: filepath.Join(td, "proxy.pac"), ContentType: ipn.PACContentType},
+				}},
+			},
+		},
+	})
+	add(step{ // missing file
+		command: cmd("https:443 /proxy.pac pac:" + filepath.Join(td, "missing.pac")),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+	add(step{ // directory
+		command: cmd("https:443 /proxy.pac pac:" + td),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+	add(step{ // relative path
+		command: cmd("https:443 /proxy.pac pac:proxy.pac"),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+
+	// --drain
+	add(step{reset: true})
+	add(step{
+		command: cmd("https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--drain 30s https:443 / http://localhost:3001"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3001"},
+				}},
+			},
+			Drain: "30s",
+		},
+	})
+	add(step{ // no --drain means an immediate switchover
+		command: cmd("https:443 / http://localhost:3002"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3002"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--drain 1m https:443 /api http://localhost:3003"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3002"},
+					"/api": {Proxy: "http://127.0.0.1:3003"},
+				}},
+			},
+			Drain: "1m",
+		},
+	})
+	add(step{ // removing a handler can drain too
+		command: cmd("--drain 10s https:443 /api off"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3002"},
+				}},
+			},
+			Drain: "10s",
+		},
+	})
+	add(step{ // invalid duration
+		command: cmd("--drain soon https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // too long
+		command: cmd("--drain 2h https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// redirect-to-https
+	add(step{reset: true})
+	add(step{
+		command: cmd("https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("http:80 / redirect-to-https"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 80: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+				"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {RedirectToHTTPS: true},
+				}},
+			},
+		},
+	})
+	add(step{ // already https
+		command: cmd("https:8443 / redirect-to-https"),
+		wantErr: anyErr(),
+	})
+
+	// --sni
+	add(step{reset: true})
+	add(step{
+		command: cmd("--sni a.example.ts.net=localhost:8001 --sni b.example.ts.net=127.0.0.1:8002 tls-terminated-tcp:443 tcp://localhost:80"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443: {
+					TCPForward:   "127.0.0.1:80",
+					TerminateTLS: "foo.test.ts.net",
+					SNIRoutes: map[string]string{
+						"a.example.ts.net": "127.0.0.1:8001",
+						"b.example.ts.net": "127.0.0.1:8002",
+					},
+				},
+			},
+		},
+	})
+	add(step{ // replaces the previous routes
+		command: cmd("--sni c.example.ts.net=localhost:8003 tls-terminated-tcp:443 tcp://localhost:80"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443: {
+					TCPForward:   "127.0.0.1:80",
+					TerminateTLS: "foo.test.ts.net",
+					SNIRoutes:    map[string]string{"c.example.ts.net": "127.0.0.1:8003"},
+				},
+			},
+		},
+	})
+	add(step{ // requires TLS termination
+		command: cmd("--sni a.example.ts.net=localhost:8001 tcp:443 tcp://localhost:80"),
+		wantErr: anyErr(),
+	})
+	add(step{ // conflicts with the default target
+		command: cmd("--sni foo.test.ts.net=localhost:8001 tls-terminated-tcp:443 tcp://localhost:80"),
+		wantErr: anyErr(),
+	})
+	add(step{ // conflicting backends for one name
+		command: cmd("--sni a.example.ts.net=localhost:8001 --sni a.example.ts.net=localhost:8002 tls-terminated-tcp:443 tcp://localhost:80"),
+		wantErr: anyErr(),
+	})
+
+	// --proxy-host
+	add(step{reset: true})
+	add(step{
+		command: cmd("--proxy-host backend.internal https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", ProxyHost: "backend.internal"},
+				}},
+			},
+		},
+	})
+	add(step{ // only valid for proxies
+		command: cmd("--proxy-host backend.internal https:443 /txt text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // invalid host
+		command: cmd("--proxy-host backend/internal https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --grpc-web
+	add(step{reset: true})
+	add(step{
+		command: cmd("--grpc-web https:443 / http://localhost:50051"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:50051", GRPCWeb: true},
+				}},
+			},
+		},
+	})
+	add(step{ // only valid for proxies
+		command: cmd("--grpc-web https:443 /txt text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // gRPC needs HTTP/2
+		command: cmd("--grpc-web --no-http2 https:443 / http://localhost:50051"),
+		wantErr: anyErr(),
+	})
+
+	// --backend-keepalive
+	add(step{reset: true})
+	add(step{
+		command: cmd("--backend-keepalive 30s https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", BackendKeepalive: "30s"},
+				}},
+			},
+		},
+	})
+	add(step{ // only valid for proxies
+		command: cmd("--backend-keepalive 30s https:443 /txt text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a duration
+		command: cmd("--backend-keepalive 30 https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // negative
+		command: cmd("--backend-keepalive -1s https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --connect-timeout and --response-header-timeout
+	add(step{reset: true})
+	add(step{
+		command: cmd("--connect-timeout 5s --response-header-timeout 2m https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", ConnectTimeout: "5s", ResponseHeaderTimeout: "2m"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--response-header-timeout 30s https:443 /api http://localhost:3001"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000", ConnectTimeout: "5s", ResponseHeaderTimeout: "2m"},
+					"/api": {Proxy: "http://127.0.0.1:3001", ResponseHeaderTimeout: "30s"},
+				}},
+			},
+		},
+	})
+	add(step{ // only valid for proxies
+		command: cmd("--connect-timeout 5s https:443 /txt text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // only valid for proxies
+		command: cmd("--response-header-timeout 5s https:443 /txt text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a duration
+		command: cmd("--connect-timeout 5 https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // negative
+		command: cmd("--connect-timeout -1s https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a duration
+		command: cmd("--response-header-timeout soon https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // negative
+		command: cmd("--response-header-timeout -30s https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --request-id-header
+	add(step{reset: true})
+	add(step{
+		command: cmd("--request-id-header X-Request-Id https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", RequestIDHeader: "X-Request-Id"},
+				}},
+			},
+		},
+	})
+	add(step{ // only valid for proxies
+		command: cmd("--request-id-header X-Request-Id https:443 /txt text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a header name
+		command: []string{"--request-id-header", "X Request Id", "https:443", "/", "http://localhost:3000"},
+		wantErr: anyErr(),
+	})
+	add(step{ // reserved
+		command: cmd("--request-id-header Host https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --canary
+	add(step{reset: true})
+	add(step{
+		command: cmd("--canary localhost:3001=10% https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", Canary: "http://127.0.0.1:3001", CanaryPercent: 10},
+				}},
+			},
+		},
+	})
+	add(step{ // only valid for proxies
+		command: cmd("--canary localhost:3001=10% https:443 /txt text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // out of range
+		command: cmd("--canary localhost:3001=150% https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --tls-min-version
+	add(step{reset: true})
+	add(step{
+		command: cmd("--tls-min-version 1.3 https:443 / http://localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true, TLSMinVersion: "1.3"}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{ // kept when adding another handler on the port
+		command: cmd("https:443 /txt text:hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true, TLSMinVersion: "1.3"}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/txt": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--tls-min-version 1.2 tls-terminated-tcp:8443 tcp://localhost:5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:  {HTTPS: true, TLSMinVersion: "1.3"},
+				8443: {TCPForward: "127.0.0.1:5432", TerminateTLS: "foo.test.ts.net", TLSMinVersion: "1.2"},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/txt": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{ // too old
+		command: cmd("--tls-min-version 1.1 https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a version
+		command: cmd("--tls-min-version tls13 https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // plain http
+		command: cmd("--tls-min-version 1.3 http:80 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // TLS passed through
+		command: cmd("--tls-min-version 1.3 tcp:5432 tcp://localhost:5432"),
+		wantErr: anyErr(),
+	})
+
+	// --max-conns
+	add(step{reset: true})
+	add(step{
+		command: cmd("--max-conns 16 tcp:25565 tcp://localhost:25565"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{25565: {TCPForward: "127.0.0.1:25565", MaxConns: 16}},
+		},
+	})
+	add(step{
+		command: cmd("--max-conns 4 tls-terminated-tcp:8443 tcp://localhost:5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				25565: {TCPForward: "127.0.0.1:25565", MaxConns: 16},
+				8443:  {TCPForward: "127.0.0.1:5432", TerminateTLS: "foo.test.ts.net", MaxConns: 4},
+			},
+		},
+	})
+	add(step{ // re-serving without the flag removes the limit
+		command: cmd("tcp:25565 tcp://localhost:25565"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				25565: {TCPForward: "127.0.0.1:25565"},
+				8443:  {TCPForward: "127.0.0.1:5432", TerminateTLS: "foo.test.ts.net", MaxConns: 4},
+			},
+		},
+	})
+	add(step{ // negative
+		command: cmd("--max-conns -1 tcp:25565 tcp://localhost:25565"),
+		wantErr: anyErr(),
+	})
+	add(step{ // web
+		command: cmd("--max-conns 16 https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --backlog
+	add(step{reset: true})
+	add(step{
+		command: cmd("--backlog 4096 tcp:5432 tcp://localhost:5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{5432: {TCPForward: "127.0.0.1:5432", Backlog: 4096}},
+		},
+	})
+	add(step{ // re-serving without the flag goes back to the OS default
+		command: cmd("tcp:5432 tcp://localhost:5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{5432: {TCPForward: "127.0.0.1:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("--backlog 65535 tls-terminated-tcp:8443 tcp://localhost:5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				5432: {TCPForward: "127.0.0.1:5432"},
+				8443: {TCPForward: "127.0.0.1:5432", TerminateTLS: "foo.test.ts.net", Backlog: 65535},
+			},
+		},
+	})
+	add(step{ // too big
+		command: cmd("--backlog 65536 tcp:5432 tcp://localhost:5432"),
+		wantErr: anyErr(),
+	})
+	add(step{ // negative
+		command: cmd("--backlog -1 tcp:5432 tcp://localhost:5432"),
+		wantErr: anyErr(),
+	})
+	add(step{ // web
+		command: cmd("--backlog 128 https:443 / http://localhost:3000"),
+		wantErr: anyErr(),
+	})
+
+	// --if-not-exists
+	add(step{reset: true})
+	add(step{ // creates the handler if there's none
+		command: cmd("--if-not-exists https:443 / http://127.0.0.1:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{ // leaves an existing handler alone, successfully
+		command: cmd("--if-not-exists https:443 / http://127.0.0.1:4000"),
+		want:    nil, // nothing to save
+	})
+	add(step{ // other mount points are still added
+		command: cmd("--if-not-exists https:443 /api http://127.0.0.1:4000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/api": {Proxy: "http://127.0.0.1:4000"},
+				}},
+			},
+		},
+	})
+	add(step{ // as are other ports
+		command: cmd("--if-not-exists https:8443 / http://127.0.0.1:4000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 8443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/api": {Proxy: "http://127.0.0.1:4000"},
+				}},
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:4000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--if-not-exists --replace https:443 / http://127.0.0.1:4000"),
+		wantErr: anyErr(),
+	})
+
+	// basic auth; see TestServeBasicAuth for the configs it makes
+	add(step{reset: true})
+	add(step{ // no password
+		command: cmd("--basic-auth alice https:443 / http://127.0.0.1:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("--basic-auth-file /does/not/exist https:443 / http://127.0.0.1:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // web only
+		command: cmd("--basic-auth alice:hunter2 tcp:2222 tcp://localhost:22"),
+		wantErr: anyErr(),
+	})
+
+	// services
+	add(step{reset: true})
+	add(step{
+		command: cmd("--service svc:wiki https:443 / http://127.0.0.1:3000"),
+		want: &ipn.ServeConfig{
+			Services: map[string]*ipn.ServiceConfig{
+				"svc:wiki": {
+					TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+					Web: map[ipn.HostPort]*ipn.WebServerConfig{
+						"wiki.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+							"/": {Proxy: "http://127.0.0.1:3000"},
+						}},
+					},
+				},
+			},
+		},
+	})
+	add(step{ // the node's own handlers are separate
+		command: cmd("https:443 / http://127.0.0.1:4000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:4000"},
+				}},
+			},
+			Services: map[string]*ipn.ServiceConfig{
+				"svc:wiki": {
+					TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+					Web: map[ipn.HostPort]*ipn.WebServerConfig{
+						"wiki.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+							"/": {Proxy: "http://127.0.0.1:3000"},
+						}},
+					},
+				},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--service svc:wiki https:443 / off"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:4000"},
+				}},
+			},
+		},
+	})
+	add(step{ // already removed
+		command: cmd("--service svc:wiki https:443 / off"),
+		wantErr: anyErr(),
+	})
+	add(step{ // missing svc: prefix
+		command: cmd("--service wiki https:443 / http://127.0.0.1:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // not a DNS label
+		command: cmd("--service svc:my_wiki https:443 / http://127.0.0.1:3000"),
+		wantErr: anyErr(),
+	})
+	add(step{ // web only
+		command: cmd("--service svc:ssh tcp:2222 tcp://localhost:22"),
+		wantErr: anyErr(),
+	})
+
+	// error states
+	add(step{reset: true})
+	add(step{ // tcp forward 5432 on serve port 443
+		command: cmd("tls-terminated-tcp:443 tcp://localhost:5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443: {
+					TCPForward:   "127.0.0.1:5432",
+					TerminateTLS: "foo.test.ts.net",
+				},
+			},
+		},
+	})
+	add(step{ // try to start a web handler on the same port
+		command: cmd("https:443 / localhost:3000"),
+		wantErr: exactErr(errHelp, "errHelp"),
+	})
+	add(step{reset: true})
+	add(step{ // start a web handler on port 443
+		command: cmd("https:443 / localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{ // try to start a tcp forwarder on the same serve port
+		command: cmd("tls-terminated-tcp:443 tcp://localhost:5432"),
+		wantErr: anyErr(),
+	})
+
+	lc := &fakeLocalServeClient{}
+	// And now run the steps above.
+	for i, st := range steps {
+		if st.debugBreak != nil {
+			st.debugBreak()
+		}
+		if st.reset {
+			t.Logf("Executing step #%d, line %v: [reset]", i, st.line)
+			lc.config = nil
+		}
+		if st.command == nil {
+			continue
+		}
+		t.Logf("Executing step #%d, line %v: %q ... ", i, st.line, st.command)
+
+		var stdout bytes.Buffer
+		var flagOut bytes.Buffer
+		e := &serveEnv{
+			lc:          lc,
+			testFlagOut: &flagOut,
+			testStdout:  &stdout,
+			testStderr:  io.Discard,
+		}
+		lastCount := lc.setCount
+		var cmd *ffcli.Command
+		var args []string
+		if st.command[0] == "funnel" {
+			cmd = newFunnelCommand(e)
 			args = st.command[1:]
 		} else {
 			cmd = newServeLegacyCommand(e)
 			args = st.command
 		}
-		if cmd.FlagSet == nil {
-			cmd.FlagSet = flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
-			cmd.FlagSet.SetOutput(Stdout)
+		if cmd.FlagSet == nil {
+			cmd.FlagSet = flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+			cmd.FlagSet.SetOutput(Stdout)
+		}
+		err := cmd.ParseAndRun(context.Background(), args)
+		if flagOut.Len() > 0 {
+			t.Logf("flag package output: %q", flagOut.Bytes())
+		}
+		if err != nil {
+			if st.wantErr == nil {
+				t.Fatalf("step #%d, line %v: unexpected error: %v", i, st.line, err)
+			}
+			if bad := st.wantErr(err); bad != "" {
+				t.Fatalf("step #%d, line %v: unexpected error: %v", i, st.line, bad)
+			}
+			continue
+		}
+		if st.wantErr != nil {
+			t.Fatalf("step #%d, line %v: got success (saved=%v), but wanted an error", i, st.line, lc.config != nil)
+		}
+		var got *ipn.ServeConfig = nil
+		if lc.setCount > lastCount {
+			got = lc.config
+		}
+		if !reflect.DeepEqual(got, st.want) {
+			t.Fatalf("[%d] %v: bad state. got:\n%v\n\nwant:\n%v\n",
+				i, st.command, logger.AsJSON(got), logger.AsJSON(st.want))
+			// NOTE: asJSON will omit empty fields, which might make
+			// result in bad state got/want diffs being the same, even
+			// though the actual state is different. Use below to debug:
+			// t.Fatalf("[%d] %v: bad state. got:\n%+v\n\nwant:\n%+v\n",
+			// 	i, st.command, got, st.want)
+		}
+	}
+}
+
+func TestVerifyFunnelEnabled(t *testing.T) {
+	tstest.Replace(t, &Stderr, io.Discard)
+	tstest.Replace(t, &Stdout, io.Discard)
+
+	lc := &fakeLocalServeClient{}
+	var stdout bytes.Buffer
+	var flagOut bytes.Buffer
+	e := &serveEnv{
+		lc:          lc,
+		testFlagOut: &flagOut,
+		testStdout:  &stdout,
+		testStderr:  io.Discard,
+	}
+
+	tests := []struct {
+		name string
+		// queryFeatureResponse is the mock response desired from the
+		// call made to lc.QueryFeature by verifyFunnelEnabled.
+		queryFeatureResponse mockQueryFeatureResponse
+		caps                 []tailcfg.NodeCapability // optionally set at fakeStatus.Capabilities
+		wantErr              string
+		wantPanic            string
+	}{
+		{
+			name:                 "enabled",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: &tailcfg.QueryFeatureResponse{Complete: true}, err: nil},
+			wantErr:              "", // no error, success
+		},
+		{
+			name:                 "fallback-to-non-interactive-flow",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
+			wantErr:              "Funnel not available; HTTPS must be enabled. See https://tailscale.com/s/https.",
+		},
+		{
+			name:                 "fallback-flow-missing-acl-rule",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
+			caps:                 []tailcfg.NodeCapability{tailcfg.CapabilityHTTPS},
+			wantErr:              `Funnel not available; "funnel" node attribute not set. See https://tailscale.com/s/no-funnel.`,
+		},
+		{
+			name:                 "fallback-flow-enabled",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
+			caps:                 []tailcfg.NodeCapability{tailcfg.CapabilityHTTPS, tailcfg.NodeAttrFunnel, "https://tailscale.com/cap/funnel-ports?ports=80,443,8080-8090"},
+			wantErr:              "", // no error, success
+		},
+		{
+			name: "not-allowed-to-enable",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: &tailcfg.QueryFeatureResponse{
+				Complete:   false,
+				Text:       "You don't have permission to enable this feature.",
+				ShouldWait: false,
+			}, err: nil},
+			wantErr:   "",
+			wantPanic: "unexpected call to os.Exit(0) during test", // os.Exit(0) should be called to end process
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			lc.setQueryFeatureResponse(tt.queryFeatureResponse)
+
+			if tt.caps != nil {
+				cm := make(tailcfg.NodeCapMap)
+				for _, c := range tt.caps {
+					cm[c] = nil
+				}
+				tstest.Replace(t, &fakeStatus.Self.CapMap, cm)
+			}
+
+			defer func() {
+				r := recover()
+				var gotPanic string
+				if r != nil {
+					gotPanic = fmt.Sprint(r)
+				}
+				if gotPanic != tt.wantPanic {
+					t.Errorf("wrong panic; got=%s, want=%s", gotPanic, tt.wantPanic)
+				}
+			}()
+			gotErr := e.verifyFunnelEnabled(ctx, 443)
+			var got string
+			if gotErr != nil {
+				got = gotErr.Error()
+			}
+			if got != tt.wantErr {
+				t.Errorf("wrong error; got=%s, want=%s", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeLocalServeClient is a fake tailscale.LocalClient for tests.
+// It's not a full implementation, just enough to test the serve command.
+//
+// The fake client is stateful, and is used to test manipulating
+// ServeConfig state. This implementation cannot be used concurrently.
+type fakeLocalServeClient struct {
+	config               *ipn.ServeConfig
+	setCount             int                       // counts calls to SetServeConfig
+	queryFeatureResponse *mockQueryFeatureResponse // mock response to QueryFeature calls
+	bus                  *tailscale.LocalClient    // if non-nil, serves WatchIPNBus
+	certPEM              []byte                    // returned by CertPair; nil means an error
+	prefs                *ipn.Prefs                // nil means the zero Prefs
+	stats                []ipn.ServeHandlerStats   // returned by ServeStats
+}
+
+// fakeStatus is a fake ipnstate.Status value for tests.
+// It's not a full implementation, just enough to test the serve command.
+//
+// It returns a state that's running, with a fake DNSName and the Funnel
+// node attribute capability.
+var fakeStatus = &ipnstate.Status{
+	BackendState: ipn.Running.String(),
+	Self: &ipnstate.PeerStatus{
+		DNSName: "foo.test.ts.net",
+		CapMap: tailcfg.NodeCapMap{
+			tailcfg.NodeAttrFunnel:                            nil,
+			tailcfg.CapabilityFunnelPorts + "?ports=443,8443": nil,
+		},
+	},
+}
+
+func (lc *fakeLocalServeClient) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	return fakeStatus, nil
+}
+
+func (lc *fakeLocalServeClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, error) {
+	return lc.config.Clone(), nil
+}
+
+func (lc *fakeLocalServeClient) SetServeConfig(ctx context.Context, config *ipn.ServeConfig) error {
+	lc.setCount += 1
+	lc.config = config.Clone()
+	return nil
+}
+
+type mockQueryFeatureResponse struct {
+	resp *tailcfg.QueryFeatureResponse
+	err  error
+}
+
+func (lc *fakeLocalServeClient) setQueryFeatureResponse(resp mockQueryFeatureResponse) {
+	lc.queryFeatureResponse = &resp
+}
+
+func (lc *fakeLocalServeClient) QueryFeature(ctx context.Context, feature string) (*tailcfg.QueryFeatureResponse, error) {
+	if resp := lc.queryFeatureResponse; resp != nil {
+		// If we're testing QueryFeature, use the response value set for the test.
+		return resp.resp, resp.err
+	}
+	return &tailcfg.QueryFeatureResponse{Complete: true}, nil // fallback to already enabled
+}
+
+func (lc *fakeLocalServeClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*tailscale.IPNBusWatcher, error) {
+	if lc.bus != nil {
+		return lc.bus.WatchIPNBus(ctx, mask)
+	}
+	return nil, nil // unused in tests
+}
+
+func (lc *fakeLocalServeClient) CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	if lc.certPEM == nil {
+		return nil, nil, errors.New("no certificate")
+	}
+	return lc.certPEM, nil, nil
+}
+
+func (lc *fakeLocalServeClient) GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
+	if lc.prefs == nil {
+		return new(ipn.Prefs), nil
+	}
+	return lc.prefs.Clone(), nil
+}
+
+func (lc *fakeLocalServeClient) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	if lc.prefs == nil {
+		lc.prefs = new(ipn.Prefs)
+	}
+	lc.prefs.ApplyEdits(mp)
+	return lc.prefs.Clone(), nil
+}
+
+func (lc *fakeLocalServeClient) IncrementCounter(ctx context.Context, name string, delta int) error {
+	return nil // unused in tests
+}
+
+func (lc *fakeLocalServeClient) ServeStats(ctx context.Context) ([]ipn.ServeHandlerStats, error) {
+	return lc.stats, nil
+}
+
+// exactError returns an error checker that wants exactly the provided want error.
+// If optName is non-empty, it's used in the error message.
+func exactErr(want error, optName ...string) func(error) string {
+	return func(got error) string {
+		if got == want {
+			return ""
+		}
+		if len(optName) > 0 {
+			return fmt.Sprintf("got error %v, want %v", got, optName[0])
+		}
+		return fmt.Sprintf("got error %v, want %v", got, want)
+	}
+}
+
+// anyErr returns an error checker that wants any error.
+func anyErr() func(error) string {
+	return func(got error) string {
+		return ""
+	}
+}
+
+func cmd(s string) []string {
+	return strings.Fields(s)
+}
+
+func TestSNIRoutesFlag(t *testing.T) {
+	var r sniRoutes
+	for _, s := range []string{
+		"a.example.ts.net=localhost:8001",
+		"B.Example.ts.net=127.0.0.1:8002",
+		"a.example.ts.net=127.0.0.1:8001", // same backend again is fine
+	} {
+		if err := r.Set(s); err != nil {
+			t.Fatalf("Set(%q): %v", s, err)
+		}
+	}
+	want := sniRoutes{
+		"a.example.ts.net": "127.0.0.1:8001",
+		"b.example.ts.net": "127.0.0.1:8002",
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("got %v; want %v", r, want)
+	}
+	if got, want := r.String(), "a.example.ts.net=127.0.0.1:8001,b.example.ts.net=127.0.0.1:8002"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+
+	for _, s := range []string{
+		"a.example.ts.net=localhost:9000", // conflicts with existing route
+		"c.example.ts.net",                // missing backend
+		"c.example.ts.net=localhost",      // missing port
+		"c.example.ts.net=localhost:0",    // invalid port
+		"c.example.ts.net=10.0.0.1:80",    // not local
+		"c.example.ts.net.=localhost:80",  // trailing dot
+		"-bad-.example=localhost:80",      // invalid label
+		"=localhost:80",                   // empty name
+	} {
+		if err := r.Set(s); err == nil {
+			t.Errorf("Set(%q) succeeded; want error", s)
+		}
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("failed Sets modified routes: got %v; want %v", r, want)
+	}
+}
+
+func TestParseCanary(t *testing.T) {
+	tests := []struct {
+		in          string
+		wantTarget  string
+		wantPercent int
+		wantErr     bool
+	}{
+		{in: "http://127.0.0.1:3001=10%", wantTarget: "http://127.0.0.1:3001", wantPercent: 10},
+		{in: "localhost:3001=10", wantTarget: "http://127.0.0.1:3001", wantPercent: 10},
+		{in: "https+insecure://localhost:8443/v2=0%", wantTarget: "https+insecure://127.0.0.1:8443/v2", wantPercent: 0},
+		{in: "localhost:3001=100%", wantTarget: "http://127.0.0.1:3001", wantPercent: 100},
+		{in: "localhost:3001", wantErr: true},      // no percentage
+		{in: "localhost:3001=", wantErr: true},     // empty percentage
+		{in: "localhost:3001=%", wantErr: true},    // empty percentage
+		{in: "localhost:3001=101%", wantErr: true}, // over 100
+		{in: "localhost:3001=-1%", wantErr: true},  // negative
+		{in: "localhost:3001=2.5%", wantErr: true}, // not whole
+		{in: "localhost:3001=10%%", wantErr: true}, // extra %
+		{in: "=10%", wantErr: true},                // no target
+		{in: "10.0.0.1:3001=10%", wantErr: true},   // not local
+		{in: "3001=10%", wantErr: true},            // no host
+	}
+	for _, tt := range tests {
+		target, percent, err := parseCanary(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCanary(%q) = %q, %d; want error", tt.in, target, percent)
+			}
+			continue
+		}
+		if err != nil || target != tt.wantTarget || percent != tt.wantPercent {
+			t.Errorf("parseCanary(%q) = %q, %d, %v; want %q, %d", tt.in, target, percent, err, tt.wantTarget, tt.wantPercent)
+		}
+	}
+}
+
+func TestServeConfigVersion(t *testing.T) {
+	tstest.Replace(t, &Stderr, io.Discard)
+	tstest.Replace(t, &Stdout, io.Discard)
+
+	lc := &fakeLocalServeClient{}
+	run := func(args string) (version string, unchanged bool) {
+		t.Helper()
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			lc:          lc,
+			testFlagOut: io.Discard,
+			testStdout:  &stdout,
+			testStderr:  io.Discard,
+		}
+		if err := newServeLegacyCommand(e).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+		line := strings.TrimSpace(stdout.String())
+		rest, ok := strings.CutPrefix(line, "Serve config version: ")
+		if !ok {
+			t.Fatalf("%q: unexpected output %q", args, line)
+		}
+		version, unchanged = strings.CutSuffix(rest, " (unchanged)")
+		if want := lc.config.Hash(); version != want {
+			t.Fatalf("%q: version = %q; want %q", args, version, want)
+		}
+		return version, unchanged
+	}
+
+	v1, unchanged := run("https:443 / http://127.0.0.1:3000")
+	if unchanged {
+		t.Errorf("first set reported unchanged")
+	}
+	v2, unchanged := run("https:443 / http://127.0.0.1:3000")
+	if !unchanged || v2 != v1 {
+		t.Errorf("no-op set: got version %q (unchanged=%v); want %q (unchanged=true)", v2, unchanged, v1)
+	}
+	v3, unchanged := run("https:443 /api http://127.0.0.1:3001")
+	if unchanged || v3 == v1 {
+		t.Errorf("real change: got version %q (unchanged=%v); want new version", v3, unchanged)
+	}
+	v4, unchanged := run("tcp:2222 tcp://localhost:22")
+	if unchanged || v4 == v3 {
+		t.Errorf("tcp change: got version %q (unchanged=%v); want new version", v4, unchanged)
+	}
+	if _, unchanged := run("tcp:2222 tcp://localhost:22"); !unchanged {
+		t.Errorf("no-op tcp set reported a change")
+	}
+}
+
+func TestServeLabels(t *testing.T) {
+	tstest.Replace(t, &Stderr, io.Discard)
+	tstest.Replace(t, &Stdout, io.Discard)
+
+	lc := &fakeLocalServeClient{}
+	for _, args := range []string{
+		`--label internal-dashboard https:443 /grafana http://127.0.0.1:3000`,
+		`https:443 /plain http://127.0.0.1:3001`,
+		`--label ssh tcp:2222 tcp://localhost:22`,
+	} {
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		if err := newServeLegacyCommand(e).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+	}
+
+	// The labels survive being re-read as JSON.
+	sc, err := lc.GetServeConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ipn.ServeConfig
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	hp := ipn.HostPort("foo.test.ts.net:443")
+	if l := got.Web[hp].Handlers["/grafana"].Label; l != "internal-dashboard" {
+		t.Errorf("web label = %q; want %q", l, "internal-dashboard")
+	}
+	if l := got.Web[hp].Handlers["/plain"].Label; l != "" {
+		t.Errorf("unlabeled handler has label %q", l)
+	}
+	if l := got.TCP[2222].Label; l != "ssh" {
+		t.Errorf("TCP label = %q; want %q", l, "ssh")
+	}
+
+	// And they're shown in status.
+	var out bytes.Buffer
+	tstest.Replace(t, &Stdout, io.Writer(&out))
+	e := &serveEnv{lc: lc}
+	if err := e.printWebStatusTree(&got, hp, nil, "foo.test.ts.net"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.printTCPStatusTree(context.Background(), &got, fakeStatus); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"/grafana proxy http://127.0.0.1:3000  # internal-dashboard\n",
+		"/plain   proxy http://127.0.0.1:3001\n",
+		"|--> tcp://127.0.0.1:22  # ssh\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("status output missing %q; got:\n%s", want, out.String())
 		}
-		err := cmd.ParseAndRun(context.Background(), args)
-		if flagOut.Len() > 0 {
-			t.Logf("flag package output: %q", flagOut.Bytes())
+	}
+}
+
+func TestHashBasicAuth(t *testing.T) {
+	entry, err := hashBasicAuth("alice:correct:horse") // passwords may contain colons
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ipn.CheckBasicAuthEntry(entry); err != nil {
+		t.Fatalf("hashBasicAuth returned invalid entry %q: %v", entry, err)
+	}
+	user, hash, _ := strings.Cut(entry, ":")
+	if user != "alice" {
+		t.Errorf("user = %q; want alice", user)
+	}
+	if strings.Contains(hash, "horse") {
+		t.Errorf("entry %q contains the plaintext password", entry)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte("correct:horse")); err != nil {
+		t.Errorf("hash doesn't match password: %v", err)
+	}
+
+	for _, bad := range []string{"", "alice", "alice:", ":hunter2"} {
+		if _, err := hashBasicAuth(bad); err == nil {
+			t.Errorf("hashBasicAuth(%q) succeeded; want error", bad)
 		}
-		if err != nil {
-			if st.wantErr == nil {
-				t.Fatalf("step #%d, line %v: unexpected error: %v", i, st.line, err)
+	}
+}
+
+// testBcryptHash is a bcrypt hash of "hunter2".
+const testBcryptHash = "$2a$04$fYZIPvWXt8M8FKpwgmhDpusdKqzfQiK2smRl9SmaFdDcAO/JlXhV6"
+
+func TestReadHtpasswd(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	good := write("good", "# admins\nalice:"+testBcryptHash+"\r\n\nbob:"+testBcryptHash+"\n")
+	got, err := readHtpasswd(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice:" + testBcryptHash, "bob:" + testBcryptHash}; !slices.Equal(got, want) {
+		t.Errorf("readHtpasswd = %q; want %q", got, want)
+	}
+
+	for name, contents := range map[string]string{
+		"md5":   "alice:" + testBcryptHash + "\nbob:$apr1$abcdefgh$0123456789012345678901\n",
+		"plain": "alice:hunter2\n",
+		"empty": "# nobody\n",
+	} {
+		if _, err := readHtpasswd(write(name, contents)); err == nil {
+			t.Errorf("readHtpasswd of %s file succeeded; want error", name)
+		}
+	}
+}
+
+func TestServeBasicAuth(t *testing.T) {
+	tstest.Replace(t, &Stderr, io.Discard)
+	tstest.Replace(t, &Stdout, io.Discard)
+
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("bob:"+testBcryptHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lc := &fakeLocalServeClient{}
+	run := func(args ...string) error {
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		return newServeLegacyCommand(e).ParseAndRun(context.Background(), args)
+	}
+	if err := run("--basic-auth", "alice:s3cret", "--basic-auth-file", htpasswd, "https:443", "/admin", "http://127.0.0.1:9000"); err != nil {
+		t.Fatal(err)
+	}
+	h := lc.config.Web["foo.test.ts.net:443"].Handlers["/admin"]
+	if h == nil || h.Proxy != "http://127.0.0.1:9000" || len(h.BasicAuth) != 2 {
+		t.Fatalf("handler = %+v; want proxy with 2 basic auth users", h)
+	}
+	alice, ok := strings.CutPrefix(h.BasicAuth[0], "alice:")
+	if !ok || bcrypt.CompareHashAndPassword([]byte(alice), []byte("s3cret")) != nil {
+		t.Errorf("BasicAuth[0] = %q; want alice with a hash of her password", h.BasicAuth[0])
+	}
+	if want := "bob:" + testBcryptHash; h.BasicAuth[1] != want {
+		t.Errorf("BasicAuth[1] = %q; want %q", h.BasicAuth[1], want)
+	}
+	if j, _ := json.Marshal(lc.config); strings.Contains(string(j), "s3cret") {
+		t.Errorf("config contains the plaintext password: %s", j)
+	}
+
+	// The same user can't be given twice.
+	if err := run("--basic-auth", "bob:hunter2", "--basic-auth-file", htpasswd, "https:443", "/admin2", "http://127.0.0.1:9000"); err == nil {
+		t.Error("duplicate user accepted")
+	}
+
+	// Status shows that auth is required, but not who can authenticate.
+	var out bytes.Buffer
+	tstest.Replace(t, &Stdout, io.Writer(&out))
+	e := &serveEnv{lc: lc}
+	if err := e.printWebStatusTree(lc.config, "foo.test.ts.net:443", nil, "foo.test.ts.net"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/admin proxy http://127.0.0.1:9000 (basic auth)\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("status output missing %q; got:\n%s", want, out.String())
+	}
+	if strings.Contains(out.String(), "alice") || strings.Contains(out.String(), "$2") {
+		t.Errorf("status output shows credentials:\n%s", out.String())
+	}
+}
+
+func TestServiceDNSName(t *testing.T) {
+	for _, tt := range []struct {
+		svc, self, want string
+	}{
+		{"svc:wiki", "foo.test.ts.net", "wiki.test.ts.net"},
+		{"svc:my-db", "bar.tail1234.ts.net", "my-db.tail1234.ts.net"},
+	} {
+		if got := serviceDNSName(tt.svc, tt.self); got != tt.want {
+			t.Errorf("serviceDNSName(%q, %q) = %q; want %q", tt.svc, tt.self, got, tt.want)
+		}
+	}
+}
+
+func TestServeService(t *testing.T) {
+	tstest.Replace(t, &Stderr, io.Discard)
+	tstest.Replace(t, &Stdout, io.Discard)
+
+	lc := &fakeLocalServeClient{prefs: &ipn.Prefs{AdvertiseServices: []string{"svc:db"}}}
+	run := func(args string) {
+		t.Helper()
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		if err := newServeLegacyCommand(e).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+	}
+	checkAdvertised := func(want ...string) {
+		t.Helper()
+		if got := lc.prefs.AdvertiseServices; !slices.Equal(got, want) {
+			t.Errorf("AdvertiseServices = %q; want %q", got, want)
+		}
+	}
+
+	run("--service svc:wiki https:443 / http://127.0.0.1:3000")
+	checkAdvertised("svc:db", "svc:wiki")
+	run("--service svc:wiki https:443 /edit http://127.0.0.1:3001")
+	checkAdvertised("svc:db", "svc:wiki")
+	run("https:443 / http://127.0.0.1:4000")
+
+	// Service handlers are shown separately from the node's own.
+	var out bytes.Buffer
+	tstest.Replace(t, &Stdout, io.Writer(&out))
+	e := &serveEnv{lc: lc}
+	if err := e.printServeStatus(context.Background(), lc.config); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	node := strings.Index(got, "https://foo.test.ts.net (tailnet only)\n")
+	svc := strings.Index(got, "Service svc:wiki:\nhttps://wiki.test.ts.net (tailnet only)\n")
+	if node < 0 || svc < node {
+		t.Errorf("status output doesn't show the node's handlers followed by the service's; got:\n%s", got)
+	}
+	if !strings.Contains(got[svc:], "/edit proxy http://127.0.0.1:3001\n") {
+		t.Errorf("status output missing service handler; got:\n%s", got)
+	}
+
+	// The service stops being advertised along with its last handler.
+	tstest.Replace(t, &Stdout, io.Discard)
+	run("--service svc:wiki https:443 / off")
+	checkAdvertised("svc:db", "svc:wiki")
+	run("--service svc:wiki https:443 /edit off")
+	checkAdvertised("svc:db")
+}
+
+func TestServeVirtualHost(t *testing.T) {
+	tstest.Replace(t, &Stderr, io.Discard)
+	tstest.Replace(t, &Stdout, io.Discard)
+	tstest.Replace(t, &fakeStatus.CertDomains, []string{"foo.test.ts.net", "foo.example.com"})
+
+	lc := &fakeLocalServeClient{}
+	run := func(args string) error {
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		return newServeLegacyCommand(e).ParseAndRun(context.Background(), cmd(args))
+	}
+	for _, args := range []string{
+		"https:443 / http://127.0.0.1:3000",
+		"--virtual-host foo.example.com https:443 / http://127.0.0.1:3001",
+		"--virtual-host wiki.example.com http:80 / http://127.0.0.1:3002",
+	} {
+		if err := run(args); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+	}
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			80:  {HTTP: true},
+			443: {HTTPS: true},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3000"},
+			}},
+			"foo.example.com:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3001"},
+			}},
+			"wiki.example.com:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3002"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(lc.config, want) {
+		t.Errorf("config = %v; want %v", logger.AsJSON(lc.config), logger.AsJSON(want))
+	}
+
+	// Each host is shown separately, virtual hosts without a short name.
+	var out bytes.Buffer
+	tstest.Replace(t, &Stdout, io.Writer(&out))
+	e := &serveEnv{lc: lc}
+	if err := e.printServeStatus(context.Background(), lc.config); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"https://foo.test.ts.net (tailnet only)\n",
+		"https://foo.example.com (tailnet only, virtual host)\n|-- / proxy http://127.0.0.1:3001\n",
+		"\nhttp://wiki.example.com (tailnet only, virtual host)\n|-- / proxy http://127.0.0.1:3002\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("status output missing %q; got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "http://wiki ") {
+		t.Errorf("status output has a short name for a virtual host; got:\n%s", got)
+	}
+
+	tstest.Replace(t, &Stdout, io.Discard)
+	if err := run("--virtual-host wiki.example.com http:80 / off"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lc.config.Web["wiki.example.com:80"]; ok {
+		t.Error("virtual host handler not removed")
+	}
+
+	for _, tt := range []struct {
+		args    string
+		wantErr string
+	}{
+		{"--virtual-host Wiki.example.com http / http://127.0.0.1:3002", "must be a lowercase DNS name"},
+		{"--virtual-host wiki.example.com. http / http://127.0.0.1:3002", "without a trailing dot"},
+		{"--virtual-host wiki_example http / http://127.0.0.1:3002", "invalid host name"},
+		{"--virtual-host wiki.example.com tcp:2222 tcp://localhost:22", "only supported for http and https"},
+		{"--virtual-host wiki.example.com --service svc:wiki http / http://127.0.0.1:3002", "can't be used together"},
+		{"--virtual-host foo.test.ts.net http / http://127.0.0.1:3002", "the node's own name"},
+		{"--virtual-host wiki.example.com https / http://127.0.0.1:3002", "can't get a TLS certificate"},
+	} {
+		if err := run(tt.args); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got error %v; want one containing %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServeReservedPort(t *testing.T) {
+	tstest.Replace(t, &fakeStatus.Self.PeerAPIURL, []string{"http://100.101.102.103:41641"})
+
+	lc := &fakeLocalServeClient{prefs: &ipn.Prefs{RunSSH: true, RunWebClient: true}}
+	run := func(args string) (stderr string, err error) {
+		t.Helper()
+		var buf bytes.Buffer
+		tstest.Replace(t, &Stderr, io.Writer(&buf))
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		err = newServeLegacyCommand(e).ParseAndRun(context.Background(), cmd(args))
+		return buf.String(), err
+	}
+
+	for _, args := range []string{
+		"tcp:22 tcp://localhost:2222",
+		"https:5252 / http://127.0.0.1:3000",
+		"tls-terminated-tcp:41641 tcp://localhost:8080",
+	} {
+		if _, err := run(args); err == nil || !strings.Contains(err.Error(), "--force") {
+			t.Errorf("%q: got error %v; want one suggesting --force", args, err)
+		}
+	}
+	if lc.config != nil {
+		t.Fatalf("config saved for reserved ports: %+v", lc.config)
+	}
+
+	stderr, err := run("--force tcp:22 tcp://localhost:2222")
+	if err != nil {
+		t.Fatalf("--force: %v", err)
+	}
+	if !strings.Contains(stderr, "warning: port 22 is used by Tailscale SSH") {
+		t.Errorf("--force: stderr = %q; want a warning about Tailscale SSH", stderr)
+	}
+	if h := lc.config.TCP[22]; h == nil || h.TCPForward != "127.0.0.1:2222" {
+		t.Errorf("--force: TCP[22] = %+v; want forwarding to 127.0.0.1:2222", h)
+	}
+
+	// Ports are only reserved while the service using them is on, and
+	// handlers can always be removed.
+	lc.prefs.RunSSH = false
+	if _, err := run("tcp:22 tcp://localhost:2222"); err != nil {
+		t.Errorf("port 22 without Tailscale SSH: %v", err)
+	}
+	lc.prefs.RunSSH = true
+	if _, err := run("tcp:22 off"); err != nil {
+		t.Errorf("removing port 22: %v", err)
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	lc := &fakeLocalServeClient{}
+	run := func(args string) string {
+		t.Helper()
+		var out bytes.Buffer
+		tstest.Replace(t, &Stdout, io.Writer(&out))
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: &out, testStderr: io.Discard}
+		if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+		return out.String()
+	}
+
+	if got, want := run("stats"), "No serve traffic\n"; got != want {
+		t.Errorf("stats with no traffic = %q; want %q", got, want)
+	}
+	if got, want := run("stats --json"), "[]\n"; got != want {
+		t.Errorf("stats --json with no traffic = %q; want %q", got, want)
+	}
+
+	lc.stats = []ipn.ServeHandlerStats{
+		{HostPort: "foo.test.ts.net:443", Mount: "/", Requests: 12, BytesSent: 3456},
+		{HostPort: "foo.test.ts.net:443", Mount: "/api/", Requests: 7, BytesSent: 89},
+		{HostPort: "foo.test.ts.net:8443", Mount: "/", Requests: 1},
+	}
+	want := `HOST:PORT             MOUNT  REQUESTS  BYTES SENT
+foo.test.ts.net:443   /      12        3456
+foo.test.ts.net:443   /api/  7         89
+foo.test.ts.net:8443  /      1         0
+`
+	if got := run("stats"); got != want {
+		t.Errorf("stats output:\n%s\nwant:\n%s", got, want)
+	}
+
+	var got []ipn.ServeHandlerStats
+	if err := json.Unmarshal([]byte(run("stats --json")), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, lc.stats) {
+		t.Errorf("stats --json = %+v; want %+v", got, lc.stats)
+	}
+}
+
+func TestServeStatusMaxConns(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			25565: {TCPForward: "127.0.0.1:25565", MaxConns: 16, Backlog: 1024},
+		},
+	}
+	var out bytes.Buffer
+	tstest.Replace(t, &Stdout, io.Writer(&out))
+	e := &serveEnv{}
+	if err := e.printTCPStatusTree(context.Background(), sc, fakeStatus); err != nil {
+		t.Fatal(err)
+	}
+	if want := "|-- tcp://foo.test.ts.net:25565 (TLS over TCP, tailnet only, max 16 connections, backlog 1024)\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("status output missing %q; got:\n%s", want, out.String())
+	}
+}
+
+func TestServeStatusFamily(t *testing.T) {
+	tstest.Replace(t, &Stderr, io.Discard)
+	tstest.Replace(t, &fakeStatus.TailscaleIPs, []netip.Addr{
+		netip.MustParseAddr("100.101.102.103"),
+		netip.MustParseAddr("fd7a:115c:a1e0::1"),
+	})
+
+	lc := &fakeLocalServeClient{}
+	for _, args := range []string{
+		"--bg localhost:3000",
+		"--bg --tcp=2222 tcp://localhost:22",
+	} {
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+	}
+
+	const (
+		webV4 = "https://foo.test.ts.net (tailnet only)\n|-- 100.101.102.103:443 (IPv4)\n"
+		webV6 = "|-- [fd7a:115c:a1e0::1]:443 (IPv6)\n"
+		tcpV4 = "|-- tcp://100.101.102.103:2222 (IPv4)\n"
+		tcpV6 = "|-- tcp://[fd7a:115c:a1e0::1]:2222 (IPv6)\n"
+	)
+	for _, tt := range []struct {
+		family        string
+		want, notWant []string
+	}{
+		{"", []string{webV4 + webV6, tcpV4 + tcpV6}, nil},
+		{"v4", []string{webV4, tcpV4}, []string{webV6, tcpV6}},
+		{"v6", []string{"https://foo.test.ts.net (tailnet only)\n" + webV6, tcpV6}, []string{"(IPv4)"}},
+	} {
+		var out bytes.Buffer
+		tstest.Replace(t, &Stdout, io.Writer(&out))
+		e := &serveEnv{lc: lc, family: tt.family}
+		if err := e.printServeStatus(context.Background(), lc.config); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("family %q: status output missing %q; got:\n%s", tt.family, want, out.String())
 			}
-			if bad := st.wantErr(err); bad != "" {
-				t.Fatalf("step #%d, line %v: unexpected error: %v", i, st.line, bad)
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(out.String(), notWant) {
+				t.Errorf("family %q: status output contains %q; got:\n%s", tt.family, notWant, out.String())
 			}
-			continue
 		}
-		if st.wantErr != nil {
-			t.Fatalf("step #%d, line %v: got success (saved=%v), but wanted an error", i, st.line, lc.config != nil)
+	}
+
+	var out bytes.Buffer
+	tstest.Replace(t, &Stdout, io.Writer(&out))
+	e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+	if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd("status --family v6")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), webV6) || strings.Contains(out.String(), "(IPv4)") {
+		t.Errorf("status --family v6 output = %q; want only IPv6 addresses", out.String())
+	}
+
+	for _, args := range []string{
+		"status --family v5",
+		"status --family v4 --json",
+	} {
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd(args)); err == nil {
+			t.Errorf("%q: succeeded; want error", args)
 		}
-		var got *ipn.ServeConfig = nil
-		if lc.setCount > lastCount {
-			got = lc.config
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that's safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// fakeIPNBus returns a LocalClient whose WatchIPNBus, with the mask used
+// by "serve status --watch", sends notifies and then stays open.
+func fakeIPNBus(t *testing.T, notifies []ipn.Notify) *tailscale.LocalClient {
+	ln := memnet.Listen("local-tailscaled.sock:80")
+	t.Cleanup(func() { ln.Close() })
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/watch-ipn-bus" {
+			http.NotFound(w, r)
+			return
 		}
-		if !reflect.DeepEqual(got, st.want) {
-			t.Fatalf("[%d] %v: bad state. got:\n%v\n\nwant:\n%v\n",
-				i, st.command, logger.AsJSON(got), logger.AsJSON(st.want))
-			// NOTE: asJSON will omit empty fields, which might make
-			// result in bad state got/want diffs being the same, even
-			// though the actual state is different. Use below to debug:
-			// t.Fatalf("[%d] %v: bad state. got:\n%+v\n\nwant:\n%+v\n",
-			// 	i, st.command, got, st.want)
+		if got, want := r.FormValue("mask"), fmt.Sprint(ipn.NotifyInitialServeConfig); got != want {
+			http.Error(w, "unexpected mask "+got, http.StatusBadRequest)
+			return
+		}
+		enc := json.NewEncoder(w)
+		for _, n := range notifies {
+			enc.Encode(n)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return &tailscale.LocalClient{Dial: ln.Dial}
+}
+
+func TestServeStatusWatch(t *testing.T) {
+	// Two serve configs, with an unrelated notification in between.
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{2222: {TCPForward: "127.0.0.1:22"}},
+	}
+	notifies := []ipn.Notify{
+		{ServeConfig: ptr.To((&ipn.ServeConfig{}).View())},
+		{State: ptr.To(ipn.Running)},
+		{ServeConfig: ptr.To(conf.View())},
+	}
+
+	var out lockedBuffer
+	tstest.Replace(t, &Stdout, io.Writer(&out))
+	lc := &fakeLocalServeClient{bus: fakeIPNBus(t, notifies)}
+	e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- newServeV2Command(e, serve).ParseAndRun(ctx, cmd("status --watch"))
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for strings.Count(out.String(), clearScreen) < 2 || !strings.Contains(out.String(), "Config version") {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for two renders; got:\n%s", out.String())
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("watch exited early: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel() // like Ctrl-C
+	if err := <-errc; err != nil {
+		t.Fatalf("watch returned %v; want nil", err)
+	}
+
+	renders := strings.Split(out.String(), clearScreen)[1:]
+	if len(renders) != 2 {
+		t.Fatalf("got %d renders; want 2; output:\n%s", len(renders), out.String())
+	}
+	if !strings.Contains(renders[0], "No serve config") {
+		t.Errorf("first render = %q; want it to report no serve config", renders[0])
+	}
+	if want := "|--> tcp://127.0.0.1:22\n"; !strings.Contains(renders[1], want) {
+		t.Errorf("second render = %q; want it to contain %q", renders[1], want)
+	}
+}
+
+func TestServeStatusWatchCertChange(t *testing.T) {
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{2222: {TCPForward: "127.0.0.1:22"}},
+	}
+	notAfter := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	notifies := []ipn.Notify{
+		{ServeConfig: ptr.To(conf.View())},
+		{CertChange: &ipn.CertChange{Domain: "foo.test.ts.net", NotAfter: notAfter}},
+	}
+
+	var out lockedBuffer
+	tstest.Replace(t, &Stdout, io.Writer(&out))
+	lc := &fakeLocalServeClient{bus: fakeIPNBus(t, notifies)}
+	e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- newServeV2Command(e, serve).ParseAndRun(ctx, cmd("status --watch"))
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(out.String(), "rotated") {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the cert change; got:\n%s", out.String())
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("watch exited early: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("watch returned %v; want nil", err)
+	}
+
+	renders := strings.Split(out.String(), clearScreen)[1:]
+	if len(renders) != 2 {
+		t.Fatalf("got %d renders; want 2; output:\n%s", len(renders), out.String())
+	}
+	if strings.Contains(renders[0], "TLS certificate") {
+		t.Errorf("first render = %q; want no cert change yet", renders[0])
+	}
+	// The cert change is shown below the unchanged status.
+	if want := "|--> tcp://127.0.0.1:22\n"; !strings.Contains(renders[1], want) {
+		t.Errorf("second render = %q; want it to contain %q", renders[1], want)
+	}
+	if want := "TLS certificate for foo.test.ts.net rotated at "; !strings.Contains(renders[1], want) {
+		t.Errorf("second render = %q; want it to contain %q", renders[1], want)
+	}
+	if want := "; valid until 2026-03-01\n"; !strings.HasSuffix(renders[1], want) {
+		t.Errorf("second render = %q; want it to end with %q", renders[1], want)
+	}
+}
+
+func TestServeRemoveWait(t *testing.T) {
+	newConfig := func(mounts ...string) *ipn.ServeConfig {
+		sc := &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{}}},
+		}
+		for _, m := range mounts {
+			sc.Web["foo.test.ts.net:443"].Handlers[m] = &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}
+		}
+		return sc
+	}
+	run := func(notifies []ipn.Notify, args string) error {
+		lc := &fakeLocalServeClient{config: newConfig("/", "/old"), bus: fakeIPNBus(t, notifies)}
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		return newServeLegacyCommand(e).ParseAndRun(context.Background(), cmd(args))
+	}
+
+	t.Run("confirmed", func(t *testing.T) {
+		// tailscaled first reports the config from before the change,
+		// then the one without the handler.
+		notifies := []ipn.Notify{
+			{ServeConfig: ptr.To(newConfig("/", "/old").View())},
+			{State: ptr.To(ipn.Running)},
+			{ServeConfig: ptr.To(newConfig("/").View())},
+		}
+		if err := run(notifies, "--wait 10s https:443 /old off"); err != nil {
+			t.Fatalf("got %v; want success", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		notifies := []ipn.Notify{
+			{ServeConfig: ptr.To(newConfig("/", "/old").View())},
+		}
+		err := run(notifies, "--wait 50ms https:443 /old off")
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("got %v; want a timeout error", err)
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		for _, args := range []string{
+			"--wait 10s https:443 / http://localhost:3000", // not removing
+			"--wait 10s tcp:2222 off",                      // not web
+			"--wait -1s https:443 /old off",                // negative
+		} {
+			if err := run(nil, args); err == nil {
+				t.Errorf("%q: got success; want error", args)
+			}
+		}
+	})
+}
+
+func TestServeStatusWatchJSON(t *testing.T) {
+	e := &serveEnv{lc: &fakeLocalServeClient{}, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+	if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd("status --watch --json")); err == nil {
+		t.Error("got no error combining --watch and --json")
+	}
+}
+
+// testCertPEM returns a self-signed PEM certificate for name that expires
+// at notAfter.
+func testCertPEM(t *testing.T, name string, notAfter time.Time) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestServeStatusCheckCert(t *testing.T) {
+	notAfter := time.Now().Add(3*24*time.Hour + time.Hour).Truncate(time.Second)
+	lc := &fakeLocalServeClient{
+		config: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:  {HTTPS: true},
+				8443: {HTTPS: true},
+				22:   {TCPForward: "127.0.0.1:22"},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443":  {Handlers: map[string]*ipn.HTTPHandler{"/": {Text: "hi"}}},
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{"/": {Text: "hi"}}},
+			},
+		},
+		certPEM: testCertPEM(t, "foo.test.ts.net", notAfter),
+	}
+	run := func() string {
+		t.Helper()
+		var out bytes.Buffer
+		tstest.Replace(t, &Stdout, io.Writer(&out))
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd("status --check-cert")); err != nil {
+			t.Fatal(err)
 		}
+		return out.String()
 	}
-}
 
-func TestVerifyFunnelEnabled(t *testing.T) {
-	tstest.Replace(t, &Stderr, io.Discard)
-	tstest.Replace(t, &Stdout, io.Discard)
+	got := run()
+	date := notAfter.UTC().Format(time.RFC3339)
+	for _, want := range []string{
+		"https:443 foo.test.ts.net: certificate expires " + date + " (3 days left; WARNING: renewal may be failing)\n",
+		"https:8443 foo.test.ts.net: certificate expires " + date + " (3 days left; WARNING: renewal may be failing)\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q; got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "https:22 ") {
+		t.Errorf("output includes the TCP port; got:\n%s", got)
+	}
 
-	lc := &fakeLocalServeClient{}
-	var stdout bytes.Buffer
-	var flagOut bytes.Buffer
-	e := &serveEnv{
-		lc:          lc,
-		testFlagOut: &flagOut,
-		testStdout:  &stdout,
-		testStderr:  io.Discard,
+	lc.certPEM = nil
+	if got := run(); !strings.Contains(got, "https:443 foo.test.ts.net: error getting certificate: no certificate\n") {
+		t.Errorf("output doesn't report the CertPair error; got:\n%s", got)
 	}
 
+	e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+	if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd("status --check-cert --json")); err == nil {
+		t.Error("got no error combining --check-cert and --json")
+	}
+}
+
+func TestCertDaysLeft(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
 	tests := []struct {
-		name string
-		// queryFeatureResponse is the mock response desired from the
-		// call made to lc.QueryFeature by verifyFunnelEnabled.
-		queryFeatureResponse mockQueryFeatureResponse
-		caps                 []tailcfg.NodeCapability // optionally set at fakeStatus.Capabilities
-		wantErr              string
-		wantPanic            string
+		notAfter time.Time
+		want     string
+	}{
+		{now.Add(60*day + time.Hour), "60 days left"},
+		{now.Add(14 * day), "14 days left"},
+		{now.Add(3*day + time.Hour), "3 days left; WARNING: renewal may be failing"},
+		{now.Add(time.Hour), "0 days left; WARNING: renewal may be failing"},
+		{now, "EXPIRED"},
+		{now.Add(-day), "EXPIRED"},
+	}
+	for _, tt := range tests {
+		if got := certDaysLeft(tt.notAfter, now); got != tt.want {
+			t.Errorf("certDaysLeft(%v) = %q; want %q", tt.notAfter.Sub(now), got, tt.want)
+		}
+	}
+}
+
+func TestParseServeConfigJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string // empty means success
 	}{
 		{
-			name:                 "enabled",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: &tailcfg.QueryFeatureResponse{Complete: true}, err: nil},
-			wantErr:              "", // no error, success
+			name: "valid",
+			in:   `{"TCP":{"443":{"HTTPS":true}},"Web":{"foo.test.ts.net:443":{"Handlers":{"/":{"Proxy":"http://127.0.0.1:3000"}}}}}`,
 		},
 		{
-			name:                 "fallback-to-non-interactive-flow",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
-			wantErr:              "Funnel not available; HTTPS must be enabled. See https://tailscale.com/s/https.",
+			name: "empty",
+			in:   `{}`,
 		},
 		{
-			name:                 "fallback-flow-missing-acl-rule",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
-			caps:                 []tailcfg.NodeCapability{tailcfg.CapabilityHTTPS},
-			wantErr:              `Funnel not available; "funnel" node attribute not set. See https://tailscale.com/s/no-funnel.`,
+			name:    "unknown-field",
+			in:      `{"TCP":{"443":{"HTTPS":true}},"Web":{"foo.test.ts.net:443":{"Handlers":{"/":{"Proxxy":"http://127.0.0.1:3000"}}}}}`,
+			wantErr: `unknown field "Proxxy"`,
 		},
 		{
-			name:                 "fallback-flow-enabled",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
-			caps:                 []tailcfg.NodeCapability{tailcfg.CapabilityHTTPS, tailcfg.NodeAttrFunnel, "https://tailscale.com/cap/funnel-ports?ports=80,443,8080-8090"},
-			wantErr:              "", // no error, success
+			name:    "unknown-top-level-field",
+			in:      `{"AllowFunel":{"foo.test.ts.net:443":true}}`,
+			wantErr: `unknown field "AllowFunel"`,
 		},
 		{
-			name: "not-allowed-to-enable",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: &tailcfg.QueryFeatureResponse{
-				Complete:   false,
-				Text:       "You don't have permission to enable this feature.",
-				ShouldWait: false,
-			}, err: nil},
-			wantErr:   "",
-			wantPanic: "unexpected call to os.Exit(0) during test", // os.Exit(0) should be called to end process
+			name:    "trailing-data",
+			in:      `{} {}`,
+			wantErr: "unexpected data after serve config",
+		},
+		{
+			name:    "malformed",
+			in:      `{"TCP":`,
+			wantErr: "invalid JSON",
+		},
+		{
+			name:    "semantically-invalid",
+			in:      `{"TCP":{"443":{"HTTPS":true}},"Web":{"foo.test.ts.net:443":{"Handlers":{"/":{"Proxy":"ftp://127.0.0.1:21"}}}}}`,
+			wantErr: `invalid serve config: Web["foo.test.ts.net:443"].Handlers["/"].Proxy: invalid target`,
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ctx := context.Background()
-			lc.setQueryFeatureResponse(tt.queryFeatureResponse)
-
-			if tt.caps != nil {
-				cm := make(tailcfg.NodeCapMap)
-				for _, c := range tt.caps {
-					cm[c] = nil
-				}
-				tstest.Replace(t, &fakeStatus.Self.CapMap, cm)
-			}
-
-			defer func() {
-				r := recover()
-				var gotPanic string
-				if r != nil {
-					gotPanic = fmt.Sprint(r)
+			sc, err := parseServeConfigJSON([]byte(tt.in))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
 				}
-				if gotPanic != tt.wantPanic {
-					t.Errorf("wrong panic; got=%s, want=%s", gotPanic, tt.wantPanic)
+				if sc == nil {
+					t.Fatal("got nil config")
 				}
-			}()
-			gotErr := e.verifyFunnelEnabled(ctx, 443)
-			var got string
-			if gotErr != nil {
-				got = gotErr.Error()
+				return
 			}
-			if got != tt.wantErr {
-				t.Errorf("wrong error; got=%s, want=%s", gotErr, tt.wantErr)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v; want one containing %q", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-// fakeLocalServeClient is a fake tailscale.LocalClient for tests.
-// It's not a full implementation, just enough to test the serve command.
-//
-// The fake client is stateful, and is used to test manipulating
-// ServeConfig state. This implementation cannot be used concurrently.
-type fakeLocalServeClient struct {
-	config               *ipn.ServeConfig
-	setCount             int                       // counts calls to SetServeConfig
-	queryFeatureResponse *mockQueryFeatureResponse // mock response to QueryFeature calls
-}
+func TestServeFromEnv(t *testing.T) {
+	run := func(lc *fakeLocalServeClient, environ []string, args string) error {
+		t.Helper()
+		tstest.Replace(t, &Stderr, io.Discard)
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard, testEnviron: environ}
+		return newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd(args))
+	}
 
-// fakeStatus is a fake ipnstate.Status value for tests.
-// It's not a full implementation, just enough to test the serve command.
-//
-// It returns a state that's running, with a fake DNSName and the Funnel
-// node attribute capability.
-var fakeStatus = &ipnstate.Status{
-	BackendState: ipn.Running.String(),
-	Self: &ipnstate.PeerStatus{
-		DNSName: "foo.test.ts.net",
-		CapMap: tailcfg.NodeCapMap{
-			tailcfg.NodeAttrFunnel:                            nil,
-			tailcfg.CapabilityFunnelPorts + "?ports=443,8443": nil,
+	fg := map[string]*ipn.ServeConfig{
+		"session": {TCP: map[uint16]*ipn.TCPPortHandler{8080: {HTTPS: true}}},
+	}
+	lc := &fakeLocalServeClient{config: &ipn.ServeConfig{
+		TCP:        map[uint16]*ipn.TCPPortHandler{8443: {TCPForward: "127.0.0.1:8443"}},
+		Foreground: fg,
+	}}
+	environ := []string{
+		"PATH=/usr/bin",
+		"TS_SERVE_CONFIG=/etc/ts/serve.json",
+		"TS_SERVE_443=/=http://127.0.0.1:3000; /motd=text:hello",
+		"TS_SERVE_HTTP_80=/=redirect-to-https",
+		"TS_SERVE_TCP_2222=tcp://localhost:22",
+	}
+	if err := run(lc, environ, "--from-env"); err != nil {
+		t.Fatal(err)
+	}
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			80:   {HTTP: true},
+			443:  {HTTPS: true},
+			2222: {TCPForward: "127.0.0.1:22"},
 		},
-	},
-}
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {RedirectToHTTPS: true},
+			}},
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":     {Proxy: "http://127.0.0.1:3000"},
+				"/motd": {Text: "hello"},
+			}},
+		},
+		Foreground: fg,
+	}
+	if !reflect.DeepEqual(lc.config, want) {
+		t.Errorf("config = %v; want %v", logger.AsJSON(lc.config), logger.AsJSON(want))
+	}
 
-func (lc *fakeLocalServeClient) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
-	return fakeStatus, nil
-}
+	for _, tt := range []struct {
+		name    string
+		environ []string
+		args    string
+		wantErr string
+	}{
+		{"none", []string{"TS_SERVE_CONFIG=/etc/ts/serve.json"}, "--from-env", "no TS_SERVE_* environment variables"},
+		{"args", environ, "--from-env http://127.0.0.1:3000", "doesn't take arguments"},
+		{"port-zero", []string{"TS_SERVE_0=/=localhost:3000"}, "--from-env", "TS_SERVE_0: invalid port"},
+		{"duplicate-port", []string{"TS_SERVE_443=/=localhost:3000", "TS_SERVE_HTTP_443=/=localhost:3001"}, "--from-env", "port 443 is already configured by"},
+		{"no-mount", []string{"TS_SERVE_443=http://127.0.0.1:3000"}, "--from-env", "TS_SERVE_443: invalid entry"},
+		{"no-mounts", []string{"TS_SERVE_443=;"}, "--from-env", "TS_SERVE_443: no mount points"},
+		{"remote-proxy", []string{"TS_SERVE_443=/=http://example.com:3000"}, "--from-env", "TS_SERVE_443: only localhost"},
+		{"redirect-https", []string{"TS_SERVE_443=/=redirect-to-https"}, "--from-env", "TS_SERVE_443: redirect-to-https is only supported for http"},
+		{"remote-tcp", []string{"TS_SERVE_TCP_2222=tcp://example.com:22"}, "--from-env", "TS_SERVE_TCP_2222: invalid TCP source"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &fakeLocalServeClient{}
+			err := run(lc, tt.environ, tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v; want one containing %q", err, tt.wantErr)
+			}
+			if lc.config != nil {
+				t.Errorf("config set despite error: %+v", lc.config)
+			}
+		})
+	}
 
-func (lc *fakeLocalServeClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, error) {
-	return lc.config.Clone(), nil
+	t.Run("funnel", func(t *testing.T) {
+		e := &serveEnv{lc: &fakeLocalServeClient{}, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard, testEnviron: environ}
+		err := newServeV2Command(e, funnel).ParseAndRun(context.Background(), cmd("--from-env"))
+		if err == nil || !strings.Contains(err.Error(), "flag provided but not defined") {
+			t.Fatalf("got error %v; want --from-env to be undefined for funnel", err)
+		}
+	})
 }
 
-func (lc *fakeLocalServeClient) SetServeConfig(ctx context.Context, config *ipn.ServeConfig) error {
-	lc.setCount += 1
-	lc.config = config.Clone()
-	return nil
-}
+func TestServeEdit(t *testing.T) {
+	ctx := context.Background()
+	newConfig := func() *ipn.ServeConfig {
+		return &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:  {HTTPS: true},
+				2222: {TCPForward: "127.0.0.1:22", Label: "ssh"},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":       {Proxy: "http://127.0.0.1:3000"},
+					"/static": {Path: "/srv/static"},
+				}},
+			},
+		}
+	}
+	run := func(lc *fakeLocalServeClient, input, args string) (stdout, stderr string, err error) {
+		var out, errOut bytes.Buffer
+		e := &serveEnv{
+			lc:          lc,
+			testFlagOut: io.Discard,
+			testStdout:  &out,
+			testStderr:  &errOut,
+			testStdin:   strings.NewReader(input),
+		}
+		err = newServeV2Command(e, serve).ParseAndRun(ctx, cmd(args))
+		return out.String(), errOut.String(), err
+	}
 
-type mockQueryFeatureResponse struct {
-	resp *tailcfg.QueryFeatureResponse
-	err  error
-}
+	t.Run("needs-interactive", func(t *testing.T) {
+		lc := &fakeLocalServeClient{config: newConfig()}
+		if _, _, err := run(lc, "d 1\n", "edit"); err == nil || !strings.Contains(err.Error(), "--interactive") {
+			t.Fatalf("got error %v; want one about --interactive", err)
+		}
+		if lc.setCount != 0 {
+			t.Errorf("config set %d times without --interactive", lc.setCount)
+		}
+	})
 
-func (lc *fakeLocalServeClient) setQueryFeatureResponse(resp mockQueryFeatureResponse) {
-	lc.queryFeatureResponse = &resp
+	t.Run("script", func(t *testing.T) {
+		lc := &fakeLocalServeClient{config: newConfig()}
+		input := strings.Join([]string{
+			"f 1", // Funnel on for port 443
+			"d 2", // delete /static
+			"x 1", // unknown command
+			"d 9", // no such handler
+			"f 2", // Funnel on for tcp:2222, which isn't a Funnel port
+			"d 2", // delete the TCP forwarder, now second
+			"q",
+			"d 1", // not read
+		}, "\n")
+		stdout, stderr, err := run(lc, input, "edit --interactive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lc.setCount != 3 {
+			t.Errorf("setCount = %d; want 3", lc.setCount)
+		}
+		want := &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+			AllowFunnel: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		}
+		if !reflect.DeepEqual(lc.config, want) {
+			t.Errorf("config = %v; want %v", logger.AsJSON(lc.config), logger.AsJSON(want))
+		}
+		for _, want := range []string{
+			"1  foo.test.ts.net:443/        proxy  http://127.0.0.1:3000  (tailnet only)\n",
+			"2  foo.test.ts.net:443/static  path   /srv/static            (tailnet only)\n",
+			"3  tcp://foo.test.ts.net:2222  tcp    127.0.0.1:22  # ssh    (tailnet only)\n",
+			"1  foo.test.ts.net:443/        proxy  http://127.0.0.1:3000  (Funnel on)\n",
+		} {
+			if !strings.Contains(stdout, want) {
+				t.Errorf("stdout missing %q; got:\n%s", want, stdout)
+			}
+		}
+		for _, want := range []string{
+			`unknown command "x"`,
+			`invalid handler number "9"`,
+			"error: ",
+		} {
+			if !strings.Contains(stderr, want) {
+				t.Errorf("stderr missing %q; got:\n%s", want, stderr)
+			}
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		lc := &fakeLocalServeClient{}
+		stdout, _, err := run(lc, "", "edit --interactive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stdout != "No serve config\n" {
+			t.Errorf("stdout = %q; want %q", stdout, "No serve config\n")
+		}
+	})
 }
 
-func (lc *fakeLocalServeClient) QueryFeature(ctx context.Context, feature string) (*tailcfg.QueryFeatureResponse, error) {
-	if resp := lc.queryFeatureResponse; resp != nil {
-		// If we're testing QueryFeature, use the response value set for the test.
-		return resp.resp, resp.err
+func TestServeWatchFile(t *testing.T) {
+	tstest.Replace(t, &watchFilePollInterval, 10*time.Millisecond)
+	path := filepath.Join(t.TempDir(), "serve.json")
+	writeConfig := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
 	}
-	return &tailcfg.QueryFeatureResponse{Complete: true}, nil // fallback to already enabled
+	const conf1 = `{"TCP": {"2222": {"TCPForward": "127.0.0.1:22"}}}`
+	const conf2 = `{"TCP": {"2222": {"TCPForward": "127.0.0.1:2200"}}}`
+
+	t.Run("invalid-at-start", func(t *testing.T) {
+		writeConfig(`{"TCP": {"2222": {"TCPFoward": "127.0.0.1:22"}}}`)
+		lc := &fakeLocalServeClient{}
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd("watch-file "+path)); err == nil {
+			t.Fatal("got no error for invalid file")
+		}
+		if lc.setCount != 0 {
+			t.Errorf("config set %d times; want 0", lc.setCount)
+		}
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		writeConfig(conf1)
+		var stdout, stderr lockedBuffer
+		lc := &fakeLocalServeClient{}
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: &stdout, testStderr: &stderr}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- newServeV2Command(e, serve).ParseAndRun(ctx, cmd("watch-file "+path))
+		}()
+		waitFor := func(what string, buf *lockedBuffer, substr string, n int) {
+			t.Helper()
+			deadline := time.Now().Add(10 * time.Second)
+			for strings.Count(buf.String(), substr) < n {
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for %s; stdout:\n%s\nstderr:\n%s", what, stdout.String(), stderr.String())
+				}
+				select {
+				case err := <-errc:
+					t.Fatalf("watch-file exited early: %v", err)
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}
+
+		waitFor("initial apply", &stdout, "Applied serve config", 1)
+		writeConfig("{not json")
+		waitFor("rejection", &stderr, "keeping the running serve config", 1)
+		writeConfig(conf2)
+		waitFor("second apply", &stdout, "Applied serve config", 2)
+		cancel() // like Ctrl-C
+		if err := <-errc; err != nil {
+			t.Fatalf("watch-file returned %v; want nil", err)
+		}
+
+		if lc.setCount != 2 {
+			t.Errorf("config set %d times; want 2", lc.setCount)
+		}
+		want := &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{2222: {TCPForward: "127.0.0.1:2200"}}}
+		if !reflect.DeepEqual(lc.config, want) {
+			t.Errorf("config = %v; want %v", logger.AsJSON(lc.config), logger.AsJSON(want))
+		}
+	})
 }
 
-func (lc *fakeLocalServeClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*tailscale.IPNBusWatcher, error) {
-	return nil, nil // unused in tests
+func TestServeValidate(t *testing.T) {
+	dir := t.TempDir()
+	run := func(conf string) (stdout string, err error) {
+		t.Helper()
+		path := filepath.Join(dir, "serve.json")
+		if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		// No lc: validate must not talk to tailscaled.
+		e := &serveEnv{testFlagOut: io.Discard, testStdout: &out, testStderr: io.Discard}
+		err = newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd("validate "+path))
+		return out.String(), err
+	}
+
+	out, err := run(`{
+		"TCP": {"443": {"HTTPS": true}, "80": {"HTTP": true}, "2222": {"TCPForward": "127.0.0.1:22"}},
+		"Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Proxy": "http://127.0.0.1:3000"}}}},
+		"AllowFunnel": {"foo.test.ts.net:443": true, "foo.test.ts.net:2222": true, "foo.test.ts.net:80": false}
+	}`)
+	if err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+	if !strings.Contains(out, "valid serve config") {
+		t.Errorf("valid config: got output %q", out)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		conf    string
+		wantErr string
+	}{
+		{"malformed", `{"TCP":`, "invalid JSON"},
+		{"unknown-field", `{"TCP": {"443": {"HTTPS": true, "Funnel": true}}}`, `unknown field "Funnel"`},
+		{"port-zero", `{"TCP": {"0": {"HTTPS": true}}}`, "TCP[0]: invalid port 0"},
+		{"bad-mount", `{"TCP": {"443": {"HTTPS": true}}, "Web": {"foo.test.ts.net:443": {"Handlers": {"api": {"Proxy": "3000"}}}}}`, `Handlers["api"]`},
+		{"bad-target", `{"TCP": {"443": {"HTTPS": true}}, "Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Proxy": "ftp://127.0.0.1:21"}}}}}`, `Handlers["/"].Proxy: invalid target`},
+		{"funnel-unserved-port", `{"TCP": {"443": {"HTTPS": true}}, "AllowFunnel": {"foo.test.ts.net:8443": true}}`, `AllowFunnel["foo.test.ts.net:8443"]: port 8443 is not served`},
+		{"funnel-plain-http", `{"TCP": {"80": {"HTTP": true}}, "AllowFunnel": {"foo.test.ts.net:80": true}}`, `AllowFunnel["foo.test.ts.net:80"]: port 80 is served as plain HTTP`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := run(tt.conf)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	e := &serveEnv{testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+	if err := newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd("validate "+filepath.Join(dir, "missing.json"))); err == nil {
+		t.Error("missing file: got no error")
+	}
 }
 
-func (lc *fakeLocalServeClient) IncrementCounter(ctx context.Context, name string, delta int) error {
-	return nil // unused in tests
+func TestWebHandlerTypeAndDesc(t *testing.T) {
+	for _, tt := range []struct {
+		h        *ipn.HTTPHandler
+		wantType string
+		wantDesc string
+	}{
+		{&ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}, "proxy", "http://127.0.0.1:3000"},
+		{&ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000", BackendKeepalive: "30s"}, "proxy", "http://127.0.0.1:3000 (keepalive 30s)"},
+		{&ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000", ConnectTimeout: "5s", ResponseHeaderTimeout: "2m"}, "proxy", "http://127.0.0.1:3000 (connect timeout 5s) (response header timeout 2m)"},
+		{&ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000", RequestIDHeader: "X-Request-Id"}, "proxy", "http://127.0.0.1:3000 (request ID: X-Request-Id)"},
+		{&ipn.HTTPHandler{Path: "/srv/app"}, "path", "/srv/app"},
+		{&ipn.HTTPHandler{Path: "/srv/app", SPAFallback: true}, "path", "/srv/app (SPA fallback)"},
+		{&ipn.HTTPHandler{Path: "/srv/files", WebDAV: true}, "path", "/srv/files (WebDAV)"},
+		{&ipn.HTTPHandler{Path: "/srv/files", WebDAV: true, WebDAVReadOnly: true}, "path", "/srv/files (WebDAV, read-only)"},
+		{&ipn.HTTPHandler{Path: "/srv/site", ServeDotfiles: true}, "path", "/srv/site (dotfiles)"},
+		{&ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000", Compress: true}, "proxy", "http://127.0.0.1:3000 (gzip)"},
+		{&ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000", Canary: "http://127.0.0.1:3001", CanaryPercent: 10}, "proxy", "http://127.0.0.1:3000 (10% to canary http://127.0.0.1:3001)"},
+		{&ipn.HTTPHandler{Path: "/srv/base", OverlayPaths: []string{"/srv/env", "/srv/local"}}, "path", strings.Join([]string{"/srv/base", "/srv/env", "/srv/local"}, string(filepath.ListSeparator))},
+	} {
+		typ, desc := webHandlerTypeAndDesc(tt.h)
+		if typ != tt.wantType || desc != tt.wantDesc {
+			t.Errorf("webHandlerTypeAndDesc(%+v) = %q, %q; want %q, %q", tt.h, typ, desc, tt.wantType, tt.wantDesc)
+		}
+	}
 }
 
-// exactError returns an error checker that wants exactly the provided want error.
-// If optName is non-empty, it's used in the error message.
-func exactErr(want error, optName ...string) func(error) string {
-	return func(got error) string {
-		if got == want {
-			return ""
+func TestServeMaintenance(t *testing.T) {
+	tstest.Replace(t, &Stderr, io.Discard)
+	dir := t.TempDir()
+	page := filepath.Join(dir, "maintenance.html")
+	if err := os.WriteFile(page, []byte("<h1>Back soon</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	web := map[ipn.HostPort]*ipn.WebServerConfig{
+		"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+			"/": {Proxy: "http://127.0.0.1:3000"},
+		}},
+	}
+	lc := &fakeLocalServeClient{config: &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: web,
+	}}
+	run := func(args string) error {
+		e := &serveEnv{lc: lc, testFlagOut: io.Discard, testStdout: io.Discard, testStderr: io.Discard}
+		return newServeV2Command(e, serve).ParseAndRun(context.Background(), cmd(args))
+	}
+	check := func(wantMode bool, wantPage string) {
+		t.Helper()
+		if lc.config.MaintenanceMode != wantMode || lc.config.MaintenancePage != wantPage {
+			t.Errorf("MaintenanceMode, MaintenancePage = %v, %q; want %v, %q",
+				lc.config.MaintenanceMode, lc.config.MaintenancePage, wantMode, wantPage)
 		}
-		if len(optName) > 0 {
-			return fmt.Sprintf("got error %v, want %v", got, optName[0])
+		if !reflect.DeepEqual(lc.config.Web, web) || !lc.config.TCP[443].HTTPS {
+			t.Errorf("rest of serve config changed: %v", logger.AsJSON(lc.config))
 		}
-		return fmt.Sprintf("got error %v, want %v", got, want)
 	}
-}
+	status := func() string {
+		t.Helper()
+		var out bytes.Buffer
+		tstest.Replace(t, &Stdout, io.Writer(&out))
+		e := &serveEnv{lc: lc}
+		if err := e.printServeStatus(context.Background(), lc.config); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	const statusOn = "Maintenance mode is on: web handlers respond with "
 
-// anyErr returns an error checker that wants any error.
-func anyErr() func(error) string {
-	return func(got error) string {
-		return ""
+	if err := run("maintenance on"); err != nil {
+		t.Fatal(err)
+	}
+	check(true, "")
+	if got, want := status(), statusOn+"a default maintenance page (503)\n"; !strings.Contains(got, want) {
+		t.Errorf("status missing %q; got:\n%s", want, got)
 	}
-}
 
-func cmd(s string) []string {
-	return strings.Fields(s)
+	if err := run("maintenance --page " + page + " on"); err != nil {
+		t.Fatal(err)
+	}
+	check(true, page)
+	if got, want := status(), statusOn+page+" (503)\n"; !strings.Contains(got, want) {
+		t.Errorf("status missing %q; got:\n%s", want, got)
+	}
+
+	for _, args := range []string{
+		"maintenance",
+		"maintenance maybe",
+		"maintenance on off",
+		"maintenance --page maintenance.html on",
+		"maintenance --page " + filepath.Join(dir, "missing.html") + " on",
+		"maintenance --page " + dir + " on",
+		"maintenance --page " + page + " off",
+	} {
+		if err := run(args); err == nil {
+			t.Errorf("%q: got no error", args)
+		}
+	}
+	check(true, page)
+
+	if err := run("maintenance off"); err != nil {
+		t.Fatal(err)
+	}
+	check(false, "")
+	if got := status(); strings.Contains(got, "Maintenance") {
+		t.Errorf("status mentions maintenance after turning it off:\n%s", got)
+	}
 }
@@ -0,0 +1,39 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandProxyTargetNamedPipe(t *testing.T) {
+	tests := []struct {
+		source  string
+		want    string
+		wantErr string
+	}{
+		{source: "pipe:myapp", want: `\\.\pipe\myapp`},
+		{source: `\\.\pipe\myapp`, want: `\\.\pipe\myapp`},
+		{source: `\\.\PIPE\myapp`, want: `\\.\pipe\myapp`},
+		{source: "pipe:", wantErr: "empty pipe name"},
+		{source: `pipe:a\b`, wantErr: "must not contain a backslash"},
+		{source: "pipe:" + strings.Repeat("a", 300), wantErr: "too long"},
+	}
+	for _, tt := range tests {
+		if !isProxyTarget(tt.source) {
+			t.Errorf("isProxyTarget(%q) = false; want true", tt.source)
+		}
+		got, err := expandProxyTarget(tt.source)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expandProxyTarget(%q) = %q, %v; want error containing %q", tt.source, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("expandProxyTarget(%q) = %q, %v; want %q", tt.source, got, err, tt.want)
+		}
+	}
+}
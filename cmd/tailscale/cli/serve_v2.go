@@ -4,6 +4,8 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,19 +13,27 @@
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/crypto/bcrypt"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/web"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -57,6 +67,24 @@ type commandInfo struct {
 For more examples and use cases visit our docs site https://tailscale.com/kb/1247/funnel-serve-use-cases
 `)
 
+// serveFromEnvHelp documents the environment variables that
+// "tailscale serve --from-env" reads.
+var serveFromEnvHelp = strings.TrimSpace(`
+ENVIRONMENT
+  With --from-env, each of the following variables configures one port;
+  other variables, including other TS_SERVE_* ones, are ignored:
+
+  TS_SERVE_<port>=<mount-point>=<target>[;<mount-point>=<target>...]
+      Serve over HTTPS on the port, as with --https=<port>.
+  TS_SERVE_HTTP_<port>=<mount-point>=<target>[;<mount-point>=<target>...]
+      Serve over HTTP on the port, as with --http=<port>.
+  TS_SERVE_TCP_<port>=tcp://localhost:<local-port>
+      Forward TCP connections to the port, as with --tcp=<port>.
+
+  The resulting config replaces the current one in a single change, in the
+  background. Other flags, such as --label, don't apply to it.
+`)
+
 type serveMode int
 
 const (
@@ -98,6 +126,37 @@ type commandInfo struct {
 	return fmt.Errorf("try `tailscale %s --help` for usage info", infoMap[m].Name)
 }
 
+// serveWatchFileHelp is the long help of the "serve watch-file" subcommand.
+var serveWatchFileHelp = strings.TrimSpace(`
+The watch-file command sets the serve config from a JSON file, in the format
+shown by 'tailscale serve status --json', and keeps running to set it again
+each time the file changes, until interrupted. An edit is applied once the
+file has stayed the same for a second, so that a burst of writes is applied
+once. A file that isn't a valid serve config is reported and ignored, leaving
+the running config as it was; at startup, it's an error.
+`)
+
+// serveMaintenanceHelp is the long help of the "serve maintenance"
+// subcommand.
+var serveMaintenanceHelp = strings.TrimSpace(`
+The maintenance command turns maintenance mode on or off. In maintenance mode,
+every web handler responds with 503 Service Unavailable and a maintenance
+page, the HTML file given with --page or a short default message, instead of
+serving its source. The rest of the serve config is kept, so turning
+maintenance mode off serves it as before. TCP forwarding is not affected.
+`)
+
+// serveValidateHelp is the long help of the "serve validate" subcommand.
+var serveValidateHelp = strings.TrimSpace(`
+The validate command checks a serve config in a JSON file, in the format shown
+by 'tailscale serve status --json', the same way watch-file does before
+applying one, without talking to tailscaled, such as to lint configs in CI.
+It rejects unknown fields, invalid ports, mount points and targets, and Funnel
+on ports that the config doesn't serve or serves as plain HTTP. Whether the
+node may use Funnel on a port depends on its tailnet's policy, so that isn't
+checked. It exits non-zero and reports the first problem found.
+`)
+
 // newServeV2Command returns a new "serve" subcommand using e as its environment.
 func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 	if subcmd != serve && subcmd != funnel {
@@ -105,16 +164,26 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 	}
 
 	info := infoMap[subcmd]
+	longHelp := info.LongHelp + fmt.Sprintf(strings.TrimSpace(serveHelpCommon), info.Name)
+	if subcmd == serve {
+		longHelp += "\n\n" + serveFromEnvHelp
+	}
 
 	return &ffcli.Command{
 		Name:      info.Name,
 		ShortHelp: info.ShortHelp,
 		ShortUsage: strings.Join([]string{
 			fmt.Sprintf("tailscale %s <target>", info.Name),
-			fmt.Sprintf("tailscale %s status [--json]", info.Name),
+			fmt.Sprintf("tailscale %s --aggregate-backends --set-path <path>", info.Name),
+			fmt.Sprintf("tailscale %s status [--json] [--watch] [--check-cert] [--family v4|v6]", info.Name),
+			fmt.Sprintf("tailscale %s stats [--json]", info.Name),
+			fmt.Sprintf("tailscale %s watch-file <path>", info.Name),
+			fmt.Sprintf("tailscale %s validate <path>", info.Name),
+			fmt.Sprintf("tailscale %s maintenance [--page <html-file>] (on|off)", info.Name),
+			fmt.Sprintf("tailscale %s edit --interactive", info.Name),
 			fmt.Sprintf("tailscale %s reset", info.Name),
 		}, "\n"),
-		LongHelp: info.LongHelp + fmt.Sprintf(strings.TrimSpace(serveHelpCommon), info.Name),
+		LongHelp: longHelp,
 		Exec:     e.runServeCombined(subcmd),
 
 		FlagSet: e.newFlags("serve-set", func(fs *flag.FlagSet) {
@@ -123,20 +192,69 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 			fs.UintVar(&e.https, "https", 0, "Expose an HTTPS server at the specified port (default mode)")
 			if subcmd == serve {
 				fs.UintVar(&e.http, "http", 0, "Expose an HTTP server at the specified port")
+				fs.BoolVar(&e.fromEnv, "from-env", false, "Replace the serve config with one built from TS_SERVE_* environment variables (see ENVIRONMENT)")
 			}
 			fs.UintVar(&e.tcp, "tcp", 0, "Expose a TCP forwarder to forward raw TCP packets at the specified port")
 			fs.UintVar(&e.tlsTerminatedTCP, "tls-terminated-tcp", 0, "Expose a TCP forwarder to forward TLS-terminated TCP packets at the specified port")
 			fs.BoolVar(&e.yes, "yes", false, "Update without interactive prompts (default false)")
+			e.addServeFlags(fs)
 		}),
 		UsageFunc: usageFuncNoDefaultValues,
 		Subcommands: []*ffcli.Command{
 			{
 				Name:       "status",
-				ShortUsage: "tailscale " + info.Name + " status [--json]",
+				ShortUsage: "tailscale " + info.Name + " status [--json] [--watch] [--check-cert] [--family v4|v6]",
 				Exec:       e.runServeStatus,
 				ShortHelp:  "View current " + info.Name + " configuration",
 				FlagSet: e.newFlags("serve-status", func(fs *flag.FlagSet) {
 					fs.BoolVar(&e.json, "json", false, "output JSON")
+					fs.BoolVar(&e.watch, "watch", false, "keep running, and show the status again whenever the serve config changes")
+					fs.BoolVar(&e.checkCert, "check-cert", false, "also show when the TLS certificate of each https port expires")
+					fs.StringVar(&e.family, "family", "", "only show the node's addresses of this IP family, v4 or v6, that each port is served on")
+				}),
+			},
+			{
+				Name:       "stats",
+				ShortUsage: "tailscale " + info.Name + " stats [--json]",
+				Exec:       e.runServeStats,
+				ShortHelp:  "Show request and byte counts of each web handler",
+				FlagSet: e.newFlags("serve-stats", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.json, "json", false, "output JSON")
+				}),
+			},
+			{
+				Name:       "watch-file",
+				ShortUsage: "tailscale " + info.Name + " watch-file <path>",
+				ShortHelp:  "Set the serve config from a JSON file, and again whenever it changes",
+				LongHelp:   serveWatchFileHelp,
+				Exec:       e.runServeWatchFile,
+				FlagSet:    e.newFlags("serve-watch-file", nil),
+			},
+			{
+				Name:       "validate",
+				ShortUsage: "tailscale " + info.Name + " validate <path>",
+				ShortHelp:  "Check a serve config JSON file without applying it",
+				LongHelp:   serveValidateHelp,
+				Exec:       e.runServeValidate,
+				FlagSet:    e.newFlags("serve-validate", nil),
+			},
+			{
+				Name:       "maintenance",
+				ShortUsage: "tailscale " + info.Name + " maintenance [--page <html-file>] (on|off)",
+				ShortHelp:  "Turn maintenance mode on or off",
+				LongHelp:   serveMaintenanceHelp,
+				Exec:       e.runServeMaintenance,
+				FlagSet: e.newFlags("serve-maintenance", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.maintenancePage, "page", "", "absolute path of an HTML file to serve as the maintenance page (on only)")
+				}),
+			},
+			{
+				Name:       "edit",
+				ShortUsage: "tailscale " + info.Name + " edit --interactive",
+				ShortHelp:  "List handlers and delete them or toggle Funnel by number",
+				Exec:       e.runServeEdit,
+				FlagSet: e.newFlags("serve-edit", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.interactive, "interactive", false, "show a numbered menu of handlers and read commands from stdin (required)")
 				}),
 			},
 			{
@@ -150,6 +268,44 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 	}
 }
 
+// addServeFlags registers the flags that configure how a target is served,
+// which the serve and funnel commands share with the legacy serve command.
+func (e *serveEnv) addServeFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&e.replace, "replace", false, "replace all existing web handlers on the port instead of adding to them")
+	fs.BoolVar(&e.noHTTP2, "no-http2", false, "only use HTTP/1.1 when proxying to the backend")
+	fs.BoolVar(&e.aggregateBackends, "aggregate-backends", false, "serve a health endpoint reporting whether all proxy backends are reachable, instead of a target")
+	fs.StringVar(&e.label, "label", "", "description of the handler, shown in 'tailscale serve status'")
+	fs.StringVar(&e.allowMethods, "allow-methods", "", "comma-separated list of HTTP methods to allow, such as GET,HEAD (default all)")
+	fs.StringVar(&e.requireTag, "require-tag", "", "only serve requests from tailnet nodes with this ACL tag, such as tag:admin")
+	fs.StringVar(&e.cacheControl, "cache-control", "", "Cache-Control header to send with files served from a path, such as max-age=3600")
+	fs.Var(&e.sniRoutes, "sni", "route TLS connections for an SNI name to a local backend, as name=localhost:port; can be repeated (tls-terminated-tcp only)")
+	fs.StringVar(&e.proxyHost, "proxy-host", "", "Host header to send to the proxy backend instead of the incoming one")
+	fs.StringVar(&e.tlsMinVersion, "tls-min-version", "", "minimum TLS version to accept on the port, 1.2 or 1.3 (https and tls-terminated-tcp only)")
+	fs.BoolVar(&e.grpcWeb, "grpc-web", false, "translate gRPC-Web requests to gRPC when proxying to the backend")
+	fs.StringVar(&e.drain, "drain", "", "how long connections open before this change keep being served by the previous config, such as 30s (http and https only; default 0, switching over immediately)")
+	fs.Var(&e.allowCIDRs, "allow-cidr", "only serve requests from client addresses in this CIDR, such as 100.64.0.0/10; can be repeated (http and https only)")
+	fs.StringVar(&e.logLevel, "log-level", "", "how much tailscaled logs about the handler's requests: error, info (each request) or debug (also headers) (default error)")
+	fs.StringVar(&e.service, "service", "", "serve for this service, such as svc:wiki, instead of for the node itself, and advertise the node as a host of it (http and https only)")
+	fs.StringVar(&e.basicAuth, "basic-auth", "", "require HTTP Basic auth as this user:password; only a hash of the password is stored (http and https only)")
+	fs.StringVar(&e.basicAuthFile, "basic-auth-file", "", "require HTTP Basic auth as one of the users in this htpasswd file, which must use bcrypt hashes (http and https only)")
+	fs.BoolVar(&e.ifNotExists, "if-not-exists", false, "do nothing if the mount point already has a web handler, instead of replacing it")
+	fs.IntVar(&e.maxConns, "max-conns", 0, "maximum number of connections to forward at once; more are closed (tcp and tls-terminated-tcp only; default 0, no limit)")
+	fs.BoolVar(&e.force, "force", false, "serve on the port even if one of tailscaled's own services, such as Tailscale SSH, handles connections to it")
+	fs.StringVar(&e.virtualHost, "virtual-host", "", "serve for requests to this host name, such as another DNS name of the node, instead of the node's MagicDNS name; https needs a name the node can get a certificate for (http and https only)")
+	fs.StringVar(&e.backendKeepalive, "backend-keepalive", "", "how long to keep idle connections to the proxy backend open for reuse, such as 30s (default 90s)")
+	fs.BoolVar(&e.spaFallback, "spa-fallback", false, "serve the directory's index.html for paths that don't name a file, for single-page apps (directory paths only)")
+	fs.StringVar(&e.requestIDHeader, "request-id-header", "", "request header, such as X-Request-Id, to send to the proxy backend with a generated ID if the request doesn't have it")
+	fs.BoolVar(&e.compress, "compress", false, "gzip responses for clients that accept it, unless they're small or already compressed (path, archive and proxy sources only)")
+	fs.StringVar(&e.canary, "canary", "", "second proxy backend to send a percentage of requests to, picked at random, as <proxy-target>=<percent>%, such as http://127.0.0.1:3001=10%")
+	fs.DurationVar(&e.wait, "wait", 0, "with off, wait up to this long, such as 10s, for tailscaled to confirm that it no longer serves the handler; fail if it doesn't (http and https only)")
+	fs.IntVar(&e.backlog, "backlog", 0, fmt.Sprintf("length of the queue of connections not yet accepted to listen with on the host, up to %d; the OS may cap it (tcp and tls-terminated-tcp only; default 0, the OS default)", ipn.MaxBacklog))
+	fs.BoolVar(&e.webDAV, "webdav", false, "serve the directory over WebDAV, for clients to mount and change files in (directory paths only)")
+	fs.BoolVar(&e.webDAVReadOnly, "webdav-read-only", false, "with --webdav, reject requests that would change files")
+	fs.BoolVar(&e.serveDotfiles, "serve-dotfiles", false, "serve files and directories whose names start with a period, such as .git and .env, instead of hiding them (directory paths only)")
+	fs.StringVar(&e.connectTimeout, "connect-timeout", "", "how long to wait to connect to the proxy backend before failing the request, such as 5s (default no timeout)")
+	fs.StringVar(&e.responseHeaderTimeout, "response-header-timeout", "", "how long to wait for the proxy backend's response headers after sending the request, such as 30s; the body may take longer (default no timeout)")
+}
+
 func (e *serveEnv) validateArgs(subcmd serveMode, args []string) error {
 	if translation, ok := isLegacyInvocation(subcmd, args); ok {
 		fmt.Fprint(e.stderr(), "Error: the CLI for serve and funnel has changed.")
@@ -161,6 +317,10 @@ func (e *serveEnv) validateArgs(subcmd serveMode, args []string) error {
 		return errHelpFunc(subcmd)
 	}
 	if len(args) == 0 {
+		if e.aggregateBackends {
+			// the health endpoint has no target
+			return nil
+		}
 		return flag.ErrHelp
 	}
 	if len(args) > 2 {
@@ -172,6 +332,10 @@ func (e *serveEnv) validateArgs(subcmd serveMode, args []string) error {
 		fmt.Fprintln(e.stderr(), "Error: invalid argument format")
 		return errHelpFunc(subcmd)
 	}
+	if e.aggregateBackends && !turnOff {
+		fmt.Fprintln(e.stderr(), "Error: --aggregate-backends does not take a target")
+		return errHelpFunc(subcmd)
+	}
 
 	// Given the two checks above, we can assume there
 	// are only 1 or 2 arguments which is valid.
@@ -190,13 +354,20 @@ func (e *serveEnv) runServeCombined(subcmd serveMode) execFunc {
 			if err != nil {
 				return err
 			}
-			sc := new(ipn.ServeConfig)
-			if err := json.Unmarshal(valb, sc); err != nil {
-				return fmt.Errorf("invalid JSON: %w", err)
+			sc, err := parseServeConfigJSON(valb)
+			if err != nil {
+				return err
 			}
 			return e.lc.SetServeConfig(ctx, sc)
 		}
 
+		if e.fromEnv {
+			if len(args) > 0 {
+				return errors.New("--from-env doesn't take arguments")
+			}
+			return e.runServeFromEnv(ctx)
+		}
+
 		if err := e.validateArgs(subcmd, args); err != nil {
 			return err
 		}
@@ -222,11 +393,21 @@ func (e *serveEnv) runServeCombined(subcmd serveMode) execFunc {
 			fmt.Fprintf(e.stderr(), "error: %v\n\n", err)
 			return errHelpFunc(subcmd)
 		}
+		if e.drain != "" && srvType != serveTypeHTTPS && srvType != serveTypeHTTP {
+			return errors.New("--drain is only supported for http and https")
+		}
+		if e.maxConns != 0 && (srvType == serveTypeHTTPS || srvType == serveTypeHTTP) {
+			return errors.New("--max-conns is only supported for tcp and tls-terminated-tcp")
+		}
+		if e.backlog != 0 && (srvType == serveTypeHTTPS || srvType == serveTypeHTTP) {
+			return errors.New("--backlog is only supported for tcp and tls-terminated-tcp")
+		}
 
 		sc, err := e.lc.GetServeConfig(ctx)
 		if err != nil {
 			return fmt.Errorf("error getting serve config: %w", err)
 		}
+		cur := sc.Clone() // to report whether the config changed
 
 		// nil if no config
 		if sc == nil {
@@ -244,7 +425,53 @@ func (e *serveEnv) runServeCombined(subcmd serveMode) execFunc {
 		// foreground or background.
 		parentSC := sc
 
-		turnOff := "off" == args[len(args)-1]
+		turnOff := len(args) > 0 && args[len(args)-1] == "off"
+		if e.wait != 0 {
+			if !turnOff || (srvType != serveTypeHTTPS && srvType != serveTypeHTTP) {
+				return errors.New("--wait is only supported for removing http and https handlers, with off")
+			}
+			if e.wait < 0 {
+				return fmt.Errorf("invalid --wait %v; must be positive", e.wait)
+			}
+		}
+		if e.service != "" {
+			if err := tailcfg.CheckServiceName(e.service); err != nil {
+				return fmt.Errorf("invalid --service %q: %w", e.service, err)
+			}
+			if srvType != serveTypeHTTPS && srvType != serveTypeHTTP {
+				return errors.New("--service is only supported for http and https")
+			}
+			if funnel {
+				return errors.New("--service can't be used with funnel")
+			}
+			if !e.bg && !turnOff {
+				return errors.New("--service requires --bg")
+			}
+		}
+		if e.virtualHost != "" {
+			if funnel {
+				return errors.New("--virtual-host can't be used with funnel")
+			}
+			if err := e.checkVirtualHost(ctx, srvType.String()); err != nil {
+				return err
+			}
+		}
+		if !turnOff && e.service == "" {
+			use, err := e.reservedPortUse(ctx, srvPort)
+			if err != nil {
+				return err
+			}
+			if use != "" {
+				name := infoMap[subcmd].Name
+				if !e.force {
+					return fmt.Errorf("port %d is used by %s, which handles connections to it before %s does; use another port, or --force to %s on it anyway", srvPort, use, name, name)
+				}
+				fmt.Fprintf(e.stderr(), "warning: port %d is used by %s; %s won't get its connections while that's on\n", srvPort, use, name)
+			}
+		}
+		// portSC is the config to check for conflicts on the port, which
+		// for --service is the service's rather than the node's.
+		portSC, _, _ := e.webServeTarget(parentSC, dnsName)
 		if !turnOff && srvType == serveTypeHTTPS {
 			// Running serve with https requires that the tailnet has enabled
 			// https cert provisioning. Send users through an interactive flow
@@ -264,7 +491,7 @@ func (e *serveEnv) runServeCombined(subcmd serveMode) execFunc {
 		wantFg := !e.bg && !turnOff
 		if wantFg {
 			// validate the config before creating a WatchIPNBus session
-			if err := e.validateConfig(parentSC, srvPort, srvType); err != nil {
+			if err := e.validateConfig(portSC, srvPort, srvType); err != nil {
 				return err
 			}
 
@@ -289,27 +516,61 @@ func (e *serveEnv) runServeCombined(subcmd serveMode) execFunc {
 		}
 
 		var msg string
+		var waitHP ipn.HostPort
+		var waitMounts []string // removed web handlers to wait for, with --wait
 		if turnOff {
+			if e.wait > 0 {
+				web, host, _ := e.webServeTarget(sc, dnsName)
+				waitHP = ipn.HostPort(net.JoinHostPort(host, strconv.Itoa(int(srvPort))))
+				if wc := web.Web[waitHP]; wc != nil {
+					waitMounts = slices.Collect(maps.Keys(wc.Handlers))
+				}
+			}
 			err = e.unsetServe(sc, dnsName, srvType, srvPort, mount)
+			if e.wait > 0 {
+				web, _, _ := e.webServeTarget(sc, dnsName)
+				waitMounts = slices.DeleteFunc(waitMounts, func(m string) bool { return web.WebHandlerExists(waitHP, m) })
+			}
 		} else {
-			if err := e.validateConfig(parentSC, srvPort, srvType); err != nil {
+			if err := e.validateConfig(portSC, srvPort, srvType); err != nil {
 				return err
 			}
-			err = e.setServe(sc, st, dnsName, srvType, srvPort, mount, args[0], funnel)
-			msg = e.messageForPort(sc, st, dnsName, srvType, srvPort)
+			var target string // empty for --aggregate-backends
+			if len(args) > 0 {
+				target = args[0]
+			}
+			err = e.setServe(sc, st, dnsName, srvType, srvPort, mount, target, funnel)
+			web, host, _ := e.webServeTarget(sc, dnsName)
+			msg = e.messageForPort(web, st, host, srvType, srvPort)
 		}
 		if err != nil {
 			fmt.Fprintf(e.stderr(), "error: %v\n\n", err)
 			return errHelpFunc(subcmd)
 		}
+		if err := e.setDrain(parentSC); err != nil {
+			return err
+		}
 
-		if err := e.lc.SetServeConfig(ctx, parentSC); err != nil {
+		if err := e.setServeConfigIfChanged(ctx, cur, parentSC); err != nil {
 			if tailscale.IsPreconditionsFailedError(err) {
 				fmt.Fprintln(e.stderr(), "Another client is changing the serve config; please try again.")
 			}
 			return err
 		}
+		if e.service != "" {
+			// Advertise the service along with its first handler, and
+			// stop along with its last.
+			_, ok := parentSC.Services[e.service]
+			if err := e.setServiceAdvertised(ctx, e.service, ok); err != nil {
+				return err
+			}
+		}
 
+		if len(waitMounts) > 0 {
+			if err := e.waitWebHandlerRemoved(ctx, dnsName, waitHP, waitMounts...); err != nil {
+				return err
+			}
+		}
 		if msg != "" {
 			fmt.Fprintln(e.stdout(), msg)
 		}
@@ -370,10 +631,12 @@ func (e *serveEnv) setServe(sc *ipn.ServeConfig, st *ipnstate.Status, dnsName st
 	switch srvType {
 	case serveTypeHTTPS, serveTypeHTTP:
 		useTLS := srvType == serveTypeHTTPS
-		err := e.applyWebServe(sc, dnsName, srvPort, useTLS, mount, target)
+		web, host, saveWeb := e.webServeTarget(sc, dnsName)
+		err := e.applyWebServe(web, host, srvPort, useTLS, mount, target)
 		if err != nil {
 			return fmt.Errorf("failed apply web serve: %w", err)
 		}
+		saveWeb()
 	case serveTypeTCP, serveTypeTLSTerminatedTCP:
 		if e.setPath != "" {
 			return fmt.Errorf("cannot mount a path for TCP serve")
@@ -387,8 +650,13 @@ func (e *serveEnv) setServe(sc *ipn.ServeConfig, st *ipnstate.Status, dnsName st
 		return fmt.Errorf("invalid type %q", srvType)
 	}
 
-	// update the serve config based on if funnel is enabled
-	e.applyFunnel(sc, dnsName, srvPort, allowFunnel)
+	// update the serve config based on if funnel is enabled,
+	// which is only supported for the node's own name
+	if e.service == "" && e.virtualHost == "" {
+		if err := e.applyFunnel(sc, dnsName, srvPort, allowFunnel); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -426,18 +694,6 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 		portPart = ""
 	}
 
-	srvTypeAndDesc := func(h *ipn.HTTPHandler) (string, string) {
-		switch {
-		case h.Path != "":
-			return "path", h.Path
-		case h.Proxy != "":
-			return "proxy", h.Proxy
-		case h.Text != "":
-			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
-		}
-		return "", ""
-	}
-
 	if sc.Web[hp] != nil {
 		var mounts []string
 
@@ -450,7 +706,7 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 
 		for _, m := range mounts {
 			h := sc.Web[hp].Handlers[m]
-			t, d := srvTypeAndDesc(h)
+			t, d := webHandlerTypeAndDesc(h)
 			output.WriteString(fmt.Sprintf("%s://%s%s%s\n", scheme, dnsName, portPart, m))
 			output.WriteString(fmt.Sprintf("%s %-5s %s\n\n", "|--", t, d))
 		}
@@ -487,15 +743,36 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 }
 
 func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort uint16, useTLS bool, mount, target string) error {
+	if e.replace && e.ifNotExists {
+		return errors.New("--replace and --if-not-exists can't be used together")
+	}
 	h := new(ipn.HTTPHandler)
 
 	switch {
+	case e.aggregateBackends:
+		h.AggregateBackends = true
+	case target == "redirect-to-https",
+		strings.HasPrefix(target, "archive:"),
+		strings.HasPrefix(target, "pac:"),
+		strings.HasPrefix(target, "pipe:"), ipn.IsNamedPipeProxy(target):
+		var err error
+		h, mount, err = webSourceHandler(target, mount, useTLS)
+		if err != nil {
+			return err
+		}
 	case strings.HasPrefix(target, "text:"):
 		text := strings.TrimPrefix(target, "text:")
 		if text == "" {
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case filepath.IsAbs(target) && len(filepath.SplitList(target)) > 1:
+		// directories to merge, later ones winning
+		var err error
+		h, mount, err = webSourceHandler(target, mount, useTLS)
+		if err != nil {
+			return err
+		}
 	case filepath.IsAbs(target):
 		if version.IsMacAppStore() || version.IsMacSys() {
 			// The Tailscale network extension cannot serve arbitrary paths on macOS due to sandbox restrictions (2024-03-26)
@@ -522,13 +799,33 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 		}
 		h.Proxy = t
 	}
+	if err := e.applyWebHandlerFlags(h, useTLS); err != nil {
+		return err
+	}
 
 	// TODO: validation needs to check nested foreground configs
 	if sc.IsTCPForwardingOnPort(srvPort) {
 		return errors.New("cannot serve web; already serving TCP")
 	}
 
-	sc.SetWebHandler(h, dnsName, srvPort, mount, useTLS)
+	hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(srvPort))))
+	if e.ifNotExists && sc.WebHandlerExists(hp, mount) {
+		fmt.Fprintf(e.stderr(), "%s already has a handler on port %d; leaving it as is\n", mount, srvPort)
+		return nil
+	}
+	if e.replace {
+		// Drop all handlers for this host:port so the new handler is the
+		// only one. Other ports and the Funnel setting for this port are
+		// left alone.
+		delete(sc.Web, hp)
+	}
+	e.setWebHandler(sc, h, dnsName, srvPort, mount, useTLS)
+	if h.AggregateBackends && !hasProxyBackend(sc) {
+		return errors.New("--aggregate-backends requires at least one proxy backend to be configured")
+	}
+	if h.RedirectToHTTPS && !sc.IsServingHTTPS(443) {
+		fmt.Fprintf(e.stderr(), "warning: redirecting to https, but nothing is served over https on port 443 yet\n")
+	}
 
 	return nil
 }
@@ -561,10 +858,10 @@ func (e *serveEnv) applyTCPServe(sc *ipn.ServeConfig, dnsName string, srcType se
 
 	sc.SetTCPForwarding(srcPort, dstURL.Host, terminateTLS, dnsName)
 
-	return nil
+	return e.applyTCPHandlerFlags(sc.TCP[srcPort])
 }
 
-func (e *serveEnv) applyFunnel(sc *ipn.ServeConfig, dnsName string, srvPort uint16, allowFunnel bool) {
+func (e *serveEnv) applyFunnel(sc *ipn.ServeConfig, dnsName string, srvPort uint16, allowFunnel bool) error {
 	hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(srvPort))))
 
 	// TODO: Should we return an error? Should not be possible.
@@ -573,20 +870,44 @@ func (e *serveEnv) applyFunnel(sc *ipn.ServeConfig, dnsName string, srvPort uint
 		sc = new(ipn.ServeConfig)
 	}
 
+	if allowFunnel {
+		if err := checkFunnelWebDAV(sc, hp); err != nil {
+			return err
+		}
+	}
 	if _, exists := sc.AllowFunnel[hp]; exists && !allowFunnel {
 		fmt.Fprintf(e.stderr(), "Removing Funnel for %s:%s\n", dnsName, hp)
 	}
 	sc.SetFunnel(dnsName, srvPort, allowFunnel)
+	return nil
+}
+
+// checkFunnelWebDAV returns an error if hp has a WebDAV handler that isn't
+// read-only, which Funnel would let anyone on the internet change files
+// through. ipn.ServeConfig.CheckValid rejects such configs too.
+func checkFunnelWebDAV(sc *ipn.ServeConfig, hp ipn.HostPort) error {
+	conf := sc.Web[hp]
+	if conf == nil {
+		return nil
+	}
+	for _, mount := range slices.Sorted(maps.Keys(conf.Handlers)) {
+		if h := conf.Handlers[mount]; h.WebDAV && !h.WebDAVReadOnly {
+			return fmt.Errorf("can't use Funnel on %s: %s is served over WebDAV without --webdav-read-only", hp, mount)
+		}
+	}
+	return nil
 }
 
 // unsetServe removes the serve config for the given serve port.
 func (e *serveEnv) unsetServe(sc *ipn.ServeConfig, dnsName string, srvType serveType, srvPort uint16, mount string) error {
 	switch srvType {
 	case serveTypeHTTPS, serveTypeHTTP:
-		err := e.removeWebServe(sc, dnsName, srvPort, mount)
+		web, host, saveWeb := e.webServeTarget(sc, dnsName)
+		err := e.removeWebServe(web, host, srvPort, mount)
 		if err != nil {
 			return fmt.Errorf("failed to remove web serve: %w", err)
 		}
+		saveWeb()
 	case serveTypeTCP, serveTypeTLSTerminatedTCP:
 		err := e.removeTCPServe(sc, srvPort)
 		if err != nil {
@@ -786,6 +1107,7 @@ func (e *serveEnv) removeTCPServe(sc *ipn.ServeConfig, src uint16) error {
 }
 
 // cleanURLPath ensures the path is clean and has a leading "/".
+// The bare wildcard "*" (or "/*") is normalized to ipn.WildcardMountPoint.
 func cleanURLPath(urlPath string) (string, error) {
 	if urlPath == "" {
 		return "/", nil
@@ -796,6 +1118,12 @@ func cleanURLPath(urlPath string) (string, error) {
 	if !strings.HasPrefix(urlPath, "/") {
 		urlPath = "/" + urlPath
 	}
+	if urlPath == ipn.WildcardMountPoint {
+		return urlPath, nil
+	}
+	if strings.Contains(urlPath, "*") {
+		return "", fmt.Errorf("invalid mount point %q; wildcards are only supported as %q", urlPath, ipn.WildcardMountPoint)
+	}
 
 	c := path.Clean(urlPath)
 	if urlPath == c || urlPath == c+"/" {
@@ -832,3 +1160,1252 @@ func (e *serveEnv) stderr() io.Writer {
 	}
 	return Stderr
 }
+
+// runServeFromEnv implements "tailscale serve --from-env", replacing the
+// serve config with the one that the TS_SERVE_* environment variables
+// describe.
+func (e *serveEnv) runServeFromEnv(ctx context.Context) error {
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	sc, err := parseServeEnv(e.environ(), dnsName)
+	if err != nil {
+		return err
+	}
+	if len(sc.TCP) == 0 {
+		return errors.New("--from-env: no TS_SERVE_* environment variables set; use 'tailscale serve reset' to clear the serve config")
+	}
+	var https bool
+	for _, port := range slices.Sorted(maps.Keys(sc.TCP)) {
+		https = https || sc.TCP[port].HTTPS
+		use, err := e.reservedPortUse(ctx, port)
+		if err != nil {
+			return err
+		}
+		if use != "" {
+			if !e.force {
+				return fmt.Errorf("port %d is used by %s, which handles connections to it before serve does; use another port, or --force to serve on it anyway", port, use)
+			}
+			fmt.Fprintf(Stderr, "warning: port %d is used by %s; serve won't get its connections while that's on\n", port, use)
+		}
+	}
+	if https {
+		// Like runServe, this doesn't fail if the flow can't be started.
+		e.enableFeatureInteractive(ctx, "serve", tailcfg.CapabilityHTTPS)
+	}
+
+	cursc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if cursc != nil {
+		// Foreground configs belong to running "tailscale serve"
+		// sessions, not to the config being replaced.
+		sc.Foreground = cursc.Clone().Foreground
+	}
+	return e.setServeConfigIfChanged(ctx, cursc, sc)
+}
+
+// environ returns the environment variables that --from-env reads, as
+// "key=value" strings.
+func (e *serveEnv) environ() []string {
+	if e.testEnviron != nil {
+		return e.testEnviron
+	}
+	return os.Environ()
+}
+
+// parseServeEnv returns the serve config for the node named dnsName that
+// the TS_SERVE_* variables in environ describe; see the ENVIRONMENT section
+// of the serve command's help. Variables that don't have one of the
+// documented forms are ignored.
+func parseServeEnv(environ []string, dnsName string) (*ipn.ServeConfig, error) {
+	sc := new(ipn.ServeConfig)
+	seen := make(map[uint16]string) // port => variable that configured it
+	for _, kv := range slices.Sorted(slices.Values(environ)) {
+		name, val, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, "TS_SERVE_")
+		if !ok {
+			continue
+		}
+		kind := "https"
+		if r, ok := strings.CutPrefix(rest, "HTTP_"); ok {
+			kind, rest = "http", r
+		} else if r, ok := strings.CutPrefix(rest, "TCP_"); ok {
+			kind, rest = "tcp", r
+		}
+		if !allNumeric(rest) {
+			continue // such as TS_SERVE_CONFIG, used by containerboot
+		}
+		port, err := parseServePort(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid port %q: %w", name, rest, err)
+		}
+		if prev, ok := seen[port]; ok {
+			return nil, fmt.Errorf("%s: port %d is already configured by %s", name, port, prev)
+		}
+		seen[port] = name
+
+		if kind == "tcp" {
+			fwdAddr, err := tcpForwardAddr(strings.TrimSpace(val))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			sc.SetTCPForwarding(port, fwdAddr, false, dnsName)
+			continue
+		}
+		useTLS := kind == "https"
+		var n int
+		for _, entry := range strings.Split(val, ";") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			mount, source, ok := strings.Cut(entry, "=")
+			if !ok || source == "" {
+				return nil, fmt.Errorf("%s: invalid entry %q; want <mount-point>=<source>", name, entry)
+			}
+			mount, err := cleanMountPoint(mount)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			h, mount, err := webSourceHandler(source, mount, useTLS)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			sc.SetWebHandler(h, dnsName, port, mount, useTLS)
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("%s: no mount points", name)
+		}
+	}
+	if err := sc.CheckValid(); err != nil {
+		return nil, fmt.Errorf("invalid serve config: %w", err)
+	}
+	return sc, nil
+}
+
+// reservedPortUse returns a description of the tailscaled service, such as
+// Tailscale SSH, that currently handles connections to port on the node's
+// Tailscale IPs, or "" if there's none. tailscaled hands connections to
+// those services before consulting the serve config, so serving on such a
+// port has no effect.
+func (e *serveEnv) reservedPortUse(ctx context.Context, port uint16) (string, error) {
+	prefs, err := e.lc.GetPrefs(ctx)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case port == 22 && prefs.RunSSH:
+		return "Tailscale SSH", nil
+	case port == web.ListenPort && prefs.RunWebClient:
+		return "the web interface (tailscale set --webclient)", nil
+	}
+	st, err := e.getLocalClientStatusWithoutPeers(ctx)
+	if err != nil {
+		return "", err
+	}
+	if st.Self == nil {
+		return "", nil
+	}
+	for _, s := range st.Self.PeerAPIURL {
+		u, err := url.Parse(s)
+		if err != nil {
+			continue
+		}
+		if p, err := strconv.ParseUint(u.Port(), 10, 16); err == nil && uint16(p) == port {
+			return "the peer API", nil
+		}
+	}
+	return "", nil
+}
+
+// applyWebHandlerFlags sets the options of the web handler h, served over
+// TLS if useTLS, from the flags that configure them, checking that h's
+// source supports them.
+func (e *serveEnv) applyWebHandlerFlags(h *ipn.HTTPHandler, useTLS bool) error {
+	if e.noHTTP2 {
+		if h.Proxy == "" {
+			return errors.New("--no-http2 is only supported for proxy targets")
+		}
+		h.NoHTTP2 = true
+	}
+	if e.proxyHost != "" {
+		if h.Proxy == "" {
+			return errors.New("--proxy-host is only supported for proxy targets")
+		}
+		if err := ipn.CheckProxyHost(e.proxyHost); err != nil {
+			return err
+		}
+		h.ProxyHost = e.proxyHost
+	}
+	if e.grpcWeb {
+		if h.Proxy == "" {
+			return errors.New("--grpc-web is only supported for proxy targets")
+		}
+		if e.noHTTP2 {
+			return errors.New("--grpc-web can't be used with --no-http2; gRPC requires HTTP/2")
+		}
+		h.GRPCWeb = true
+	}
+	if e.backendKeepalive != "" {
+		if h.Proxy == "" {
+			return errors.New("--backend-keepalive is only supported for proxy targets")
+		}
+		if _, err := ipn.ParseBackendKeepalive(e.backendKeepalive); err != nil {
+			return err
+		}
+		h.BackendKeepalive = e.backendKeepalive
+	}
+	if e.connectTimeout != "" {
+		if h.Proxy == "" {
+			return errors.New("--connect-timeout is only supported for proxy targets")
+		}
+		if _, err := ipn.ParseProxyTimeout(e.connectTimeout); err != nil {
+			return fmt.Errorf("invalid --connect-timeout: %w", err)
+		}
+		h.ConnectTimeout = e.connectTimeout
+	}
+	if e.responseHeaderTimeout != "" {
+		if h.Proxy == "" {
+			return errors.New("--response-header-timeout is only supported for proxy targets")
+		}
+		if _, err := ipn.ParseProxyTimeout(e.responseHeaderTimeout); err != nil {
+			return fmt.Errorf("invalid --response-header-timeout: %w", err)
+		}
+		h.ResponseHeaderTimeout = e.responseHeaderTimeout
+	}
+	if e.requestIDHeader != "" {
+		if h.Proxy == "" {
+			return errors.New("--request-id-header is only supported for proxy targets")
+		}
+		if err := ipn.CheckRequestIDHeader(e.requestIDHeader); err != nil {
+			return err
+		}
+		h.RequestIDHeader = e.requestIDHeader
+	}
+	if e.canary != "" {
+		if h.Proxy == "" {
+			return errors.New("--canary is only supported for proxy targets")
+		}
+		target, percent, err := parseCanary(e.canary)
+		if err != nil {
+			return err
+		}
+		h.Canary, h.CanaryPercent = target, percent
+	}
+	if e.allowMethods != "" {
+		methods, err := ipn.ParseHTTPMethods(e.allowMethods)
+		if err != nil {
+			return fmt.Errorf("invalid --allow-methods: %w", err)
+		}
+		h.AllowMethods = methods
+	}
+	if e.requireTag != "" {
+		if err := tailcfg.CheckTag(e.requireTag); err != nil {
+			return fmt.Errorf("invalid --require-tag %q: %w", e.requireTag, err)
+		}
+		h.RequireTag = e.requireTag
+	}
+	h.AllowCIDRs = slices.Clone([]netip.Prefix(e.allowCIDRs))
+	if e.basicAuth != "" || e.basicAuthFile != "" {
+		entries, err := e.basicAuthEntries()
+		if err != nil {
+			return err
+		}
+		h.BasicAuth = entries
+	}
+	if e.tlsMinVersion != "" {
+		if !useTLS {
+			return errors.New("--tls-min-version is only supported for https")
+		}
+		if _, err := ipn.ParseTLSVersion(e.tlsMinVersion); err != nil {
+			return err
+		}
+	}
+	if e.cacheControl != "" {
+		if h.Path == "" && h.Archive == "" {
+			return errors.New("--cache-control is only supported for path and archive sources")
+		}
+		if err := ipn.CheckCacheControl(e.cacheControl); err != nil {
+			return fmt.Errorf("invalid --cache-control: %w", err)
+		}
+		h.CacheControl = e.cacheControl
+	}
+	if e.spaFallback {
+		if fi, err := os.Stat(h.Path); h.Path == "" || err != nil || !fi.IsDir() {
+			return errors.New("--spa-fallback is only supported for directory paths")
+		}
+		h.SPAFallback = true
+	}
+	if e.webDAVReadOnly && !e.webDAV {
+		return errors.New("--webdav-read-only can only be used with --webdav")
+	}
+	if e.webDAV {
+		if fi, err := os.Stat(h.Path); h.Path == "" || err != nil || !fi.IsDir() || len(h.OverlayPaths) > 0 || h.ContentType != "" {
+			return errors.New("--webdav is only supported for a single directory path")
+		}
+		if e.spaFallback {
+			return errors.New("--webdav and --spa-fallback can't be used together")
+		}
+		h.WebDAV = true
+		h.WebDAVReadOnly = e.webDAVReadOnly
+	}
+	if e.serveDotfiles {
+		if fi, err := os.Stat(h.Path); h.Path == "" || err != nil || !fi.IsDir() {
+			return errors.New("--serve-dotfiles is only supported for directory paths")
+		}
+		if e.webDAV {
+			return errors.New("--serve-dotfiles can't be used with --webdav, which serves every file")
+		}
+		h.ServeDotfiles = true
+	}
+	if e.compress {
+		if h.Path == "" && h.Archive == "" && h.Proxy == "" {
+			return errors.New("--compress is only supported for path, archive and proxy sources")
+		}
+		h.Compress = true
+	}
+	if err := ipn.CheckLogLevel(e.logLevel); err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	h.LogLevel = e.logLevel
+	h.Label = e.label
+	return nil
+}
+
+// setWebHandler is like sc.SetWebHandler, but it also sets the port's
+// minimum TLS version from --tls-min-version, or, if that's not set,
+// keeps the one the port already had.
+func (e *serveEnv) setWebHandler(sc *ipn.ServeConfig, h *ipn.HTTPHandler, host string, srvPort uint16, mount string, useTLS bool) {
+	prevTCP := sc.TCP[srvPort]
+	sc.SetWebHandler(h, host, srvPort, mount, useTLS)
+	if e.tlsMinVersion != "" {
+		sc.TCP[srvPort].TLSMinVersion = e.tlsMinVersion
+	} else if useTLS && prevTCP != nil && prevTCP.HTTPS {
+		// Keep the port's TLS settings when adding another handler.
+		sc.TCP[srvPort].TLSMinVersion = prevTCP.TLSMinVersion
+	}
+}
+
+// webSourceHandler returns the web handler that serves source, a
+// "tailscale serve" source argument such as a proxy target, path, list of
+// directories to merge or text:..., at mount, along with the mount point
+// to use, which has a trailing slash added for directories and archives.
+func webSourceHandler(source, mount string, useTLS bool) (*ipn.HTTPHandler, string, error) {
+	h := new(ipn.HTTPHandler)
+	ts, _, _ := strings.Cut(source, ":")
+	switch {
+	case source == "redirect-to-https":
+		if useTLS {
+			return nil, "", errors.New("redirect-to-https is only supported for http")
+		}
+		h.RedirectToHTTPS = true
+	case ts == "text":
+		text := strings.TrimPrefix(source, "text:")
+		if text == "" {
+			return nil, "", errors.New("unable to serve; text cannot be an empty string")
+		}
+		h.Text = text
+	case ts == "archive":
+		if version.IsSandboxedMacOS() {
+			return nil, "", fmt.Errorf("archive serving is not supported if sandboxed on macOS")
+		}
+		archive := strings.TrimPrefix(source, "archive:")
+		if !filepath.IsAbs(archive) {
+			fmt.Fprintf(Stderr, "error: archive path must be absolute\n\n")
+			return nil, "", errHelp
+		}
+		archive = filepath.Clean(archive)
+		if err := checkServeArchive(archive); err != nil {
+			fmt.Fprintf(Stderr, "error: invalid archive: %v\n\n", err)
+			return nil, "", errHelp
+		}
+		if !strings.HasSuffix(mount, "/") {
+			// archives are served like directories, so their
+			// mount points must end in / for relative links to work
+			mount += "/"
+		}
+		h.Archive = archive
+	case ts == "pac":
+		if version.IsSandboxedMacOS() {
+			return nil, "", fmt.Errorf("path serving is not supported if sandboxed on macOS")
+		}
+		pac := strings.TrimPrefix(source, "pac:")
+		if !filepath.IsAbs(pac) {
+			fmt.Fprintf(Stderr, "error: PAC file path must be absolute\n\n")
+			return nil, "", errHelp
+		}
+		pac = filepath.Clean(pac)
+		fi, err := os.Stat(pac)
+		if err != nil {
+			fmt.Fprintf(Stderr, "error: invalid PAC file: %v\n\n", err)
+			return nil, "", errHelp
+		}
+		if !fi.Mode().IsRegular() {
+			fmt.Fprintf(Stderr, "error: invalid PAC file: %s is not a regular file\n\n", pac)
+			return nil, "", errHelp
+		}
+		h.Path = pac
+		h.ContentType = ipn.PACContentType
+	case isProxyTarget(source):
+		t, err := expandProxyTarget(source)
+		if err != nil {
+			return nil, "", err
+		}
+		h.Proxy = t
+	default: // assume path
+		if version.IsSandboxedMacOS() {
+			// don't allow path serving for now on macOS (2022-11-15)
+			return nil, "", fmt.Errorf("path serving is not supported if sandboxed on macOS")
+		}
+		if paths := filepath.SplitList(source); len(paths) > 1 {
+			// directories to merge, later ones winning
+			for i, p := range paths {
+				if !filepath.IsAbs(p) {
+					fmt.Fprintf(Stderr, "error: path must be absolute\n\n")
+					return nil, "", errHelp
+				}
+				p = filepath.Clean(p)
+				fi, err := os.Stat(p)
+				if err != nil {
+					fmt.Fprintf(Stderr, "error: invalid path: %v\n\n", err)
+					return nil, "", errHelp
+				}
+				if !fi.IsDir() {
+					fmt.Fprintf(Stderr, "error: %s is not a directory; only directories can be merged\n\n", p)
+					return nil, "", errHelp
+				}
+				if i == 0 {
+					h.Path = p
+				} else {
+					h.OverlayPaths = append(h.OverlayPaths, p)
+				}
+			}
+			if !strings.HasSuffix(mount, "/") {
+				mount += "/"
+			}
+			return h, mount, nil
+		}
+		if !filepath.IsAbs(source) {
+			fmt.Fprintf(Stderr, "error: path must be absolute\n\n")
+			return nil, "", errHelp
+		}
+		source = filepath.Clean(source)
+		fi, err := os.Stat(source)
+		if err != nil {
+			fmt.Fprintf(Stderr, "error: invalid path: %v\n\n", err)
+			return nil, "", errHelp
+		}
+		if fi.IsDir() && !strings.HasSuffix(mount, "/") {
+			// dir mount points must end in /
+			// for relative file links to work
+			mount += "/"
+		}
+		h.Path = source
+	}
+	return h, mount, nil
+}
+
+// webServeTarget returns the config that web handlers are added to or
+// removed from and the host name they're served on. That's sc and the
+// node's DNS name, unless the --service flag is set, in which case it's a
+// config holding the TCP and Web settings of the service's entry in
+// sc.Services, and the service's DNS name.
+//
+// The returned save func must be called once the returned config has been
+// changed, to store the changes back into sc.
+func (e *serveEnv) webServeTarget(sc *ipn.ServeConfig, dnsName string) (web *ipn.ServeConfig, host string, save func()) {
+	if e.virtualHost != "" {
+		return sc, e.virtualHost, func() {}
+	}
+	if e.service == "" {
+		return sc, dnsName, func() {}
+	}
+	web = new(ipn.ServeConfig)
+	if svc := sc.Services[e.service]; svc != nil {
+		web.TCP, web.Web = svc.TCP, svc.Web
+	}
+	return web, serviceDNSName(e.service, dnsName), func() {
+		svc := sc.Services[e.service]
+		if len(web.TCP) == 0 && len(web.Web) == 0 && (svc == nil || !svc.Tun) {
+			delete(sc.Services, e.service)
+			if len(sc.Services) == 0 {
+				sc.Services = nil
+			}
+			return
+		}
+		if svc == nil {
+			svc = new(ipn.ServiceConfig)
+			mak.Set(&sc.Services, e.service, svc)
+		}
+		svc.TCP, svc.Web = web.TCP, web.Web
+	}
+}
+
+// checkVirtualHost checks that --virtual-host can be used for a srcType
+// ("http", "https", ...) serve: that it's a valid host name, other than
+// the node's own, and, for https, one the node can get a TLS certificate
+// for.
+func (e *serveEnv) checkVirtualHost(ctx context.Context, srcType string) error {
+	if err := ipn.CheckVirtualHost(e.virtualHost); err != nil {
+		return fmt.Errorf("invalid --virtual-host: %w", err)
+	}
+	if srcType != "https" && srcType != "http" {
+		return errors.New("--virtual-host is only supported for http and https")
+	}
+	if e.service != "" {
+		return errors.New("--virtual-host and --service can't be used together")
+	}
+	st, err := e.getLocalClientStatusWithoutPeers(ctx)
+	if err != nil {
+		return err
+	}
+	if e.virtualHost == strings.TrimSuffix(st.Self.DNSName, ".") {
+		return fmt.Errorf("--virtual-host %q is the node's own name; leave it out to serve for it", e.virtualHost)
+	}
+	if srcType == "https" && !slices.Contains(st.CertDomains, e.virtualHost) {
+		return fmt.Errorf("can't get a TLS certificate for --virtual-host %q; serve it over http, or use one of the node's certificate domains", e.virtualHost)
+	}
+	return nil
+}
+
+// serviceDNSName returns the MagicDNS name of the service svc (such as
+// "svc:wiki") in the tailnet of the node named selfDNSName: the service's
+// name without its "svc:" prefix, in the node's domain.
+func serviceDNSName(svc, selfDNSName string) string {
+	_, domain, _ := strings.Cut(selfDNSName, ".")
+	return strings.TrimPrefix(svc, "svc:") + "." + domain
+}
+
+// setServiceAdvertised adds the service svc to, or removes it from, the
+// services that the node advertises that it hosts, if it isn't already.
+func (e *serveEnv) setServiceAdvertised(ctx context.Context, svc string, advertise bool) error {
+	prefs, err := e.lc.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(prefs.AdvertiseServices, svc) == advertise {
+		return nil
+	}
+	services := slices.DeleteFunc(slices.Clone(prefs.AdvertiseServices), func(s string) bool { return s == svc })
+	if advertise {
+		services = append(services, svc)
+	}
+	_, err = e.lc.EditPrefs(ctx, &ipn.MaskedPrefs{
+		AdvertiseServicesSet: true,
+		Prefs: ipn.Prefs{
+			AdvertiseServices: services,
+		},
+	})
+	return err
+}
+
+// basicAuthEntries returns the ipn.HTTPHandler.BasicAuth entries for the
+// --basic-auth and --basic-auth-file flags.
+func (e *serveEnv) basicAuthEntries() ([]string, error) {
+	var entries []string
+	if e.basicAuth != "" {
+		entry, err := hashBasicAuth(e.basicAuth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --basic-auth: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if e.basicAuthFile != "" {
+		fileEntries, err := readHtpasswd(e.basicAuthFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --basic-auth-file: %w", err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	users := make(map[string]bool)
+	for _, entry := range entries {
+		user, _, _ := strings.Cut(entry, ":")
+		if users[user] {
+			return nil, fmt.Errorf("basic auth user %q is given more than once", user)
+		}
+		users[user] = true
+	}
+	return entries, nil
+}
+
+// hashBasicAuth returns the ipn.HTTPHandler.BasicAuth entry for userPass,
+// a "user:password" pair, with the password replaced by its bcrypt hash.
+func hashBasicAuth(userPass string) (string, error) {
+	user, pass, ok := strings.Cut(userPass, ":")
+	if !ok || user == "" || pass == "" {
+		return "", errors.New("want user:password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return user + ":" + string(hash), nil
+}
+
+// readHtpasswd returns the ipn.HTTPHandler.BasicAuth entries in the
+// htpasswd file name. Blank lines and # comments are ignored; the other
+// lines must all be valid entries, with bcrypt password hashes.
+func readHtpasswd(name string) ([]string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := ipn.CheckBasicAuthEntry(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, i+1, err)
+		}
+		entries = append(entries, line)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no users", name)
+	}
+	return entries, nil
+}
+
+// setDrain sets sc.Drain from the --drain flag. As tailscaled reads the
+// drain period from the new config whenever the config changes, it's set
+// (or cleared) for every change, so that it only applies to this one.
+func (e *serveEnv) setDrain(sc *ipn.ServeConfig) error {
+	if _, err := ipn.ParseDrain(e.drain); err != nil {
+		return fmt.Errorf("invalid --drain: %w", err)
+	}
+	sc.Drain = e.drain
+	return nil
+}
+
+// hasProxyBackend reports whether any web handler in sc proxies to a backend.
+func hasProxyBackend(sc *ipn.ServeConfig) bool {
+	for _, conf := range sc.Web {
+		for _, h := range conf.Handlers {
+			if h.Proxy != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setServeConfigIfChanged sets sc as the current serve config unless it's
+// identical to cur, then prints the resulting config version (see
+// ipn.ServeConfig.Hash) so that scripts can detect no-op changes.
+func (e *serveEnv) setServeConfigIfChanged(ctx context.Context, cur, sc *ipn.ServeConfig) error {
+	if reflect.DeepEqual(cur, sc) {
+		fmt.Fprintf(e.stdout(), "Serve config version: %s (unchanged)\n", cur.Hash())
+		return nil
+	}
+	if err := e.lc.SetServeConfig(ctx, sc); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout(), "Serve config version: %s\n", sc.Hash())
+	return nil
+}
+
+// parseServeConfigJSON parses a ServeConfig given to the set-raw command.
+// Unlike plain json.Unmarshal, it rejects unknown fields (such as typos of
+// real ones) and configs that fail ipn.ServeConfig.CheckValid.
+func parseServeConfigJSON(b []byte) (*ipn.ServeConfig, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	sc := new(ipn.ServeConfig)
+	if err := dec.Decode(sc); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: unexpected data after serve config")
+	}
+	if err := sc.CheckValid(); err != nil {
+		return nil, fmt.Errorf("invalid serve config: %w", err)
+	}
+	return sc, nil
+}
+
+// waitWebHandlerRemoved waits, for up to the --wait duration, until the
+// serve config that tailscaled runs, as it reports on the IPN bus, no
+// longer has web handlers at any of the mounts of hp, looked up as
+// handleWebServeRemove does.
+func (e *serveEnv) waitWebHandlerRemoved(ctx context.Context, dnsName string, hp ipn.HostPort, mounts ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, e.wait)
+	defer cancel()
+	watcher, err := e.lc.WatchIPNBus(ctx, ipn.NotifyInitialServeConfig)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("timed out after %v waiting for tailscaled to stop serving %s", e.wait, strings.Join(mounts, ", "))
+			}
+			return err
+		}
+		if n.ServeConfig == nil {
+			continue
+		}
+		sc := n.ServeConfig.AsStruct()
+		if sc == nil {
+			return nil
+		}
+		web, _, _ := e.webServeTarget(sc, dnsName)
+		if !slices.ContainsFunc(mounts, func(m string) bool { return web.WebHandlerExists(hp, m) }) {
+			return nil
+		}
+	}
+}
+
+// applyTCPHandlerFlags sets the options of the TCP port handler ph from the
+// flags that configure them, checking that ph supports them.
+func (e *serveEnv) applyTCPHandlerFlags(ph *ipn.TCPPortHandler) error {
+	if len(e.allowCIDRs) > 0 {
+		return errors.New("--allow-cidr is only supported for http and https")
+	}
+	if e.basicAuth != "" || e.basicAuthFile != "" {
+		return errors.New("--basic-auth and --basic-auth-file are only supported for http and https")
+	}
+	if e.compress {
+		return errors.New("--compress is only supported for http and https")
+	}
+	if e.webDAV || e.webDAVReadOnly {
+		return errors.New("--webdav and --webdav-read-only are only supported for http and https")
+	}
+	if e.serveDotfiles {
+		return errors.New("--serve-dotfiles is only supported for http and https")
+	}
+	ph.Label = e.label
+	if e.tlsMinVersion != "" {
+		if ph.TerminateTLS == "" {
+			return errors.New("--tls-min-version is only supported for tls-terminated-tcp")
+		}
+		if _, err := ipn.ParseTLSVersion(e.tlsMinVersion); err != nil {
+			return err
+		}
+		ph.TLSMinVersion = e.tlsMinVersion
+	}
+	if e.maxConns < 0 {
+		return fmt.Errorf("invalid --max-conns %d; must be positive", e.maxConns)
+	}
+	ph.MaxConns = e.maxConns
+	if e.backlog < 0 || e.backlog > ipn.MaxBacklog {
+		return fmt.Errorf("invalid --backlog %d; must be between 0 and %d", e.backlog, ipn.MaxBacklog)
+	}
+	ph.Backlog = e.backlog
+	if len(e.sniRoutes) > 0 {
+		if ph.TerminateTLS == "" {
+			return errors.New("--sni is only supported for tls-terminated-tcp")
+		}
+		if _, ok := e.sniRoutes[ph.TerminateTLS]; ok {
+			return fmt.Errorf("--sni %s conflicts with the default target, which serves that name", ph.TerminateTLS)
+		}
+		ph.SNIRoutes = maps.Clone(e.sniRoutes)
+	}
+	return nil
+}
+
+// runServeStats is the entry point for the "serve stats" subcommand. It
+// prints the number of requests served and bytes sent by each web handler
+// since tailscaled started.
+func (e *serveEnv) runServeStats(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	stats, err := e.lc.ServeStats(ctx)
+	if err != nil {
+		return err
+	}
+	if e.json {
+		if stats == nil {
+			stats = []ipn.ServeHandlerStats{}
+		}
+		j, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		j = append(j, '\n')
+		e.stdout().Write(j)
+		return nil
+	}
+	if len(stats) == 0 {
+		printf("No serve traffic\n")
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "HOST:PORT\tMOUNT\tREQUESTS\tBYTES SENT\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", s.HostPort, s.Mount, s.Requests, s.BytesSent)
+	}
+	return w.Flush()
+}
+
+// webHandlerTypeAndDesc returns the kind of source h serves, such as "proxy",
+// and a description of it for status output.
+func webHandlerTypeAndDesc(h *ipn.HTTPHandler) (typ, desc string) {
+	switch {
+	case h.Path != "" && h.ContentType == ipn.PACContentType:
+		typ, desc = "pac", h.Path
+	case h.Path != "":
+		typ, desc = "path", h.Path
+		if len(h.OverlayPaths) > 0 {
+			desc = strings.Join(append([]string{h.Path}, h.OverlayPaths...), string(filepath.ListSeparator))
+		}
+	case h.Archive != "":
+		typ, desc = "archive", h.Archive
+	case h.Proxy != "":
+		typ, desc = "proxy", h.Proxy
+		if ipn.IsNamedPipeProxy(h.Proxy) {
+			typ = "pipe"
+		}
+		if h.NoHTTP2 {
+			desc += " (HTTP/1.1 only)"
+		}
+		if h.ProxyHost != "" {
+			desc += " (Host: " + h.ProxyHost + ")"
+		}
+		if h.GRPCWeb {
+			desc += " (gRPC-Web)"
+		}
+		if h.BackendKeepalive != "" {
+			desc += " (keepalive " + h.BackendKeepalive + ")"
+		}
+		if h.ConnectTimeout != "" {
+			desc += " (connect timeout " + h.ConnectTimeout + ")"
+		}
+		if h.ResponseHeaderTimeout != "" {
+			desc += " (response header timeout " + h.ResponseHeaderTimeout + ")"
+		}
+		if h.RequestIDHeader != "" {
+			desc += " (request ID: " + h.RequestIDHeader + ")"
+		}
+		if h.Canary != "" {
+			desc += fmt.Sprintf(" (%d%% to canary %s)", h.CanaryPercent, h.Canary)
+		}
+	case h.Text != "":
+		typ, desc = "text", "\""+elipticallyTruncate(h.Text, 20)+"\""
+	case h.AggregateBackends:
+		typ, desc = "health", "all proxy backends"
+	case h.RedirectToHTTPS:
+		typ, desc = "redirect", "https (301)"
+	}
+	if len(h.AllowMethods) > 0 {
+		desc += " [" + strings.Join(h.AllowMethods, ",") + "]"
+	}
+	if h.RequireTag != "" {
+		desc += " (" + h.RequireTag + " only)"
+	}
+	if len(h.AllowCIDRs) > 0 {
+		desc += " (from " + cidrList(h.AllowCIDRs).String() + ")"
+	}
+	if len(h.BasicAuth) > 0 {
+		desc += " (basic auth)"
+	}
+	if h.CacheControl != "" {
+		desc += " (Cache-Control: " + h.CacheControl + ")"
+	}
+	if h.SPAFallback {
+		desc += " (SPA fallback)"
+	}
+	if h.WebDAV {
+		if h.WebDAVReadOnly {
+			desc += " (WebDAV, read-only)"
+		} else {
+			desc += " (WebDAV)"
+		}
+	}
+	if h.ServeDotfiles {
+		desc += " (dotfiles)"
+	}
+	if h.Compress {
+		desc += " (gzip)"
+	}
+	if h.LogLevel != "" && h.LogLevel != ipn.LogLevelError {
+		desc += " (log: " + h.LogLevel + ")"
+	}
+	return typ, desc + labelSuffix(h.Label)
+}
+
+// sniRoutes is a flag.Value for the repeatable --sni flag. It maps SNI
+// names to local TCP backends; see ipn.TCPPortHandler.SNIRoutes.
+type sniRoutes map[string]string
+
+func (r *sniRoutes) String() string {
+	var routes []string
+	for _, name := range slices.Sorted(maps.Keys(*r)) {
+		routes = append(routes, name+"="+(*r)[name])
+	}
+	return strings.Join(routes, ",")
+}
+
+func (r *sniRoutes) Set(s string) error {
+	name, backend, err := ipn.ParseSNIRoute(s)
+	if err != nil {
+		return err
+	}
+	host, port, _ := net.SplitHostPort(backend) // checked by ParseSNIRoute
+	switch host {
+	case "localhost", "127.0.0.1":
+		backend = "127.0.0.1:" + port
+	default:
+		return fmt.Errorf("invalid backend %q for SNI name %q: host must be localhost or 127.0.0.1", backend, name)
+	}
+	if prev, ok := (*r)[name]; ok && prev != backend {
+		return fmt.Errorf("conflicting backends for SNI name %q: %s and %s", name, prev, backend)
+	}
+	mak.Set(r, name, backend)
+	return nil
+}
+
+// cidrList is a flag.Value for the repeatable --allow-cidr flag; see
+// ipn.HTTPHandler.AllowCIDRs.
+type cidrList []netip.Prefix
+
+func (l cidrList) String() string {
+	var ss []string
+	for _, p := range l {
+		ss = append(ss, p.String())
+	}
+	return strings.Join(ss, ",")
+}
+
+func (l *cidrList) Set(s string) error {
+	p, err := ipn.ParseCIDR(s)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(*l, p) {
+		*l = append(*l, p)
+	}
+	return nil
+}
+
+// runServeMaintenance turns maintenance mode on or off, leaving the rest of
+// the serve config as it is.
+//
+// Usage:
+//   - tailscale serve maintenance on
+//   - tailscale serve maintenance --page /srv/maintenance.html on
+//   - tailscale serve maintenance off
+func (e *serveEnv) runServeMaintenance(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	page := e.maintenancePage
+	switch args[0] {
+	case "on":
+	case "off":
+		if page != "" {
+			return errors.New("--page can only be used with on")
+		}
+	default:
+		return flag.ErrHelp
+	}
+	if page != "" {
+		if !filepath.IsAbs(page) {
+			fmt.Fprintf(Stderr, "error: maintenance page path must be absolute\n\n")
+			return errHelp
+		}
+		page = filepath.Clean(page)
+		fi, err := os.Stat(page)
+		if err != nil {
+			fmt.Fprintf(Stderr, "error: invalid maintenance page: %v\n\n", err)
+			return errHelp
+		}
+		if !fi.Mode().IsRegular() {
+			fmt.Fprintf(Stderr, "error: invalid maintenance page: %s is not a regular file\n\n", page)
+			return errHelp
+		}
+	}
+	sc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+	sc.MaintenanceMode = args[0] == "on"
+	sc.MaintenancePage = page
+	return e.lc.SetServeConfig(ctx, sc)
+}
+
+// watchFilePollInterval is how often "serve watch-file" reads the file. A
+// change is applied once the file reads the same twice in a row.
+var watchFilePollInterval = time.Second
+
+// runServeWatchFile implements "serve watch-file". It polls the file rather
+// than using file system notifications, so that it sees changes made by
+// renaming a new file into place, as editors and config management tools
+// do, the same way on every platform.
+func (e *serveEnv) runServeWatchFile(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	path := args[0]
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancel()
+
+	applied, err := os.ReadFile(path) // contents last applied or rejected
+	if err != nil {
+		return err
+	}
+	sc, err := parseServeConfigJSON(applied)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := e.lc.SetServeConfig(ctx, sc); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout(), "Applied serve config from %s (version %s)\n", path, sc.Hash())
+
+	// lastWarning is the last problem reported, so that one that persists
+	// across polls, such as a missing file, is only reported once.
+	var lastWarning string
+	warnf := func(format string, args ...any) {
+		if msg := fmt.Sprintf(format, args...); msg != lastWarning {
+			fmt.Fprintln(e.stderr(), msg)
+			lastWarning = msg
+		}
+	}
+
+	ticker := time.NewTicker(watchFilePollInterval)
+	defer ticker.Stop()
+	prev := applied // contents at the previous poll
+	for {
+		select {
+		case <-ctx.Done():
+			// Interrupted; not an error.
+			return nil
+		case <-ticker.C:
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			warnf("error reading %s: %v", path, err)
+			prev = nil
+			continue
+		}
+		if !bytes.Equal(b, prev) || bytes.Equal(b, applied) {
+			// Still changing, or nothing new to apply.
+			prev = b
+			continue
+		}
+		sc, err := parseServeConfigJSON(b)
+		if err != nil {
+			warnf("ignoring %s, keeping the running serve config: %v", path, err)
+			applied = b
+			continue
+		}
+		if err := e.lc.SetServeConfig(ctx, sc); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Try again at the next poll.
+			warnf("error applying %s: %v", path, err)
+			continue
+		}
+		fmt.Fprintf(e.stdout(), "Applied serve config from %s (version %s)\n", path, sc.Hash())
+		applied, lastWarning = b, ""
+	}
+}
+
+// runServeValidate implements "serve validate". It never uses e.lc.
+func (e *serveEnv) runServeValidate(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	path := args[0]
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sc, err := parseServeConfigJSON(b)
+	if err == nil {
+		err = checkServeConfigFunnelPorts(sc)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fmt.Fprintf(e.stdout(), "%s: valid serve config\n", path)
+	return nil
+}
+
+// checkServeConfigFunnelPorts checks that each port that sc allows Funnel
+// on is served by sc, or by one of its services, and not as plain HTTP,
+// which Funnel doesn't carry. sc must have passed CheckValid.
+func checkServeConfigFunnelPorts(sc *ipn.ServeConfig) error {
+	if sc == nil {
+		return nil
+	}
+	served := func(port uint16) *ipn.TCPPortHandler {
+		if h := sc.TCP[port]; h != nil {
+			return h
+		}
+		for _, name := range slices.Sorted(maps.Keys(sc.Services)) {
+			if h := sc.Services[name].TCP[port]; h != nil {
+				return h
+			}
+		}
+		return nil
+	}
+	for _, hp := range slices.Sorted(maps.Keys(sc.AllowFunnel)) {
+		if !sc.AllowFunnel[hp] {
+			continue
+		}
+		_, portStr, _ := net.SplitHostPort(string(hp))
+		port, err := parseServePort(portStr)
+		if err != nil {
+			return fmt.Errorf("AllowFunnel[%q]: %w", hp, err)
+		}
+		switch h := served(port); {
+		case h == nil:
+			return fmt.Errorf("AllowFunnel[%q]: port %d is not served", hp, port)
+		case h.HTTP:
+			return fmt.Errorf("AllowFunnel[%q]: port %d is served as plain HTTP, which Funnel doesn't carry", hp, port)
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(sc.Foreground)) {
+		if err := checkServeConfigFunnelPorts(sc.Foreground[id]); err != nil {
+			return fmt.Errorf("Foreground[%q].%w", id, err)
+		}
+	}
+	return nil
+}
+
+// serveEditEntry is one of the handlers listed by "serve edit".
+type serveEditEntry struct {
+	hp    ipn.HostPort
+	port  uint16
+	mount string // empty for a TCP forwarder
+}
+
+// serveEditEntries returns the node's web handlers and TCP forwarders in sc,
+// in the order "serve edit" numbers them.
+func serveEditEntries(sc *ipn.ServeConfig, dnsName string) []serveEditEntry {
+	if sc == nil {
+		return nil
+	}
+	var entries []serveEditEntry
+	for _, hp := range slices.Sorted(maps.Keys(sc.Web)) {
+		_, portStr, _ := net.SplitHostPort(string(hp))
+		port, err := parseServePort(portStr)
+		if err != nil {
+			continue
+		}
+		for _, mount := range slices.Sorted(maps.Keys(sc.Web[hp].Handlers)) {
+			entries = append(entries, serveEditEntry{hp: hp, port: port, mount: mount})
+		}
+	}
+	for _, port := range slices.Sorted(maps.Keys(sc.TCP)) {
+		if sc.TCP[port].TCPForward == "" {
+			continue
+		}
+		hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(port))))
+		entries = append(entries, serveEditEntry{hp: hp, port: port})
+	}
+	return entries
+}
+
+// printServeEditMenu prints entries, numbered from 1, with what each
+// handler serves and whether Funnel is on for it.
+func (e *serveEnv) printServeEditMenu(sc *ipn.ServeConfig, entries []serveEditEntry) {
+	w := tabwriter.NewWriter(e.stdout(), 0, 0, 2, ' ', 0)
+	for i, ent := range entries {
+		fStatus := "tailnet only"
+		if sc.AllowFunnel[ent.hp] {
+			fStatus = "Funnel on"
+		}
+		if ent.mount == "" {
+			h := sc.TCP[ent.port]
+			fmt.Fprintf(w, "%d\ttcp://%s\ttcp\t%s%s\t(%s)\n", i+1, ent.hp, h.TCPForward, labelSuffix(h.Label), fStatus)
+			continue
+		}
+		t, d := webHandlerTypeAndDesc(sc.Web[ent.hp].Handlers[ent.mount])
+		fmt.Fprintf(w, "%d\t%s%s\t%s\t%s\t(%s)\n", i+1, ent.hp, ent.mount, t, d, fStatus)
+	}
+	w.Flush()
+}
+
+// runServeEdit is the entry point for the "serve edit" subcommand. It lists
+// the node's handlers with numbers, then reads commands from stdin to
+// delete a handler ("d N") or toggle Funnel for its port ("f N") until
+// "q" or EOF. Each change is applied with its own SetServeConfig call.
+//
+// Usage:
+//   - tailscale serve edit --interactive
+func (e *serveEnv) runServeEdit(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	if !e.interactive {
+		return errors.New("serve edit reads commands from stdin; run it with --interactive")
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	in := bufio.NewScanner(e.stdin())
+	for {
+		sc, err := e.lc.GetServeConfig(ctx)
+		if err != nil {
+			return err
+		}
+		entries := serveEditEntries(sc, dnsName)
+		if len(entries) == 0 {
+			fmt.Fprintln(e.stdout(), "No serve config")
+			return nil
+		}
+		e.printServeEditMenu(sc, entries)
+		fmt.Fprint(e.stdout(), "Command (d N: delete, f N: toggle Funnel, q: quit): ")
+		if !in.Scan() {
+			fmt.Fprintln(e.stdout())
+			return in.Err()
+		}
+		cmd, numStr, _ := strings.Cut(strings.TrimSpace(in.Text()), " ")
+		if cmd == "q" {
+			return nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(numStr))
+		if err != nil || n < 1 || n > len(entries) {
+			fmt.Fprintf(e.stderr(), "invalid handler number %q\n", numStr)
+			continue
+		}
+		ent := entries[n-1]
+		host, _, _ := net.SplitHostPort(string(ent.hp))
+		switch cmd {
+		case "d":
+			if ent.mount == "" {
+				sc.RemoveTCPForwarding(ent.port)
+				sc.SetFunnel(host, ent.port, false)
+			} else {
+				sc.RemoveWebHandler(host, ent.port, []string{ent.mount}, true)
+			}
+		case "f":
+			on := !sc.AllowFunnel[ent.hp]
+			if on {
+				if err := e.verifyFunnelEnabled(ctx, ent.port); err != nil {
+					fmt.Fprintf(e.stderr(), "error: %v\n", err)
+					continue
+				}
+				if err := checkFunnelWebDAV(sc, ent.hp); err != nil {
+					fmt.Fprintf(e.stderr(), "error: %v\n", err)
+					continue
+				}
+			}
+			sc.SetFunnel(host, ent.port, on)
+		default:
+			fmt.Fprintf(e.stderr(), "unknown command %q\n", cmd)
+			continue
+		}
+		if err := e.lc.SetServeConfig(ctx, sc); err != nil {
+			if tailscale.IsPreconditionsFailedError(err) {
+				fmt.Fprintln(e.stderr(), "Another client is changing the serve config; please try again.")
+			}
+			return err
+		}
+	}
+}
@@ -8,17 +8,24 @@
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/crypto/bcrypt"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tstest"
+	"tailscale.com/types/ptr"
 )
 
 func TestServeDevConfigMutations(t *testing.T) {
@@ -49,6 +56,11 @@ type group struct {
 		t.Fatal(err)
 	}
 	writeFile("subdir/file-a", "this is subdir")
+	if err := os.MkdirAll(filepath.Join(td, "override"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("docs.tar", "") // an empty tar file
+	writeFile("proxy.pac", `function FindProxyForURL(url, host) { return "DIRECT"; }`)
 
 	groups := [...]group{
 		{
@@ -811,155 +823,1029 @@ type group struct {
 				},
 			},
 		},
-	}
-
-	for _, group := range groups {
-		t.Run(group.name, func(t *testing.T) {
-			lc := &fakeLocalServeClient{}
-			for i, st := range group.steps {
-				var stderr bytes.Buffer
-				var stdout bytes.Buffer
-				var flagOut bytes.Buffer
-				e := &serveEnv{
-					lc:          lc,
-					testFlagOut: &flagOut,
-					testStdout:  &stdout,
-					testStderr:  &stderr,
-				}
-				lastCount := lc.setCount
-				var cmd *ffcli.Command
-				var args []string
-
-				mode := serve
-				if st.command[0] == "funnel" {
-					mode = funnel
-				}
-				cmd = newServeV2Command(e, mode)
-				args = st.command[1:]
-
-				err := cmd.ParseAndRun(context.Background(), args)
-				if flagOut.Len() > 0 {
-					t.Logf("flag package output: %q", flagOut.Bytes())
-				}
-				if err != nil {
-					if st.wantErr == nil {
-						t.Fatalf("step #%d: unexpected error: %v", i, err)
-					}
-					if bad := st.wantErr(err); bad != "" {
-						t.Fatalf("step #%d: unexpected error: %v", i, bad)
-					}
-					continue
-				}
-				if st.wantErr != nil {
-					t.Fatalf("step #%d: got success (saved=%v), but wanted an error", i, lc.config != nil)
-				}
-				var got *ipn.ServeConfig = nil
-				if lc.setCount > lastCount {
-					got = lc.config
-				}
-				if !reflect.DeepEqual(got, st.want) {
-					gotbts, _ := json.MarshalIndent(got, "", "\t")
-					wantbts, _ := json.MarshalIndent(st.want, "", "\t")
-					t.Fatalf("step: %d, cmd: %v, diff:\n%s", i, st.command, cmp.Diff(string(gotbts), string(wantbts)))
-
-				}
-			}
-		})
-
-	}
-}
-
-func TestValidateConfig(t *testing.T) {
-	tests := [...]struct {
-		name      string
-		desc      string
-		cfg       *ipn.ServeConfig
-		servePort uint16
-		serveType serveType
-		bg        bool
-		wantErr   bool
-	}{
 		{
-			name:      "nil_config",
-			desc:      "when config is nil, all requests valid",
-			cfg:       nil,
-			servePort: 3000,
-			serveType: serveTypeHTTPS,
+			name: "wildcard_mount",
+			steps: []step{
+				{
+					command: cmd("serve --bg --set-path=* localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/*": {Proxy: "http://localhost:3000"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/static/ localhost:3001"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/*":       {Proxy: "http://localhost:3000"},
+								"/static/": {Proxy: "http://localhost:3001"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/static/* localhost:3002"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/* off"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/static/": {Proxy: "http://localhost:3001"},
+							}},
+						},
+					},
+				},
+			},
 		},
 		{
-			name: "new_bg_tcp",
-			desc: "no error when config exists but we're adding a new bg tcp port",
-			cfg: &ipn.ServeConfig{
-				TCP: map[uint16]*ipn.TCPPortHandler{
-					443: {HTTPS: true},
+			name: "replace",
+			steps: []step{
+				{
+					command: cmd("serve --bg --set-path=/foo localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/foo": {Proxy: "http://localhost:3000"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/bar localhost:3001"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/foo": {Proxy: "http://localhost:3000"},
+								"/bar": {Proxy: "http://localhost:3001"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --replace localhost:3002"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3002"},
+							}},
+						},
+					},
 				},
 			},
-			bg:        true,
-			servePort: 10000,
-			serveType: serveTypeHTTPS,
 		},
 		{
-			name: "override_bg_tcp",
-			desc: "no error when overwriting previous port under the same serve type",
-			cfg: &ipn.ServeConfig{
-				TCP: map[uint16]*ipn.TCPPortHandler{
-					443: {TCPForward: "http://localhost:4545"},
+			name: "no_http2",
+			steps: []step{
+				{
+					command: cmd("serve --bg --no-http2 localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000", NoHTTP2: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --no-http2 --set-path=/motd text:hello"),
+					wantErr: anyErr(),
 				},
 			},
-			bg:        true,
-			servePort: 443,
-			serveType: serveTypeTCP,
 		},
 		{
-			name: "override_bg_tcp",
-			desc: "error when overwriting previous port under a different serve type",
-			cfg: &ipn.ServeConfig{
-				TCP: map[uint16]*ipn.TCPPortHandler{
-					443: {HTTPS: true},
+			name: "allow_methods",
+			steps: []step{
+				{
+					command: cmd("serve --bg --allow-methods=get,HEAD localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000", AllowMethods: []string{"GET", "HEAD"}},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --allow-methods=GET,NOPE localhost:3000"),
+					wantErr: anyErr(),
 				},
 			},
-			bg:        true,
-			servePort: 443,
-			serveType: serveTypeHTTP,
-			wantErr:   true,
 		},
 		{
-			name: "new_fg_port",
-			desc: "no error when serving a new foreground port",
-			cfg: &ipn.ServeConfig{
-				TCP: map[uint16]*ipn.TCPPortHandler{
-					443: {HTTPS: true},
+			name: "aggregate_backends",
+			steps: []step{
+				{
+					command: cmd("serve --bg --aggregate-backends --set-path=/healthz"),
+					wantErr: anyErr(), // no proxy backend yet
 				},
-				Foreground: map[string]*ipn.ServeConfig{
-					"abc123": {
-						TCP: map[uint16]*ipn.TCPPortHandler{
-							3000: {HTTPS: true},
+				{
+					command: cmd("serve --bg localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --aggregate-backends --set-path=/healthz localhost:3001"),
+					wantErr: anyErr(), // takes no target
+				},
+				{
+					command: cmd("serve --bg --aggregate-backends --set-path=/healthz"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/":        {Proxy: "http://localhost:3000"},
+								"/healthz": {AggregateBackends: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/healthz off"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000"},
+							}},
 						},
 					},
 				},
 			},
-			servePort: 4040,
-			serveType: serveTypeTCP,
 		},
 		{
-			name: "same_fg_port",
-			desc: "error when overwriting a previous fg port",
-			cfg: &ipn.ServeConfig{
-				Foreground: map[string]*ipn.ServeConfig{
-					"abc123": {
+			name: "label",
+			steps: []step{
+				{
+					command: cmd("serve --bg --label=dashboard --set-path=/grafana localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/grafana": {Proxy: "http://localhost:3000", Label: "dashboard"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --label=ssh --tcp=2222 tcp://localhost:22"),
+					want: &ipn.ServeConfig{
 						TCP: map[uint16]*ipn.TCPPortHandler{
-							3000: {HTTPS: true},
+							443:  {HTTPS: true},
+							2222: {TCPForward: "localhost:22", Label: "ssh"},
+						},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/grafana": {Proxy: "http://localhost:3000", Label: "dashboard"},
+							}},
 						},
 					},
 				},
 			},
-			servePort: 3000,
-			serveType: serveTypeTCP,
-			wantErr:   true,
 		},
-	}
-
-	for _, tc := range tests {
+		{
+			name: "require_tag",
+			steps: []step{
+				{
+					command: cmd("serve --bg --require-tag=tag:admin --set-path=/admin localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/admin": {Proxy: "http://localhost:3000", RequireTag: "tag:admin"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --require-tag=admin --set-path=/admin localhost:3000"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "cache_control",
+			steps: []step{
+				{
+					command: cmd("serve --bg --cache-control=max-age=3600 --set-path=/static " + filepath.Join(td, "subdir")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/static/": {Path: filepath.Join(td, "subdir"), CacheControl: "max-age=3600"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --cache-control=max-age=3600 localhost:3000"),
+					wantErr: anyErr(), // only for paths
+				},
+			},
+		},
+		{
+			name: "redirect_to_https",
+			steps: []step{
+				{
+					command: cmd("serve --bg --http=80 redirect-to-https"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {RedirectToHTTPS: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --https=8443 redirect-to-https"),
+					wantErr: anyErr(), // only for http
+				},
+			},
+		},
+		{
+			name: "sni_routes",
+			steps: []step{
+				{
+					command: cmd("serve --bg --sni=svc.example.ts.net=localhost:8080 --tls-terminated-tcp=443 tcp://localhost:80"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							443: {
+								TCPForward:   "localhost:80",
+								TerminateTLS: "foo.test.ts.net",
+								SNIRoutes:    map[string]string{"svc.example.ts.net": "127.0.0.1:8080"},
+							},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --sni=svc.example.ts.net=localhost:8080 --tcp=2222 tcp://localhost:22"),
+					wantErr: anyErr(), // only for tls-terminated-tcp
+				},
+				{
+					command: cmd("serve --bg --sni=foo.test.ts.net=localhost:8080 --tls-terminated-tcp=443 tcp://localhost:80"),
+					wantErr: anyErr(), // conflicts with the default target
+				},
+			},
+		},
+		{
+			name: "proxy_host",
+			steps: []step{
+				{
+					command: cmd("serve --bg --proxy-host=backend.internal localhost:8080"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:8080", ProxyHost: "backend.internal"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --proxy-host=backend.internal --set-path=/motd text:hello"),
+					wantErr: anyErr(), // only for proxies
+				},
+			},
+		},
+		{
+			name: "tls_min_version",
+			steps: []step{
+				{
+					command: cmd("serve --bg --tls-min-version=1.3 localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true, TLSMinVersion: "1.3"}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/api localhost:3001"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true, TLSMinVersion: "1.3"}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/":    {Proxy: "http://localhost:3000"},
+								"/api": {Proxy: "http://localhost:3001"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --tls-min-version=1.3 --http=80 localhost:3000"),
+					wantErr: anyErr(), // only for https
+				},
+				{
+					command: cmd("serve --bg --tls-min-version=1.2 --tls-terminated-tcp=8443 tcp://localhost:80"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							443:  {HTTPS: true, TLSMinVersion: "1.3"},
+							8443: {TCPForward: "localhost:80", TerminateTLS: "foo.test.ts.net", TLSMinVersion: "1.2"},
+						},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/":    {Proxy: "http://localhost:3000"},
+								"/api": {Proxy: "http://localhost:3001"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --tls-min-version=1.2 --tcp=2222 tcp://localhost:22"),
+					wantErr: anyErr(), // only for tls-terminated-tcp
+				},
+			},
+		},
+		{
+			name: "grpc_web",
+			steps: []step{
+				{
+					command: cmd("serve --bg --grpc-web localhost:50051"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:50051", GRPCWeb: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --grpc-web --no-http2 localhost:50051"),
+					wantErr: anyErr(), // gRPC requires HTTP/2
+				},
+			},
+		},
+		{
+			name: "archive",
+			steps: []step{
+				{
+					command: cmd("serve --bg --set-path=/docs archive:" + filepath.Join(td, "docs.tar")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/docs/": {Archive: filepath.Join(td, "docs.tar")},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/docs archive:" + filepath.Join(td, "foo")),
+					wantErr: anyErr(), // not a .zip or .tar file
+				},
+			},
+		},
+		{
+			name: "drain",
+			steps: []step{
+				{
+					command: cmd("serve --bg --drain=30s localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000"},
+							}},
+						},
+						Drain: "30s",
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/api localhost:3001"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/":    {Proxy: "http://localhost:3000"},
+								"/api": {Proxy: "http://localhost:3001"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --drain=10s --set-path=/api off"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000"},
+							}},
+						},
+						Drain: "10s",
+					},
+				},
+				{
+					command: cmd("serve --bg --drain=soon localhost:3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --drain=30s --tcp=2222 tcp://localhost:22"),
+					wantErr: anyErr(), // only for http and https
+				},
+			},
+		},
+		{
+			name: "pac",
+			steps: []step{
+				{
+					command: cmd("serve --bg --set-path=/proxy.pac pac:" + filepath.Join(td, "proxy.pac")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/proxy.pac": {Path: filepath.Join(td, "proxy.pac"), ContentType: ipn.PACContentType},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/proxy.pac pac:" + filepath.Join(td, "subdir")),
+					wantErr: anyErr(), // not a regular file
+				},
+			},
+		},
+		{
+			name: "allow_cidr",
+			steps: []step{
+				{
+					command: cmd("serve --bg --allow-cidr=192.168.10.0/24 --allow-cidr=100.64.0.0/10 localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000", AllowCIDRs: []netip.Prefix{
+									netip.MustParsePrefix("192.168.10.0/24"),
+									netip.MustParsePrefix("100.64.0.0/10"),
+								}},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --allow-cidr=192.168.10.0/24 --tcp=2222 tcp://localhost:22"),
+					wantErr: anyErr(), // only for http and https
+				},
+			},
+		},
+		{
+			name: "log_level",
+			steps: []step{
+				{
+					command: cmd("serve --bg --log-level=debug --set-path=/api localhost:8080"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/api": {Proxy: "http://localhost:8080", LogLevel: "debug"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --log-level=verbose --set-path=/api localhost:8080"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "service",
+			steps: []step{
+				{
+					command: cmd("serve --bg --service=svc:wiki localhost:3000"),
+					want: &ipn.ServeConfig{
+						Services: map[string]*ipn.ServiceConfig{
+							"svc:wiki": {
+								TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+								Web: map[ipn.HostPort]*ipn.WebServerConfig{
+									"wiki.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+										"/": {Proxy: "http://localhost:3000"},
+									}},
+								},
+							},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg localhost:4000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:4000"},
+							}},
+						},
+						Services: map[string]*ipn.ServiceConfig{
+							"svc:wiki": {
+								TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+								Web: map[ipn.HostPort]*ipn.WebServerConfig{
+									"wiki.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+										"/": {Proxy: "http://localhost:3000"},
+									}},
+								},
+							},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --service=svc:wiki off"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:4000"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --service=wiki localhost:3000"),
+					wantErr: anyErr(), // not a service name
+				},
+				{
+					command: cmd("serve --bg --service=svc:wiki --tcp=2222 tcp://localhost:22"),
+					wantErr: anyErr(), // only for http and https
+				},
+				{
+					command: cmd("serve --service=svc:wiki localhost:3000"),
+					wantErr: anyErr(), // not in the foreground
+				},
+				{
+					command: cmd("funnel --bg --service=svc:wiki localhost:3000"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "if_not_exists",
+			steps: []step{
+				{
+					command: cmd("serve --bg --if-not-exists localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --if-not-exists localhost:3001"),
+					want:    nil, // left as is
+				},
+				{
+					command: cmd("serve --bg --if-not-exists --replace localhost:3001"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "max_conns",
+			steps: []step{
+				{
+					command: cmd("serve --bg --max-conns=16 --tcp=25565 tcp://localhost:25565"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{25565: {TCPForward: "localhost:25565", MaxConns: 16}},
+					},
+				},
+				{
+					command: cmd("serve --bg --max-conns=-1 --tcp=25565 tcp://localhost:25565"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --max-conns=16 localhost:3000"),
+					wantErr: anyErr(), // only for tcp and tls-terminated-tcp
+				},
+			},
+		},
+		{
+			name: "backend_keepalive",
+			steps: []step{
+				{
+					command: cmd("serve --bg --backend-keepalive=30s localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000", BackendKeepalive: "30s"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --backend-keepalive=soon localhost:3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --backend-keepalive=30s text:hi"),
+					wantErr: anyErr(), // only for proxy targets
+				},
+			},
+		},
+		{
+			name: "spa_fallback",
+			steps: []step{
+				{
+					command: cmd("serve --bg --spa-fallback " + filepath.Join(td, "subdir")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Path: filepath.Join(td, "subdir/"), SPAFallback: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --spa-fallback " + filepath.Join(td, "foo")),
+					wantErr: anyErr(), // not a directory
+				},
+				{
+					command: cmd("serve --bg --spa-fallback localhost:3000"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "request_id_header",
+			steps: []step{
+				{
+					command: cmd("serve --bg --request-id-header=X-Request-Id localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000", RequestIDHeader: "X-Request-Id"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --request-id-header=X-Request:Id localhost:3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --request-id-header=X-Request-Id text:hi"),
+					wantErr: anyErr(), // only for proxy targets
+				},
+			},
+		},
+		{
+			name: "merged_dirs",
+			steps: []step{
+				{
+					command: cmd("serve --bg --set-path=/site " + filepath.Join(td, "subdir") + string(filepath.ListSeparator) + filepath.Join(td, "override")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/site/": {Path: filepath.Join(td, "subdir"), OverlayPaths: []string{filepath.Join(td, "override")}},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg " + filepath.Join(td, "subdir") + string(filepath.ListSeparator) + filepath.Join(td, "foo")),
+					wantErr: anyErr(), // only directories can be merged
+				},
+			},
+		},
+		{
+			name: "compress",
+			steps: []step{
+				{
+					command: cmd("serve --bg --compress localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000", Compress: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --compress --set-path=/motd text:hi"),
+					wantErr: anyErr(), // only for path, archive and proxy sources
+				},
+				{
+					command: cmd("serve --bg --compress --tcp=2222 tcp://localhost:22"),
+					wantErr: anyErr(), // only for http and https
+				},
+			},
+		},
+		{
+			name: "canary",
+			steps: []step{
+				{
+					command: cmd("serve --bg --canary=http://127.0.0.1:3001=10% localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000", Canary: "http://127.0.0.1:3001", CanaryPercent: 10},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --canary=http://127.0.0.1:3001=110% localhost:3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --canary=http://127.0.0.1:3001=10% text:hi"),
+					wantErr: anyErr(), // only for proxy targets
+				},
+			},
+		},
+		{
+			name: "backlog",
+			steps: []step{
+				{
+					command: cmd("serve --bg --backlog=4096 --tcp=5432 tcp://localhost:5432"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{5432: {TCPForward: "localhost:5432", Backlog: 4096}},
+					},
+				},
+				{
+					command: cmd("serve --bg --backlog=-1 --tcp=5432 tcp://localhost:5432"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --backlog=4096 localhost:3000"),
+					wantErr: anyErr(), // only for tcp and tls-terminated-tcp
+				},
+			},
+		},
+		{
+			name: "webdav",
+			steps: []step{
+				{
+					command: cmd("serve --bg --webdav --webdav-read-only --set-path=/files " + filepath.Join(td, "subdir")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/files/": {Path: filepath.Join(td, "subdir"), WebDAV: true, WebDAVReadOnly: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --webdav-read-only " + filepath.Join(td, "subdir")),
+					wantErr: anyErr(), // needs --webdav
+				},
+				{
+					command: cmd("serve --bg --webdav " + filepath.Join(td, "foo")),
+					wantErr: anyErr(), // not a directory
+				},
+				{
+					command: cmd("serve --bg --webdav --tcp=2222 tcp://localhost:22"),
+					wantErr: anyErr(), // only for http and https
+				},
+				{
+					command: cmd("funnel --bg --webdav " + filepath.Join(td, "subdir")),
+					wantErr: anyErr(), // writable over Funnel
+				},
+				{
+					command: cmd("funnel --bg --webdav --webdav-read-only " + filepath.Join(td, "subdir")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/files/": {Path: filepath.Join(td, "subdir"), WebDAV: true, WebDAVReadOnly: true},
+								"/":       {Path: filepath.Join(td, "subdir"), WebDAV: true, WebDAVReadOnly: true},
+							}},
+						},
+						AllowFunnel: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+					},
+				},
+			},
+		},
+		{
+			name: "serve_dotfiles",
+			steps: []step{
+				{
+					command: cmd("serve --bg --serve-dotfiles " + filepath.Join(td, "subdir")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Path: filepath.Join(td, "subdir"), ServeDotfiles: true},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --serve-dotfiles --webdav " + filepath.Join(td, "subdir")),
+					wantErr: anyErr(), // WebDAV serves every file
+				},
+				{
+					command: cmd("serve --bg --serve-dotfiles localhost:3000"),
+					wantErr: anyErr(), // only for directory paths
+				},
+				{
+					command: cmd("serve --bg --serve-dotfiles --tcp=2222 tcp://localhost:22"),
+					wantErr: anyErr(), // only for http and https
+				},
+			},
+		},
+		{
+			name: "proxy_timeouts",
+			steps: []step{
+				{
+					command: cmd("serve --bg --connect-timeout=5s --response-header-timeout=30s localhost:3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {Proxy: "http://localhost:3000", ConnectTimeout: "5s", ResponseHeaderTimeout: "30s"},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --connect-timeout=soon localhost:3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --response-header-timeout=30s text:hi"),
+					wantErr: anyErr(), // only for proxy targets
+				},
+			},
+		},
+	}
+
+	for _, group := range groups {
+		t.Run(group.name, func(t *testing.T) {
+			lc := &fakeLocalServeClient{}
+			for i, st := range group.steps {
+				var stderr bytes.Buffer
+				var stdout bytes.Buffer
+				var flagOut bytes.Buffer
+				e := &serveEnv{
+					lc:          lc,
+					testFlagOut: &flagOut,
+					testStdout:  &stdout,
+					testStderr:  &stderr,
+				}
+				lastCount := lc.setCount
+				var cmd *ffcli.Command
+				var args []string
+
+				mode := serve
+				if st.command[0] == "funnel" {
+					mode = funnel
+				}
+				cmd = newServeV2Command(e, mode)
+				args = st.command[1:]
+
+				err := cmd.ParseAndRun(context.Background(), args)
+				if flagOut.Len() > 0 {
+					t.Logf("flag package output: %q", flagOut.Bytes())
+				}
+				if err != nil {
+					if st.wantErr == nil {
+						t.Fatalf("step #%d: unexpected error: %v", i, err)
+					}
+					if bad := st.wantErr(err); bad != "" {
+						t.Fatalf("step #%d: unexpected error: %v", i, bad)
+					}
+					continue
+				}
+				if st.wantErr != nil {
+					t.Fatalf("step #%d: got success (saved=%v), but wanted an error", i, lc.config != nil)
+				}
+				var got *ipn.ServeConfig = nil
+				if lc.setCount > lastCount {
+					got = lc.config
+				}
+				if !reflect.DeepEqual(got, st.want) {
+					gotbts, _ := json.MarshalIndent(got, "", "\t")
+					wantbts, _ := json.MarshalIndent(st.want, "", "\t")
+					t.Fatalf("step: %d, cmd: %v, diff:\n%s", i, st.command, cmp.Diff(string(gotbts), string(wantbts)))
+
+				}
+			}
+		})
+
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := [...]struct {
+		name      string
+		desc      string
+		cfg       *ipn.ServeConfig
+		servePort uint16
+		serveType serveType
+		bg        bool
+		wantErr   bool
+	}{
+		{
+			name:      "nil_config",
+			desc:      "when config is nil, all requests valid",
+			cfg:       nil,
+			servePort: 3000,
+			serveType: serveTypeHTTPS,
+		},
+		{
+			name: "new_bg_tcp",
+			desc: "no error when config exists but we're adding a new bg tcp port",
+			cfg: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{
+					443: {HTTPS: true},
+				},
+			},
+			bg:        true,
+			servePort: 10000,
+			serveType: serveTypeHTTPS,
+		},
+		{
+			name: "override_bg_tcp",
+			desc: "no error when overwriting previous port under the same serve type",
+			cfg: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{
+					443: {TCPForward: "http://localhost:4545"},
+				},
+			},
+			bg:        true,
+			servePort: 443,
+			serveType: serveTypeTCP,
+		},
+		{
+			name: "override_bg_tcp",
+			desc: "error when overwriting previous port under a different serve type",
+			cfg: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{
+					443: {HTTPS: true},
+				},
+			},
+			bg:        true,
+			servePort: 443,
+			serveType: serveTypeHTTP,
+			wantErr:   true,
+		},
+		{
+			name: "new_fg_port",
+			desc: "no error when serving a new foreground port",
+			cfg: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{
+					443: {HTTPS: true},
+				},
+				Foreground: map[string]*ipn.ServeConfig{
+					"abc123": {
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							3000: {HTTPS: true},
+						},
+					},
+				},
+			},
+			servePort: 4040,
+			serveType: serveTypeTCP,
+		},
+		{
+			name: "same_fg_port",
+			desc: "error when overwriting a previous fg port",
+			cfg: &ipn.ServeConfig{
+				Foreground: map[string]*ipn.ServeConfig{
+					"abc123": {
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							3000: {HTTPS: true},
+						},
+					},
+				},
+			},
+			servePort: 3000,
+			serveType: serveTypeTCP,
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			se := serveEnv{bg: tc.bg}
 			err := se.validateConfig(tc.cfg, tc.servePort, tc.serveType)
@@ -1052,6 +1938,10 @@ func TestCleanURLPath(t *testing.T) {
 		{input: "/foo", expected: "/foo"},
 		{input: "/foo/", expected: "/foo/"},
 		{input: "/../bar", wantErr: true},
+		{input: "*", expected: "/*"},
+		{input: "/*", expected: "/*"},
+		{input: "/foo/*", wantErr: true},
+		{input: "/*/", wantErr: true},
 	}
 
 	for _, tt := range tests {
@@ -1147,6 +2037,35 @@ func TestMessageForPort(t *testing.T) {
 				fmt.Sprintf(msgDisableProxy, "serve", "http", 80),
 			}, "\n"),
 		},
+		{
+			name:   "serve-health",
+			subcmd: serve,
+			serveConfig: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{
+					443: {HTTPS: true},
+				},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"foo.test.ts.net:443": {
+						Handlers: map[string]*ipn.HTTPHandler{
+							"/healthz": {AggregateBackends: true},
+						},
+					},
+				},
+			},
+			status:  &ipnstate.Status{},
+			dnsName: "foo.test.ts.net",
+			srvType: serveTypeHTTPS,
+			srvPort: 443,
+			expected: strings.Join([]string{
+				msgServeAvailable,
+				"",
+				"https://foo.test.ts.net/healthz",
+				"|-- health all proxy backends",
+				"",
+				fmt.Sprintf(msgRunningInBackground, "Serve"),
+				fmt.Sprintf(msgDisableProxy, "serve", "https", 443),
+			}, "\n"),
+		},
 	}
 
 	for _, tt := range tests {
@@ -1277,6 +2196,268 @@ func TestIsLegacyInvocation(t *testing.T) {
 	}
 }
 
+// runServeV2 runs the serve command, or the funnel command if args starts
+// with "funnel", given as args against lc, and returns its standard output.
+func runServeV2(lc *fakeLocalServeClient, args string) (string, error) {
+	var stdout bytes.Buffer
+	e := &serveEnv{
+		lc:          lc,
+		testFlagOut: io.Discard,
+		testStdout:  &stdout,
+		testStderr:  io.Discard,
+	}
+	fields := cmd(args)
+	mode := serve
+	if fields[0] == "funnel" {
+		mode = funnel
+	}
+	err := newServeV2Command(e, mode).ParseAndRun(context.Background(), fields[1:])
+	return stdout.String(), err
+}
+
+func TestServeV2ConfigVersion(t *testing.T) {
+	lc := &fakeLocalServeClient{}
+	run := func(args string) (version string, unchanged bool) {
+		t.Helper()
+		out, err := runServeV2(lc, args)
+		if err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+		line, _, _ := strings.Cut(out, "\n")
+		rest, ok := strings.CutPrefix(line, "Serve config version: ")
+		if !ok {
+			t.Fatalf("%q: unexpected output %q", args, out)
+		}
+		version, unchanged = strings.CutSuffix(rest, " (unchanged)")
+		if want := lc.config.Hash(); version != want {
+			t.Fatalf("%q: version = %q; want %q", args, version, want)
+		}
+		return version, unchanged
+	}
+
+	v1, unchanged := run("serve --bg localhost:3000")
+	if unchanged {
+		t.Errorf("first set reported unchanged")
+	}
+	v2, unchanged := run("serve --bg localhost:3000")
+	if !unchanged || v2 != v1 {
+		t.Errorf("no-op set: got version %q (unchanged=%v); want %q (unchanged=true)", v2, unchanged, v1)
+	}
+	v3, unchanged := run("serve --bg --set-path=/api localhost:3001")
+	if unchanged || v3 == v1 {
+		t.Errorf("real change: got version %q (unchanged=%v); want new version", v3, unchanged)
+	}
+	v4, unchanged := run("serve --bg --tcp=2222 tcp://localhost:22")
+	if unchanged || v4 == v3 {
+		t.Errorf("tcp change: got version %q (unchanged=%v); want new version", v4, unchanged)
+	}
+	if _, unchanged := run("serve --bg --tcp=2222 tcp://localhost:22"); !unchanged {
+		t.Errorf("no-op tcp set reported a change")
+	}
+}
+
+func TestServeV2Service(t *testing.T) {
+	lc := &fakeLocalServeClient{prefs: &ipn.Prefs{AdvertiseServices: []string{"svc:db"}}}
+	run := func(args string) string {
+		t.Helper()
+		out, err := runServeV2(lc, args)
+		if err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+		return out
+	}
+	checkAdvertised := func(want ...string) {
+		t.Helper()
+		if got := lc.prefs.AdvertiseServices; !slices.Equal(got, want) {
+			t.Errorf("AdvertiseServices = %q; want %q", got, want)
+		}
+	}
+
+	out := run("serve --bg --service=svc:wiki localhost:3000")
+	checkAdvertised("svc:db", "svc:wiki")
+	if want := "https://wiki.test.ts.net/\n|-- proxy http://localhost:3000\n"; !strings.Contains(out, want) {
+		t.Errorf("output missing %q; got:\n%s", want, out)
+	}
+	run("serve --bg --service=svc:wiki --set-path=/edit localhost:3001")
+	checkAdvertised("svc:db", "svc:wiki")
+
+	// The service stops being advertised along with its last handler.
+	run("serve --bg --service=svc:wiki --set-path=/ off")
+	checkAdvertised("svc:db", "svc:wiki")
+	run("serve --bg --service=svc:wiki --set-path=/edit off")
+	checkAdvertised("svc:db")
+}
+
+func TestServeV2BasicAuth(t *testing.T) {
+	lc := &fakeLocalServeClient{}
+	if _, err := runServeV2(lc, "serve --bg --basic-auth=alice:secret --set-path=/admin localhost:9000"); err != nil {
+		t.Fatal(err)
+	}
+	h := lc.config.Web["foo.test.ts.net:443"].Handlers["/admin"]
+	if len(h.BasicAuth) != 1 {
+		t.Fatalf("BasicAuth = %q; want one entry", h.BasicAuth)
+	}
+	user, hash, _ := strings.Cut(h.BasicAuth[0], ":")
+	if user != "alice" {
+		t.Errorf("BasicAuth user = %q; want alice", user)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")); err != nil {
+		t.Errorf("BasicAuth hash doesn't match the password: %v", err)
+	}
+
+	if _, err := runServeV2(lc, "serve --bg --basic-auth=alice:secret --tcp=2222 tcp://localhost:22"); err == nil {
+		t.Error("got no error using --basic-auth with --tcp")
+	}
+}
+
+func TestServeV2ReservedPort(t *testing.T) {
+	lc := &fakeLocalServeClient{prefs: &ipn.Prefs{RunSSH: true}}
+	_, err := runServeV2(lc, "serve --bg --tcp=22 tcp://localhost:2222")
+	if err == nil || !strings.Contains(err.Error(), "Tailscale SSH") {
+		t.Fatalf("got %v; want an error naming Tailscale SSH", err)
+	}
+	if lc.config != nil {
+		t.Fatalf("config set despite the error: %v", lc.config)
+	}
+	if _, err := runServeV2(lc, "serve --bg --force --tcp=22 tcp://localhost:2222"); err != nil {
+		t.Fatalf("with --force: %v", err)
+	}
+	if lc.config.TCP[22] == nil {
+		t.Errorf("port 22 not served with --force; config: %v", lc.config)
+	}
+	// Removing the handler doesn't need --force.
+	if _, err := runServeV2(lc, "serve --bg --tcp=22 off"); err != nil {
+		t.Fatalf("removing: %v", err)
+	}
+}
+
+func TestServeV2NamedPipe(t *testing.T) {
+	lc := &fakeLocalServeClient{}
+	_, err := runServeV2(lc, "serve --bg pipe:myapp")
+	if runtime.GOOS != "windows" {
+		if err == nil {
+			t.Fatalf("got success on %s; want an error", runtime.GOOS)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lc.config.Web["foo.test.ts.net:443"].Handlers["/"].Proxy, `\\.\pipe\myapp`; got != want {
+		t.Errorf("Proxy = %q; want %q", got, want)
+	}
+}
+
+func TestServeV2VirtualHost(t *testing.T) {
+	tstest.Replace(t, &fakeStatus.CertDomains, []string{"foo.test.ts.net", "foo.example.com"})
+
+	lc := &fakeLocalServeClient{}
+	for _, args := range []string{
+		"serve --bg localhost:3000",
+		"serve --bg --virtual-host=foo.example.com localhost:3001",
+		"serve --bg --virtual-host=wiki.example.com --http=80 localhost:3002",
+	} {
+		if _, err := runServeV2(lc, args); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+	}
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			80:  {HTTP: true},
+			443: {HTTPS: true},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://localhost:3000"},
+			}},
+			"foo.example.com:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://localhost:3001"},
+			}},
+			"wiki.example.com:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://localhost:3002"},
+			}},
+		},
+	}
+	if diff := cmp.Diff(want, lc.config); diff != "" {
+		t.Errorf("config mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := runServeV2(lc, "serve --bg --virtual-host=wiki.example.com --http=80 off"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lc.config.Web["wiki.example.com:80"]; ok {
+		t.Error("virtual host handler not removed")
+	}
+
+	for _, tt := range []struct {
+		args    string
+		wantErr string
+	}{
+		{"serve --bg --virtual-host=wiki.example.com --tcp=2222 tcp://localhost:22", "only supported for http and https"},
+		{"serve --bg --virtual-host=foo.test.ts.net --http=80 localhost:3002", "the node's own name"},
+		{"serve --bg --virtual-host=wiki.example.com localhost:3002", "can't get a TLS certificate"},
+		{"funnel --bg --virtual-host=foo.example.com localhost:3001", "can't be used with funnel"},
+	} {
+		if _, err := runServeV2(lc, tt.args); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got error %v; want one containing %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServeV2RemoveWait(t *testing.T) {
+	newConfig := func(mounts ...string) *ipn.ServeConfig {
+		sc := &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{}}},
+		}
+		for _, m := range mounts {
+			sc.Web["foo.test.ts.net:443"].Handlers[m] = &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}
+		}
+		return sc
+	}
+	run := func(notifies []ipn.Notify, args string) error {
+		lc := &fakeLocalServeClient{config: newConfig("/", "/old"), bus: fakeIPNBus(t, notifies)}
+		_, err := runServeV2(lc, args)
+		return err
+	}
+
+	// tailscaled first reports the config from before the change, then
+	// the one without the removed handlers.
+	notifies := []ipn.Notify{
+		{ServeConfig: ptr.To(newConfig("/", "/old").View())},
+		{State: ptr.To(ipn.Running)},
+		{ServeConfig: ptr.To(newConfig("/").View())},
+	}
+	if err := run(notifies, "serve --wait=10s --set-path=/old off"); err != nil {
+		t.Fatalf("one handler: got %v; want success", err)
+	}
+	notifies = []ipn.Notify{
+		{ServeConfig: ptr.To(newConfig("/", "/old").View())},
+		{ServeConfig: ptr.To((&ipn.ServeConfig{}).View())},
+	}
+	if err := run(notifies, "serve --wait=10s --yes off"); err != nil {
+		t.Fatalf("all handlers: got %v; want success", err)
+	}
+
+	notifies = []ipn.Notify{
+		{ServeConfig: ptr.To(newConfig("/", "/old").View())},
+	}
+	err := run(notifies, "serve --wait=50ms --set-path=/old off")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v; want a timeout error", err)
+	}
+
+	for _, args := range []string{
+		"serve --bg --wait=10s localhost:3000", // not removing
+		"serve --wait=10s --tcp=2222 off",      // not web
+		"serve --wait=-1s --set-path=/old off", // negative
+	} {
+		if err := run(nil, args); err == nil {
+			t.Errorf("%q: got success; want error", args)
+		}
+	}
+}
+
 // exactErrMsg returns an error checker that wants exactly the provided want error.
 // If optName is non-empty, it's used in the error message.
 func exactErrMsg(want error) func(error) string {
@@ -75,6 +75,8 @@ type EngineStatus struct {
 	NotifyInitialHealthState // if set, the first Notify message (sent immediately) will contain the current health.State of the client
 
 	NotifyRateLimit // if set, rate limit spammy netmap updates to every few seconds
+
+	NotifyInitialServeConfig // if set, the first Notify message (sent immediately) will contain the current ServeConfig
 )
 
 // Notify is a communication from a backend (e.g. tailscaled) to a frontend
@@ -147,6 +149,16 @@ type Notify struct {
 	// any changes to the user in the UI.
 	Health *health.State `json:",omitempty"`
 
+	// ServeConfig, if non-nil, is the new or current serve config. It's
+	// sent when the config changes. An empty config means nothing is
+	// being served.
+	ServeConfig *ServeConfigView `json:",omitempty"`
+
+	// CertChange, if non-nil, reports that tailscaled has just obtained a
+	// new TLS certificate for one of the node's domains, replacing any
+	// previous one, such as when renewing it before it expires.
+	CertChange *CertChange `json:",omitempty"`
+
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
@@ -186,10 +198,23 @@ func (n Notify) String() string {
 	if n.Health != nil {
 		sb.WriteString("Health{...} ")
 	}
+	if n.ServeConfig != nil {
+		sb.WriteString("ServeConfig{...} ")
+	}
+	if n.CertChange != nil {
+		fmt.Fprintf(&sb, "CertChange(%s) ", n.CertChange.Domain)
+	}
 	s := sb.String()
 	return s[0:len(s)-1] + "}"
 }
 
+// CertChange describes a TLS certificate that tailscaled has obtained,
+// as sent in Notify.CertChange.
+type CertChange struct {
+	Domain   string    // the domain the certificate is for
+	NotAfter time.Time // when the new certificate expires
+}
+
 // PartialFile represents an in-progress incoming file transfer.
 type PartialFile struct {
 	Name         string    // e.g. "foo.jpg"
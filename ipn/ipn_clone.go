@@ -131,12 +131,15 @@ func (src *ServeConfig) Clone() *ServeConfig {
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigCloneNeedsRegeneration = ServeConfig(struct {
-	TCP         map[uint16]*TCPPortHandler
-	Web         map[HostPort]*WebServerConfig
-	Services    map[string]*ServiceConfig
-	AllowFunnel map[HostPort]bool
-	Foreground  map[string]*ServeConfig
-	ETag        string
+	TCP             map[uint16]*TCPPortHandler
+	Web             map[HostPort]*WebServerConfig
+	Services        map[string]*ServiceConfig
+	AllowFunnel     map[HostPort]bool
+	Foreground      map[string]*ServeConfig
+	Drain           string
+	MaintenanceMode bool
+	MaintenancePage string
+	ETag            string
 }{})
 
 // Clone makes a deep copy of ServiceConfig.
@@ -185,15 +188,21 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	}
 	dst := new(TCPPortHandler)
 	*dst = *src
+	dst.SNIRoutes = maps.Clone(src.SNIRoutes)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerCloneNeedsRegeneration = TCPPortHandler(struct {
-	HTTPS        bool
-	HTTP         bool
-	TCPForward   string
-	TerminateTLS string
+	HTTPS         bool
+	HTTP          bool
+	TCPForward    string
+	TerminateTLS  string
+	SNIRoutes     map[string]string
+	TLSMinVersion string
+	MaxConns      int
+	Backlog       int
+	Label         string
 }{})
 
 // Clone makes a deep copy of HTTPHandler.
@@ -204,14 +213,44 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	dst.AllowMethods = append(src.AllowMethods[:0:0], src.AllowMethods...)
+	dst.AllowCIDRs = append(src.AllowCIDRs[:0:0], src.AllowCIDRs...)
+	dst.BasicAuth = append(src.BasicAuth[:0:0], src.BasicAuth...)
+	dst.OverlayPaths = append(src.OverlayPaths[:0:0], src.OverlayPaths...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Archive               string
+	AggregateBackends     bool
+	RedirectToHTTPS       bool
+	NoHTTP2               bool
+	ProxyHost             string
+	GRPCWeb               bool
+	BackendKeepalive      string
+	ConnectTimeout        string
+	ResponseHeaderTimeout string
+	RequestIDHeader       string
+	Canary                string
+	CanaryPercent         int
+	AllowMethods          []string
+	RequireTag            string
+	AllowCIDRs            []netip.Prefix
+	BasicAuth             []string
+	CacheControl          string
+	ContentType           string
+	SPAFallback           bool
+	OverlayPaths          []string
+	WebDAV                bool
+	WebDAVReadOnly        bool
+	ServeDotfiles         bool
+	Compress              bool
+	LogLevel              string
+	Label                 string
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -228,7 +267,7 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 			if v == nil {
 				dst.Handlers[k] = nil
 			} else {
-				dst.Handlers[k] = ptr.To(*v)
+				dst.Handlers[k] = v.Clone()
 			}
 		}
 	}
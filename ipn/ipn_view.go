@@ -210,16 +210,22 @@ func (v ServeConfigView) Foreground() views.MapFn[string, *ServeConfig, ServeCon
 		return t.View()
 	})
 }
-func (v ServeConfigView) ETag() string { return v.ж.ETag }
+func (v ServeConfigView) Drain() string           { return v.ж.Drain }
+func (v ServeConfigView) MaintenanceMode() bool   { return v.ж.MaintenanceMode }
+func (v ServeConfigView) MaintenancePage() string { return v.ж.MaintenancePage }
+func (v ServeConfigView) ETag() string            { return v.ж.ETag }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigViewNeedsRegeneration = ServeConfig(struct {
-	TCP         map[uint16]*TCPPortHandler
-	Web         map[HostPort]*WebServerConfig
-	Services    map[string]*ServiceConfig
-	AllowFunnel map[HostPort]bool
-	Foreground  map[string]*ServeConfig
-	ETag        string
+	TCP             map[uint16]*TCPPortHandler
+	Web             map[HostPort]*WebServerConfig
+	Services        map[string]*ServiceConfig
+	AllowFunnel     map[HostPort]bool
+	Foreground      map[string]*ServeConfig
+	Drain           string
+	MaintenanceMode bool
+	MaintenancePage string
+	ETag            string
 }{})
 
 // View returns a readonly view of ServiceConfig.
@@ -337,12 +343,25 @@ func (v TCPPortHandlerView) HTTP() bool           { return v.ж.HTTP }
 func (v TCPPortHandlerView) TCPForward() string   { return v.ж.TCPForward }
 func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
 
+func (v TCPPortHandlerView) SNIRoutes() views.Map[string, string] {
+	return views.MapOf(v.ж.SNIRoutes)
+}
+func (v TCPPortHandlerView) TLSMinVersion() string { return v.ж.TLSMinVersion }
+func (v TCPPortHandlerView) MaxConns() int         { return v.ж.MaxConns }
+func (v TCPPortHandlerView) Backlog() int          { return v.ж.Backlog }
+func (v TCPPortHandlerView) Label() string         { return v.ж.Label }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerViewNeedsRegeneration = TCPPortHandler(struct {
-	HTTPS        bool
-	HTTP         bool
-	TCPForward   string
-	TerminateTLS string
+	HTTPS         bool
+	HTTP          bool
+	TCPForward    string
+	TerminateTLS  string
+	SNIRoutes     map[string]string
+	TLSMinVersion string
+	MaxConns      int
+	Backlog       int
+	Label         string
 }{})
 
 // View returns a readonly view of HTTPHandler.
@@ -390,15 +409,73 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string                  { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string                 { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string                  { return v.ж.Text }
+func (v HTTPHandlerView) Archive() string               { return v.ж.Archive }
+func (v HTTPHandlerView) AggregateBackends() bool       { return v.ж.AggregateBackends }
+func (v HTTPHandlerView) RedirectToHTTPS() bool         { return v.ж.RedirectToHTTPS }
+func (v HTTPHandlerView) NoHTTP2() bool                 { return v.ж.NoHTTP2 }
+func (v HTTPHandlerView) ProxyHost() string             { return v.ж.ProxyHost }
+func (v HTTPHandlerView) GRPCWeb() bool                 { return v.ж.GRPCWeb }
+func (v HTTPHandlerView) BackendKeepalive() string      { return v.ж.BackendKeepalive }
+func (v HTTPHandlerView) ConnectTimeout() string        { return v.ж.ConnectTimeout }
+func (v HTTPHandlerView) ResponseHeaderTimeout() string { return v.ж.ResponseHeaderTimeout }
+func (v HTTPHandlerView) RequestIDHeader() string       { return v.ж.RequestIDHeader }
+func (v HTTPHandlerView) Canary() string                { return v.ж.Canary }
+func (v HTTPHandlerView) CanaryPercent() int            { return v.ж.CanaryPercent }
+func (v HTTPHandlerView) AllowMethods() views.Slice[string] {
+	return views.SliceOf(v.ж.AllowMethods)
+}
+func (v HTTPHandlerView) RequireTag() string { return v.ж.RequireTag }
+func (v HTTPHandlerView) AllowCIDRs() views.Slice[netip.Prefix] {
+	return views.SliceOf(v.ж.AllowCIDRs)
+}
+func (v HTTPHandlerView) BasicAuth() views.Slice[string] { return views.SliceOf(v.ж.BasicAuth) }
+func (v HTTPHandlerView) CacheControl() string           { return v.ж.CacheControl }
+func (v HTTPHandlerView) ContentType() string            { return v.ж.ContentType }
+func (v HTTPHandlerView) SPAFallback() bool              { return v.ж.SPAFallback }
+func (v HTTPHandlerView) OverlayPaths() views.Slice[string] {
+	return views.SliceOf(v.ж.OverlayPaths)
+}
+func (v HTTPHandlerView) WebDAV() bool         { return v.ж.WebDAV }
+func (v HTTPHandlerView) WebDAVReadOnly() bool { return v.ж.WebDAVReadOnly }
+func (v HTTPHandlerView) ServeDotfiles() bool  { return v.ж.ServeDotfiles }
+func (v HTTPHandlerView) Compress() bool       { return v.ж.Compress }
+func (v HTTPHandlerView) LogLevel() string     { return v.ж.LogLevel }
+func (v HTTPHandlerView) Label() string        { return v.ж.Label }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Archive               string
+	AggregateBackends     bool
+	RedirectToHTTPS       bool
+	NoHTTP2               bool
+	ProxyHost             string
+	GRPCWeb               bool
+	BackendKeepalive      string
+	ConnectTimeout        string
+	ResponseHeaderTimeout string
+	RequestIDHeader       string
+	Canary                string
+	CanaryPercent         int
+	AllowMethods          []string
+	RequireTag            string
+	AllowCIDRs            []netip.Prefix
+	BasicAuth             []string
+	CacheControl          string
+	ContentType           string
+	SPAFallback           bool
+	OverlayPaths          []string
+	WebDAV                bool
+	WebDAVReadOnly        bool
+	ServeDotfiles         bool
+	Compress              bool
+	LogLevel              string
+	Label                 string
 }{})
 
 // View returns a readonly view of WebServerConfig.
@@ -154,6 +154,8 @@ func isNotableNotify(n *ipn.Notify) bool {
 		n.LoginFinished != nil ||
 		!n.DriveShares.IsNil() ||
 		n.Health != nil ||
+		n.ServeConfig != nil ||
+		n.CertChange != nil ||
 		len(n.IncomingFiles) > 0 ||
 		len(n.OutgoingFiles) > 0 ||
 		n.FilesWaiting != nil
@@ -572,10 +572,26 @@ func (b *LocalBackend) getCertPEM(ctx context.Context, cs certStore, logf logger
 		return nil, err
 	}
 	b.domainRenewed(domain)
+	b.notifyCertChange(logf, domain, der)
 
 	return &TLSCertKeyPair{CertPEM: certPEM.Bytes(), KeyPEM: privPEM.Bytes()}, nil
 }
 
+// notifyCertChange tells IPN bus watchers, such as "tailscale serve status
+// --watch", that a new certificate chain, der, has been obtained for
+// domain.
+func (b *LocalBackend) notifyCertChange(logf logger.Logf, domain string, der [][]byte) {
+	if len(der) == 0 {
+		return
+	}
+	cert, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		logf("parsing new certificate: %v", err)
+		return
+	}
+	b.send(ipn.Notify{CertChange: &ipn.CertChange{Domain: domain, NotAfter: cert.NotAfter}})
+}
+
 // certRequest generates a CSR for the given common name cn and optional SANs.
 func certRequest(key crypto.Signer, cn string, ext []pkix.Extension, san ...string) ([]byte, error) {
 	req := &x509.CertificateRequest{
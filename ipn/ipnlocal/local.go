@@ -63,6 +63,7 @@
 	"tailscale.com/ipn/policy"
 	"tailscale.com/log/sockstatlog"
 	"tailscale.com/logpolicy"
+	tsmetrics "tailscale.com/metrics"
 	"tailscale.com/net/captivedetection"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/dnscache"
@@ -229,6 +230,7 @@ type LocalBackend struct {
 	filterAtomic                 atomic.Pointer[filter.Filter]
 	containsViaIPFuncAtomic      syncs.AtomicValue[func(netip.Addr) bool]
 	shouldInterceptTCPPortAtomic syncs.AtomicValue[func(uint16) bool]
+	vipServiceAddrPortsAtomic    syncs.AtomicValue[map[netip.AddrPort]string] // served VIP Service IP:port to service name
 	numClientStatusCalls         atomic.Uint32
 
 	// The mutex protects the following elements.
@@ -314,11 +316,19 @@ type LocalBackend struct {
 	lastServeConfJSON mem.RO              // last JSON that was parsed into serveConfig
 	serveConfig       ipn.ServeConfigView // or !Valid if none
 
+	// serveDrains are the replaced serve configs that are still serving
+	// the HTTP(S) connections accepted under them, mapped to when they
+	// stop. See ipn.ServeConfig.Drain.
+	serveDrains map[ipn.ServeConfigView]time.Time
+
 	webClient          webClient
 	webClientListeners map[netip.AddrPort]*localListener // listeners for local web client traffic
 
 	serveListeners     map[netip.AddrPort]*localListener // listeners for local serve traffic
-	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *reverseProxy
+	serveProxyHandlers sync.Map                          // proxyKey => *reverseProxy
+	serveArchives      archiveCache                      // open archives of Archive handlers
+	serveWebDAVLocks   webDAVLocks                       // locks of directories served over WebDAV
+	serveConns         connLimiter                       // open connections of TCP ports with MaxConns
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -407,6 +417,11 @@ type metrics struct {
 	// approvedRoutes is a metric that reports the number of network routes served by the local node and approved
 	// by the control server.
 	approvedRoutes *usermetric.Gauge
+
+	// serveRequests and serveBytesSent count the requests served by each
+	// serve web handler, and the bytes of their response bodies.
+	serveRequests  *tsmetrics.MultiLabelMap[serveHandlerLabel]
+	serveBytesSent *tsmetrics.MultiLabelMap[serveHandlerLabel]
 }
 
 // clientGen is a func that creates a control plane client.
@@ -457,6 +472,12 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 			"tailscaled_advertised_routes", "Number of advertised network routes (e.g. by a subnet router)"),
 		approvedRoutes: sys.UserMetricsRegistry().NewGauge(
 			"tailscaled_approved_routes", "Number of approved network routes (e.g. by a subnet router)"),
+		serveRequests: usermetric.NewMultiLabelMapWithRegistry[serveHandlerLabel](
+			sys.UserMetricsRegistry(), "tailscaled_serve_requests_total", "counter",
+			"Counts the number of requests served by each serve web handler"),
+		serveBytesSent: usermetric.NewMultiLabelMapWithRegistry[serveHandlerLabel](
+			sys.UserMetricsRegistry(), "tailscaled_serve_sent_bytes_total", "counter",
+			"Counts the number of response body bytes sent by each serve web handler"),
 	}
 
 	b := &LocalBackend{
@@ -2327,6 +2348,10 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 			localNetsB.Add(netip.MustParseAddr("::0"))
 		}
 	}
+	// The IPs of the VIP Services that the node serves are local too.
+	for ap := range b.vipServiceAddrPortsAtomic.Load() {
+		localNetsB.Add(ap.Addr())
+	}
 	localNets, _ := localNetsB.IPSet()
 	logNets, _ := logNetsB.IPSet()
 	var sshPol tailcfg.SSHPolicy
@@ -2781,7 +2806,7 @@ func (b *LocalBackend) WatchNotificationsAs(ctx context.Context, actor ipnauth.A
 
 	b.mu.Lock()
 
-	const initialBits = ipn.NotifyInitialState | ipn.NotifyInitialPrefs | ipn.NotifyInitialNetMap | ipn.NotifyInitialDriveShares
+	const initialBits = ipn.NotifyInitialState | ipn.NotifyInitialPrefs | ipn.NotifyInitialNetMap | ipn.NotifyInitialDriveShares | ipn.NotifyInitialServeConfig
 	if mask&initialBits != 0 {
 		ini = &ipn.Notify{Version: version.Long()}
 		if mask&ipn.NotifyInitialState != 0 {
@@ -2803,6 +2828,9 @@ func (b *LocalBackend) WatchNotificationsAs(ctx context.Context, actor ipnauth.A
 		if mask&ipn.NotifyInitialHealthState != 0 {
 			ini.Health = b.HealthTracker().CurrentState()
 		}
+		if mask&ipn.NotifyInitialServeConfig != 0 {
+			ini.ServeConfig = ptr.To(b.serveConfigForNotifyLocked())
+		}
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -3338,6 +3366,7 @@ func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
 	if !p.Valid() {
 		b.containsViaIPFuncAtomic.Store(ipset.FalseContainsIPFunc())
 		b.setTCPPortsIntercepted(nil)
+		b.vipServiceAddrPortsAtomic.Store(nil)
 		b.lastServeConfJSON = mem.B(nil)
 		b.serveConfig = ipn.ServeConfigView{}
 	} else {
@@ -4075,6 +4104,11 @@ func (b *LocalBackend) TCPHandlerForDst(src, dst netip.AddrPort) (handler func(c
 		}
 	}
 
+	// Then handle connections to the VIP Services that the node serves.
+	if svc, ok := b.vipServiceAddrPortsAtomic.Load()[dst]; ok {
+		return b.tcpHandlerForVIPService(svc, dst.Port(), src), opts
+	}
+
 	// Then handle external connections to the local IP.
 	if !b.isLocalIP(dst.Addr()) {
 		return nil, nil
@@ -5830,6 +5864,7 @@ func (b *LocalBackend) reloadServeConfigLocked(prefs ipn.PrefsView) {
 		// Don't try to load the serve config.
 		b.lastServeConfJSON = mem.B(nil)
 		b.serveConfig = ipn.ServeConfigView{}
+		clear(b.serveDrains)
 		return
 	}
 
@@ -5882,6 +5917,8 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 	}
 
 	b.reloadServeConfigLocked(prefs)
+	b.pruneServeArchivesLocked()
+	b.pruneServeWebDAVLocksLocked()
 	if b.serveConfig.Valid() {
 		servePorts := make([]uint16, 0, 3)
 		b.serveConfig.RangeOverTCPs(func(port uint16, _ ipn.TCPPortHandlerView) bool {
@@ -5899,6 +5936,7 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 			b.updateServeTCPPortNetMapAddrListenersLocked(servePorts)
 		}
 	}
+	b.setVIPServicesInterceptedLocked(prefs)
 	// Kick off a Hostinfo update to control if WireIngress changed.
 	if wire := b.wantIngressLocked(); b.hostinfo != nil && b.hostinfo.WireIngress != wire {
 		b.logf("Hostinfo.WireIngress changed to %v", wire)
@@ -5916,41 +5954,46 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	if !b.serveConfig.Valid() {
 		return
 	}
-	var backends map[string]bool
-	b.serveConfig.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
-		conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
-			backend := h.Proxy()
-			if backend == "" {
-				// Only create proxy handlers for servers with a proxy backend.
-				return true
-			}
-			mak.Set(&backends, backend, true)
-			if _, ok := b.serveProxyHandlers.Load(backend); ok {
-				return true
-			}
+	var keys map[proxyKey]bool
+	for _, sc := range b.servingServeConfigsLocked() {
+		sc.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
+			conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
+				// Only create proxy handlers for servers with a proxy backend,
+				// and for their canary backend, if any.
+				for _, backend := range []string{h.Proxy(), h.Canary()} {
+					if backend == "" {
+						continue
+					}
+					key := serveProxyKeyFor(h, backend)
+					mak.Set(&keys, key, true)
+					if _, ok := b.serveProxyHandlers.Load(key); ok {
+						continue
+					}
 
-			b.logf("serve: creating a new proxy handler for %s", backend)
-			p, err := b.proxyHandlerForBackend(backend)
-			if err != nil {
-				// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
-				// in the CLI, so just log the error here.
-				b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
+					b.logf("serve: creating a new proxy handler for %s", backend)
+					p, err := b.proxyHandlerForBackend(backend, proxyOptionsOf(h))
+					if err != nil {
+						// The backend endpoint (h.Proxy or h.Canary) should have been validated by expandProxyTarget
+						// in the CLI, so just log the error here.
+						b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
+						continue
+					}
+					b.serveProxyHandlers.Store(key, p)
+				}
 				return true
-			}
-			b.serveProxyHandlers.Store(backend, p)
+			})
 			return true
 		})
-		return true
-	})
+	}
 
 	// Clean up handlers for proxy backends that are no longer present
 	// in configuration.
 	b.serveProxyHandlers.Range(func(key, value any) bool {
-		backend := key.(string)
-		if !backends[backend] {
-			b.logf("serve: closing idle connections to %s", backend)
-			b.serveProxyHandlers.Delete(backend)
-			value.(*reverseProxy).close()
+		if !keys[key.(proxyKey)] {
+			rp := value.(*reverseProxy)
+			b.logf("serve: closing idle connections to %s", rp.backend)
+			b.serveProxyHandlers.Delete(key)
+			rp.close()
 		}
 		return true
 	})
@@ -6726,6 +6769,14 @@ func (b *LocalBackend) ShouldInterceptTCPPort(port uint16) bool {
 	return b.shouldInterceptTCPPortAtomic.Load()(port)
 }
 
+// ShouldInterceptVIPServiceTCPPort reports whether the given TCP address and
+// port is that of a VIP Service that this node serves, and so should be
+// intercepted by Tailscaled and handled in-process.
+func (b *LocalBackend) ShouldInterceptVIPServiceTCPPort(ap netip.AddrPort) bool {
+	_, ok := b.vipServiceAddrPortsAtomic.Load()[ap]
+	return ok
+}
+
 // SwitchProfile switches to the profile with the given id.
 // It will restart the backend on success.
 // If the profile is not known, it returns an errProfileNotFound.
@@ -1127,6 +1127,11 @@ func (hrw *httpResponseWrapper) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (hrw *httpResponseWrapper) Unwrap() http.ResponseWriter {
+	return hrw.ResponseWriter
+}
+
 // requestBodyWrapper wraps an io.ReadCloser and stores
 // the number of bytesRead.
 type requestBodyWrapper struct {
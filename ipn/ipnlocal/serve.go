@@ -4,14 +4,22 @@
 package ipnlocal
 
 import (
+	"cmp"
 	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"math/rand/v2"
 	"mime"
 	"net"
 	"net/http"
@@ -28,22 +36,28 @@
 	"time"
 	"unicode/utf8"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/http2"
 	"tailscale.com/ipn"
 	"tailscale.com/logtail/backoff"
+	tsmetrics "tailscale.com/metrics"
 	"tailscale.com/net/netutil"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/lazy"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/ptr"
+	"tailscale.com/types/views"
 	"tailscale.com/util/ctxkey"
 	"tailscale.com/util/mak"
+	"tailscale.com/util/rands"
 	"tailscale.com/version"
 )
 
 const (
 	contentTypeHeader   = "Content-Type"
 	grpcBaseContentType = "application/grpc"
+	grpcWebContentType  = "application/grpc-web"
 )
 
 // ErrETagMismatch signals that the given
@@ -57,6 +71,10 @@ type serveHTTPContext struct {
 	SrcAddr  netip.AddrPort
 	DestPort uint16
 
+	// Config is the serve config that was current when the connection
+	// was accepted, or !Valid if unknown. See serveConfigForConn.
+	Config ipn.ServeConfigView
+
 	// provides funnel-specific context, nil if not funneled
 	Funnel *funnelFlow
 }
@@ -86,6 +104,10 @@ type localListener struct {
 	logf   logger.Logf
 	bo     *backoff.Backoff // for retrying failed Listen calls
 
+	// backlog, if positive, is the listen backlog to ask for instead of
+	// the OS default; see ipn.TCPPortHandler.Backlog.
+	backlog int
+
 	handler       func(net.Conn) error            // handler for inbound connections
 	closeListener syncs.AtomicValue[func() error] // Listener's Close method, if any
 }
@@ -177,6 +199,11 @@ func (s *localListener) Run() {
 			continue
 		}
 		s.closeListener.Store(ln.Close)
+		if s.backlog > 0 {
+			if err := setListenBacklog(ln, s.backlog); err != nil {
+				s.logf("localListener failed to set backlog of %v to %d: %v", s.ap, s.backlog, err)
+			}
+		}
 
 		s.logf("listening on %v", s.ap)
 		err = s.handleListenersAccept(ln)
@@ -217,14 +244,15 @@ func (s *localListener) handleListenersAccept(ln net.Listener) error {
 
 // updateServeTCPPortNetMapAddrListenersLocked starts a net.Listen for configured
 // Serve ports on all the node's addresses.
-// Existing Listeners are closed if port no longer in incoming ports list.
+// Existing Listeners are closed if port no longer in incoming ports list,
+// or restarted if the port's backlog changed.
 //
 // b.mu must be held.
 func (b *LocalBackend) updateServeTCPPortNetMapAddrListenersLocked(ports []uint16) {
 	// close existing listeners where port
 	// is no longer in incoming ports list
 	for ap, sl := range b.serveListeners {
-		if !slices.Contains(ports, ap.Port()) {
+		if !slices.Contains(ports, ap.Port()) || sl.backlog != b.serveBacklogLocked(ap.Port()) {
 			b.logf("closing listener %v", ap)
 			sl.Close()
 			delete(b.serveListeners, ap)
@@ -250,6 +278,7 @@ func (b *LocalBackend) updateServeTCPPortNetMapAddrListenersLocked(ports []uint1
 			}
 
 			sl := b.newServeListener(context.Background(), addrPort, b.logf)
+			sl.backlog = b.serveBacklogLocked(p)
 			mak.Set(&b.serveListeners, addrPort, sl)
 
 			go sl.Run()
@@ -257,6 +286,25 @@ func (b *LocalBackend) updateServeTCPPortNetMapAddrListenersLocked(ports []uint1
 	}
 }
 
+// serveBacklogLocked returns the listen backlog configured for the serve
+// TCP port, or 0 for the OS default.
+//
+// b.mu must be held.
+func (b *LocalBackend) serveBacklogLocked(port uint16) int {
+	if !b.serveConfig.Valid() {
+		return 0
+	}
+	backlog := 0
+	b.serveConfig.RangeOverTCPs(func(p uint16, tcph ipn.TCPPortHandlerView) bool {
+		if p != port {
+			return true
+		}
+		backlog = tcph.Backlog()
+		return false
+	})
+	return backlog
+}
+
 // SetServeConfig establishes or replaces the current serve config.
 // ETag is an optional parameter to enforce Optimistic Concurrency Control.
 // If it is an empty string, then the config will be overwritten.
@@ -266,6 +314,18 @@ func (b *LocalBackend) SetServeConfig(config *ipn.ServeConfig, etag string) erro
 	return b.setServeConfigLocked(config, etag)
 }
 
+// serveConfigForNotifyLocked returns b.serveConfig for sending in an
+// ipn.Notify. If there's no config, it returns an empty one, as a nil
+// Notify.ServeConfig means the config is unchanged.
+//
+// b.mu must be held.
+func (b *LocalBackend) serveConfigForNotifyLocked() ipn.ServeConfigView {
+	if b.serveConfig.Valid() {
+		return b.serveConfig
+	}
+	return (&ipn.ServeConfig{}).View()
+}
+
 func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string) error {
 	prefs := b.pm.CurrentPrefs()
 	if config.IsFunnelOn() && prefs.ShieldsUp() {
@@ -317,7 +377,14 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 		return fmt.Errorf("writing ServeConfig to StateStore: %w", err)
 	}
 
+	var drain time.Duration
+	if config != nil {
+		drain, _ = ipn.ParseDrain(config.Drain)
+	}
+	b.drainServeConfigLocked(prevConfig, drain)
+
 	b.setTCPPortsInterceptedFromNetmapAndPrefsLocked(b.pm.CurrentPrefs())
+	b.sendToLocked(ipn.Notify{ServeConfig: ptr.To(b.serveConfigForNotifyLocked())}, allClients)
 
 	// clean up and close all previously open foreground sessions
 	// if the current ServeConfig has overwritten them.
@@ -341,6 +408,71 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 	return nil
 }
 
+// drainServeConfigLocked arranges for prev, the serve config being
+// replaced, to keep serving the HTTP(S) connections accepted under it for
+// d. If d is zero, it instead ends all draining, so that all connections
+// switch to the new config.
+//
+// b.mu must be held.
+func (b *LocalBackend) drainServeConfigLocked(prev ipn.ServeConfigView, d time.Duration) {
+	if d <= 0 {
+		clear(b.serveDrains)
+		return
+	}
+	if !prev.Valid() {
+		return
+	}
+	until := b.clock.Now().Add(d)
+	mak.Set(&b.serveDrains, prev, until)
+	b.clock.AfterFunc(d, func() { b.endServeDrain(prev, until) })
+}
+
+// endServeDrain forgets sc, a serve config that was draining until the
+// given time, and closes the proxies and archives that only it used.
+func (b *LocalBackend) endServeDrain(sc ipn.ServeConfigView, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cur, ok := b.serveDrains[sc]; !ok || !cur.Equal(until) {
+		// Already ended, or draining again for longer.
+		return
+	}
+	delete(b.serveDrains, sc)
+	b.setServeProxyHandlersLocked()
+	b.pruneServeArchivesLocked()
+	b.pruneServeWebDAVLocksLocked()
+}
+
+// servingServeConfigsLocked returns the serve configs that may serve
+// requests: the current one, if any, and those that are draining.
+//
+// b.mu must be held.
+func (b *LocalBackend) servingServeConfigsLocked() []ipn.ServeConfigView {
+	var ret []ipn.ServeConfigView
+	if b.serveConfig.Valid() {
+		ret = append(ret, b.serveConfig)
+	}
+	for sc := range b.serveDrains {
+		if sc != b.serveConfig {
+			ret = append(ret, sc)
+		}
+	}
+	return ret
+}
+
+// serveConfigForConn returns the serve config that requests on the
+// connection described by sctx are served with: the config the connection
+// was accepted under, if it's still draining, or else the current one.
+func (b *LocalBackend) serveConfigForConn(sctx *serveHTTPContext) ipn.ServeConfigView {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sc := sctx.Config; sc.Valid() && sc != b.serveConfig {
+		if until, ok := b.serveDrains[sc]; ok && b.clock.Now().Before(until) {
+			return sc
+		}
+	}
+	return b.serveConfig
+}
+
 // ServeConfig provides a view of the current serve mappings.
 // If serving is not configured, the returned view is not Valid.
 func (b *LocalBackend) ServeConfig() ipn.ServeConfigView {
@@ -449,7 +581,70 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort,
 	if !ok {
 		return nil
 	}
+	return b.tcpHandlerForPort(sc, tcph, dport, srcAddr, f)
+}
+
+// tcpHandlerForVIPService is like tcpHandlerForServe, but for a connection
+// to port dport of the VIP Service named svc (such as "svc:web"), which
+// Funnel doesn't reach.
+func (b *LocalBackend) tcpHandlerForVIPService(svc string, dport uint16, srcAddr netip.AddrPort) (handler func(net.Conn) error) {
+	b.mu.Lock()
+	sc := b.serveConfig
+	b.mu.Unlock()
+
+	if !sc.Valid() {
+		return nil
+	}
+
+	tcph, ok := sc.FindServiceTCP(svc, dport)
+	if !ok {
+		return nil
+	}
+	return b.tcpHandlerForPort(sc, tcph, dport, srcAddr, nil)
+}
+
+// setVIPServicesInterceptedLocked populates b.vipServiceAddrPortsAtomic with
+// the TCP ports of the Services in the serve config that the node
+// advertises, on the IPs that the tailcfg.NodeAttrServiceHost capability
+// assigns to them. As those IPs are local to the node, it updates the
+// packet filter if they changed.
+//
+// b.mu must be held.
+func (b *LocalBackend) setVIPServicesInterceptedLocked(prefs ipn.PrefsView) {
+	var aps map[netip.AddrPort]string
+	if prefs.Valid() && b.serveConfig.Valid() && b.netMap != nil && b.netMap.SelfNode.Valid() {
+		mappings, err := tailcfg.UnmarshalNodeCapJSON[tailcfg.ServiceIPMappings](b.netMap.SelfNode.CapMap().AsMap(), tailcfg.NodeAttrServiceHost)
+		if err != nil {
+			b.logf("[unexpected] error parsing %s: %v", tailcfg.NodeAttrServiceHost, err)
+		}
+		ips := make(tailcfg.ServiceIPMappings)
+		for _, m := range mappings {
+			maps.Copy(ips, m)
+		}
+		for name, addrs := range ips {
+			svc, ok := b.serveConfig.Services().GetOk(name)
+			if !ok || svc.Tun() || !views.SliceContains(prefs.AdvertiseServices(), name) {
+				continue
+			}
+			svc.TCP().Range(func(port uint16, _ ipn.TCPPortHandlerView) bool {
+				for _, ip := range addrs {
+					mak.Set(&aps, netip.AddrPortFrom(ip, port), name)
+				}
+				return true
+			})
+		}
+	}
 
+	old := b.vipServiceAddrPortsAtomic.Load()
+	b.vipServiceAddrPortsAtomic.Store(aps)
+	if !maps.Equal(old, aps) {
+		b.updateFilterLocked(b.netMap, prefs)
+	}
+}
+
+// tcpHandlerForPort returns the handler for a connection to port dport
+// served by tcph, a TCP port handler of sc.
+func (b *LocalBackend) tcpHandlerForPort(sc ipn.ServeConfigView, tcph ipn.TCPPortHandlerView, dport uint16, srcAddr netip.AddrPort, f *funnelFlow) (handler func(net.Conn) error) {
 	if tcph.HTTPS() || tcph.HTTP() {
 		hs := &http.Server{
 			Handler: http.HandlerFunc(b.serveWebHandler),
@@ -458,12 +653,14 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort,
 					Funnel:   f,
 					SrcAddr:  srcAddr,
 					DestPort: dport,
+					Config:   sc,
 				})
 			},
 		}
 		if tcph.HTTPS() {
 			hs.TLSConfig = &tls.Config{
 				GetCertificate: b.getTLSServeCertForPort(dport),
+				MinVersion:     tcph.MinTLSVersion(),
 			}
 			return func(c net.Conn) error {
 				return hs.ServeTLS(netutil.NewOneConnListener(c, nil), "", "")
@@ -476,7 +673,10 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort,
 	}
 
 	if backDst := tcph.TCPForward(); backDst != "" {
-		return func(conn net.Conn) error {
+		if tcph.SNIRoutes().Len() > 0 {
+			return b.limitServeConns(tcph, dport, srcAddr, b.tcpHandlerForSNIRoutes(tcph, dport, srcAddr))
+		}
+		return b.limitServeConns(tcph, dport, srcAddr, func(conn net.Conn) error {
 			defer conn.Close()
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 			backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
@@ -488,6 +688,7 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort,
 			defer backConn.Close()
 			if sni := tcph.TerminateTLS(); sni != "" {
 				conn = tls.Server(conn, &tls.Config{
+					MinVersion: tcph.MinTLSVersion(),
 					GetCertificate: func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 						ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 						defer cancel()
@@ -506,81 +707,290 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort,
 
 			// TODO(bradfitz): do the RegisterIPPortIdentity and
 			// UnregisterIPPortIdentity stuff that netstack does
-			errc := make(chan error, 1)
-			go func() {
-				_, err := io.Copy(backConn, conn)
-				errc <- err
-			}()
-			go func() {
-				_, err := io.Copy(conn, backConn)
-				errc <- err
-			}()
-			return <-errc
-		}
+			return proxyTCPConns(conn, backConn)
+		})
 	}
 
 	return nil
 }
 
-func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, at string, ok bool) {
-	var z ipn.HTTPHandlerView // zero value
+// proxyTCPConns copies data between conn and backConn in both directions
+// until either direction fails or hits EOF.
+func proxyTCPConns(conn, backConn net.Conn) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(backConn, conn)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backConn)
+		errc <- err
+	}()
+	return <-errc
+}
 
-	hostname := r.Host
-	if r.TLS == nil {
-		tcd := "." + b.Status().CurrentTailnet.MagicDNSSuffix
-		if host, _, err := net.SplitHostPort(hostname); err == nil {
-			hostname = host
+// limitServeConns wraps handler, the handler for a TCP forwarding port,
+// to close connections instead of forwarding them while the port already
+// has tcph.MaxConns connections open. It returns handler as is if
+// tcph.MaxConns isn't set.
+//
+// Connections over the limit are closed after being accepted, rather than
+// refused by tcpHandlerForServe returning nil, as netstack would then
+// forward them to the port on localhost itself.
+func (b *LocalBackend) limitServeConns(tcph ipn.TCPPortHandlerView, dport uint16, srcAddr netip.AddrPort, handler func(net.Conn) error) func(net.Conn) error {
+	max := tcph.MaxConns()
+	if max <= 0 {
+		return handler
+	}
+	return func(conn net.Conn) error {
+		if !b.serveConns.acquire(dport, max) {
+			b.logf("localbackend: closing TCP connection to port %v from %v: already at max of %d connections", dport, srcAddr, max)
+			conn.Close()
+			return nil
 		}
-		if !strings.HasSuffix(hostname, tcd) {
-			hostname += tcd
+		defer b.serveConns.release(dport)
+		return handler(conn)
+	}
+}
+
+// connLimiter counts the open connections of TCP forwarding ports with
+// a MaxConns limit. The zero value is ready for use.
+type connLimiter struct {
+	mu sync.Mutex
+	n  map[uint16]int // open connections by port
+}
+
+// acquire counts a new connection to port, reporting false, without
+// counting it, if port already has max connections open. Each successful
+// call must be followed by a call to release.
+func (l *connLimiter) acquire(port uint16, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n[port] >= max {
+		return false
+	}
+	mak.Set(&l.n, port, l.n[port]+1)
+	return true
+}
+
+// release stops counting a connection to port counted by acquire.
+func (l *connLimiter) release(port uint16) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n[port]--; l.n[port] <= 0 {
+		delete(l.n, port)
+	}
+}
+
+// tcpHandlerForSNIRoutes returns a handler for a TLS-terminated TCP
+// forwarding port with SNI routes. Unlike the plain TCP forwarding
+// handler, it completes the TLS handshake before dialing the backend, as
+// the backend depends on the SNI name the client asked for.
+func (b *LocalBackend) tcpHandlerForSNIRoutes(tcph ipn.TCPPortHandlerView, dport uint16, srcAddr netip.AddrPort) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		defer conn.Close()
+		tlsConn := tls.Server(conn, &tls.Config{
+			MinVersion: tcph.MinTLSVersion(),
+			GetCertificate: func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				name := cmp.Or(hi.ServerName, tcph.TerminateTLS())
+				if _, ok := tcph.BackendForSNI(name); !ok {
+					return nil, fmt.Errorf("no backend for SNI name %q", name)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				pair, err := b.GetCertPEM(ctx, name)
+				if err != nil {
+					return nil, err
+				}
+				cert, err := tls.X509KeyPair(pair.CertPEM, pair.KeyPEM)
+				if err != nil {
+					return nil, err
+				}
+				return &cert, nil
+			},
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			b.logf("localbackend: TLS handshake on port %v (from %v) failed: %v", dport, srcAddr, err)
+			return nil
 		}
-	} else {
-		hostname = r.TLS.ServerName
+		// Clients that don't send SNI get the TerminateTLS name's backend.
+		sni := cmp.Or(tlsConn.ConnectionState().ServerName, tcph.TerminateTLS())
+		backDst, _ := tcph.BackendForSNI(sni) // checked by GetCertificate
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
+		cancel()
+		if err != nil {
+			b.logf("localbackend: failed to TCP proxy port %v (from %v, SNI %q) to %s: %v", dport, srcAddr, sni, backDst, err)
+			return nil
+		}
+		defer backConn.Close()
+		return proxyTCPConns(tlsConn, backConn)
 	}
+}
 
+// serveRequestHostname returns the fully qualified name of the serve host
+// that r was sent to: the TLS server name for HTTPS requests, or the Host
+// header, without any port and qualified with the tailnet's MagicDNS
+// suffix, for HTTP requests.
+func (b *LocalBackend) serveRequestHostname(r *http.Request) string {
+	if r.TLS != nil {
+		return r.TLS.ServerName
+	}
+	hostname := r.Host
+	tcd := "." + b.Status().CurrentTailnet.MagicDNSSuffix
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	if !strings.HasSuffix(hostname, tcd) {
+		hostname += tcd
+	}
+	return hostname
+}
+
+// serveRequestVirtualHost returns the host name in the Host header of the
+// plain HTTP request r, without any port or trailing dot, or "" if it's
+// empty. Unlike serveRequestHostname, it doesn't qualify the name.
+func serveRequestVirtualHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, hp ipn.HostPort, at string, ok bool) {
+	var z ipn.HTTPHandlerView // zero value
+
+	hostname := b.serveRequestHostname(r)
 	sctx, ok := serveHTTPContextKey.ValueOk(r.Context())
 	if !ok {
 		b.logf("[unexpected] localbackend: no serveHTTPContext in request")
-		return z, "", false
+		return z, "", "", false
+	}
+	sc := b.serveConfigForConn(sctx)
+	if !sc.Valid() {
+		return z, "", "", false
+	}
+	hp = ipn.HostPort(fmt.Sprintf("%s:%v", hostname, sctx.DestPort))
+	wsc, ok := sc.FindWeb(hp)
+	if !ok && r.TLS == nil {
+		// Not one of the node's MagicDNS names; the Host header may name
+		// a virtual host (see "tailscale serve --virtual-host") as is.
+		if vhost := serveRequestVirtualHost(r); vhost != "" {
+			hp = ipn.HostPort(fmt.Sprintf("%s:%v", vhost, sctx.DestPort))
+			wsc, ok = sc.FindWeb(hp)
+		}
 	}
-	wsc, ok := b.webServerConfig(hostname, sctx.DestPort)
 	if !ok {
-		return z, "", false
+		return z, "", "", false
 	}
 
-	if h, ok := wsc.Handlers().GetOk(r.URL.Path); ok {
-		return h, r.URL.Path, true
+	if h, ok := wsc.Handlers().GetOk(r.URL.Path); ok && r.URL.Path != ipn.WildcardMountPoint {
+		return h, hp, r.URL.Path, true
 	}
 	pth := path.Clean(r.URL.Path)
 	for {
 		withSlash := pth + "/"
 		if h, ok := wsc.Handlers().GetOk(withSlash); ok {
-			return h, withSlash, true
+			return h, hp, withSlash, true
 		}
-		if h, ok := wsc.Handlers().GetOk(pth); ok {
-			return h, pth, true
+		if h, ok := wsc.Handlers().GetOk(pth); ok && pth != ipn.WildcardMountPoint {
+			return h, hp, pth, true
 		}
 		if pth == "/" {
-			return z, "", false
+			// Nothing more specific matched; fall back to the wildcard
+			// mount, if any. It's treated as being mounted at the root.
+			if h, ok := wsc.Handlers().GetOk(ipn.WildcardMountPoint); ok {
+				return h, hp, "/", true
+			}
+			return z, "", "", false
 		}
 		pth = path.Dir(pth)
 	}
 }
 
+// proxyKey is the key of a reverse proxy in LocalBackend.serveProxyHandlers.
+// Handlers that share a backend share a proxy, unless they differ in how
+// the proxy talks to the backend.
+type proxyKey struct {
+	backend string
+	opts    proxyOptions
+}
+
+// serveProxyKey returns the key under which the reverse proxy for h's
+// Proxy backend is stored in LocalBackend.serveProxyHandlers.
+func serveProxyKey(h ipn.HTTPHandlerView) proxyKey {
+	return serveProxyKeyFor(h, h.Proxy())
+}
+
+// serveProxyKeyFor is like serveProxyKey, but for backend, which is h's
+// Proxy or Canary.
+func serveProxyKeyFor(h ipn.HTTPHandlerView, backend string) proxyKey {
+	return proxyKey{backend: backend, opts: proxyOptionsOf(h)}
+}
+
+// proxyOptions are the settings of an ipn.HTTPHandler that determine how a
+// reverseProxy talks to its backend.
+type proxyOptions struct {
+	// noHTTP2 tracks whether HTTP/2 (including h2c) must not be used
+	// when talking to the backend.
+	noHTTP2 bool
+	// host, if non-empty, is the Host header to send to the backend
+	// instead of the incoming request's.
+	host string
+	// grpcWeb tracks whether gRPC-Web requests are translated to gRPC
+	// for the backend.
+	grpcWeb bool
+	// keepalive is how long idle connections to the backend are kept
+	// open for reuse (see ipn.HTTPHandler.BackendKeepalive).
+	keepalive time.Duration
+	// connectTimeout and responseHeaderTimeout, if non-zero, are how long
+	// to wait to connect to the backend and for its response headers (see
+	// ipn.HTTPHandler.ConnectTimeout and ResponseHeaderTimeout).
+	connectTimeout        time.Duration
+	responseHeaderTimeout time.Duration
+}
+
+// proxyOptionsOf returns the proxyOptions of h.
+func proxyOptionsOf(h ipn.HTTPHandlerView) proxyOptions {
+	return proxyOptions{
+		noHTTP2:               h.NoHTTP2(),
+		host:                  h.ProxyHost(),
+		grpcWeb:               h.GRPCWeb(),
+		keepalive:             h.BackendKeepaliveDuration(),
+		connectTimeout:        h.ConnectTimeoutDuration(),
+		responseHeaderTimeout: h.ResponseHeaderTimeoutDuration(),
+	}
+}
+
 // proxyHandlerForBackend creates a new HTTP reverse proxy for a particular backend that
 // we serve requests for. `backend` is a HTTPHandler.Proxy string (url, hostport or just port).
-func (b *LocalBackend) proxyHandlerForBackend(backend string) (http.Handler, error) {
+// The proxy talks to the backend according to opts.
+func (b *LocalBackend) proxyHandlerForBackend(backend string, opts proxyOptions) (http.Handler, error) {
+	var pipe string
+	if ipn.IsNamedPipeProxy(backend) {
+		// Requests to a named pipe backend are plain HTTP; the URL's host
+		// is only a placeholder, as all connections go to the pipe.
+		pipe = backend
+		backend = "http://localhost"
+	}
 	targetURL, insecure := expandProxyArg(backend)
 	u, err := url.Parse(targetURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid url %s: %w", targetURL, err)
 	}
 	p := &reverseProxy{
-		logf:     b.logf,
-		url:      u,
-		insecure: insecure,
-		backend:  backend,
-		lb:       b,
+		logf:         b.logf,
+		url:          u,
+		pipe:         pipe,
+		insecure:     insecure,
+		proxyOptions: opts,
+		backend:      backend,
+		lb:           b,
 	}
 	return p, nil
 }
@@ -594,9 +1004,14 @@ func (b *LocalBackend) proxyHandlerForBackend(backend string) (http.Handler, err
 type reverseProxy struct {
 	logf logger.Logf
 	url  *url.URL
+	// pipe, if non-empty, is the path of the local Windows named pipe
+	// that the backend listens on, which all connections go to instead
+	// of url's host.
+	pipe string
 	// insecure tracks whether the connection to an https backend should be
 	// insecure (i.e because we cannot verify its CA).
-	insecure      bool
+	insecure bool
+	proxyOptions
 	backend       string
 	lb            *LocalBackend
 	httpTransport lazy.SyncValue[*http.Transport]  // transport for non-h2c backends
@@ -626,25 +1041,13 @@ func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "proxy is closed", http.StatusServiceUnavailable)
 		return
 	}
-	p := &httputil.ReverseProxy{Rewrite: func(r *httputil.ProxyRequest) {
-		oldOutPath := r.Out.URL.Path
-		r.SetURL(rp.url)
-
-		// If mount point matches the request path exactly, the outbound
-		// request URL was set to empty string in serveWebHandler which
-		// would have resulted in the outbound path set to <proxy path>
-		// + '/' in SetURL. In that case, if the proxy path was set, we
-		// want to send the request to the <proxy path> (without the
-		// '/') .
-		if oldOutPath == "" && rp.url.Path != "" {
-			r.Out.URL.Path = rp.url.Path
-			r.Out.URL.RawPath = rp.url.RawPath
+	if rp.grpcWeb {
+		if suffix, text, ok := parseGRPCWebContentType(r.Header.Get(contentTypeHeader)); ok {
+			rp.serveGRPCWeb(w, r, suffix, text)
+			return
 		}
-
-		r.Out.Host = r.In.Host
-		addProxyForwardedHeaders(r)
-		rp.lb.addTailscaleIdentityHeaders(r)
-	}}
+	}
+	p := &httputil.ReverseProxy{Rewrite: rp.rewrite}
 
 	// There is no way to autodetect h2c as per RFC 9113
 	// https://datatracker.ietf.org/doc/html/rfc9113#name-starting-http-2.
@@ -660,22 +1063,50 @@ func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p.ServeHTTP(w, r)
 }
 
+// rewrite rewrites the outgoing request r.Out to go to the backend.
+func (rp *reverseProxy) rewrite(r *httputil.ProxyRequest) {
+	oldOutPath := r.Out.URL.Path
+	r.SetURL(rp.url)
+
+	// If mount point matches the request path exactly, the outbound
+	// request URL was set to empty string in serveWebHandler which
+	// would have resulted in the outbound path set to <proxy path>
+	// + '/' in SetURL. In that case, if the proxy path was set, we
+	// want to send the request to the <proxy path> (without the
+	// '/') .
+	if oldOutPath == "" && rp.url.Path != "" {
+		r.Out.URL.Path = rp.url.Path
+		r.Out.URL.RawPath = rp.url.RawPath
+	}
+
+	r.Out.Host = cmp.Or(rp.host, r.In.Host)
+	addProxyForwardedHeaders(r)
+	rp.lb.addTailscaleIdentityHeaders(r)
+}
+
 // getTransport returns the Transport used for regular (non-GRPC) requests
 // to the backend. The Transport gets created lazily, at most once.
 func (rp *reverseProxy) getTransport() *http.Transport {
 	return rp.httpTransport.Get(func() *http.Transport {
-		return &http.Transport{
-			DialContext: rp.lb.dialer.SystemDial,
+		t := &http.Transport{
+			DialContext: rp.dial,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: rp.insecure,
 			},
 			// Values for the following parameters have been copied from http.DefaultTransport.
 			ForceAttemptHTTP2:     true,
 			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
+			IdleConnTimeout:       cmp.Or(rp.keepalive, ipn.DefaultBackendKeepalive),
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
+			ResponseHeaderTimeout: rp.responseHeaderTimeout,
+		}
+		if rp.noHTTP2 {
+			// A non-nil, empty TLSNextProto disables HTTP/2 negotiation.
+			t.ForceAttemptHTTP2 = false
+			t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
 		}
+		return t
 	})
 }
 
@@ -684,19 +1115,51 @@ func (rp *reverseProxy) getTransport() *http.Transport {
 func (rp *reverseProxy) getH2CTransport() *http2.Transport {
 	return rp.h2cTransport.Get(func() *http2.Transport {
 		return &http2.Transport{
-			AllowHTTP: true,
+			AllowHTTP:       true,
+			IdleConnTimeout: cmp.Or(rp.keepalive, ipn.DefaultBackendKeepalive),
 			DialTLSContext: func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
-				return rp.lb.dialer.SystemDial(ctx, "tcp", rp.url.Host)
+				return rp.dial(ctx, "tcp", rp.url.Host)
 			},
 		}
 	})
 }
 
+// dial connects to the backend: to its named pipe, if it has one, or else
+// to addr.
+func (rp *reverseProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if rp.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rp.connectTimeout)
+		defer cancel()
+	}
+	if rp.pipe != "" {
+		return dialPipe(ctx, rp.pipe)
+	}
+	return rp.lb.dialer.SystemDial(ctx, network, addr)
+}
+
+// checkReachable reports whether the backend accepts connections.
+func (rp *reverseProxy) checkReachable(ctx context.Context) error {
+	addr := rp.url.Host
+	if rp.url.Port() == "" {
+		port := "80"
+		if rp.url.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(rp.url.Hostname(), port)
+	}
+	c, err := rp.dial(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
 // This is not a generally reliable way how to determine whether a request is
 // for a h2c server, but sufficient for our particular use case.
 func (rp *reverseProxy) shouldProxyViaH2C(r *http.Request) bool {
 	contentType := r.Header.Get(contentTypeHeader)
-	return r.ProtoMajor == 2 && strings.HasPrefix(rp.backend, "http://") && isGRPCContentType(contentType)
+	return !rp.noHTTP2 && r.ProtoMajor == 2 && strings.HasPrefix(rp.backend, "http://") && isGRPCContentType(contentType)
 }
 
 // isGRPC accepts an HTTP request's content type header value and determines
@@ -709,6 +1172,148 @@ func isGRPCContentType(contentType string) bool {
 	return ok && (len(s) == 0 || s[0] == '+' || s[0] == ';')
 }
 
+// parseGRPCWebContentType reports whether contentType is a gRPC-Web content
+// type (application/grpc-web or application/grpc-web-text, optionally
+// followed by a "+codec" or ";params" suffix). If so, it returns the suffix
+// and whether the body is base64 encoded (the -text variant).
+func parseGRPCWebContentType(contentType string) (suffix string, text, ok bool) {
+	s, ok := strings.CutPrefix(contentType, grpcWebContentType)
+	if !ok {
+		return "", false, false
+	}
+	s, text = strings.CutPrefix(s, "-text")
+	if len(s) != 0 && s[0] != '+' && s[0] != ';' {
+		return "", false, false
+	}
+	return s, text, true
+}
+
+// grpcWebDropHeaders are the request headers that serveGRPCWeb doesn't
+// forward to the backend: hop-by-hop headers and, like
+// httputil.ReverseProxy, incoming forwarding headers.
+var grpcWebDropHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Forwarded",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Grpc-Web",
+}
+
+// serveGRPCWeb serves a gRPC-Web request by making the equivalent gRPC
+// request to the backend and translating the response back: gRPC response
+// trailers are sent as a final length-prefixed message with the 0x80 flag
+// set, as specified by
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md.
+// The suffix is the content type's "+codec" or ";params" suffix, and text
+// reports whether messages are base64 encoded (application/grpc-web-text).
+func (rp *reverseProxy) serveGRPCWeb(w http.ResponseWriter, r *http.Request, suffix string, text bool) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Close = false
+	for _, h := range grpcWebDropHeaders {
+		out.Header.Del(h)
+	}
+	rp.rewrite(&httputil.ProxyRequest{In: r, Out: out})
+	out.Header.Set(contentTypeHeader, grpcBaseContentType+suffix)
+	out.Header.Set("Te", "trailers")
+	if text {
+		out.ContentLength = -1
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{base64.NewDecoder(base64.StdEncoding, r.Body), r.Body}
+	}
+
+	var rt http.RoundTripper
+	if rp.url.Scheme == "http" {
+		rt = rp.getH2CTransport()
+	} else {
+		rt = rp.getTransport()
+	}
+	res, err := rt.RoundTrip(out)
+	if err != nil {
+		rp.logf("gRPC-Web proxy error: %v", err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	h := w.Header()
+	for k, vv := range res.Header {
+		h[k] = vv
+	}
+	h.Del("Content-Length")
+	if ct := res.Header.Get(contentTypeHeader); isGRPCContentType(ct) {
+		webCT := grpcWebContentType
+		if text {
+			webCT += "-text"
+		}
+		h.Set(contentTypeHeader, webCT+strings.TrimPrefix(ct, grpcBaseContentType))
+	}
+	w.WriteHeader(res.StatusCode)
+
+	var bw io.Writer = w
+	var enc io.WriteCloser
+	if text {
+		enc = base64.NewEncoder(base64.StdEncoding, w)
+		bw = enc
+	}
+	rc := http.NewResponseController(w) // w may be wrapped; see logServeRequest
+	flush := func() {
+		rc.Flush()
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := bw.Write(buf[:n]); werr != nil {
+				return
+			}
+			flush()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rp.logf("gRPC-Web proxy: reading response: %v", err)
+			return
+		}
+	}
+	// Trailers are only known once the body has been read. A
+	// "trailers-only" response has its status in the headers instead.
+	if len(res.Trailer) > 0 {
+		bw.Write(grpcWebTrailerFrame(res.Trailer))
+	}
+	if enc != nil {
+		enc.Close()
+	}
+	flush()
+}
+
+// grpcWebTrailerFrame returns the gRPC-Web message that carries the
+// trailers tr: a 0x80 flag byte, the big-endian uint32 length, and
+// the trailers as lower-case "key: value\r\n" lines.
+func grpcWebTrailerFrame(tr http.Header) []byte {
+	var b []byte
+	for _, k := range slices.Sorted(maps.Keys(tr)) {
+		for _, v := range tr[k] {
+			b = fmt.Appendf(b, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+	frame := make([]byte, 5, 5+len(b))
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	return append(frame, b...)
+}
+
 func addProxyForwardedHeaders(r *httputil.ProxyRequest) {
 	r.Out.Header.Set("X-Forwarded-Host", r.In.Host)
 	if r.In.TLS != nil {
@@ -765,29 +1370,176 @@ func encTailscaleHeaderValue(v string) string {
 	return mime.QEncoding.Encode("utf-8", v)
 }
 
+// serveRequestHasTag reports whether r comes from a tailnet peer that has
+// the given ACL tag. Funnel requests never do.
+func (b *LocalBackend) serveRequestHasTag(r *http.Request, tag string) bool {
+	c, ok := serveHTTPContextKey.ValueOk(r.Context())
+	if !ok || c.Funnel != nil {
+		return false
+	}
+	node, _, ok := b.WhoIs("tcp", c.SrcAddr)
+	return ok && views.SliceContains(node.Tags(), tag)
+}
+
+// serveRequestFromTailnet reports whether r comes from a tailnet peer,
+// rather than over Funnel or from the local machine.
+func (b *LocalBackend) serveRequestFromTailnet(r *http.Request) bool {
+	c, ok := serveHTTPContextKey.ValueOk(r.Context())
+	if !ok || c.Funnel != nil {
+		return false
+	}
+	_, _, ok = b.WhoIs("tcp", c.SrcAddr)
+	return ok
+}
+
+// serveRequestFromAllowedSource reports whether r comes from a client
+// address that h accepts, per its AllowCIDRs.
+func serveRequestFromAllowedSource(r *http.Request, h ipn.HTTPHandlerView) bool {
+	if h.AllowCIDRs().Len() == 0 {
+		return true
+	}
+	c, ok := serveHTTPContextKey.ValueOk(r.Context())
+	return ok && h.AllowsSource(c.SrcAddr.Addr())
+}
+
+// serveRequestHasBasicAuth reports whether r has the HTTP Basic auth
+// credentials of one of h's BasicAuth users, if it has any.
+//
+// So as not to reveal through its timing which users exist, it compares
+// user names in constant time and always checks the password against a
+// bcrypt hash, a dummy one if there's no such user.
+func serveRequestHasBasicAuth(r *http.Request, h ipn.HTTPHandlerView) bool {
+	if h.BasicAuth().Len() == 0 {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	var hash string
+	found := false
+	for _, e := range h.BasicAuth().All() {
+		u, uh, _ := strings.Cut(e, ":")
+		if subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 && !found {
+			hash, found = uh, true
+		}
+	}
+	if !found {
+		_, hash, _ = strings.Cut(h.BasicAuth().At(0), ":")
+		bcrypt.CompareHashAndPassword(basicAuthDummyHash(hash), []byte(pass))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// basicAuthDummyHashes caches, by bcrypt cost, the hashes that
+// serveRequestHasBasicAuth checks the passwords of unknown users against.
+var basicAuthDummyHashes syncs.Map[int, []byte]
+
+// basicAuthDummyHash returns a bcrypt hash with the same cost as hash, so
+// that checking a password against it takes as long.
+func basicAuthDummyHash(hash string) []byte {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		cost = bcrypt.DefaultCost
+	}
+	dummy, _ := basicAuthDummyHashes.LoadOrInit(cost, func() []byte {
+		h, _ := bcrypt.GenerateFromPassword([]byte("tailscale-serve-dummy-password"), cost)
+		return h
+	})
+	return dummy
+}
+
 // serveWebHandler is an http.HandlerFunc that maps incoming requests to the
 // correct *http.
 func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
-	h, mountPoint, ok := b.getServeHandler(r)
+	h, hp, mountPoint, ok := b.getServeHandler(r)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	hrw := &httpResponseWrapper{ResponseWriter: w}
+	w = hrw
+	defer b.countServeRequest(hrw, hp, mountPoint)
+	if lvl := h.LogLevel(); lvl == ipn.LogLevelInfo || lvl == ipn.LogLevelDebug {
+		defer b.logServeRequest(r, hrw, mountPoint, lvl == ipn.LogLevelDebug, b.clock.Now())
+	}
+	if !h.AllowsMethod(r.Method) {
+		w.Header().Set("Allow", strings.Join(h.AllowMethods().AsSlice(), ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !serveRequestFromAllowedSource(r, h) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if tag := h.RequireTag(); tag != "" && !b.serveRequestHasTag(r, tag) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !serveRequestHasBasicAuth(r, h) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tailscale serve", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if page, ok := b.serveMaintenance(r); ok {
+		b.serveMaintenancePage(w, page)
+		return
+	}
+	if h.Compress() && acceptsGzip(r) {
+		gw := newGzipResponseWriter(w)
+		defer gw.Close()
+		w = gw
+	}
 	if s := h.Text(); s != "" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		io.WriteString(w, s)
 		return
 	}
 	if v := h.Path(); v != "" {
-		b.serveFileOrDirectory(w, r, v, mountPoint)
+		if cc := h.CacheControl(); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		if h.WebDAV() {
+			b.serveWebDAV(w, r, v, mountPoint, h.WebDAVReadOnly())
+			return
+		}
+		if ct := h.ContentType(); ct != "" {
+			// http.ServeContent doesn't replace a Content-Type that's
+			// already set.
+			w.Header().Set("Content-Type", ct)
+		}
+		b.serveFileOrDirectory(w, r, v, mountPoint, h.OverlayPaths().AsSlice(), h.SPAFallback(), h.ServeDotfiles())
 		return
 	}
-	if v := h.Proxy(); v != "" {
-		p, ok := b.serveProxyHandlers.Load(v)
+	if v := h.Archive(); v != "" {
+		if cc := h.CacheControl(); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		b.serveArchive(w, r, v, mountPoint)
+		return
+	}
+	if h.AggregateBackends() {
+		b.serveAggregateBackendHealth(w, r)
+		return
+	}
+	if h.RedirectToHTTPS() {
+		host, _, _ := net.SplitHostPort(string(hp))
+		http.Redirect(w, r, httpsRedirectURL(host, r.URL), http.StatusMovedPermanently)
+		return
+	}
+	if backend := h.Proxy(); backend != "" {
+		if c := h.Canary(); c != "" && rand.IntN(100) < h.CanaryPercent() {
+			backend = c
+		}
+		p, ok := b.serveProxyHandlers.Load(serveProxyKeyFor(h, backend))
 		if !ok {
 			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
 			return
 		}
+		if name := h.RequestIDHeader(); name != "" && r.Header.Get(name) == "" {
+			r.Header.Set(name, newServeRequestID())
+		}
 		h := p.(http.Handler)
 		// Trim the mount point from the URL path before proxying. (#6571)
 		if r.URL.Path != "/" {
@@ -800,7 +1552,208 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "empty handler", 500)
 }
 
-func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
+// serveMaintenance reports whether the serve config that r is served with
+// is in maintenance mode, and if so, the path of its maintenance page, if
+// any. See ipn.ServeConfig.MaintenanceMode.
+func (b *LocalBackend) serveMaintenance(r *http.Request) (page string, ok bool) {
+	sctx, ok := serveHTTPContextKey.ValueOk(r.Context())
+	if !ok {
+		return "", false
+	}
+	sc := b.serveConfigForConn(sctx)
+	return sc.MaintenancePage(), sc.MaintenanceMode()
+}
+
+// serveMaintenancePage responds to a request for a web handler in
+// maintenance mode with 503 Service Unavailable and the HTML file page, or
+// a plain text message if page is empty or can't be read.
+func (b *LocalBackend) serveMaintenancePage(w http.ResponseWriter, page string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if page != "" {
+		html, err := os.ReadFile(page)
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(html)
+			return
+		}
+		b.logf("serve: can't read maintenance page: %v", err)
+	}
+	http.Error(w, "This service is down for maintenance. Please try again later.", http.StatusServiceUnavailable)
+}
+
+// newServeRequestID returns a new random ID for the
+// ipn.HTTPHandler.RequestIDHeader of a proxied request.
+func newServeRequestID() string {
+	return rands.HexString(32)
+}
+
+// serveHandlerLabel is the label of the serve web handler metrics: the web
+// server and mount point of the handler.
+type serveHandlerLabel struct {
+	HostPort string
+	Mount    string
+}
+
+// countServeRequest counts a request served by the web handler at
+// mountPoint of hp, once its response has been written to w.
+func (b *LocalBackend) countServeRequest(w *httpResponseWrapper, hp ipn.HostPort, mountPoint string) {
+	l := serveHandlerLabel{HostPort: string(hp), Mount: mountPoint}
+	b.metrics.serveRequests.Add(l, 1)
+	b.metrics.serveBytesSent.Add(l, w.contentLength)
+}
+
+// ServeStats returns the traffic counters of the serve web handlers that
+// have served requests since tailscaled started, sorted by HostPort and
+// mount point.
+func (b *LocalBackend) ServeStats() []ipn.ServeHandlerStats {
+	var ret []ipn.ServeHandlerStats
+	index := map[serveHandlerLabel]int{} // into ret
+	b.metrics.serveRequests.Do(func(kv tsmetrics.KeyValue[serveHandlerLabel]) {
+		index[kv.Key] = len(ret)
+		ret = append(ret, ipn.ServeHandlerStats{
+			HostPort: ipn.HostPort(kv.Key.HostPort),
+			Mount:    kv.Key.Mount,
+			Requests: kv.Value.(*expvar.Int).Value(),
+		})
+	})
+	b.metrics.serveBytesSent.Do(func(kv tsmetrics.KeyValue[serveHandlerLabel]) {
+		if i, ok := index[kv.Key]; ok {
+			ret[i].BytesSent = kv.Value.(*expvar.Int).Value()
+		}
+	})
+	slices.SortFunc(ret, func(a, b ipn.ServeHandlerStats) int {
+		return cmp.Or(cmp.Compare(a.HostPort, b.HostPort), cmp.Compare(a.Mount, b.Mount))
+	})
+	return ret
+}
+
+// redactedServeHeaders are the headers whose values logServeRequest doesn't
+// log.
+var redactedServeHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
+// logServeRequest logs a request r served by a handler with an
+// ipn.HTTPHandler.LogLevel of info or, if debug, debug, once the response
+// has been written to w. The request started at start.
+func (b *LocalBackend) logServeRequest(r *http.Request, w *httpResponseWrapper, mountPoint string, debug bool, start time.Time) {
+	var src netip.AddrPort
+	if c, ok := serveHTTPContextKey.ValueOk(r.Context()); ok {
+		src = c.SrcAddr
+	}
+	status := w.statusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	b.logf("serve: [%s] %s %s%s from %v: %d, %d bytes in %v",
+		mountPoint, r.Method, r.Host, r.URL.RequestURI(), src, status, w.contentLength, b.clock.Since(start).Round(time.Millisecond))
+	if debug {
+		b.logf("serve: [%s] request headers: %v", mountPoint, redactServeHeaders(r.Header))
+		b.logf("serve: [%s] response headers: %v", mountPoint, redactServeHeaders(w.Header()))
+	}
+}
+
+// redactServeHeaders returns a copy of h with the values of the
+// redactedServeHeaders replaced, for logging.
+func redactServeHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedServeHeaders {
+		if _, ok := h[k]; ok {
+			h[k] = []string{"[redacted]"}
+		}
+	}
+	return h
+}
+
+// httpsRedirectURL returns the HTTPS URL that an ipn.HTTPHandler with
+// RedirectToHTTPS redirects a request for u on host to: the same host (on
+// the default port), path and query.
+func httpsRedirectURL(host string, u *url.URL) string {
+	return (&url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     u.Path,
+		RawPath:  u.RawPath,
+		RawQuery: u.RawQuery,
+	}).String()
+}
+
+// backendHealthTimeout is how long serveAggregateBackendHealth waits for
+// each proxy backend to accept a connection.
+const backendHealthTimeout = 5 * time.Second
+
+// serveAggregateBackendHealth serves an ipn.HTTPHandler with
+// AggregateBackends set. It responds 200 OK if every proxy backend in the
+// current serve config (not counting those of configs still draining)
+// accepts a TCP connection, and 503 Service Unavailable if any don't or if
+// there are none. For tailnet peers, the body lists the status of each
+// backend; others, such as Funnel clients, only get the aggregate state,
+// and failures are logged instead.
+func (b *LocalBackend) serveAggregateBackendHealth(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	sc := b.serveConfig
+	b.mu.Unlock()
+
+	proxies := make(map[string]*reverseProxy)
+	if sc.Valid() {
+		sc.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
+			conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
+				for _, backend := range []string{h.Proxy(), h.Canary()} {
+					if backend == "" {
+						continue
+					}
+					if v, ok := b.serveProxyHandlers.Load(serveProxyKeyFor(h, backend)); ok {
+						proxies[backend] = v.(*reverseProxy)
+					}
+				}
+				return true
+			})
+			return true
+		})
+	}
+	backends := slices.Sorted(maps.Keys(proxies))
+
+	ctx, cancel := context.WithTimeout(r.Context(), backendHealthTimeout)
+	defer cancel()
+	errs := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = proxies[backend].checkReachable(ctx)
+		}()
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	var sb strings.Builder
+	if len(backends) == 0 {
+		code = http.StatusServiceUnavailable
+		sb.WriteString("no proxy backends configured\n")
+	}
+	for i, backend := range backends {
+		if err := errs[i]; err != nil {
+			code = http.StatusServiceUnavailable
+			b.logf("serve: backend %s is unhealthy: %v", backend, err)
+			fmt.Fprintf(&sb, "%s: %v\n", backend, err)
+		} else {
+			fmt.Fprintf(&sb, "%s: ok\n", backend)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if !b.serveRequestFromTailnet(r) {
+		if code == http.StatusOK {
+			io.WriteString(w, "ok\n")
+		} else {
+			io.WriteString(w, "unavailable\n")
+		}
+		return
+	}
+	io.WriteString(w, sb.String())
+}
+
+func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string, overlays []string, spaFallback, serveDotfiles bool) {
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -834,8 +1787,19 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 		http.Redirect(w, r, mountPoint, http.StatusFound)
 		return
 	}
+	var dir http.FileSystem = http.Dir(fileOrDir)
+	if len(overlays) > 0 {
+		dir = overlayDirs(append([]string{fileOrDir}, overlays...))
+	}
+	if !serveDotfiles {
+		dir = dotfileHidingFS{dir}
+	}
+	if spaFallback && !fsHasPath(dir, strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(mountPoint, "/"))) {
+		b.serveSPAIndex(w, r, dir)
+		return
+	}
 
-	var fs http.Handler = http.FileServer(http.Dir(fileOrDir))
+	var fs http.Handler = http.FileServer(dir)
 	if mountPoint != "/" {
 		fs = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), fs)
 	}
@@ -845,6 +1809,101 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 	}, r)
 }
 
+// overlayDirs is an http.FileSystem that merges directories, for an
+// ipn.HTTPHandler with OverlayPaths set. Opening a name opens it in the last
+// directory that has it.
+type overlayDirs []string
+
+func (dirs overlayDirs) Open(name string) (http.File, error) {
+	var err error
+	for i := len(dirs) - 1; i >= 0; i-- {
+		var f http.File
+		f, err = http.Dir(dirs[i]).Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return nil, err
+}
+
+// dotfileHidingFS is an http.FileSystem that hides the files and
+// directories whose names start with a period, such as .git and .env, for
+// an ipn.HTTPHandler without ServeDotfiles set. Opening one, or anything
+// under one, fails as if it didn't exist, and directory listings leave
+// them out.
+type dotfileHidingFS struct {
+	http.FileSystem
+}
+
+func (fsys dotfileHidingFS) Open(name string) (http.File, error) {
+	if hasDotfileElem(name) {
+		return nil, fs.ErrNotExist
+	}
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dotfileHidingFile{f}, nil
+}
+
+// hasDotfileElem reports whether any element of the slash-separated path
+// name starts with a period.
+func hasDotfileElem(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// dotfileHidingFile is an http.File of a dotfileHidingFS, whose Readdir
+// leaves out dotfiles.
+type dotfileHidingFile struct {
+	http.File
+}
+
+func (f dotfileHidingFile) Readdir(n int) ([]fs.FileInfo, error) {
+	fis, err := f.File.Readdir(n)
+	fis = slices.DeleteFunc(fis, func(fi fs.FileInfo) bool {
+		return strings.HasPrefix(fi.Name(), ".")
+	})
+	return fis, err
+}
+
+// fsHasPath reports whether the slash-separated path p names an existing
+// file or directory in fsys.
+func fsHasPath(fsys http.FileSystem, p string) bool {
+	f, err := fsys.Open(path.Clean("/" + p))
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// serveSPAIndex serves the index.html file at the root of dir, for an
+// ipn.HTTPHandler with SPAFallback set.
+func (b *LocalBackend) serveSPAIndex(w http.ResponseWriter, r *http.Request, dir http.FileSystem) {
+	f, err := dir.Open("/index.html")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		b.logf("error opening index.html: %v", err)
+		http.Error(w, "an error occurred reading the file or directory", 500)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, "index.html", fi.ModTime(), f)
+}
+
 // fixLocationHeaderResponseWriter is an http.ResponseWriter wrapper that, upon
 // flushing HTTP headers, prefixes any Location header with the mount point.
 type fixLocationHeaderResponseWriter struct {
@@ -0,0 +1,306 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+// serveArchive serves the files in the zip or tar archive at archivePath
+// for an ipn.HTTPHandler with Archive set, like serveFileOrDirectory does
+// for a directory.
+func (b *LocalBackend) serveArchive(w http.ResponseWriter, r *http.Request, archivePath, mountPoint string) {
+	a, err := b.serveArchives.get(archivePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		b.logf("error opening archive %s: %v", archivePath, err)
+		http.Error(w, "an error occurred reading the archive", 500)
+		return
+	}
+	if len(r.URL.Path) < len(mountPoint) && r.URL.Path+"/" == mountPoint {
+		http.Redirect(w, r, mountPoint, http.StatusFound)
+		return
+	}
+
+	var fs http.Handler = http.FileServer(http.FS(a))
+	if mountPoint != "/" {
+		fs = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), fs)
+	}
+	fs.ServeHTTP(&fixLocationHeaderResponseWriter{
+		ResponseWriter: w,
+		mountPoint:     mountPoint,
+	}, r)
+}
+
+// pruneServeArchivesLocked removes the archives that neither b.serveConfig
+// nor a draining config serves from b.serveArchives.
+func (b *LocalBackend) pruneServeArchivesLocked() {
+	keep := make(set.Set[string])
+	for _, sc := range b.servingServeConfigsLocked() {
+		sc.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
+			conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
+				if a := h.Archive(); a != "" {
+					keep.Add(a)
+				}
+				return true
+			})
+			return true
+		})
+	}
+	b.serveArchives.retain(keep.Contains)
+}
+
+// archiveCache caches the open archives of Archive handlers, so they
+// don't need to be re-read for every request. The zero value is ready
+// for use.
+//
+// Archives that are evicted, or replaced because they changed on disk,
+// aren't closed, as requests may still be reading from them; their files
+// are closed by the os.File finalizer once they're no longer in use.
+type archiveCache struct {
+	mu sync.Mutex
+	m  map[string]*archiveFS // by path
+}
+
+// get returns the archive at name, opening it if it's not cached or if
+// it has changed on disk since it was opened.
+func (c *archiveCache) get(name string) (*archiveFS, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if a, ok := c.m[name]; ok && a.size == fi.Size() && a.modTime.Equal(fi.ModTime()) {
+		return a, nil
+	}
+	a, err := openArchive(name)
+	if err != nil {
+		return nil, err
+	}
+	mak.Set(&c.m, name, a)
+	return a, nil
+}
+
+// retain removes the archives whose path keep doesn't report true from
+// the cache.
+func (c *archiveCache) retain(keep func(name string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.m {
+		if !keep(name) {
+			delete(c.m, name)
+		}
+	}
+}
+
+// archiveFS is a read-only fs.FS of the files in an archive file.
+type archiveFS struct {
+	fs.FS
+
+	// size and modTime are those of the archive file when it was opened.
+	size    int64
+	modTime time.Time
+}
+
+// openArchive opens the zip or tar file at name, as determined by
+// ipn.ArchiveFormat, and reads its index.
+func openArchive(name string) (*archiveFS, error) {
+	format := ipn.ArchiveFormat(name)
+	if format == "" {
+		return nil, fmt.Errorf("%s: unsupported archive format", name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var fsys fs.FS
+	switch format {
+	case "zip":
+		fsys, err = zip.NewReader(f, fi.Size())
+	case "tar":
+		fsys, err = newTarFS(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &archiveFS{FS: fsys, size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+// tarFS is an fs.FS of the regular files and directories in an
+// uncompressed tar file. Files are read directly out of the tar file.
+type tarFS struct {
+	ra    io.ReaderAt
+	files map[string]*tarEntry // by fs.ValidPath name; "." is the root
+}
+
+type tarEntry struct {
+	fi   fs.FileInfo
+	off  int64         // offset of the file's contents in the tar file
+	kids []fs.DirEntry // for directories, sorted by name
+}
+
+// countingReader is an io.Reader that counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// newTarFS reads the index of the tar file in ra, which must also be
+// readable from its start as an io.Reader.
+func newTarFS(ra interface {
+	io.Reader
+	io.ReaderAt
+}) (*tarFS, error) {
+	t := &tarFS{
+		ra:    ra,
+		files: map[string]*tarEntry{".": {fi: tarDirInfo(".")}},
+	}
+	// The tar.Reader reads exactly up to the end of each header, so the
+	// number of bytes read when Next returns is the offset of the entry's
+	// contents.
+	cr := &countingReader{r: ra}
+	tr := tar.NewReader(cr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+h.Name), "/")
+		if name == "" || !fs.ValidPath(name) {
+			continue
+		}
+		switch h.Typeflag {
+		case tar.TypeReg:
+			t.addParents(name)
+			t.files[name] = &tarEntry{fi: h.FileInfo(), off: cr.n}
+		case tar.TypeDir:
+			t.addParents(name)
+			if e, ok := t.files[name]; ok {
+				e.fi = h.FileInfo()
+			} else {
+				t.files[name] = &tarEntry{fi: h.FileInfo()}
+			}
+		default:
+			// Links, devices, sparse files, etc. aren't served.
+		}
+	}
+	for name, e := range t.files {
+		if name == "." {
+			continue
+		}
+		parent := t.files[path.Dir(name)]
+		parent.kids = append(parent.kids, fs.FileInfoToDirEntry(e.fi))
+	}
+	for _, e := range t.files {
+		slices.SortFunc(e.kids, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	}
+	return t, nil
+}
+
+// addParents adds directory entries for the parent directories of name
+// that don't have one yet, replacing any file entries in the way.
+func (t *tarFS) addParents(name string) {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if e, ok := t.files[dir]; ok && e.fi.IsDir() {
+			return
+		}
+		t.files[dir] = &tarEntry{fi: tarDirInfo(path.Base(dir))}
+	}
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := t.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.fi.IsDir() {
+		return &tarDir{e: e}, nil
+	}
+	return &tarFile{SectionReader: io.NewSectionReader(t.ra, e.off, e.fi.Size()), fi: e.fi}, nil
+}
+
+// tarFile is an open regular file in a tarFS.
+type tarFile struct {
+	*io.SectionReader
+	fi fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+func (f *tarFile) Close() error               { return nil }
+
+// tarDir is an open directory in a tarFS.
+type tarDir struct {
+	e   *tarEntry
+	pos int // index into e.kids of the next ReadDir result
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.e.fi, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.e.fi.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.e.kids[d.pos:]
+	if n <= 0 {
+		d.pos += len(rest)
+		return slices.Clone(rest), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.pos += n
+	return slices.Clone(rest[:n]), nil
+}
+
+// tarDirInfo is the fs.FileInfo of a directory that's implied by the
+// paths in a tar file but has no entry of its own.
+type tarDirInfo string
+
+func (fi tarDirInfo) Name() string       { return string(fi) }
+func (fi tarDirInfo) Size() int64        { return 0 }
+func (fi tarDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (fi tarDirInfo) ModTime() time.Time { return time.Time{} }
+func (fi tarDirInfo) IsDir() bool        { return true }
+func (fi tarDirInfo) Sys() any           { return nil }
@@ -0,0 +1,213 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// testArchiveFiles are the files in the archives made by writeTestZip and
+// makeTestTar.
+var testArchiveFiles = map[string]string{
+	"index.html":     "<h1>home</h1>",
+	"./sub/a.txt":    "aaa",
+	"sub/deep/b.txt": "bbb",
+}
+
+func writeTestZip(t *testing.T, name string) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range testArchiveFiles {
+		w, err := zw.Create(filepath.Clean(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, contents)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func makeTestTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(h *tar.Header, contents string) {
+		t.Helper()
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, contents)
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	add(&tar.Header{Name: "empty/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}, "")
+	add(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", ModTime: mtime}, "")
+	add(&tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, ModTime: mtime}, "bad")
+	for name, contents := range testArchiveFiles {
+		add(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents)), ModTime: mtime}, contents)
+	}
+	// A long name needs a PAX header, which moves the contents further
+	// from the start of the entry.
+	long := "sub/" + string(bytes.Repeat([]byte("x"), 150)) + ".txt"
+	add(&tar.Header{Name: long, Typeflag: tar.TypeReg, Mode: 0644, Size: 4, ModTime: mtime}, "long")
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarFS(t *testing.T) {
+	fsys, err := newTarFS(bytes.NewReader(makeTestTar(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "index.html", "sub/a.txt", "sub/deep/b.txt", "empty", "escape.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Open("link"); err == nil {
+		t.Error("symlink was served")
+	}
+	b, err := fs.ReadFile(fsys, "sub/"+string(bytes.Repeat([]byte("x"), 150))+".txt")
+	if err != nil || string(b) != "long" {
+		t.Errorf("reading long name = %q, %v; want %q", b, err, "long")
+	}
+}
+
+func TestServeArchive(t *testing.T) {
+	b := newTestBackend(t)
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "site.zip")
+	writeTestZip(t, zipPath)
+	tarPath := filepath.Join(dir, "site.tar")
+	if err := os.WriteFile(tarPath, makeTestTar(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":        {Archive: zipPath, CacheControl: "max-age=60"},
+				"/t/":      {Archive: tarPath},
+				"/gone/":   {Archive: filepath.Join(dir, "missing.zip")},
+				"/broken/": {Archive: filepath.Join(dir, "broken.zip")},
+			}},
+		},
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.zip"), []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"/", 200, "<h1>home</h1>"},
+		{"/sub/a.txt", 200, "aaa"},
+		{"/sub/deep/b.txt", 200, "bbb"},
+		{"/nope.txt", 404, ""},
+		{"/t/", 200, "<h1>home</h1>"},
+		{"/t/sub/deep/b.txt", 200, "bbb"},
+		{"/t/link", 404, ""},
+		{"/gone/index.html", 404, ""},
+		{"/broken/index.html", 500, ""},
+	}
+	for _, tt := range tests {
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: tt.path},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+			}))
+
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d; want %d", tt.path, w.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+			t.Errorf("%s: got body %q; want %q", tt.path, w.Body.String(), tt.wantBody)
+		}
+	}
+
+	// Archives are cached until they're no longer served.
+	if _, ok := b.serveArchives.m[zipPath]; !ok {
+		t.Errorf("%s not cached", zipPath)
+	}
+	if err := b.SetServeConfig(&ipn.ServeConfig{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(b.serveArchives.m); n != 0 {
+		t.Errorf("%d archives still cached after config reset", n)
+	}
+}
+
+func TestArchiveCacheReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "site.tar")
+	write := func(contents string, mtime time.Time) {
+		t.Helper()
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "f.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+		io.WriteString(tw, contents)
+		tw.Close()
+		if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(c *archiveCache) string {
+		t.Helper()
+		a, err := c.get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := fs.ReadFile(a, "f.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	var c archiveCache
+	write("one", time.Unix(1000, 0))
+	if got := read(&c); got != "one" {
+		t.Errorf("got %q; want %q", got, "one")
+	}
+	write("two", time.Unix(2000, 0))
+	if got := read(&c); got != "two" {
+		t.Errorf("after change, got %q; want %q", got, "two")
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !unix
+
+package ipnlocal
+
+import (
+	"errors"
+	"net"
+)
+
+// setListenBacklog reports that setting the backlog of a listener, for
+// ipn.TCPPortHandler.Backlog, isn't supported on this platform.
+func setListenBacklog(ln net.Listener, n int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,36 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package ipnlocal
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setListenBacklog sets the length of ln's queue of connections not yet
+// accepted to n, for ipn.TCPPortHandler.Backlog. The net package always
+// listens with the system's maximum, so it calls listen(2) again on the
+// socket, which updates the backlog of a socket that's already listening.
+func setListenBacklog(ln net.Listener, n int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := rc.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), n)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,183 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// serveCompressMinSize is the size below which responses of a handler with
+// ipn.HTTPHandler.Compress set are sent uncompressed, as compressing them
+// would save little or nothing.
+const serveCompressMinSize = 1024
+
+// acceptsGzip reports whether the client that sent r accepts gzip-encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(r.Header["Accept-Encoding"], "gzip")
+}
+
+// incompressibleType reports whether responses of the media type ct are
+// already compressed, such that gzipping them again is a waste of CPU.
+func incompressibleType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mt == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mt, "image/"), strings.HasPrefix(mt, "video/"), strings.HasPrefix(mt, "audio/"),
+		strings.HasPrefix(mt, "font/woff"):
+		return true
+	}
+	switch mt {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed", "application/pdf":
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter is an http.ResponseWriter that gzips the response, for
+// an ipn.HTTPHandler with Compress set, if it turns out to be worth it: at
+// least serveCompressMinSize bytes, of a type that isn't already compressed
+// and not already encoded by the handler (such as by a proxy backend).
+//
+// Until it has seen serveCompressMinSize bytes of the body, it buffers the
+// body and holds back the response header. Flushing it before then sends
+// the response uncompressed, so that streaming responses aren't delayed.
+// Close must be called once the handler has returned.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	code    int    // status code passed to WriteHeader, or 0
+	buf     []byte // body written before deciding whether to compress
+	decided bool   // whether the header has been sent
+	gz      *gzip.Writer
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+// WriteHeader implements http.ResponseWriter. Informational (1xx) headers
+// are sent right away; others are held back until the body is known to be
+// big enough to compress.
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if code >= 100 && code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < serveCompressMinSize {
+			return len(p), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// decide sends the response header, gzip-encoded if compress is true and
+// the response is eligible, followed by any buffered body.
+func (w *gzipResponseWriter) decide(compress bool) error {
+	w.decided = true
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	h := w.Header()
+	if compress && w.shouldCompress() {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		h.Add("Vary", "Accept-Encoding")
+		w.ResponseWriter.WriteHeader(w.code)
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		_, err := w.gz.Write(w.buf)
+		w.buf = nil
+		return err
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *gzipResponseWriter) shouldCompress() bool {
+	h := w.Header()
+	switch w.code {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	return h.Get("Content-Encoding") == "" &&
+		h.Get("Content-Range") == "" &&
+		!incompressibleType(h.Get("Content-Type"))
+}
+
+// Flush implements http.Flusher.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker, for proxying protocol upgrades such as
+// WebSockets.
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.decided {
+		return nil, nil, errors.New("can't hijack a connection after writing a response")
+	}
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the response, sending any body still buffered
+// uncompressed, since it's smaller than serveCompressMinSize.
+func (w *gzipResponseWriter) Close() error {
+	if !w.decided {
+		if w.code == 0 {
+			// Nothing was written; leave the response to the caller.
+			return nil
+		}
+		return w.decide(false)
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
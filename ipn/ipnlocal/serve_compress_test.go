@@ -0,0 +1,161 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestGzipResponseWriter(t *testing.T) {
+	big := strings.Repeat("hello, world\n", 200)
+	tests := []struct {
+		name         string
+		contentType  string
+		encoding     string // Content-Encoding set by the handler
+		code         int
+		body         string
+		flushEarly   bool
+		wantCompress bool
+	}{
+		{name: "big-text", contentType: "text/html; charset=utf-8", body: big, wantCompress: true},
+		{name: "big-svg", contentType: "image/svg+xml", body: big, wantCompress: true},
+		{name: "big-not-found", contentType: "text/plain", code: 404, body: big, wantCompress: true},
+		{name: "small", contentType: "text/html", body: "hi"},
+		{name: "image", contentType: "image/png", body: big},
+		{name: "zip", contentType: "application/zip", body: big},
+		{name: "already-encoded", contentType: "text/html", encoding: "br", body: big},
+		{name: "partial", contentType: "text/html", code: 206, body: big},
+		{name: "flushed-before-min-size", contentType: "text/event-stream", body: big, flushEarly: true},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := newGzipResponseWriter(rec)
+			if tt.contentType != "" {
+				w.Header().Set("Content-Type", tt.contentType)
+			}
+			if tt.encoding != "" {
+				w.Header().Set("Content-Encoding", tt.encoding)
+			}
+			if tt.code != 0 {
+				w.WriteHeader(tt.code)
+			}
+			body := tt.body
+			if tt.flushEarly {
+				io.WriteString(w, body[:10])
+				w.Flush()
+				body = body[10:]
+			}
+			// Write in pieces, to check the buffering.
+			for len(body) > 0 {
+				n := min(len(body), 100)
+				if _, err := io.WriteString(w, body[:n]); err != nil {
+					t.Fatal(err)
+				}
+				body = body[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			res := rec.Result()
+			if want := max(tt.code, 200); res.StatusCode != want {
+				t.Errorf("status = %d; want %d", res.StatusCode, want)
+			}
+			got := rec.Body.String()
+			if compressed := res.Header.Get("Content-Encoding") == "gzip"; compressed != tt.wantCompress {
+				t.Fatalf("compressed = %v; want %v (headers %v)", compressed, tt.wantCompress, res.Header)
+			}
+			if tt.wantCompress {
+				if res.Header.Get("Vary") != "Accept-Encoding" {
+					t.Errorf("Vary = %q; want Accept-Encoding", res.Header.Get("Vary"))
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = string(b)
+			}
+			if got != tt.body {
+				t.Errorf("body = %q; want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestServeWebHandlerCompress(t *testing.T) {
+	b := newTestBackend(t)
+	dir := t.TempDir()
+	page := strings.Repeat("<p>hello</p>\n", 200)
+	if err := os.WriteFile(filepath.Join(dir, "page.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Path: dir},
+				"/gz/": {Path: dir, Compress: true},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"/page.html", "gzip", false},
+		{"/gz/page.html", "", false},
+		{"/gz/page.html", "br", false},
+		{"/gz/page.html", "gzip, br", true},
+	} {
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: tt.path},
+			Header: http.Header{},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+			}))
+
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s (Accept-Encoding %q): got status %d; want %d", tt.path, tt.acceptEncoding, w.Code, http.StatusOK)
+			continue
+		}
+		if gotGzip := w.Header().Get("Content-Encoding") == "gzip"; gotGzip != tt.wantGzip {
+			t.Errorf("%s (Accept-Encoding %q): gzipped = %v; want %v", tt.path, tt.acceptEncoding, gotGzip, tt.wantGzip)
+		}
+		if tt.wantGzip && w.Body.Len() >= len(page) {
+			t.Errorf("%s: gzipped body is %d bytes; want less than %d", tt.path, w.Body.Len(), len(page))
+		}
+	}
+}
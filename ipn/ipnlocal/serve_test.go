@@ -9,10 +9,13 @@
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
@@ -21,9 +24,13 @@
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
@@ -79,6 +86,16 @@ func TestGetServeHandler(t *testing.T) {
 			},
 		},
 	}
+	confWildcard := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			serverName + ":443": {
+				Handlers: map[string]*ipn.HTTPHandler{
+					"/*":       {},
+					"/static/": {},
+				},
+			},
+		},
+	}
 
 	tests := []struct {
 		name string
@@ -147,6 +164,30 @@ func TestGetServeHandler(t *testing.T) {
 			path: "/foo/../../../../../../../../etc/passwd",
 			want: "/",
 		},
+		{
+			name: "wildcard-specific-wins",
+			conf: confWildcard,
+			path: "/static/app.js",
+			want: "/static/",
+		},
+		{
+			name: "wildcard-unmatched",
+			conf: confWildcard,
+			path: "/api/users",
+			want: "/",
+		},
+		{
+			name: "wildcard-root",
+			conf: confWildcard,
+			path: "/",
+			want: "/",
+		},
+		{
+			name: "wildcard-literal-star",
+			conf: confWildcard,
+			path: "/*",
+			want: "/",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -165,7 +206,7 @@ func TestGetServeHandler(t *testing.T) {
 				DestPort: port,
 			}))
 
-			h, got, ok := b.getServeHandler(req)
+			h, _, got, ok := b.getServeHandler(req)
 			if (got != "") != ok {
 				t.Fatalf("got ok=%v, but got mountPoint=%q", ok, got)
 			}
@@ -179,6 +220,55 @@ func TestGetServeHandler(t *testing.T) {
 	}
 }
 
+func TestGetServeHandlerVirtualHost(t *testing.T) {
+	b := newTestBackend(t)
+	b.peers = nil // Status, for the MagicDNS suffix, needs their Hostinfo
+	b.serveConfig = (&ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "self"},
+			}},
+			"wiki.example.com:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "wiki"},
+			}},
+		},
+	}).View()
+
+	tests := []struct {
+		host     string
+		wantText string // or "" if no handler
+		wantHP   ipn.HostPort
+	}{
+		{"example.ts.net", "self", "example.ts.net:80"},
+		{"wiki.example.com", "wiki", "wiki.example.com:80"},
+		{"wiki.example.com:80", "wiki", "wiki.example.com:80"},
+		{"WIKI.example.com.", "wiki", "wiki.example.com:80"},
+		{"other.example.com", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+				DestPort: 80,
+			}))
+			h, hp, _, ok := b.getServeHandler(req)
+			if ok != (tt.wantText != "") {
+				t.Fatalf("ok = %v; want %v", ok, tt.wantText != "")
+			}
+			if !ok {
+				return
+			}
+			if h.Text() != tt.wantText {
+				t.Errorf("handler text = %q; want %q", h.Text(), tt.wantText)
+			}
+			if hp != tt.wantHP {
+				t.Errorf("hp = %q; want %q", hp, tt.wantHP)
+			}
+		})
+	}
+}
+
 func getEtag(t *testing.T, b any) string {
 	t.Helper()
 	bts, err := json.Marshal(b)
@@ -296,6 +386,52 @@ func TestServeConfigForeground(t *testing.T) {
 	}
 }
 
+func TestServeConfigNotify(t *testing.T) {
+	b := newTestBackend(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configs := make(chan ipn.ServeConfigView, 10)
+	go b.WatchNotifications(ctx, ipn.NotifyInitialServeConfig, nil, func(roNotify *ipn.Notify) (keepGoing bool) {
+		if roNotify.ServeConfig != nil {
+			configs <- *roNotify.ServeConfig
+		}
+		return true
+	})
+	next := func() *ipn.ServeConfig {
+		t.Helper()
+		select {
+		case sc := <-configs:
+			if !sc.Valid() {
+				t.Fatal("got invalid ServeConfig view")
+			}
+			return sc.AsStruct()
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for ServeConfig notification")
+		}
+		return nil
+	}
+
+	if got := next(); !reflect.DeepEqual(got, &ipn.ServeConfig{}) {
+		t.Errorf("initial config = %+v; want empty", got)
+	}
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{2222: {TCPForward: "127.0.0.1:22"}},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); !reflect.DeepEqual(got, conf) {
+		t.Errorf("config = %+v; want %+v", got, conf)
+	}
+	if err := b.SetServeConfig(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); !reflect.DeepEqual(got, &ipn.ServeConfig{}) {
+		t.Errorf("config after reset = %+v; want empty", got)
+	}
+}
+
 func TestServeConfigETag(t *testing.T) {
 	b := newTestBackend(t)
 
@@ -461,25 +597,64 @@ func(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 }
-func TestServeHTTPProxyHeaders(t *testing.T) {
+func TestServeWebHandlerAllowMethods(t *testing.T) {
 	b := newTestBackend(t)
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":   {Text: "hi"},
+				"/ro": {Text: "read-only", AllowMethods: []string{"GET", "HEAD"}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	// Start test serve endpoint.
-	testServ := httptest.NewServer(http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			// Piping all the headers through the response writer
-			// so we can check their values in tests below.
-			for key, val := range r.Header {
-				w.Header().Add(key, strings.Join(val, ","))
+	tests := []struct {
+		method, path string
+		wantCode     int
+	}{
+		{"GET", "/", http.StatusOK},
+		{"POST", "/", http.StatusOK}, // all methods allowed by default
+		{"DELETE", "/", http.StatusOK},
+		{"GET", "/ro", http.StatusOK},
+		{"HEAD", "/ro", http.StatusOK},
+		{"POST", "/ro", http.StatusMethodNotAllowed},
+		{"PUT", "/ro/sub", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req := &http.Request{
+			Method: tt.method,
+			URL:    &url.URL{Path: tt.path},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+			}))
+
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s: got status %d; want %d", tt.method, tt.path, w.Code, tt.wantCode)
+		}
+		if w.Code == http.StatusMethodNotAllowed {
+			if got, want := w.Header().Get("Allow"), "GET, HEAD"; got != want {
+				t.Errorf("%s %s: Allow = %q; want %q", tt.method, tt.path, got, want)
 			}
-		},
-	))
-	defer testServ.Close()
+		}
+	}
+}
 
+func TestServeWebHandlerRequireTag(t *testing.T) {
+	b := newTestBackend(t)
 	conf := &ipn.ServeConfig{
 		Web: map[ipn.HostPort]*ipn.WebServerConfig{
 			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
-				"/": {Proxy: testServ.URL},
+				"/":      {Text: "hi"},
+				"/admin": {Text: "secret", RequireTag: "tag:test"},
 			}},
 		},
 	}
@@ -487,159 +662,1259 @@ func(w http.ResponseWriter, r *http.Request) {
 		t.Fatal(err)
 	}
 
-	type headerCheck struct {
-		header string
-		want   string
-	}
-
 	tests := []struct {
-		name        string
-		srcIP       string
-		wantHeaders []headerCheck
+		name     string
+		path     string
+		srcIP    string
+		funnel   bool
+		wantCode int
 	}{
-		{
-			name:  "request-from-user-within-tailnet",
-			srcIP: "100.150.151.152",
-			wantHeaders: []headerCheck{
-				{"X-Forwarded-Proto", "https"},
-				{"X-Forwarded-For", "100.150.151.152"},
-				{"Tailscale-User-Login", "someone@example.com"},
-				{"Tailscale-User-Name", "Some One"},
-				{"Tailscale-User-Profile-Pic", "https://example.com/photo.jpg"},
-				{"Tailscale-Headers-Info", "https://tailscale.com/s/serve-headers"},
-			},
-		},
-		{
-			name:  "request-from-tagged-node-within-tailnet",
-			srcIP: "100.150.151.153",
-			wantHeaders: []headerCheck{
-				{"X-Forwarded-Proto", "https"},
-				{"X-Forwarded-For", "100.150.151.153"},
-				{"Tailscale-User-Login", ""},
-				{"Tailscale-User-Name", ""},
-				{"Tailscale-User-Profile-Pic", ""},
-				{"Tailscale-Headers-Info", ""},
-			},
-		},
-		{
-			name:  "request-from-outside-tailnet",
-			srcIP: "100.160.161.162",
-			wantHeaders: []headerCheck{
-				{"X-Forwarded-Proto", "https"},
-				{"X-Forwarded-For", "100.160.161.162"},
-				{"Tailscale-User-Login", ""},
-				{"Tailscale-User-Name", ""},
-				{"Tailscale-User-Profile-Pic", ""},
-				{"Tailscale-Headers-Info", ""},
-			},
-		},
+		{name: "untagged-peer-unrestricted", path: "/", srcIP: "100.150.151.152", wantCode: http.StatusOK},
+		{name: "tagged-peer", path: "/admin", srcIP: "100.150.151.153", wantCode: http.StatusOK},
+		{name: "tagged-peer-subpath", path: "/admin/x", srcIP: "100.150.151.153", wantCode: http.StatusOK},
+		{name: "untagged-peer", path: "/admin", srcIP: "100.150.151.152", wantCode: http.StatusForbidden},
+		{name: "unknown-source", path: "/admin", srcIP: "1.2.3.4", wantCode: http.StatusForbidden},
+		{name: "funnel", path: "/admin", srcIP: "100.150.151.153", funnel: true, wantCode: http.StatusForbidden},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			req := &http.Request{
-				URL: &url.URL{Path: "/"},
-				TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+				Method: "GET",
+				URL:    &url.URL{Path: tt.path},
+				TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
 			}
-			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+			sctx := &serveHTTPContext{
 				DestPort: 443,
 				SrcAddr:  netip.MustParseAddrPort(tt.srcIP + ":1234"), // random src port for tests
-			}))
+			}
+			if tt.funnel {
+				sctx.Funnel = &funnelFlow{}
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), sctx))
 
 			w := httptest.NewRecorder()
 			b.serveWebHandler(w, req)
-
-			// Verify the headers.
-			h := w.Result().Header
-			for _, c := range tt.wantHeaders {
-				if got := h.Get(c.header); got != c.want {
-					t.Errorf("invalid %q header; want=%q, got=%q", c.header, c.want, got)
-				}
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", w.Code, tt.wantCode)
 			}
 		})
 	}
 }
 
-func Test_reverseProxyConfiguration(t *testing.T) {
+func TestServeWebHandlerCacheControl(t *testing.T) {
 	b := newTestBackend(t)
-	type test struct {
-		backend string
-		path    string
-		// set to false to test that a proxy has been removed
-		shouldExist   bool
-		wantsInsecure bool
-		wantsURL      url.URL
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
 	}
-	runner := func(name string, tests []test) {
-		t.Logf("running tests for %s", name)
-		host := ipn.HostPort("http://example.ts.net:80")
-		conf := &ipn.ServeConfig{
-			Web: map[ipn.HostPort]*ipn.WebServerConfig{
-				host: {Handlers: map[string]*ipn.HTTPHandler{}},
-			},
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":        {Path: dir},
+				"/static/": {Path: dir, CacheControl: "public, max-age=3600"},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"/file.txt":        "",
+		"/static/file.txt": "public, max-age=3600",
+	} {
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: path},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
 		}
-		for _, tt := range tests {
-			if tt.shouldExist {
-				conf.Web[host].Handlers[tt.path] = &ipn.HTTPHandler{Proxy: tt.backend}
-			}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+			}))
+
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d; want %d", path, w.Code, http.StatusOK)
 		}
-		if err := b.setServeConfigLocked(conf, ""); err != nil {
+		if got := w.Header().Get("Cache-Control"); got != want {
+			t.Errorf("%s: Cache-Control = %q; want %q", path, got, want)
+		}
+	}
+}
+
+func TestServeFileOrDirectorySPAFallback(t *testing.T) {
+	b := newTestBackend(t)
+	td := t.TempDir()
+	for name, contents := range map[string]string{
+		"index.html":      "this is the app",
+		"app.js":          "this is js",
+		"assets/logo.svg": "this is a logo",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(td, name)), 0700); err != nil {
 			t.Fatal(err)
 		}
-		// test that reverseproxies have been set up as expected
-		for _, tt := range tests {
-			rp, ok := b.serveProxyHandlers.Load(tt.backend)
-			if !tt.shouldExist && ok {
-				t.Errorf("proxy for backend %s should not exist, but it does", tt.backend)
-			}
-			if !tt.shouldExist {
-				continue
-			}
-			parsedRp, ok := rp.(*reverseProxy)
-			if !ok {
-				t.Errorf("proxy for backend %q is not a reverseproxy", tt.backend)
-			}
-			if parsedRp.insecure != tt.wantsInsecure {
-				t.Errorf("proxy for backend %q should be insecure: %v got insecure: %v", tt.backend, tt.wantsInsecure, parsedRp.insecure)
-			}
-			if !reflect.DeepEqual(*parsedRp.url, tt.wantsURL) {
-				t.Errorf("proxy for backend %q should have URL %#+v, got URL %+#v", tt.backend, &tt.wantsURL, parsedRp.url)
-			}
-			if tt.backend != parsedRp.backend {
-				t.Errorf("proxy for backend %q should have backend %q got %q", tt.backend, tt.backend, parsedRp.backend)
-			}
+		if err := os.WriteFile(filepath.Join(td, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		req      string
+		mount    string
+		wantCode int
+		want     string
+	}{
+		{"/", "/", 200, "this is the app"},
+		{"/app.js", "/", 200, "this is js"},
+		{"/assets/logo.svg", "/", 200, "this is a logo"},
+		{"/settings/profile", "/", 200, "this is the app"},
+		{"/../../etc/passwd", "/", 200, "this is the app"},
+		{"/app/", "/app/", 200, "this is the app"},
+		{"/app/app.js", "/app/", 200, "this is js"},
+		{"/app/users/42", "/app/", 200, "this is the app"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.req, nil)
+		b.serveFileOrDirectory(rec, req, td, tt.mount, nil, true, false)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s (mount %s): got status %d; want %d", tt.req, tt.mount, rec.Code, tt.wantCode)
+		}
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s (mount %s): got body %q; want %q", tt.req, tt.mount, got, tt.want)
 		}
 	}
 
-	// configure local backend with some proxy backends
-	runner("initial proxy configs", []test{
-		{
-			backend:       "http://example.com/docs",
-			path:          "/example",
-			shouldExist:   true,
-			wantsInsecure: false,
-			wantsURL:      mustCreateURL(t, "http://example.com/docs"),
-		},
-		{
-			backend:       "https://example1.com",
-			path:          "/example1",
-			shouldExist:   true,
-			wantsInsecure: false,
-			wantsURL:      mustCreateURL(t, "https://example1.com"),
-		},
-		{
-			backend:       "https+insecure://example2.com",
-			path:          "/example2",
-			shouldExist:   true,
-			wantsInsecure: true,
-			wantsURL:      mustCreateURL(t, "https://example2.com"),
-		},
-	})
+	// Without an index.html, unknown paths are still not found.
+	if err := os.Remove(filepath.Join(td, "index.html")); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	b.serveFileOrDirectory(rec, httptest.NewRequest("GET", "/settings", nil), td, "/", nil, true, false)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("without index.html: got status %d; want %d", rec.Code, http.StatusNotFound)
+	}
+}
 
-	// reconfigure the local backend with different proxies
-	runner("reloaded proxy configs", []test{
-		{
-			backend:       "http://example.com/docs",
+func TestServeFileOrDirectoryOverlays(t *testing.T) {
+	b := newTestBackend(t)
+	base, env, local := t.TempDir(), t.TempDir(), t.TempDir()
+	for name, contents := range map[string]string{
+		filepath.Join(base, "index.html"):      "base index",
+		filepath.Join(base, "config.json"):     "base config",
+		filepath.Join(base, "style.css"):       "base style",
+		filepath.Join(base, "img", "a.png"):    "base a",
+		filepath.Join(env, "config.json"):      "env config",
+		filepath.Join(env, "style.css"):        "env style",
+		filepath.Join(env, "img", "b.png"):     "env b",
+		filepath.Join(local, "style.css"):      "local style",
+		filepath.Join(local, "img", "a.png"):   "local a",
+		filepath.Join(local, "only-local.txt"): "local only",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overlays := []string{env, local}
+	tests := []struct {
+		req      string
+		wantCode int
+		want     string
+	}{
+		{"/site/", 200, "base index"},
+		{"/site/config.json", 200, "env config"},
+		{"/site/style.css", 200, "local style"},
+		{"/site/img/a.png", 200, "local a"},
+		{"/site/img/b.png", 200, "env b"},
+		{"/site/only-local.txt", 200, "local only"},
+		{"/site/missing.txt", 404, ""},
+		{"/site/../../etc/passwd", 404, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.req, nil)
+		b.serveFileOrDirectory(rec, req, base, "/site/", overlays, false, false)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: got status %d; want %d", tt.req, rec.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantCode == 200 {
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("%s: got body %q; want %q", tt.req, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestServeWebHandlerAllowCIDRs(t *testing.T) {
+	b := newTestBackend(t)
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":         {Text: "hi"},
+				"/intranet": {Text: "secret", AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		srcIP    string
+		wantCode int
+	}{
+		{name: "unrestricted", path: "/", srcIP: "100.150.151.152", wantCode: http.StatusOK},
+		{name: "allowed", path: "/intranet", srcIP: "192.168.10.20", wantCode: http.StatusOK},
+		{name: "allowed-subpath", path: "/intranet/x", srcIP: "192.168.10.20", wantCode: http.StatusOK},
+		{name: "disallowed", path: "/intranet", srcIP: "100.150.151.152", wantCode: http.StatusForbidden},
+		{name: "disallowed-neighbor", path: "/intranet", srcIP: "192.168.11.20", wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: tt.path},
+				TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort(tt.srcIP + ":1234"), // random src port for tests
+			}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestServeWebHandlerBasicAuth(t *testing.T) {
+	b := newTestBackend(t)
+	const hash = "$2a$04$fYZIPvWXt8M8FKpwgmhDpusdKqzfQiK2smRl9SmaFdDcAO/JlXhV6" // of "hunter2"
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":      {Text: "hi"},
+				"/admin": {Text: "secret", BasicAuth: []string{"alice:" + hash, "bob:" + hash}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		user, pass string // no credentials if both empty
+		wantCode   int
+	}{
+		{name: "unprotected", path: "/", wantCode: http.StatusOK},
+		{name: "no-credentials", path: "/admin", wantCode: http.StatusUnauthorized},
+		{name: "valid", path: "/admin", user: "alice", pass: "hunter2", wantCode: http.StatusOK},
+		{name: "valid-second-user", path: "/admin/x", user: "bob", pass: "hunter2", wantCode: http.StatusOK},
+		{name: "wrong-password", path: "/admin", user: "alice", pass: "hunter3", wantCode: http.StatusUnauthorized},
+		{name: "unknown-user", path: "/admin", user: "mallory", pass: "hunter2", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: tt.path},
+				Header: make(http.Header),
+				TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+			}
+			if tt.user != "" || tt.pass != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+			}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", w.Code, tt.wantCode)
+			}
+			gotChallenge := w.Header().Get("WWW-Authenticate")
+			if wantChallenge := tt.wantCode == http.StatusUnauthorized; (gotChallenge != "") != wantChallenge {
+				t.Errorf("WWW-Authenticate = %q; want it set: %v", gotChallenge, wantChallenge)
+			}
+		})
+	}
+}
+
+func TestBasicAuthDummyHash(t *testing.T) {
+	const hash = "$2a$04$fYZIPvWXt8M8FKpwgmhDpusdKqzfQiK2smRl9SmaFdDcAO/JlXhV6" // of "hunter2"
+	for _, tt := range []struct {
+		hash     string
+		wantCost int
+	}{
+		{hash, 4},
+		{"not a hash", bcrypt.DefaultCost},
+	} {
+		dummy := basicAuthDummyHash(tt.hash)
+		if cost, err := bcrypt.Cost(dummy); err != nil || cost != tt.wantCost {
+			t.Errorf("basicAuthDummyHash(%q) cost = %v, %v; want %v", tt.hash, cost, err, tt.wantCost)
+		}
+		if !bytes.Equal(basicAuthDummyHash(tt.hash), dummy) {
+			t.Errorf("basicAuthDummyHash(%q) isn't cached", tt.hash)
+		}
+	}
+}
+
+func TestServeWebHandlerLogLevel(t *testing.T) {
+	b := newTestBackend(t)
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	b.logf = func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":      {Text: "quiet"},
+				"/info":  {Text: "hi", LogLevel: ipn.LogLevelInfo},
+				"/debug": {Text: "hello", LogLevel: ipn.LogLevelDebug},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(path string) []string {
+		t.Helper()
+		mu.Lock()
+		logs = nil
+		mu.Unlock()
+		req := &http.Request{
+			Method: "GET",
+			Host:   "example.ts.net",
+			URL:    &url.URL{Path: path},
+			Header: http.Header{"Cookie": {"session=secret"}, "User-Agent": {"test"}},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d; want %d", path, w.Code, http.StatusOK)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		var serveLogs []string
+		for _, l := range logs {
+			if strings.HasPrefix(l, "serve: ") {
+				serveLogs = append(serveLogs, l)
+			}
+		}
+		return serveLogs
+	}
+
+	if got := serve("/"); len(got) != 0 {
+		t.Errorf("default level logged %q; want nothing", got)
+	}
+
+	got := serve("/info")
+	if len(got) != 1 || !strings.HasPrefix(got[0], "serve: [/info] GET example.ts.net/info from 100.150.151.152:1234: 200, 2 bytes in ") {
+		t.Errorf("info level logged %q; want one request line", got)
+	}
+
+	got = serve("/debug")
+	if len(got) != 3 {
+		t.Fatalf("debug level logged %q; want request line and headers", got)
+	}
+	if !strings.Contains(got[0], "200, 5 bytes") {
+		t.Errorf("request line = %q; want status and size", got[0])
+	}
+	if !strings.Contains(got[1], "User-Agent:[test]") || strings.Contains(got[1], "secret") {
+		t.Errorf("request headers line = %q; want User-Agent and the cookie redacted", got[1])
+	}
+	if !strings.Contains(got[2], "Content-Type:[text/plain; charset=utf-8]") {
+		t.Errorf("response headers line = %q; want Content-Type", got[2])
+	}
+}
+
+func TestServeWebHandlerContentType(t *testing.T) {
+	b := newTestBackend(t)
+	dir := t.TempDir()
+	pac := filepath.Join(dir, "proxy.pac")
+	if err := os.WriteFile(pac, []byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/proxy.pac": {Path: pac, ContentType: ipn.PACContentType},
+				"/raw.pac":   {Path: pac},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"/proxy.pac": ipn.PACContentType,
+		"/raw.pac":   "text/plain; charset=utf-8", // sniffed
+	} {
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: path},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+			}))
+
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d; want %d", path, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Content-Type"); got != want {
+			t.Errorf("%s: Content-Type = %q; want %q", path, got, want)
+		}
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	b := newTestBackend(t)
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":      {Text: "hello"},
+				"/admin": {Text: "secret", AllowMethods: []string{"GET"}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.ServeStats(); len(got) != 0 {
+		t.Fatalf("ServeStats before any requests = %+v; want none", got)
+	}
+
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/"},
+		{"GET", "/foo"},
+		{"GET", "/admin"},
+		{"POST", "/admin"}, // rejected, but still counted
+	} {
+		req := &http.Request{
+			Method: r.method,
+			URL:    &url.URL{Path: r.path},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+			}))
+		b.serveWebHandler(httptest.NewRecorder(), req)
+	}
+
+	want := []ipn.ServeHandlerStats{
+		{HostPort: "example.ts.net:443", Mount: "/", Requests: 2, BytesSent: 2 * int64(len("hello"))},
+		{HostPort: "example.ts.net:443", Mount: "/admin", Requests: 2, BytesSent: int64(len("secret") + len("method not allowed\n"))},
+	}
+	if got := b.ServeStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ServeStats = %+v; want %+v", got, want)
+	}
+
+	// They're also user metrics.
+	if got := b.UserMetricsRegistry().String(); !strings.Contains(got, "tailscaled_serve_requests_total") {
+		t.Errorf("user metrics missing serve requests; got:\n%s", got)
+	}
+}
+
+func TestServeConfigDrain(t *testing.T) {
+	b := newTestBackend(t)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	b.clock = clock
+
+	setConf := func(text, drain string, proxy bool) ipn.ServeConfigView {
+		t.Helper()
+		handlers := map[string]*ipn.HTTPHandler{"/": {Text: text}}
+		if proxy {
+			handlers["/api/"] = &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}
+		}
+		conf := &ipn.ServeConfig{
+			TCP:   map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web:   map[ipn.HostPort]*ipn.WebServerConfig{"example.ts.net:443": {Handlers: handlers}},
+			Drain: drain,
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		return b.ServeConfig()
+	}
+	// get makes a request on a connection accepted under the config
+	// acceptedUnder, and returns the response body.
+	get := func(acceptedUnder ipn.ServeConfigView) string {
+		t.Helper()
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/"},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+				Config:   acceptedUnder,
+			}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w.Body.String()
+	}
+	hasProxy := func() bool {
+		_, ok := b.serveProxyHandlers.Load(serveProxyKey((&ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}).View()))
+		return ok
+	}
+
+	v1 := setConf("one", "", true)
+	v2 := setConf("two", "30s", false)
+	if got := v2.Drain(); got != "30s" {
+		t.Errorf("Drain = %q; want %q", got, "30s")
+	}
+	if got := get(v1); got != "one" {
+		t.Errorf("draining connection got %q; want %q", got, "one")
+	}
+	if got := get(v2); got != "two" {
+		t.Errorf("new connection got %q; want %q", got, "two")
+	}
+	if got := get(ipn.ServeConfigView{}); got != "two" {
+		t.Errorf("connection with unknown config got %q; want %q", got, "two")
+	}
+	if !hasProxy() {
+		t.Error("proxy of draining config was closed")
+	}
+
+	clock.Advance(31 * time.Second)
+	if got := get(v1); got != "two" {
+		t.Errorf("after drain period, got %q; want %q", got, "two")
+	}
+	if hasProxy() {
+		t.Error("proxy of drained config wasn't closed")
+	}
+
+	// A zero drain switches all connections over immediately, including
+	// ones still draining from an earlier change.
+	v3 := setConf("three", "1m", false)
+	setConf("four", "", false)
+	for _, v := range []ipn.ServeConfigView{v2, v3} {
+		if got := get(v); got != "four" {
+			t.Errorf("with zero drain, got %q; want %q", got, "four")
+		}
+	}
+}
+
+func TestHTTPSRedirectURL(t *testing.T) {
+	tests := []struct {
+		reqURI string
+		want   string
+	}{
+		{"/", "https://foo.test.ts.net/"},
+		{"/a/b", "https://foo.test.ts.net/a/b"},
+		{"/a/b/?x=1&y=two", "https://foo.test.ts.net/a/b/?x=1&y=two"},
+		{"/a%2Fb", "https://foo.test.ts.net/a%2Fb"},
+		{"/caf%C3%A9?q=%20", "https://foo.test.ts.net/caf%C3%A9?q=%20"},
+		{"//evil.example/", "https://foo.test.ts.net//evil.example/"},
+	}
+	for _, tt := range tests {
+		u, err := url.ParseRequestURI(tt.reqURI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := httpsRedirectURL("foo.test.ts.net", u); got != tt.want {
+			t.Errorf("httpsRedirectURL(%q) = %q; want %q", tt.reqURI, got, tt.want)
+		}
+	}
+}
+
+func TestServeAggregateBackendHealth(t *testing.T) {
+	b := newTestBackend(t)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	// Grab a free port and close it so that nothing is listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + ln.Addr().String()
+	ln.Close()
+
+	const (
+		tailnetSrc = "100.150.151.152:1234"
+		otherSrc   = "1.2.3.4:1234" // random src
+	)
+	check := func(drain, src string, handlers map[string]*ipn.HTTPHandler, wantCode int) string {
+		t.Helper()
+		handlers["/healthz"] = &ipn.HTTPHandler{AggregateBackends: true}
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: handlers},
+			},
+			Drain: drain,
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/healthz"},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort(src),
+			}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != wantCode {
+			t.Errorf("got status %d; want %d; body:\n%s", w.Code, wantCode, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	check("", otherSrc, map[string]*ipn.HTTPHandler{
+		"/a": {Proxy: up.URL},
+		"/b": {Proxy: up.URL, NoHTTP2: true},
+		"/c": {Text: "not a backend"},
+	}, http.StatusOK)
+	check("", otherSrc, map[string]*ipn.HTTPHandler{
+		"/c": {Text: "not a backend"},
+	}, http.StatusServiceUnavailable)
+
+	// Only tailnet peers get told which backends are down, and why.
+	downHandlers := func() map[string]*ipn.HTTPHandler {
+		return map[string]*ipn.HTTPHandler{
+			"/a": {Proxy: up.URL},
+			"/b": {Proxy: down},
+		}
+	}
+	if body := check("", tailnetSrc, downHandlers(), http.StatusServiceUnavailable); !strings.Contains(body, down+": ") || !strings.Contains(body, up.URL+": ok") {
+		t.Errorf("tailnet body = %q; want the status of each backend", body)
+	}
+	if body := check("", otherSrc, downHandlers(), http.StatusServiceUnavailable); body != "unavailable\n" {
+		t.Errorf("non-tailnet body = %q; want %q", body, "unavailable\n")
+	}
+
+	// The backends of the previous config, still draining, aren't probed.
+	if body := check("1m", tailnetSrc, map[string]*ipn.HTTPHandler{
+		"/a": {Proxy: up.URL},
+	}, http.StatusOK); strings.Contains(body, down) {
+		t.Errorf("body = %q; want no draining backend %s", body, down)
+	}
+}
+
+func TestServeHTTPProxyHeaders(t *testing.T) {
+	b := newTestBackend(t)
+
+	// Start test serve endpoint.
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Piping all the headers through the response writer
+			// so we can check their values in tests below.
+			for key, val := range r.Header {
+				w.Header().Add(key, strings.Join(val, ","))
+			}
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	type headerCheck struct {
+		header string
+		want   string
+	}
+
+	tests := []struct {
+		name        string
+		srcIP       string
+		wantHeaders []headerCheck
+	}{
+		{
+			name:  "request-from-user-within-tailnet",
+			srcIP: "100.150.151.152",
+			wantHeaders: []headerCheck{
+				{"X-Forwarded-Proto", "https"},
+				{"X-Forwarded-For", "100.150.151.152"},
+				{"Tailscale-User-Login", "someone@example.com"},
+				{"Tailscale-User-Name", "Some One"},
+				{"Tailscale-User-Profile-Pic", "https://example.com/photo.jpg"},
+				{"Tailscale-Headers-Info", "https://tailscale.com/s/serve-headers"},
+			},
+		},
+		{
+			name:  "request-from-tagged-node-within-tailnet",
+			srcIP: "100.150.151.153",
+			wantHeaders: []headerCheck{
+				{"X-Forwarded-Proto", "https"},
+				{"X-Forwarded-For", "100.150.151.153"},
+				{"Tailscale-User-Login", ""},
+				{"Tailscale-User-Name", ""},
+				{"Tailscale-User-Profile-Pic", ""},
+				{"Tailscale-Headers-Info", ""},
+			},
+		},
+		{
+			name:  "request-from-outside-tailnet",
+			srcIP: "100.160.161.162",
+			wantHeaders: []headerCheck{
+				{"X-Forwarded-Proto", "https"},
+				{"X-Forwarded-For", "100.160.161.162"},
+				{"Tailscale-User-Login", ""},
+				{"Tailscale-User-Name", ""},
+				{"Tailscale-User-Profile-Pic", ""},
+				{"Tailscale-Headers-Info", ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				URL: &url.URL{Path: "/"},
+				TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort(tt.srcIP + ":1234"), // random src port for tests
+			}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+
+			// Verify the headers.
+			h := w.Result().Header
+			for _, c := range tt.wantHeaders {
+				if got := h.Get(c.header); got != c.want {
+					t.Errorf("invalid %q header; want=%q, got=%q", c.header, c.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestServeTLSMinVersion(t *testing.T) {
+	b := newTestBackend(t)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true, TLSMinVersion: "1.3"},
+			8443: {HTTPS: true},
+			9443: {TCPForward: backend.Addr().String(), TerminateTLS: "example.ts.net", TLSMinVersion: "1.3"},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// handshake attempts a TLS 1.2 handshake with port and returns the
+	// error. The test backend has no certificates, so no handshake
+	// succeeds, but a rejected version fails before a certificate is
+	// needed.
+	handshake := func(port uint16) error {
+		t.Helper()
+		h := b.tcpHandlerForServe(port, netip.MustParseAddrPort("100.150.151.152:1234"), nil)
+		if h == nil {
+			t.Fatalf("no handler for port %d", port)
+		}
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go h(c2)
+		tc := tls.Client(c1, &tls.Config{
+			ServerName:         "example.ts.net",
+			MaxVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: true,
+		})
+		return tc.Handshake()
+	}
+	isVersionErr := func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "protocol version")
+	}
+	if err := handshake(443); !isVersionErr(err) {
+		t.Errorf("port 443 with TLS 1.3 minimum: got %v; want protocol version error", err)
+	}
+	if err := handshake(9443); !isVersionErr(err) {
+		t.Errorf("port 9443 with TLS 1.3 minimum: got %v; want protocol version error", err)
+	}
+	if err := handshake(8443); isVersionErr(err) {
+		t.Errorf("port 8443 without minimum: got %v; want a non-version error", err)
+	}
+}
+
+func TestServeMaxConns(t *testing.T) {
+	b := newTestBackend(t)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			2222: {TCPForward: backend.Addr().String(), MaxConns: 2},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// dial starts forwarding a connection to port 2222 and returns the
+	// client side of it, along with a channel closed when the handler
+	// returns. It reports whether the connection was forwarded to the
+	// echo backend.
+	dial := func() (c net.Conn, done chan struct{}, forwarded bool) {
+		t.Helper()
+		h := b.tcpHandlerForServe(2222, netip.MustParseAddrPort("100.150.151.152:1234"), nil)
+		if h == nil {
+			t.Fatal("no handler for port 2222")
+		}
+		c1, c2 := net.Pipe()
+		done = make(chan struct{})
+		go func() {
+			defer close(done)
+			h(c2)
+		}()
+		if _, err := c1.Write([]byte("x")); err != nil {
+			return c1, done, false
+		}
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(c1, buf); err != nil {
+			return c1, done, false
+		}
+		return c1, done, true
+	}
+
+	c1, done1, ok := dial()
+	if !ok {
+		t.Fatal("first connection not forwarded")
+	}
+	c2, done2, ok := dial()
+	if !ok {
+		t.Fatal("second connection not forwarded")
+	}
+	defer c2.Close()
+	if c3, done3, ok := dial(); ok {
+		t.Error("third connection forwarded; want it closed")
+	} else {
+		c3.Close()
+		<-done3
+	}
+
+	// Once a connection ends, there's room for another.
+	c1.Close()
+	<-done1
+	c4, _, ok := dial()
+	if !ok {
+		t.Fatal("connection after one ended not forwarded")
+	}
+	c4.Close()
+	c2.Close()
+	<-done2
+}
+
+func TestServeHTTPProxyHost(t *testing.T) {
+	b := newTestBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Got-Host", r.Host)
+			w.Header().Set("Got-X-Forwarded-Host", r.Header.Get("X-Forwarded-Host"))
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":      {Proxy: testServ.URL},
+				"/vhost": {Proxy: testServ.URL, ProxyHost: "backend.internal"},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := b.serveProxyHandlers.Load(serveProxyKey(conf.Web["example.ts.net:443"].Handlers["/vhost"].View())); p == nil {
+		t.Fatal("no proxy for the ProxyHost handler")
+	}
+
+	for path, wantHost := range map[string]string{
+		"/":      "example.ts.net",
+		"/vhost": "backend.internal",
+	} {
+		req := &http.Request{
+			URL:  &url.URL{Path: path},
+			Host: "example.ts.net",
+			TLS:  &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+			}))
+
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if got := w.Result().Header.Get("Got-Host"); got != wantHost {
+			t.Errorf("%s: backend got Host %q; want %q", path, got, wantHost)
+		}
+		if got := w.Result().Header.Get("Got-X-Forwarded-Host"); got != "example.ts.net" {
+			t.Errorf("%s: backend got X-Forwarded-Host %q; want %q", path, got, "example.ts.net")
+		}
+	}
+}
+
+func TestServeHTTPProxyRequestID(t *testing.T) {
+	b := newTestBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Got-Request-Id", r.Header.Get("X-Request-Id"))
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":       {Proxy: testServ.URL},
+				"/traced": {Proxy: testServ.URL, RequestIDHeader: "X-Request-Id"},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, requestID string) string {
+		t.Helper()
+		req := &http.Request{
+			URL:    &url.URL{Path: path},
+			Host:   "example.ts.net",
+			Header: make(http.Header),
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		if requestID != "" {
+			req.Header.Set("X-Request-Id", requestID)
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+			}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w.Result().Header.Get("Got-Request-Id")
+	}
+
+	if got := get("/", ""); got != "" {
+		t.Errorf("without RequestIDHeader: backend got X-Request-Id %q; want none", got)
+	}
+	id1, id2 := get("/traced", ""), get("/traced", "")
+	if len(id1) != 32 || len(id2) != 32 || id1 == id2 {
+		t.Errorf("generated IDs %q and %q; want two different 32-character IDs", id1, id2)
+	}
+	if got := get("/traced", "abc-123"); got != "abc-123" {
+		t.Errorf("with an existing ID: backend got X-Request-Id %q; want %q", got, "abc-123")
+	}
+}
+
+func TestServeHTTPProxyCanary(t *testing.T) {
+	b := newTestBackend(t)
+
+	newBackend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, name)
+			},
+		))
+		t.Cleanup(s.Close)
+		return s
+	}
+	stable, canary := newBackend("stable"), newBackend("canary")
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/none":   {Proxy: stable.URL, Canary: canary.URL},
+				"/all":    {Proxy: stable.URL, Canary: canary.URL, CanaryPercent: 100},
+				"/half":   {Proxy: stable.URL, Canary: canary.URL, CanaryPercent: 50},
+				"/stable": {Proxy: stable.URL},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) string {
+		t.Helper()
+		req := &http.Request{
+			URL:    &url.URL{Path: path},
+			Host:   "example.ts.net",
+			Header: make(http.Header),
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+			}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w.Body.String()
+	}
+
+	counts := map[string]map[string]int{} // path => backend => requests
+	for _, path := range []string{"/none", "/all", "/half", "/stable"} {
+		counts[path] = map[string]int{}
+		for range 100 {
+			counts[path][get(path)]++
+		}
+	}
+	if got := counts["/none"]["stable"]; got != 100 {
+		t.Errorf("CanaryPercent 0: %d of 100 requests went to the stable backend; want all (%v)", got, counts["/none"])
+	}
+	if got := counts["/all"]["canary"]; got != 100 {
+		t.Errorf("CanaryPercent 100: %d of 100 requests went to the canary; want all (%v)", got, counts["/all"])
+	}
+	// The chance of either backend getting none of 100 requests is 2^-99.
+	if counts["/half"]["stable"] == 0 || counts["/half"]["canary"] == 0 || counts["/half"]["stable"]+counts["/half"]["canary"] != 100 {
+		t.Errorf("CanaryPercent 50: got %v; want requests to both backends", counts["/half"])
+	}
+	if got := counts["/stable"]["stable"]; got != 100 {
+		t.Errorf("without Canary: %d of 100 requests went to the stable backend; want all (%v)", got, counts["/stable"])
+	}
+
+	// Removing the canary closes its proxy.
+	conf.Web["example.ts.net:443"].Handlers = map[string]*ipn.HTTPHandler{
+		"/": {Proxy: stable.URL},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	h := (&ipn.HTTPHandler{Proxy: stable.URL, Canary: canary.URL}).View()
+	if _, ok := b.serveProxyHandlers.Load(serveProxyKeyFor(h, canary.URL)); ok {
+		t.Error("canary proxy still present after the canary was removed")
+	}
+}
+
+func TestServeGRPCWeb(t *testing.T) {
+	b := newTestBackend(t)
+
+	// A plaintext (h2c) gRPC backend that echoes the request message.
+	testServ := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc+proto" || r.Header.Get("Te") != "trailers" {
+				http.Error(w, fmt.Sprintf("not gRPC: %s %q %q", r.Proto, r.Header.Get("Content-Type"), r.Header.Get("Te")), http.StatusBadRequest)
+				return
+			}
+			msg, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc+proto")
+			w.Write(msg)
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+		},
+	), &http2.Server{}))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, GRPCWeb: true},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("\x00\x00\x00\x00\x05hello")
+	trailers := []byte("\x80\x00\x00\x00\x22grpc-message: ok\r\ngrpc-status: 0\r\n")
+	tests := []struct {
+		contentType string
+		body        string
+		wantType    string
+		wantBody    string
+	}{
+		{
+			contentType: "application/grpc-web+proto",
+			body:        string(msg),
+			wantType:    "application/grpc-web+proto",
+			wantBody:    string(msg) + string(trailers),
+		},
+		{
+			contentType: "application/grpc-web-text+proto",
+			body:        base64.StdEncoding.EncodeToString(msg),
+			wantType:    "application/grpc-web-text+proto",
+			wantBody:    base64.StdEncoding.EncodeToString(append(msg, trailers...)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/svc.Echo/Echo", strings.NewReader(tt.body))
+			req.Host = "example.ts.net"
+			req.TLS = &tls.ConnectionState{ServerName: "example.ts.net"}
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("X-Grpc-Web", "1")
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+				&serveHTTPContext{
+					DestPort: 443,
+					SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+				}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			res := w.Result()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d; want 200; body: %q", res.StatusCode, w.Body.String())
+			}
+			if got := res.Header.Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q; want %q", got, tt.wantType)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q; want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_reverseProxyConfiguration(t *testing.T) {
+	b := newTestBackend(t)
+	type test struct {
+		backend string
+		path    string
+		// set to false to test that a proxy has been removed
+		shouldExist   bool
+		wantsInsecure bool
+		wantsURL      url.URL
+	}
+	runner := func(name string, tests []test) {
+		t.Logf("running tests for %s", name)
+		host := ipn.HostPort("http://example.ts.net:80")
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				host: {Handlers: map[string]*ipn.HTTPHandler{}},
+			},
+		}
+		for _, tt := range tests {
+			if tt.shouldExist {
+				conf.Web[host].Handlers[tt.path] = &ipn.HTTPHandler{Proxy: tt.backend}
+			}
+		}
+		if err := b.setServeConfigLocked(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		// test that reverseproxies have been set up as expected
+		for _, tt := range tests {
+			rp, ok := b.serveProxyHandlers.Load(serveProxyKey((&ipn.HTTPHandler{Proxy: tt.backend}).View()))
+			if !tt.shouldExist && ok {
+				t.Errorf("proxy for backend %s should not exist, but it does", tt.backend)
+			}
+			if !tt.shouldExist {
+				continue
+			}
+			parsedRp, ok := rp.(*reverseProxy)
+			if !ok {
+				t.Errorf("proxy for backend %q is not a reverseproxy", tt.backend)
+			}
+			if parsedRp.insecure != tt.wantsInsecure {
+				t.Errorf("proxy for backend %q should be insecure: %v got insecure: %v", tt.backend, tt.wantsInsecure, parsedRp.insecure)
+			}
+			if !reflect.DeepEqual(*parsedRp.url, tt.wantsURL) {
+				t.Errorf("proxy for backend %q should have URL %#+v, got URL %+#v", tt.backend, &tt.wantsURL, parsedRp.url)
+			}
+			if tt.backend != parsedRp.backend {
+				t.Errorf("proxy for backend %q should have backend %q got %q", tt.backend, tt.backend, parsedRp.backend)
+			}
+		}
+	}
+
+	// configure local backend with some proxy backends
+	runner("initial proxy configs", []test{
+		{
+			backend:       "http://example.com/docs",
+			path:          "/example",
+			shouldExist:   true,
+			wantsInsecure: false,
+			wantsURL:      mustCreateURL(t, "http://example.com/docs"),
+		},
+		{
+			backend:       "https://example1.com",
+			path:          "/example1",
+			shouldExist:   true,
+			wantsInsecure: false,
+			wantsURL:      mustCreateURL(t, "https://example1.com"),
+		},
+		{
+			backend:       "https+insecure://example2.com",
+			path:          "/example2",
+			shouldExist:   true,
+			wantsInsecure: true,
+			wantsURL:      mustCreateURL(t, "https://example2.com"),
+		},
+	})
+
+	// reconfigure the local backend with different proxies
+	runner("reloaded proxy configs", []test{
+		{
+			backend:       "http://example.com/docs",
 			path:          "/example",
 			shouldExist:   true,
 			wantsInsecure: false,
@@ -664,6 +1939,213 @@ type test struct {
 
 }
 
+func TestServeProxyBackendKeepalive(t *testing.T) {
+	b := newTestBackend(t)
+	const backend = "http://127.0.0.1:3000"
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":     {Proxy: backend},
+				"/zero": {Proxy: backend, BackendKeepalive: "0s"},
+				"/30s":  {Proxy: backend, BackendKeepalive: "30s"},
+			}},
+		},
+	}
+	if err := b.setServeConfigLocked(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	getProxy := func(h *ipn.HTTPHandler) *reverseProxy {
+		t.Helper()
+		p, ok := b.serveProxyHandlers.Load(serveProxyKey(h.View()))
+		if !ok {
+			t.Fatalf("no proxy for %+v", h)
+		}
+		return p.(*reverseProxy)
+	}
+	def := getProxy(&ipn.HTTPHandler{Proxy: backend})
+	zero := getProxy(&ipn.HTTPHandler{Proxy: backend, BackendKeepalive: "0s"})
+	short := getProxy(&ipn.HTTPHandler{Proxy: backend, BackendKeepalive: "30s"})
+	if def != zero {
+		t.Error("zero keepalive doesn't share the default proxy")
+	}
+	if def == short {
+		t.Error("handlers with different keepalives share a proxy")
+	}
+	if got := def.getTransport().IdleConnTimeout; got != ipn.DefaultBackendKeepalive {
+		t.Errorf("default IdleConnTimeout = %v; want %v", got, ipn.DefaultBackendKeepalive)
+	}
+	if got := short.getTransport().IdleConnTimeout; got != 30*time.Second {
+		t.Errorf("IdleConnTimeout = %v; want 30s", got)
+	}
+	if got := short.getH2CTransport().IdleConnTimeout; got != 30*time.Second {
+		t.Errorf("h2c IdleConnTimeout = %v; want 30s", got)
+	}
+}
+
+func TestServeProxyTimeouts(t *testing.T) {
+	b := newTestBackend(t)
+	// The backend accepts connections right away but never sends its
+	// response headers.
+	testServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer testServ.Close()
+	backend := testServ.URL
+
+	slow := &ipn.HTTPHandler{Proxy: backend, ConnectTimeout: "5s", ResponseHeaderTimeout: "50ms"}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":     {Proxy: backend},
+				"/slow": slow,
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	getProxy := func(h *ipn.HTTPHandler) *reverseProxy {
+		t.Helper()
+		p, ok := b.serveProxyHandlers.Load(serveProxyKey(h.View()))
+		if !ok {
+			t.Fatalf("no proxy for %+v", h)
+		}
+		return p.(*reverseProxy)
+	}
+	def := getProxy(&ipn.HTTPHandler{Proxy: backend})
+	rp := getProxy(slow)
+	if def == rp {
+		t.Error("handlers with different timeouts share a proxy")
+	}
+	if got := def.getTransport().ResponseHeaderTimeout; got != 0 {
+		t.Errorf("default ResponseHeaderTimeout = %v; want 0", got)
+	}
+	if got := rp.getTransport().ResponseHeaderTimeout; got != 50*time.Millisecond {
+		t.Errorf("ResponseHeaderTimeout = %v; want 50ms", got)
+	}
+	if rp.connectTimeout != 5*time.Second {
+		t.Errorf("connectTimeout = %v; want 5s", rp.connectTimeout)
+	}
+
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/slow"},
+		Header: http.Header{},
+		TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+	}
+	req = req.WithContext(serveHTTPContextKey.WithValue(context.Background(),
+		&serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+		}))
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.serveWebHandler(w, req)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("proxy didn't time out waiting for the backend's response headers")
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d; want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestServeProxyKey(t *testing.T) {
+	const backend = "http://127.0.0.1:3000"
+	base := serveProxyKey((&ipn.HTTPHandler{Proxy: backend}).View())
+	if got := serveProxyKey((&ipn.HTTPHandler{Proxy: backend, Label: "x"}).View()); got != base {
+		t.Errorf("handlers differing only in Label have keys %+v and %+v; want equal", base, got)
+	}
+	// Each of these needs a proxy of its own.
+	for _, h := range []*ipn.HTTPHandler{
+		{Proxy: "http://127.0.0.1:3001"},
+		{Proxy: backend, NoHTTP2: true},
+		{Proxy: backend, GRPCWeb: true},
+		{Proxy: backend, ProxyHost: "internal.example.com"},
+		{Proxy: backend, BackendKeepalive: "5s"},
+		{Proxy: backend, ConnectTimeout: "5s"},
+		{Proxy: backend, ResponseHeaderTimeout: "5s"},
+	} {
+		if got := serveProxyKey(h.View()); got == base {
+			t.Errorf("handler %+v has the same key as a plain proxy to %s", h, backend)
+		}
+	}
+}
+
+func TestServeProxyNoHTTP2(t *testing.T) {
+	b := newTestBackend(t)
+	const backend = "http://127.0.0.1:3000"
+	host := ipn.HostPort("example.ts.net:443")
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			host: {Handlers: map[string]*ipn.HTTPHandler{
+				"/":       {Proxy: backend},
+				"/legacy": {Proxy: backend, NoHTTP2: true},
+			}},
+		},
+	}
+	if err := b.setServeConfigLocked(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	getProxy := func(h *ipn.HTTPHandler) *reverseProxy {
+		t.Helper()
+		p, ok := b.serveProxyHandlers.Load(serveProxyKey(h.View()))
+		if !ok {
+			return nil
+		}
+		return p.(*reverseProxy)
+	}
+	def := getProxy(&ipn.HTTPHandler{Proxy: backend})
+	legacy := getProxy(&ipn.HTTPHandler{Proxy: backend, NoHTTP2: true})
+	if def == nil || legacy == nil {
+		t.Fatalf("missing proxies: default=%v, nohttp2=%v", def != nil, legacy != nil)
+	}
+	if def == legacy {
+		t.Fatal("handlers with and without NoHTTP2 share a proxy")
+	}
+	if def.noHTTP2 || !legacy.noHTTP2 {
+		t.Errorf("noHTTP2: default=%v, legacy=%v; want false, true", def.noHTTP2, legacy.noHTTP2)
+	}
+	if tr := def.getTransport(); !tr.ForceAttemptHTTP2 || tr.TLSNextProto != nil {
+		t.Errorf("default transport has HTTP/2 disabled")
+	}
+	if tr := legacy.getTransport(); tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil {
+		t.Errorf("NoHTTP2 transport has HTTP/2 enabled")
+	}
+
+	grpc := httptest.NewRequest("POST", "/legacy", nil)
+	grpc.ProtoMajor = 2
+	grpc.Header.Set(contentTypeHeader, grpcBaseContentType)
+	if !def.shouldProxyViaH2C(grpc) {
+		t.Errorf("default proxy does not use h2c for gRPC")
+	}
+	if legacy.shouldProxyViaH2C(grpc) {
+		t.Errorf("NoHTTP2 proxy uses h2c for gRPC")
+	}
+
+	// Dropping the NoHTTP2 handler closes its proxy but keeps the other.
+	delete(conf.Web[host].Handlers, "/legacy")
+	if err := b.setServeConfigLocked(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if getProxy(&ipn.HTTPHandler{Proxy: backend, NoHTTP2: true}) != nil {
+		t.Error("NoHTTP2 proxy still exists after its handler was removed")
+	}
+	if getProxy(&ipn.HTTPHandler{Proxy: backend}) != def {
+		t.Error("default proxy was replaced")
+	}
+	if !legacy.closed.Load() {
+		t.Error("NoHTTP2 proxy was not closed")
+	}
+}
+
 func mustCreateURL(t *testing.T, u string) url.URL {
 	t.Helper()
 	uParsed, err := url.Parse(u)
@@ -815,7 +2297,7 @@ func TestServeFileOrDirectory(t *testing.T) {
 	for _, tt := range tests {
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest("GET", tt.req, nil)
-		b.serveFileOrDirectory(rec, req, td, tt.mount)
+		b.serveFileOrDirectory(rec, req, td, tt.mount, nil, false, false)
 		if tt.want == nil {
 			t.Errorf("no want for path %q", tt.req)
 			return
@@ -826,6 +2308,63 @@ func TestServeFileOrDirectory(t *testing.T) {
 	}
 }
 
+func TestServeFileOrDirectoryDotfiles(t *testing.T) {
+	td := t.TempDir()
+	for name, contents := range map[string]string{
+		"index.txt":    "this is index",
+		".env":         "SECRET=1",
+		".git/config":  "[core]",
+		"sub/.hidden":  "hidden",
+		"sub/file.txt": "this is file",
+	} {
+		p := filepath.Join(td, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &LocalBackend{}
+	get := func(reqPath string, serveDotfiles bool) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		b.serveFileOrDirectory(rec, httptest.NewRequest("GET", reqPath, nil), td, "/", nil, false, serveDotfiles)
+		return rec
+	}
+	for _, tt := range []struct {
+		path          string
+		serveDotfiles bool
+		wantCode      int
+	}{
+		{"/index.txt", false, 200},
+		{"/sub/file.txt", false, 200},
+		{"/.env", false, 404},
+		{"/.git/config", false, 404},
+		{"/.git/", false, 404},
+		{"/sub/.hidden", false, 404},
+		{"/.env", true, 200},
+		{"/.git/config", true, 200},
+		{"/sub/.hidden", true, 200},
+	} {
+		if rec := get(tt.path, tt.serveDotfiles); rec.Code != tt.wantCode {
+			t.Errorf("GET %s (serveDotfiles=%v): got status %d; want %d", tt.path, tt.serveDotfiles, rec.Code, tt.wantCode)
+		}
+	}
+
+	for _, serveDotfiles := range []bool{false, true} {
+		body := get("/", serveDotfiles).Body.String()
+		if !strings.Contains(body, "index.txt") {
+			t.Errorf("listing (serveDotfiles=%v) doesn't show index.txt: %s", serveDotfiles, body)
+		}
+		for _, name := range []string{".env", ".git"} {
+			if got := strings.Contains(body, name); got != serveDotfiles {
+				t.Errorf("listing (serveDotfiles=%v) shows %s = %v; want %v", serveDotfiles, name, got, serveDotfiles)
+			}
+		}
+	}
+}
+
 func Test_isGRPCContentType(t *testing.T) {
 	tests := []struct {
 		contentType string
@@ -846,6 +2385,32 @@ func Test_isGRPCContentType(t *testing.T) {
 	}
 }
 
+func Test_parseGRPCWebContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		wantSuffix  string
+		wantText    bool
+		wantOK      bool
+	}{
+		{contentType: "application/grpc-web", wantOK: true},
+		{contentType: "application/grpc-web+proto", wantSuffix: "+proto", wantOK: true},
+		{contentType: "application/grpc-web;charset=utf-8", wantSuffix: ";charset=utf-8", wantOK: true},
+		{contentType: "application/grpc-web-text", wantText: true, wantOK: true},
+		{contentType: "application/grpc-web-text+proto", wantSuffix: "+proto", wantText: true, wantOK: true},
+		{contentType: "application/grpc-webfoo"},
+		{contentType: "application/grpc-web-textfoo"},
+		{contentType: "application/grpc"},
+		{contentType: ""},
+	}
+	for _, tt := range tests {
+		suffix, text, ok := parseGRPCWebContentType(tt.contentType)
+		if suffix != tt.wantSuffix || text != tt.wantText || ok != tt.wantOK {
+			t.Errorf("parseGRPCWebContentType(%q) = (%q, %v, %v), want (%q, %v, %v)",
+				tt.contentType, suffix, text, ok, tt.wantSuffix, tt.wantText, tt.wantOK)
+		}
+	}
+}
+
 func TestEncTailscaleHeaderValue(t *testing.T) {
 	tests := []struct {
 		in   string
@@ -863,3 +2428,220 @@ func TestEncTailscaleHeaderValue(t *testing.T) {
 		}
 	}
 }
+
+func TestServeMaintenanceMode(t *testing.T) {
+	b := newTestBackend(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("site"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	downPage := filepath.Join(dir, "down.html")
+	if err := os.WriteFile(downPage, []byte("<h1>Back soon</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: path},
+			Header: http.Header{},
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+			}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w
+	}
+
+	for _, tt := range []struct {
+		name     string
+		mode     bool
+		page     string
+		wantCode int
+		wantBody string
+		wantType string
+	}{
+		{name: "off", wantCode: http.StatusOK, wantBody: "site"},
+		{name: "on", mode: true, wantCode: http.StatusServiceUnavailable, wantBody: "down for maintenance", wantType: "text/plain"},
+		{name: "on-with-page", mode: true, page: downPage, wantCode: http.StatusServiceUnavailable, wantBody: "<h1>Back soon</h1>", wantType: "text/html"},
+		{name: "on-missing-page", mode: true, page: filepath.Join(dir, "gone.html"), wantCode: http.StatusServiceUnavailable, wantBody: "down for maintenance", wantType: "text/plain"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &ipn.ServeConfig{
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/":     {Path: dir},
+						"/text": {Text: "hello"},
+					}},
+				},
+				MaintenanceMode: tt.mode,
+				MaintenancePage: tt.page,
+			}
+			if err := b.SetServeConfig(conf, ""); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range []string{"/", "/text"} {
+				w := get(path)
+				if w.Code != tt.wantCode {
+					t.Errorf("%s: status = %d; want %d", path, w.Code, tt.wantCode)
+				}
+				if !tt.mode {
+					continue
+				}
+				if !strings.Contains(w.Body.String(), tt.wantBody) {
+					t.Errorf("%s: body = %q; want it to contain %q", path, w.Body.String(), tt.wantBody)
+				}
+				if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+					t.Errorf("%s: Content-Type = %q; want %s", path, ct, tt.wantType)
+				}
+				if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+					t.Errorf("%s: Cache-Control = %q; want no-store", path, cc)
+				}
+			}
+			if !tt.mode {
+				if got := get("/").Body.String(); got != tt.wantBody {
+					t.Errorf("body = %q; want %q", got, tt.wantBody)
+				}
+			}
+		})
+	}
+}
+
+func TestServeVIPServices(t *testing.T) {
+	b := newTestBackend(t)
+	b.pm.prefs = (&ipn.Prefs{AdvertiseServices: []string{"svc:web"}}).View()
+	b.netMap.SelfNode = (&tailcfg.Node{
+		Name: "example.ts.net",
+		CapMap: tailcfg.NodeCapMap{
+			tailcfg.NodeAttrServiceHost: []tailcfg.RawMessage{
+				`{"svc:web":["100.100.100.101"],"svc:db":["100.100.100.102"]}`,
+			},
+		},
+	}).View()
+
+	webAP := netip.MustParseAddrPort("100.100.100.101:443")
+	dbAP := netip.MustParseAddrPort("100.100.100.102:5432")
+	src := netip.MustParseAddrPort("100.150.151.152:1234")
+
+	setConf := func(maintenance bool) {
+		t.Helper()
+		conf := &ipn.ServeConfig{
+			Services: map[string]*ipn.ServiceConfig{
+				"svc:web": {
+					TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+					Web: map[ipn.HostPort]*ipn.WebServerConfig{
+						"web.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+							"/": {Text: "hello from web"},
+						}},
+					},
+				},
+				// Not advertised by the node.
+				"svc:db": {
+					TCP: map[uint16]*ipn.TCPPortHandler{5432: {TCPForward: "localhost:5432"}},
+				},
+			},
+			MaintenanceMode: maintenance,
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func() *httptest.ResponseRecorder {
+		t.Helper()
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/"},
+			Header: http.Header{},
+			TLS:    &tls.ConnectionState{ServerName: "web.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  src,
+			}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w
+	}
+
+	setConf(false)
+	if !b.ShouldInterceptVIPServiceTCPPort(webAP) {
+		t.Errorf("ShouldInterceptVIPServiceTCPPort(%v) = false; want true", webAP)
+	}
+	for _, ap := range []netip.AddrPort{
+		netip.MustParseAddrPort("100.100.100.101:80"),
+		dbAP,
+	} {
+		if b.ShouldInterceptVIPServiceTCPPort(ap) {
+			t.Errorf("ShouldInterceptVIPServiceTCPPort(%v) = true; want false", ap)
+		}
+	}
+	if h, _ := b.TCPHandlerForDst(src, webAP); h == nil {
+		t.Errorf("TCPHandlerForDst(%v) = nil; want a handler", webAP)
+	}
+	if h, _ := b.TCPHandlerForDst(src, dbAP); h != nil {
+		t.Errorf("TCPHandlerForDst(%v) = non-nil; want nil", dbAP)
+	}
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != "hello from web" {
+		t.Errorf("got %d %q; want 200 %q", w.Code, w.Body.String(), "hello from web")
+	}
+
+	setConf(true)
+	if w := get(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("in maintenance mode, got status %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	b.pm.prefs = (&ipn.Prefs{}).View()
+	setConf(false)
+	if b.ShouldInterceptVIPServiceTCPPort(webAP) {
+		t.Errorf("ShouldInterceptVIPServiceTCPPort(%v) = true after no longer advertising svc:web; want false", webAP)
+	}
+}
+
+func TestServeBacklog(t *testing.T) {
+	b := newTestBackend(t)
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			5432: {TCPForward: "127.0.0.1:5432", Backlog: 4096},
+			2222: {TCPForward: "127.0.0.1:22"},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	for port, want := range map[uint16]int{5432: 4096, 2222: 0, 443: 0} {
+		if got := b.serveBacklogLocked(port); got != want {
+			t.Errorf("serveBacklogLocked(%d) = %d; want %d", port, got, want)
+		}
+	}
+	b.mu.Unlock()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := setListenBacklog(ln, 16); err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skipf("setting the backlog isn't supported here: %v", err)
+		}
+		t.Fatal(err)
+	}
+	// The listener still accepts connections afterwards.
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ac, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.Close()
+}
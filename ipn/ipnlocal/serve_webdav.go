@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/tailscale/xnet/webdav"
+	"tailscale.com/ipn"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+// serveWebDAV serves the directory dir over WebDAV for an ipn.HTTPHandler
+// with WebDAV set. If readOnly, requests that would change files are
+// rejected with 403 Forbidden.
+func (b *LocalBackend) serveWebDAV(w http.ResponseWriter, r *http.Request, dir, mountPoint string, readOnly bool) {
+	if readOnly && !isWebDAVReadMethod(r.Method) {
+		http.Error(w, "read-only", http.StatusForbidden)
+		return
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		b.logf("serve: can't serve %s over WebDAV: not a directory", dir)
+		http.Error(w, "an error occurred reading the directory", 500)
+		return
+	}
+	h := &webdav.Handler{
+		Prefix:     strings.TrimSuffix(mountPoint, "/"),
+		FileSystem: webdav.Dir(dir),
+		LockSystem: b.serveWebDAVLocks.get(dir),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				b.logf("serve: WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(w, r)
+}
+
+// isWebDAVReadMethod reports whether the WebDAV method doesn't change
+// files, and so is allowed by a handler with WebDAVReadOnly set.
+func isWebDAVReadMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// pruneServeWebDAVLocksLocked removes the lock systems of the directories
+// that neither b.serveConfig nor a draining config serves over WebDAV from
+// b.serveWebDAVLocks.
+func (b *LocalBackend) pruneServeWebDAVLocksLocked() {
+	keep := make(set.Set[string])
+	for _, sc := range b.servingServeConfigsLocked() {
+		sc.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
+			conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
+				if h.WebDAV() {
+					keep.Add(h.Path())
+				}
+				return true
+			})
+			return true
+		})
+	}
+	b.serveWebDAVLocks.retain(keep.Contains)
+}
+
+// webDAVLocks holds the WebDAV lock system of each directory served over
+// WebDAV, so that a client's locks last across its requests. The zero
+// value is ready for use.
+type webDAVLocks struct {
+	mu sync.Mutex
+	m  map[string]webdav.LockSystem // by directory
+}
+
+// get returns the lock system for dir, creating it if needed.
+func (l *webDAVLocks) get(dir string) webdav.LockSystem {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.m[dir]
+	if !ok {
+		ls = webdav.NewMemLS()
+		mak.Set(&l.m, dir, ls)
+	}
+	return ls
+}
+
+// retain removes the lock systems of the directories that keep doesn't
+// report true for.
+func (l *webDAVLocks) retain(keep func(dir string) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for dir := range l.m {
+		if !keep(dir) {
+			delete(l.m, dir)
+		}
+	}
+}
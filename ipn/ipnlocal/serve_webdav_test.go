@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestServeWebDAV(t *testing.T) {
+	b := newTestBackend(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(file, []byte("not a directory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/dav/":  {Path: dir, WebDAV: true},
+				"/ro/":   {Path: dir, WebDAV: true, WebDAVReadOnly: true},
+				"/file/": {Path: file, WebDAV: true},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := &http.Request{
+			Method: method,
+			URL:    &url.URL{Path: path},
+			Header: http.Header{},
+			Body:   io.NopCloser(strings.NewReader(body)),
+			TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		if method == "PROPFIND" {
+			req.Header.Set("Depth", "1")
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(),
+			&serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+			}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w
+	}
+
+	tests := []struct {
+		method, path, body string
+		wantCode           int
+		wantBody           string // substring; empty means don't check
+	}{
+		{"GET", "/dav/hello.txt", "", http.StatusOK, "hello"},
+		{"PROPFIND", "/dav/", "", http.StatusMultiStatus, "/dav/hello.txt"},
+		{"PUT", "/dav/new.txt", "new", http.StatusCreated, ""},
+		{"GET", "/dav/new.txt", "", http.StatusOK, "new"},
+		{"MKCOL", "/dav/sub", "", http.StatusCreated, ""},
+		{"DELETE", "/dav/new.txt", "", http.StatusNoContent, ""},
+
+		{"GET", "/ro/hello.txt", "", http.StatusOK, "hello"},
+		{"PROPFIND", "/ro/", "", http.StatusMultiStatus, "/ro/hello.txt"},
+		{"PUT", "/ro/other.txt", "other", http.StatusForbidden, ""},
+		{"DELETE", "/ro/hello.txt", "", http.StatusForbidden, ""},
+
+		{"PROPFIND", "/file/", "", http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		w := do(tt.method, tt.path, tt.body)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s %s: status = %d; want %d; body: %s", tt.method, tt.path, w.Code, tt.wantCode, w.Body.String())
+			continue
+		}
+		if tt.wantBody != "" && !strings.Contains(w.Body.String(), tt.wantBody) {
+			t.Errorf("%s %s: body = %q; want it to contain %q", tt.method, tt.path, w.Body.String(), tt.wantBody)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "sub")); err != nil {
+		t.Errorf("MKCOL didn't create the directory: %v", err)
+	}
+	for _, name := range []string{"new.txt", "other.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after the test; want it deleted or never created (err %v)", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "hello.txt")); err != nil {
+		t.Errorf("read-only DELETE removed hello.txt: %v", err)
+	}
+}
@@ -120,6 +120,7 @@
 	"reload-config":               (*Handler).reloadConfig,
 	"reset-auth":                  (*Handler).serveResetAuth,
 	"serve-config":                (*Handler).serveServeConfig,
+	"serve-stats":                 (*Handler).serveServeStats,
 	"set-dns":                     (*Handler).serveSetDNS,
 	"set-expiry-sooner":           (*Handler).serveSetExpirySooner,
 	"set-gui-visible":             (*Handler).serveSetGUIVisible,
@@ -1507,6 +1508,23 @@ type E struct {
 	json.NewEncoder(w).Encode(E{err.Error()})
 }
 
+// serveServeStats returns the traffic counters of the serve web handlers,
+// as a JSON []ipn.ServeHandlerStats.
+func (h *Handler) serveServeStats(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "serve stats denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := h.b.ServeStats()
+	mak.NonNilSliceForJSON(&stats)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 func (h *Handler) serveFileTargets(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "access denied", http.StatusForbidden)
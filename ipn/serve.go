@@ -4,17 +4,32 @@
 package ipn
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"mime"
 	"net"
+	"net/http"
 	"net/netip"
+	"net/textproto"
 	"net/url"
+	"path"
+	"path/filepath"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"golang.org/x/net/http/httpguts"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/util/mak"
 )
 
@@ -54,6 +69,10 @@ type ServeConfig struct {
 
 	// Services maps from service name to a ServiceConfig. Which describes the
 	// L3, L4, and L7 forwarding information for the service.
+	// tailscaled serves the TCP and Web handlers of the services that the
+	// node advertises (see Prefs.AdvertiseServices) on the service IPs
+	// that control assigns in the tailcfg.NodeAttrServiceHost capability.
+	// Tun mode isn't supported yet.
 	Services map[string]*ServiceConfig `json:",omitempty"`
 
 	// AllowFunnel is the set of SNI:port values for which funnel
@@ -68,6 +87,28 @@ type ServeConfig struct {
 	// that users are not aware of.
 	Foreground map[string]*ServeConfig `json:",omitempty"`
 
+	// Drain, if non-empty, is how long (as a Go duration, such as "30s";
+	// see ParseDrain) HTTP and HTTPS connections accepted before this
+	// config replaced the previous one keep being served by the previous
+	// one. New connections use this config straight away. If empty or
+	// zero, the switchover is immediate for all connections, including
+	// any still draining from earlier changes.
+	Drain string `json:",omitempty"`
+
+	// MaintenanceMode, if true, makes every web handler, including those
+	// of the Services that the node serves, respond 503 Service
+	// Unavailable with a maintenance page instead of serving, for planned
+	// downtime. The rest of the config is kept as is for when maintenance
+	// is over. TCP forwarders, including those of Services, aren't
+	// affected.
+	MaintenanceMode bool `json:",omitempty"`
+
+	// MaintenancePage, if non-empty, is the absolute path of an HTML file
+	// to serve as the maintenance page in MaintenanceMode, instead of a
+	// plain text one. It's read for each request, so it can be edited
+	// during maintenance. It is only valid with MaintenanceMode.
+	MaintenancePage string `json:",omitempty"`
+
 	// ETag is the checksum of the serve config that's populated
 	// by the LocalClient through the HTTP ETag header during a
 	// GetServeConfig request and is translated to an If-Match header
@@ -75,6 +116,22 @@ type ServeConfig struct {
 	ETag string `json:"-"`
 }
 
+// Hash returns a hex-encoded SHA-256 checksum of sc's JSON encoding. It
+// changes whenever any serialized field of sc changes and is stable across
+// no-op updates, so it can be used as a version of the config.
+//
+// It's computed the same way as the ETag returned by LocalClient's
+// GetServeConfig, so the two are comparable. A nil sc hashes the JSON "null".
+func (sc *ServeConfig) Hash() string {
+	j, err := json.Marshal(sc)
+	if err != nil {
+		// ServeConfig only contains types that always marshal.
+		panic(fmt.Sprintf("encoding ServeConfig: %v", err))
+	}
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:])
+}
+
 // HostPort is an SNI name and port number, joined by a colon.
 // There is no implicit port 443. It must contain a colon.
 type HostPort string
@@ -114,11 +171,29 @@ type FunnelConn struct {
 	Src netip.AddrPort
 }
 
+// WildcardMountPoint is the mount point that matches any request path not
+// matched by a more specific mount point on the same WebServerConfig,
+// including "/". It may only appear at the root.
+const WildcardMountPoint = "/*"
+
 // WebServerConfig describes a web server's configuration.
 type WebServerConfig struct {
+	// Handlers maps from mount point to handler. The longest matching mount
+	// point wins. A handler at WildcardMountPoint is used only if no other
+	// mount point matches.
 	Handlers map[string]*HTTPHandler // mountPoint => handler
 }
 
+// ServeHandlerStats are the traffic counters of a web handler, as
+// reported by "tailscale serve stats". They count from when tailscaled
+// started, so they may include handlers that have since been removed.
+type ServeHandlerStats struct {
+	HostPort  HostPort // web server of the handler, such as "foo.tailnet.ts.net:443"
+	Mount     string   // mount point of the handler; "/" for WildcardMountPoint
+	Requests  int64    // requests served, including rejected ones
+	BytesSent int64    // bytes of response bodies sent
+}
+
 // TCPPortHandler describes what to do when handling a TCP
 // connection.
 type TCPPortHandler struct {
@@ -146,6 +221,39 @@ type TCPPortHandler struct {
 	// SNI name with this value. It is only used if TCPForward is non-empty.
 	// (the HTTPS mode uses ServeConfig.Web)
 	TerminateTLS string `json:",omitempty"`
+
+	// SNIRoutes, if non-empty, maps additional SNI names to the IP:port
+	// to forward connections for that name to, instead of TCPForward.
+	// tailscaled picks the backend after completing the TLS handshake, so
+	// it must be able to get a certificate for each name. Connections for
+	// the TerminateTLS name still go to TCPForward. It is only valid if
+	// TerminateTLS is set.
+	SNIRoutes map[string]string `json:",omitempty"`
+
+	// TLSMinVersion, if non-empty, is the minimum TLS version ("1.2" or
+	// "1.3") that tailscaled accepts on this port. See ParseTLSVersion.
+	// It is only valid if HTTPS or TerminateTLS is set. If empty, the
+	// crypto/tls default is used.
+	TLSMinVersion string `json:",omitempty"`
+
+	// MaxConns, if positive, is the maximum number of connections that
+	// tailscaled forwards to the backend at once; connections beyond it
+	// are closed as soon as they're accepted. It is only valid if
+	// TCPForward is set. Zero means no limit.
+	MaxConns int `json:",omitempty"`
+
+	// Backlog, if positive, is the length of the queue of connections not
+	// yet accepted that tailscaled asks the OS for when it listens on this
+	// port on the host, as it does for connections from the node itself
+	// when not in userspace-networking mode. The OS may cap it, such as at
+	// net.core.somaxconn on Linux. It is only valid if TCPForward is set,
+	// and at most MaxBacklog. Zero means the OS default.
+	Backlog int `json:",omitempty"`
+
+	// Label is an optional human-readable description of the handler,
+	// shown by "tailscale serve status". It has no effect on how
+	// connections are handled.
+	Label string `json:",omitempty"`
 }
 
 // HTTPHandler is either a path or a proxy to serve.
@@ -153,14 +261,573 @@ type HTTPHandler struct {
 	// Exactly one of the following may be set.
 
 	Path  string `json:",omitempty"` // absolute path to directory or file to serve
-	Proxy string `json:",omitempty"` // http://localhost:3000/, localhost:3030, 3030
+	Proxy string `json:",omitempty"` // http://localhost:3000/, localhost:3030, 3030, or \\.\pipe\name on Windows
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
+	// Archive is the absolute path to a zip or tar file (see
+	// ArchiveFormat) whose files are served, as if the archive had been
+	// unpacked to a directory and served as a Path.
+	Archive string `json:",omitempty"`
+
+	// AggregateBackends, if true, makes the handler a health endpoint
+	// that responds 200 OK if all the Proxy backends in the ServeConfig
+	// are reachable and 503 Service Unavailable otherwise. Only tailnet
+	// clients, not Funnel ones, are told the status of each backend.
+	AggregateBackends bool `json:",omitempty"`
+
+	// RedirectToHTTPS, if true, makes the handler permanently redirect
+	// requests to the same host, path and query over HTTPS on port 443.
+	// It is only valid on HTTP (not HTTPS) ports.
+	RedirectToHTTPS bool `json:",omitempty"`
+
+	// NoHTTP2, if true, forces requests to the Proxy backend to use
+	// HTTP/1.1, for backends that misbehave when HTTP/2 is negotiated.
+	// It is only valid for Proxy handlers.
+	NoHTTP2 bool `json:",omitempty"`
+
+	// ProxyHost, if non-empty, is the Host header (a host or host:port, see
+	// CheckProxyHost) sent with requests to the Proxy backend, for
+	// virtual-hosted backends. If empty, the incoming request's Host is
+	// passed through. It is only valid for Proxy handlers.
+	ProxyHost string `json:",omitempty"`
+
+	// GRPCWeb, if true, makes the proxy translate gRPC-Web requests
+	// (as sent by browsers) to gRPC for the Proxy backend, and the
+	// backend's gRPC responses back to gRPC-Web. Other requests are
+	// proxied unchanged. It is only valid for Proxy handlers and
+	// requires HTTP/2, so it can't be combined with NoHTTP2.
+	GRPCWeb bool `json:",omitempty"`
+
+	// BackendKeepalive, if non-empty, is how long (as a Go duration, such
+	// as "30s"; see ParseBackendKeepalive) an idle connection to the Proxy
+	// backend is kept open for reuse, for backends that close idle
+	// connections sooner than the default of DefaultBackendKeepalive. It
+	// is only valid for Proxy handlers.
+	BackendKeepalive string `json:",omitempty"`
+
+	// ConnectTimeout, if non-empty, is how long (as a Go duration, such as
+	// "5s"; see ParseProxyTimeout) the proxy waits to connect to the Proxy
+	// backend before failing the request. It is only valid for Proxy
+	// handlers.
+	ConnectTimeout string `json:",omitempty"`
+
+	// ResponseHeaderTimeout, if non-empty, is how long (as a Go duration,
+	// such as "30s"; see ParseProxyTimeout) the proxy waits for the Proxy
+	// backend's response headers, once it has sent the request, before
+	// failing the request. Unlike ConnectTimeout, it allows for backends
+	// that are quick to accept connections but slow to respond; it doesn't
+	// limit how long the response body then takes. It doesn't apply to
+	// gRPC requests to a plaintext (h2c) backend. It is only valid for
+	// Proxy handlers.
+	ResponseHeaderTimeout string `json:",omitempty"`
+
+	// RequestIDHeader, if non-empty, is the name of a request header, such
+	// as "X-Request-Id", that's sent to the Proxy backend with a unique ID
+	// for each request, for correlating requests with backend logs.
+	// Requests that already have the header keep their value. See
+	// CheckRequestIDHeader for what's accepted. It is only valid for Proxy
+	// handlers.
+	RequestIDHeader string `json:",omitempty"`
+
+	// Canary, if non-empty, is a second proxy backend, in the same forms
+	// as Proxy, that's sent CanaryPercent percent of the requests, for
+	// gradually rolling out a new version of the backend. The rest go to
+	// Proxy. Each request is routed at random, independently of the
+	// others. It is only valid for Proxy handlers.
+	Canary string `json:",omitempty"`
+
+	// CanaryPercent is the percentage, from 0 to 100, of requests that
+	// are sent to Canary. It is only valid with Canary.
+	CanaryPercent int `json:",omitempty"`
+
+	// AllowMethods, if non-empty, is the set of HTTP methods (in canonical
+	// upper case, see ParseHTTPMethods) that the handler accepts. Requests
+	// with any other method are rejected with 405 Method Not Allowed.
+	// If empty, all methods are allowed.
+	AllowMethods []string `json:",omitempty"`
+
+	// RequireTag, if non-empty, is an ACL tag (such as "tag:admin") that
+	// the requesting tailnet peer must have. Other requests, including
+	// all Funnel requests, are rejected with 403 Forbidden.
+	RequireTag string `json:",omitempty"`
+
+	// AllowCIDRs, if non-empty, is the set of IP prefixes (see ParseCIDR)
+	// that the requesting client's address must be in, such as an office
+	// subnet reached through a subnet router. Other requests are rejected
+	// with 403 Forbidden. For Funnel requests, the client's address is
+	// its address on the internet.
+	AllowCIDRs []netip.Prefix `json:",omitempty"`
+
+	// BasicAuth, if non-empty, is the users that may access the handler,
+	// which they must authenticate as with HTTP Basic auth. Each entry is
+	// a line of an htpasswd file, "user:hash", where hash is a bcrypt hash
+	// of the user's password (see CheckBasicAuthEntry); passwords are
+	// never stored in plaintext. Other requests are rejected with 401
+	// Unauthorized.
+	BasicAuth []string `json:",omitempty"`
+
+	// CacheControl, if non-empty, is the Cache-Control header value sent
+	// with responses from a Path handler, such as "max-age=3600". See
+	// CheckCacheControl for what's accepted.
+	CacheControl string `json:",omitempty"`
+
+	// ContentType, if non-empty, is the Content-Type header value sent
+	// with responses from a Path handler, instead of the type inferred
+	// from the file's name and contents. It's meant for files whose type
+	// can't be inferred, such as a proxy auto-config (PAC) file served
+	// as PACContentType.
+	ContentType string `json:",omitempty"`
+
+	// SPAFallback, if true, makes a Path handler for a directory serve
+	// the directory's index.html, with 200 OK, for any request path under
+	// the mount point that doesn't name a file or directory, instead of
+	// 404 Not Found. It's meant for single-page apps that do their own
+	// routing in the browser. It is only valid for Path handlers.
+	SPAFallback bool `json:",omitempty"`
+
+	// OverlayPaths, if non-empty, is a list of absolute paths to more
+	// directories that a Path handler for a directory serves merged with
+	// Path, such as environment-specific files layered over a base site.
+	// Later directories win: a request is served from the last of
+	// OverlayPaths that has the requested file, or from Path if none do.
+	// A directory listing shows only the directory from the last of them
+	// that has it. It is only valid for Path handlers.
+	OverlayPaths []string `json:",omitempty"`
+
+	// WebDAV, if true, makes a Path handler for a directory serve it over
+	// WebDAV, so that clients can mount it and, unless WebDAVReadOnly is
+	// set, create, change and delete files in it, such as to sync files.
+	// It is only valid for Path handlers, and not with ContentType,
+	// SPAFallback or OverlayPaths. Whether Path is a directory is only
+	// known when it's served; requests fail if it isn't.
+	WebDAV bool `json:",omitempty"`
+
+	// WebDAVReadOnly, if true, makes a WebDAV handler reject requests
+	// that would change files with 403 Forbidden. It is only valid with
+	// WebDAV.
+	WebDAVReadOnly bool `json:",omitempty"`
+
+	// ServeDotfiles, if true, makes a Path handler for a directory serve
+	// the files and directories in it whose names start with a period,
+	// such as .git and .env. By default they're left out of directory
+	// listings and requests for them, or for anything under them, get 404
+	// Not Found, so that they don't leak. It is only valid for Path
+	// handlers, and not with WebDAV, which serves every file.
+	ServeDotfiles bool `json:",omitempty"`
+
+	// Compress, if true, gzips the handler's responses for clients that
+	// accept it, to save bandwidth, such as over Funnel. Responses that
+	// are small, already compressed (such as images) or already encoded
+	// by the Proxy backend are sent as is. It is only valid for Path,
+	// Archive and Proxy handlers.
+	Compress bool `json:",omitempty"`
+
+	// LogLevel, if non-empty, is how much tailscaled logs about the
+	// handler's requests: one of the LogLevel constants. Empty means
+	// LogLevelError. It's meant for debugging a single handler without
+	// making all of tailscaled's logging more verbose.
+	LogLevel string `json:",omitempty"`
+
+	// Label is an optional human-readable description of the handler,
+	// shown by "tailscale serve status". It has no effect on how
+	// requests are handled.
+	Label string `json:",omitempty"`
+
 	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
 	// temporary ones? Error codes? Redirects?
 }
 
+// httpMethods are the HTTP methods accepted by ParseHTTPMethods.
+var httpMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+}
+
+// ParseHTTPMethods parses a comma-separated list of HTTP method names, such
+// as "GET,HEAD", into the form stored in HTTPHandler.AllowMethods. Method
+// names are case-insensitive and duplicates are dropped. It returns an error
+// if the list is empty or contains an unknown method.
+func ParseHTTPMethods(s string) ([]string, error) {
+	var methods []string
+	for _, m := range strings.Split(s, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" {
+			return nil, fmt.Errorf("invalid HTTP method list %q: empty method name", s)
+		}
+		if !slices.Contains(httpMethods, m) {
+			return nil, fmt.Errorf("unknown HTTP method %q", m)
+		}
+		if !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	return methods, nil
+}
+
+// ParseCIDR parses s, an IP prefix such as "100.64.0.0/10", into the form
+// stored in HTTPHandler.AllowCIDRs, with the host bits cleared. A bare IP
+// address isn't accepted.
+func ParseCIDR(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: must be an IP prefix such as 100.64.0.0/10", s)
+	}
+	return p.Masked(), nil
+}
+
+// CheckCacheControl reports whether v is acceptable as an
+// HTTPHandler.CacheControl value: a comma-separated list of directives,
+// each a token optionally followed by "=" and a token or quoted string.
+// The directive names themselves aren't checked. Control characters are
+// rejected so that the value can't inject other headers.
+func CheckCacheControl(v string) error {
+	if strings.TrimSpace(v) == "" {
+		return errors.New("empty Cache-Control value")
+	}
+	if strings.ContainsFunc(v, func(r rune) bool { return (r < ' ' && r != '\t') || r >= 0x7f }) {
+		return errors.New("Cache-Control value must not contain control or non-ASCII characters")
+	}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		name, val, hasVal := strings.Cut(d, "=")
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid Cache-Control directive %q", d)
+		}
+		if hasVal && !httpguts.ValidHeaderFieldName(val) && !isQuotedString(val) {
+			return fmt.Errorf("invalid value in Cache-Control directive %q", d)
+		}
+	}
+	return nil
+}
+
+func isQuotedString(s string) bool {
+	return len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' && !strings.Contains(s[1:len(s)-1], `"`)
+}
+
+// Values for HTTPHandler.LogLevel, from least to most verbose.
+const (
+	// LogLevelError logs only errors serving requests, such as failures to
+	// reach a proxy backend. It's the default.
+	LogLevelError = "error"
+
+	// LogLevelInfo also logs a line for each request, with its response
+	// status, size and duration.
+	LogLevelInfo = "info"
+
+	// LogLevelDebug also logs the headers of each request and response,
+	// with credentials such as cookies redacted.
+	LogLevelDebug = "debug"
+)
+
+// CheckLogLevel reports whether s is a valid HTTPHandler.LogLevel: empty or
+// one of the LogLevel constants.
+func CheckLogLevel(s string) error {
+	switch s {
+	case "", LogLevelError, LogLevelInfo, LogLevelDebug:
+		return nil
+	}
+	return fmt.Errorf("invalid log level %q: must be %s, %s or %s", s, LogLevelError, LogLevelInfo, LogLevelDebug)
+}
+
+// CheckBasicAuthEntry reports whether s is a valid HTTPHandler.BasicAuth
+// entry: a non-empty user name, a colon, and a bcrypt hash, as written by
+// "htpasswd -B".
+func CheckBasicAuthEntry(s string) error {
+	user, hash, ok := strings.Cut(s, ":")
+	if !ok || user == "" {
+		return errors.New("invalid basic auth entry; want user:hash")
+	}
+	if !isBcryptHash(hash) {
+		return fmt.Errorf("invalid basic auth entry for %q; the password hash must be a bcrypt hash", user)
+	}
+	return nil
+}
+
+// isBcryptHash reports whether hash looks like a bcrypt hash, such as
+// "$2y$10$" followed by the 53 characters of the salt and hash.
+func isBcryptHash(hash string) bool {
+	if len(hash) != 60 {
+		return false
+	}
+	switch hash[:4] {
+	case "$2a$", "$2b$", "$2y$":
+	default:
+		return false
+	}
+	cost, err := strconv.Atoi(hash[4:6])
+	return err == nil && hash[6] == '$' && cost >= 4 && cost <= 31
+}
+
+// ParseTLSVersion parses a TCPPortHandler.TLSMinVersion value, "1.2" or
+// "1.3", into the corresponding crypto/tls version constant. Older
+// versions aren't accepted.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version %q: must be 1.2 or 1.3", s)
+}
+
+// MinTLSVersion returns the crypto/tls version constant for the port's
+// TLSMinVersion, or 0 (meaning the crypto/tls default) if it's unset or
+// invalid.
+func (v TCPPortHandlerView) MinTLSVersion() uint16 {
+	ver, _ := ParseTLSVersion(v.TLSMinVersion())
+	return ver
+}
+
+// MaxBacklog is the largest TCPPortHandler.Backlog that's accepted.
+const MaxBacklog = 65535
+
+// MaxDrain is the longest ServeConfig.Drain that's accepted.
+const MaxDrain = time.Hour
+
+// ParseDrain parses a ServeConfig.Drain value. The empty string means
+// zero. Negative durations and those longer than MaxDrain aren't
+// accepted.
+func ParseDrain(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid drain duration %q: %w", s, err)
+	}
+	if d < 0 || d > MaxDrain {
+		return 0, fmt.Errorf("invalid drain duration %q: must be between 0 and %v", s, MaxDrain)
+	}
+	return d, nil
+}
+
+// DrainDuration returns the config's Drain as a time.Duration, or 0 if
+// it's unset or invalid.
+func (v ServeConfigView) DrainDuration() time.Duration {
+	d, _ := ParseDrain(v.Drain())
+	return d
+}
+
+// DefaultBackendKeepalive is how long idle connections to a Proxy backend
+// are kept open for reuse if HTTPHandler.BackendKeepalive is unset or zero.
+const DefaultBackendKeepalive = 90 * time.Second
+
+// MaxBackendKeepalive is the longest HTTPHandler.BackendKeepalive that's
+// accepted.
+const MaxBackendKeepalive = 24 * time.Hour
+
+// ParseBackendKeepalive parses an HTTPHandler.BackendKeepalive value. The
+// empty string means zero, which stands for DefaultBackendKeepalive.
+// Negative durations and those longer than MaxBackendKeepalive aren't
+// accepted.
+func ParseBackendKeepalive(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid backend keepalive %q: %w", s, err)
+	}
+	if d < 0 || d > MaxBackendKeepalive {
+		return 0, fmt.Errorf("invalid backend keepalive %q: must be between 0 and %v", s, MaxBackendKeepalive)
+	}
+	return d, nil
+}
+
+// BackendKeepaliveDuration returns how long idle connections to the
+// handler's Proxy backend are kept open: its BackendKeepalive, or
+// DefaultBackendKeepalive if that's unset, zero or invalid.
+func (v HTTPHandlerView) BackendKeepaliveDuration() time.Duration {
+	if d, err := ParseBackendKeepalive(v.BackendKeepalive()); err == nil && d > 0 {
+		return d
+	}
+	return DefaultBackendKeepalive
+}
+
+// ParseProxyTimeout parses an HTTPHandler.ConnectTimeout or
+// ResponseHeaderTimeout value. The empty string means zero, which stands
+// for no timeout. Negative durations aren't accepted.
+func ParseProxyTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %w", s, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must not be negative", s)
+	}
+	return d, nil
+}
+
+// ConnectTimeoutDuration returns the handler's ConnectTimeout as a
+// time.Duration, or 0, meaning no timeout, if it's unset or invalid.
+func (v HTTPHandlerView) ConnectTimeoutDuration() time.Duration {
+	d, _ := ParseProxyTimeout(v.ConnectTimeout())
+	return d
+}
+
+// ResponseHeaderTimeoutDuration returns the handler's
+// ResponseHeaderTimeout as a time.Duration, or 0, meaning no timeout, if
+// it's unset or invalid.
+func (v HTTPHandlerView) ResponseHeaderTimeoutDuration() time.Duration {
+	d, _ := ParseProxyTimeout(v.ResponseHeaderTimeout())
+	return d
+}
+
+// PACContentType is the HTTPHandler.ContentType of a proxy auto-config
+// (PAC) file, which browsers need to use it.
+const PACContentType = "application/x-ns-proxy-autoconfig"
+
+// ArchiveFormat returns the format of the archive file name, based on its
+// extension: "zip" for .zip files, "tar" for (uncompressed) .tar files, and
+// the empty string for anything else.
+func ArchiveFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".zip":
+		return "zip"
+	case ".tar":
+		return "tar"
+	}
+	return ""
+}
+
+// CheckRequestIDHeader reports whether v is acceptable as an
+// HTTPHandler.RequestIDHeader value: a valid header name, other than one
+// of the headers that the proxy itself manages, such as Host or
+// Connection.
+func CheckRequestIDHeader(v string) error {
+	if !httpguts.ValidHeaderFieldName(v) {
+		return fmt.Errorf("invalid request ID header %q", v)
+	}
+	switch textproto.CanonicalMIMEHeaderKey(v) {
+	case "Host", "Connection", "Content-Length", "Content-Type", "Keep-Alive",
+		"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+		"Authorization", "Cookie", "Forwarded", "X-Forwarded-For",
+		"X-Forwarded-Host", "X-Forwarded-Proto":
+		return fmt.Errorf("invalid request ID header %q: reserved header", v)
+	}
+	return nil
+}
+
+// CheckProxyHost reports whether v is acceptable as an
+// HTTPHandler.ProxyHost value: a DNS name or IP address, optionally
+// followed by a port. IPv6 addresses must be in brackets.
+func CheckProxyHost(v string) error {
+	host, port, err := net.SplitHostPort(v)
+	if err != nil {
+		host = v // no port
+		if len(v) > 2 && v[0] == '[' && v[len(v)-1] == ']' {
+			host = v[1 : len(v)-1]
+		}
+	} else if err := checkPort(port); err != nil {
+		return fmt.Errorf("invalid proxy host %q: %w", v, err)
+	}
+	bracketed := strings.HasPrefix(v, "[")
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is6() != bracketed {
+			return fmt.Errorf("invalid proxy host %q: only IPv6 addresses must be in brackets", v)
+		}
+		return nil
+	}
+	if bracketed {
+		return fmt.Errorf("invalid proxy host %q: not an IPv6 address", v)
+	}
+	if err := dnsname.ValidHostname(host); err != nil {
+		return fmt.Errorf("invalid proxy host %q: %w", v, err)
+	}
+	return nil
+}
+
+// ParseSNIRoute parses an SNI route of the form "name=host:port", as used
+// in TCPPortHandler.SNIRoutes. The name is lowercased.
+func ParseSNIRoute(s string) (name, backend string, err error) {
+	name, backend, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid SNI route %q: want name=host:port", s)
+	}
+	name = strings.ToLower(name)
+	if err := CheckSNIName(name); err != nil {
+		return "", "", err
+	}
+	if err := checkForwardAddr(backend); err != nil {
+		return "", "", fmt.Errorf("invalid backend for SNI name %q: %w", name, err)
+	}
+	return name, backend, nil
+}
+
+// CheckSNIName reports whether name is acceptable as a key of
+// TCPPortHandler.SNIRoutes: a lowercase DNS name without a trailing dot.
+func CheckSNIName(name string) error {
+	if name == "" || strings.HasSuffix(name, ".") || strings.ToLower(name) != name {
+		return fmt.Errorf("invalid SNI name %q: must be a lowercase DNS name without a trailing dot", name)
+	}
+	if err := dnsname.ValidHostname(name); err != nil {
+		return fmt.Errorf("invalid SNI name %q: %w", name, err)
+	}
+	return nil
+}
+
+// CheckVirtualHost reports whether name is acceptable as the host of a
+// WebServerConfig key other than the node's own name, such as one given to
+// "tailscale serve --virtual-host": a lowercase DNS name without a
+// trailing dot or port.
+func CheckVirtualHost(name string) error {
+	if name == "" || strings.HasSuffix(name, ".") || strings.ToLower(name) != name {
+		return fmt.Errorf("invalid host name %q: must be a lowercase DNS name without a trailing dot", name)
+	}
+	if err := dnsname.ValidHostname(name); err != nil {
+		return fmt.Errorf("invalid host name %q: %w", name, err)
+	}
+	return nil
+}
+
+// BackendForSNI returns the IP:port to forward a TLS-terminated connection
+// for the SNI name to, per TCPForward, TerminateTLS and SNIRoutes. It
+// reports false if there's no backend for the name.
+func (v TCPPortHandlerView) BackendForSNI(name string) (backend string, ok bool) {
+	if backend, ok := v.SNIRoutes().GetOk(name); ok {
+		return backend, true
+	}
+	if v.TCPForward() != "" && (v.SNIRoutes().Len() == 0 || name == v.TerminateTLS()) {
+		return v.TCPForward(), true
+	}
+	return "", false
+}
+
+// AllowsMethod reports whether the handler accepts requests with the given
+// HTTP method, per its AllowMethods.
+func (v HTTPHandlerView) AllowsMethod(method string) bool {
+	methods := v.AllowMethods()
+	return methods.Len() == 0 || views.SliceContains(methods, method)
+}
+
+// AllowsSource reports whether the handler accepts requests from a client
+// with the given address, per its AllowCIDRs.
+func (v HTTPHandlerView) AllowsSource(ip netip.Addr) bool {
+	cidrs := v.AllowCIDRs()
+	if cidrs.Len() == 0 {
+		return true
+	}
+	ip = ip.Unmap()
+	for _, p := range cidrs.All() {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // WebHandlerExists reports whether if the ServeConfig Web handler exists for
 // the given host:port and mount point.
 func (sc *ServeConfig) WebHandlerExists(hp HostPort, mount string) bool {
@@ -187,12 +854,12 @@ func (sc *ServeConfig) GetTCPPortHandler(port uint16) *TCPPortHandler {
 }
 
 // HasPathHandler reports whether if ServeConfig has at least
-// one path handler, including foreground configs.
+// one path (or archive) handler, including foreground configs.
 func (sc *ServeConfig) HasPathHandler() bool {
 	if sc.Web != nil {
 		for _, webServerConfig := range sc.Web {
 			for _, httpHandler := range webServerConfig.Handlers {
-				if httpHandler.Path != "" {
+				if httpHandler.Path != "" || httpHandler.Archive != "" {
 					return true
 				}
 			}
@@ -585,7 +1252,8 @@ func (v ServeConfigView) RangeOverTCPs(f func(port uint16, _ TCPPortHandlerView)
 	})
 }
 
-// RangeOverWebs ranges over both background and foreground Webs.
+// RangeOverWebs ranges over the background and foreground Webs, and those
+// of the Services.
 // If the returned bool from the given f is false, then this function stops
 // iterating immediately and does not check other foreground configs.
 func (v ServeConfigView) RangeOverWebs(f func(_ HostPort, conf WebServerConfigView) bool) {
@@ -604,6 +1272,16 @@ func (v ServeConfigView) RangeOverWebs(f func(_ HostPort, conf WebServerConfigVi
 		})
 		return parentCont
 	})
+	v.Services().Range(func(_ string, v ServiceConfigView) (cont bool) {
+		if !parentCont {
+			return false
+		}
+		v.Web().Range(func(k HostPort, v WebServerConfigView) (cont bool) {
+			parentCont = f(k, v)
+			return parentCont
+		})
+		return parentCont
+	})
 }
 
 // FindTCP returns the first TCP that matches with the given port. It
@@ -620,9 +1298,20 @@ func (v ServeConfigView) FindTCP(port uint16) (res TCPPortHandlerView, ok bool)
 	return v.TCP().GetOk(port)
 }
 
+// FindServiceTCP returns the TCP handler for port of the service named
+// name (such as "svc:web"), if any.
+func (v ServeConfigView) FindServiceTCP(name string, port uint16) (res TCPPortHandlerView, ok bool) {
+	svc, ok := v.Services().GetOk(name)
+	if !ok {
+		return res, false
+	}
+	return svc.TCP().GetOk(port)
+}
+
 // FindWeb returns the first Web that matches with the given HostPort. It
-// prefers a foreground match first followed by a background search if none
-// existed.
+// prefers a foreground match first followed by a background search, and
+// then a search of the Services, which are served under their own names,
+// if none existed.
 func (v ServeConfigView) FindWeb(hp HostPort) (res WebServerConfigView, ok bool) {
 	v.Foreground().Range(func(_ string, v ServeConfigView) (cont bool) {
 		res, ok = v.Web().GetOk(hp)
@@ -631,7 +1320,14 @@ func (v ServeConfigView) FindWeb(hp HostPort) (res WebServerConfigView, ok bool)
 	if ok {
 		return res, ok
 	}
-	return v.Web().GetOk(hp)
+	if res, ok = v.Web().GetOk(hp); ok {
+		return res, ok
+	}
+	v.Services().Range(func(_ string, v ServiceConfigView) (cont bool) {
+		res, ok = v.Web().GetOk(hp)
+		return !ok
+	})
+	return res, ok
 }
 
 // HasAllowFunnel returns whether this config has at least one AllowFunnel
@@ -662,3 +1358,450 @@ func (v ServeConfigView) HasFunnelForTarget(target HostPort) bool {
 	})
 	return exists
 }
+
+// CheckValid reports whether sc is well-formed: that its ports, host:port
+// keys, mount points and handler targets are valid and that each handler
+// sets exactly one kind of target. The returned error names the offending
+// field.
+//
+// It's meant for hand-written configs, such as those given to
+// "tailscale serve set-raw"; configs built with the ServeConfig setters
+// are always valid.
+func (sc *ServeConfig) CheckValid() error {
+	if sc == nil {
+		return nil
+	}
+	if err := checkServeHandlers("", sc.TCP, sc.Web); err != nil {
+		return err
+	}
+	if _, err := ParseDrain(sc.Drain); err != nil {
+		return fmt.Errorf("Drain: %w", err)
+	}
+	if sc.MaintenancePage != "" {
+		if !sc.MaintenanceMode {
+			return errors.New("MaintenancePage: only valid with MaintenanceMode")
+		}
+		if !filepath.IsAbs(sc.MaintenancePage) {
+			return fmt.Errorf("MaintenancePage: %q is not an absolute path", sc.MaintenancePage)
+		}
+	}
+	for _, hp := range slices.Sorted(maps.Keys(sc.AllowFunnel)) {
+		if _, err := checkHostPort(hp); err != nil {
+			return fmt.Errorf("AllowFunnel[%q]: %w", hp, err)
+		}
+		if !sc.AllowFunnel[hp] || sc.Web[hp] == nil {
+			continue
+		}
+		// A writable WebDAV share on a Funnel port would let anyone on the
+		// internet change the served files.
+		for _, mount := range slices.Sorted(maps.Keys(sc.Web[hp].Handlers)) {
+			if h := sc.Web[hp].Handlers[mount]; h.WebDAV && !h.WebDAVReadOnly {
+				return fmt.Errorf("Web[%q].Handlers[%q].WebDAV: must be WebDAVReadOnly with AllowFunnel", hp, mount)
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(sc.Services)) {
+		svc := sc.Services[name]
+		field := fmt.Sprintf("Services[%q]", name)
+		if svc == nil {
+			return fmt.Errorf("%s: null service", field)
+		}
+		if err := checkServeHandlers(field+".", svc.TCP, svc.Web); err != nil {
+			return err
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(sc.Foreground)) {
+		if err := sc.Foreground[id].CheckValid(); err != nil {
+			return fmt.Errorf("Foreground[%q].%w", id, err)
+		}
+	}
+	return nil
+}
+
+// checkServeHandlers checks the TCP and Web handlers of a ServeConfig or
+// ServiceConfig. Field names in errors are prefixed with prefix.
+func checkServeHandlers(prefix string, tcp map[uint16]*TCPPortHandler, web map[HostPort]*WebServerConfig) error {
+	for _, port := range slices.Sorted(maps.Keys(tcp)) {
+		h := tcp[port]
+		field := fmt.Sprintf("%sTCP[%d]", prefix, port)
+		if port == 0 {
+			return fmt.Errorf("%s: invalid port 0", field)
+		}
+		if h == nil {
+			return fmt.Errorf("%s: null handler", field)
+		}
+		if n := countTrue(h.HTTPS, h.HTTP, h.TCPForward != ""); n != 1 {
+			return fmt.Errorf("%s: exactly one of HTTPS, HTTP or TCPForward must be set", field)
+		}
+		if h.TCPForward != "" {
+			if err := checkForwardAddr(h.TCPForward); err != nil {
+				return fmt.Errorf("%s.TCPForward: %w", field, err)
+			}
+		}
+		if h.TerminateTLS != "" && h.TCPForward == "" {
+			return fmt.Errorf("%s.TerminateTLS: only valid with TCPForward", field)
+		}
+		if h.TLSMinVersion != "" {
+			if !h.HTTPS && h.TerminateTLS == "" {
+				return fmt.Errorf("%s.TLSMinVersion: only valid with HTTPS or TerminateTLS", field)
+			}
+			if _, err := ParseTLSVersion(h.TLSMinVersion); err != nil {
+				return fmt.Errorf("%s.TLSMinVersion: %w", field, err)
+			}
+		}
+		if h.MaxConns < 0 {
+			return fmt.Errorf("%s.MaxConns: must be positive, not %d", field, h.MaxConns)
+		}
+		if h.MaxConns > 0 && h.TCPForward == "" {
+			return fmt.Errorf("%s.MaxConns: only valid with TCPForward", field)
+		}
+		if h.Backlog < 0 || h.Backlog > MaxBacklog {
+			return fmt.Errorf("%s.Backlog: %d is not between 0 and %d", field, h.Backlog, MaxBacklog)
+		}
+		if h.Backlog > 0 && h.TCPForward == "" {
+			return fmt.Errorf("%s.Backlog: only valid with TCPForward", field)
+		}
+		if len(h.SNIRoutes) > 0 && h.TerminateTLS == "" {
+			return fmt.Errorf("%s.SNIRoutes: only valid with TerminateTLS", field)
+		}
+		for _, name := range slices.Sorted(maps.Keys(h.SNIRoutes)) {
+			rfield := fmt.Sprintf("%s.SNIRoutes[%q]", field, name)
+			if err := CheckSNIName(name); err != nil {
+				return fmt.Errorf("%s: %w", rfield, err)
+			}
+			if name == h.TerminateTLS {
+				return fmt.Errorf("%s: conflicts with TerminateTLS, which is routed to TCPForward", rfield)
+			}
+			if err := checkForwardAddr(h.SNIRoutes[name]); err != nil {
+				return fmt.Errorf("%s: %w", rfield, err)
+			}
+		}
+	}
+	for _, hp := range slices.Sorted(maps.Keys(web)) {
+		field := fmt.Sprintf("%sWeb[%q]", prefix, hp)
+		port, err := checkHostPort(hp)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		if th := tcp[port]; th == nil || !(th.HTTP || th.HTTPS) {
+			return fmt.Errorf("%s: %sTCP[%d] must exist and have HTTP or HTTPS set", field, prefix, port)
+		}
+		conf := web[hp]
+		if conf == nil {
+			return fmt.Errorf("%s: null web server config", field)
+		}
+		for _, mount := range slices.Sorted(maps.Keys(conf.Handlers)) {
+			hfield := fmt.Sprintf("%s.Handlers[%q]", field, mount)
+			if err := checkHTTPHandler(hfield, mount, conf.Handlers[mount]); err != nil {
+				return err
+			}
+			if conf.Handlers[mount].RedirectToHTTPS && tcp[port].HTTPS {
+				return fmt.Errorf("%s.RedirectToHTTPS: only valid on HTTP ports", hfield)
+			}
+		}
+	}
+	return nil
+}
+
+// checkHTTPHandler checks h, mounted at mount. Errors are reported
+// against field.
+func checkHTTPHandler(field, mount string, h *HTTPHandler) error {
+	if err := checkMountPoint(mount); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	if h == nil {
+		return fmt.Errorf("%s: null handler", field)
+	}
+	if n := countTrue(h.Path != "", h.Proxy != "", h.Text != "", h.Archive != "", h.AggregateBackends, h.RedirectToHTTPS); n != 1 {
+		return fmt.Errorf("%s: exactly one of Path, Proxy, Text, Archive, AggregateBackends or RedirectToHTTPS must be set", field)
+	}
+	if h.Path != "" && !filepath.IsAbs(h.Path) {
+		return fmt.Errorf("%s.Path: %q is not an absolute path", field, h.Path)
+	}
+	if h.Archive != "" {
+		if !filepath.IsAbs(h.Archive) {
+			return fmt.Errorf("%s.Archive: %q is not an absolute path", field, h.Archive)
+		}
+		if ArchiveFormat(h.Archive) == "" {
+			return fmt.Errorf("%s.Archive: %q is not a .zip or .tar file", field, h.Archive)
+		}
+	}
+	if h.Proxy != "" {
+		if err := checkProxyTarget(h.Proxy); err != nil {
+			return fmt.Errorf("%s.Proxy: invalid target %q: %w", field, h.Proxy, err)
+		}
+	}
+	if h.NoHTTP2 && h.Proxy == "" {
+		return fmt.Errorf("%s.NoHTTP2: only valid with Proxy", field)
+	}
+	if h.ProxyHost != "" {
+		if h.Proxy == "" {
+			return fmt.Errorf("%s.ProxyHost: only valid with Proxy", field)
+		}
+		if err := CheckProxyHost(h.ProxyHost); err != nil {
+			return fmt.Errorf("%s.ProxyHost: %w", field, err)
+		}
+	}
+	if h.BackendKeepalive != "" {
+		if h.Proxy == "" {
+			return fmt.Errorf("%s.BackendKeepalive: only valid with Proxy", field)
+		}
+		if _, err := ParseBackendKeepalive(h.BackendKeepalive); err != nil {
+			return fmt.Errorf("%s.BackendKeepalive: %w", field, err)
+		}
+	}
+	if h.ConnectTimeout != "" {
+		if h.Proxy == "" {
+			return fmt.Errorf("%s.ConnectTimeout: only valid with Proxy", field)
+		}
+		if _, err := ParseProxyTimeout(h.ConnectTimeout); err != nil {
+			return fmt.Errorf("%s.ConnectTimeout: %w", field, err)
+		}
+	}
+	if h.ResponseHeaderTimeout != "" {
+		if h.Proxy == "" {
+			return fmt.Errorf("%s.ResponseHeaderTimeout: only valid with Proxy", field)
+		}
+		if _, err := ParseProxyTimeout(h.ResponseHeaderTimeout); err != nil {
+			return fmt.Errorf("%s.ResponseHeaderTimeout: %w", field, err)
+		}
+	}
+	if h.RequestIDHeader != "" {
+		if h.Proxy == "" {
+			return fmt.Errorf("%s.RequestIDHeader: only valid with Proxy", field)
+		}
+		if err := CheckRequestIDHeader(h.RequestIDHeader); err != nil {
+			return fmt.Errorf("%s.RequestIDHeader: %w", field, err)
+		}
+	}
+	if h.Canary != "" {
+		if h.Proxy == "" {
+			return fmt.Errorf("%s.Canary: only valid with Proxy", field)
+		}
+		if err := checkProxyTarget(h.Canary); err != nil {
+			return fmt.Errorf("%s.Canary: invalid target %q: %w", field, h.Canary, err)
+		}
+	}
+	if h.CanaryPercent != 0 && h.Canary == "" {
+		return fmt.Errorf("%s.CanaryPercent: only valid with Canary", field)
+	}
+	if h.CanaryPercent < 0 || h.CanaryPercent > 100 {
+		return fmt.Errorf("%s.CanaryPercent: %d is not between 0 and 100", field, h.CanaryPercent)
+	}
+	if h.GRPCWeb {
+		if h.Proxy == "" {
+			return fmt.Errorf("%s.GRPCWeb: only valid with Proxy", field)
+		}
+		if h.NoHTTP2 {
+			return fmt.Errorf("%s.GRPCWeb: can't be combined with NoHTTP2; gRPC requires HTTP/2", field)
+		}
+	}
+	for _, m := range h.AllowMethods {
+		if !slices.Contains(httpMethods, m) {
+			return fmt.Errorf("%s.AllowMethods: unknown HTTP method %q", field, m)
+		}
+	}
+	if h.CacheControl != "" {
+		if h.Path == "" && h.Archive == "" {
+			return fmt.Errorf("%s.CacheControl: only valid with Path or Archive", field)
+		}
+		if err := CheckCacheControl(h.CacheControl); err != nil {
+			return fmt.Errorf("%s.CacheControl: %w", field, err)
+		}
+	}
+	if h.ContentType != "" {
+		if h.Path == "" {
+			return fmt.Errorf("%s.ContentType: only valid with Path", field)
+		}
+		if _, _, err := mime.ParseMediaType(h.ContentType); err != nil {
+			return fmt.Errorf("%s.ContentType: invalid media type %q: %w", field, h.ContentType, err)
+		}
+	}
+	if h.SPAFallback && h.Path == "" {
+		return fmt.Errorf("%s.SPAFallback: only valid with Path", field)
+	}
+	if len(h.OverlayPaths) > 0 && h.Path == "" {
+		return fmt.Errorf("%s.OverlayPaths: only valid with Path", field)
+	}
+	for _, p := range h.OverlayPaths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("%s.OverlayPaths: %q is not an absolute path", field, p)
+		}
+	}
+	if h.WebDAV {
+		switch {
+		case h.Path == "":
+			return fmt.Errorf("%s.WebDAV: only valid with Path", field)
+		case h.ContentType != "":
+			return fmt.Errorf("%s.WebDAV: can't be used with ContentType", field)
+		case h.SPAFallback:
+			return fmt.Errorf("%s.WebDAV: can't be used with SPAFallback", field)
+		case len(h.OverlayPaths) > 0:
+			return fmt.Errorf("%s.WebDAV: can't be used with OverlayPaths", field)
+		}
+	}
+	if h.WebDAVReadOnly && !h.WebDAV {
+		return fmt.Errorf("%s.WebDAVReadOnly: only valid with WebDAV", field)
+	}
+	if h.ServeDotfiles {
+		switch {
+		case h.Path == "":
+			return fmt.Errorf("%s.ServeDotfiles: only valid with Path", field)
+		case h.WebDAV:
+			return fmt.Errorf("%s.ServeDotfiles: can't be used with WebDAV", field)
+		}
+	}
+	if h.Compress && h.Path == "" && h.Archive == "" && h.Proxy == "" {
+		return fmt.Errorf("%s.Compress: only valid with Path, Archive or Proxy", field)
+	}
+	for _, p := range h.AllowCIDRs {
+		if !p.IsValid() || p != p.Masked() {
+			return fmt.Errorf("%s.AllowCIDRs: invalid prefix %v", field, p)
+		}
+	}
+	var basicAuthUsers map[string]bool
+	for _, e := range h.BasicAuth {
+		if err := CheckBasicAuthEntry(e); err != nil {
+			return fmt.Errorf("%s.BasicAuth: %w", field, err)
+		}
+		user, _, _ := strings.Cut(e, ":")
+		if basicAuthUsers[user] {
+			return fmt.Errorf("%s.BasicAuth: duplicate user %q", field, user)
+		}
+		mak.Set(&basicAuthUsers, user, true)
+	}
+	if err := CheckLogLevel(h.LogLevel); err != nil {
+		return fmt.Errorf("%s.LogLevel: %w", field, err)
+	}
+	if h.RequireTag != "" {
+		if err := tailcfg.CheckTag(h.RequireTag); err != nil {
+			return fmt.Errorf("%s.RequireTag: invalid tag %q: %w", field, h.RequireTag, err)
+		}
+	}
+	return nil
+}
+
+// checkForwardAddr checks that addr is a host:port with a valid, non-zero
+// port, as used by TCPPortHandler.TCPForward.
+func checkForwardAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		err = checkPort(port)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	return nil
+}
+
+// checkHostPort checks that hp is a non-empty host and a valid, non-zero
+// port, and returns the port.
+func checkHostPort(hp HostPort) (uint16, error) {
+	host, port, err := net.SplitHostPort(string(hp))
+	if err != nil {
+		return 0, err
+	}
+	if host == "" {
+		return 0, errors.New("missing host")
+	}
+	if err := checkPort(port); err != nil {
+		return 0, err
+	}
+	return hp.Port()
+}
+
+// checkMountPoint checks that mount is a clean absolute URL path, or the
+// wildcard mount point.
+func checkMountPoint(mount string) error {
+	if mount == WildcardMountPoint {
+		return nil
+	}
+	if !strings.HasPrefix(mount, "/") {
+		return fmt.Errorf("mount point %q must start with /", mount)
+	}
+	if strings.Contains(mount, "*") {
+		return fmt.Errorf("invalid mount point %q; wildcards are only supported as %q", mount, WildcardMountPoint)
+	}
+	if c := path.Clean(mount); c != mount && c+"/" != mount {
+		return fmt.Errorf("mount point %q is not a clean path (want %q)", mount, c)
+	}
+	return nil
+}
+
+// NamedPipePrefix is the prefix of the local Windows named pipe paths that
+// HTTPHandler.Proxy may be set to, as in `\\.\pipe\name`.
+const NamedPipePrefix = `\\.\pipe\`
+
+// maxPipePathLen is the maximum length of a Windows named pipe path.
+const maxPipePathLen = 256
+
+// IsNamedPipeProxy reports whether the HTTPHandler.Proxy value target is a
+// local Windows named pipe path rather than a TCP target.
+func IsNamedPipeProxy(target string) bool {
+	return len(target) >= len(NamedPipePrefix) && strings.EqualFold(target[:len(NamedPipePrefix)], NamedPipePrefix)
+}
+
+// CheckPipeName reports an error if name isn't a valid name for a local
+// Windows named pipe, the part of its path after NamedPipePrefix.
+func CheckPipeName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("empty pipe name")
+	case strings.Contains(name, `\`):
+		return fmt.Errorf("pipe name %q must not contain a backslash", name)
+	case len(NamedPipePrefix)+len(name) > maxPipePathLen:
+		return fmt.Errorf("pipe name %q is too long; pipe paths are limited to %d characters", name, maxPipePathLen)
+	}
+	return nil
+}
+
+// checkProxyTarget checks that target is in one of the forms accepted for
+// HTTPHandler.Proxy: a port number, a host:port, an http, https or
+// https+insecure URL or, on Windows, a named pipe path.
+func checkProxyTarget(target string) error {
+	if IsNamedPipeProxy(target) {
+		if runtime.GOOS != "windows" {
+			return errors.New("named pipes are only supported on Windows")
+		}
+		return CheckPipeName(target[len(NamedPipePrefix):])
+	}
+	if _, err := strconv.ParseUint(target, 10, 16); err == nil {
+		return checkPort(target)
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "https+insecure":
+	default:
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	if p := u.Port(); p != "" {
+		return checkPort(p)
+	}
+	return nil
+}
+
+// checkPort checks that s is a valid, non-zero port number.
+func checkPort(s string) error {
+	if p, err := strconv.ParseUint(s, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid port %q", s)
+	}
+	return nil
+}
+
+func countTrue(bs ...bool) (n int) {
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
@@ -3,7 +3,15 @@
 package ipn
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -67,6 +75,18 @@ func TestHasPathHandler(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "with-bg-archive-handler",
+			cfg: ServeConfig{
+				TCP: map[uint16]*TCPPortHandler{80: {HTTP: true}},
+				Web: map[HostPort]*WebServerConfig{
+					"foo.test.ts.net:80": {Handlers: map[string]*HTTPHandler{
+						"/": {Archive: "/srv/site.zip"},
+					}},
+				},
+			},
+			want: true,
+		},
 		{
 			name: "with-fg-path-handler",
 			cfg: ServeConfig{
@@ -127,6 +147,71 @@ func TestHasPathHandler(t *testing.T) {
 	}
 }
 
+func TestServeConfigServices(t *testing.T) {
+	sc := (&ServeConfig{
+		TCP: map[uint16]*TCPPortHandler{443: {HTTPS: true}},
+		Web: map[HostPort]*WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3000"},
+			}},
+		},
+		Services: map[string]*ServiceConfig{
+			"svc:web": {
+				TCP: map[uint16]*TCPPortHandler{
+					443:  {HTTPS: true},
+					5432: {TCPForward: "localhost:5432"},
+				},
+				Web: map[HostPort]*WebServerConfig{
+					"web.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+						"/": {Proxy: "http://127.0.0.1:8080"},
+					}},
+				},
+			},
+		},
+	}).View()
+
+	for _, tt := range []struct {
+		hp        HostPort
+		wantProxy string
+	}{
+		{"foo.test.ts.net:443", "http://127.0.0.1:3000"},
+		{"web.test.ts.net:443", "http://127.0.0.1:8080"},
+		{"web.test.ts.net:80", ""},
+		{"other.test.ts.net:443", ""},
+	} {
+		web, ok := sc.FindWeb(tt.hp)
+		if ok != (tt.wantProxy != "") {
+			t.Errorf("FindWeb(%q) ok = %v, want %v", tt.hp, ok, !ok)
+			continue
+		}
+		if ok {
+			if got := web.Handlers().Get("/").Proxy(); got != tt.wantProxy {
+				t.Errorf("FindWeb(%q) proxy = %q, want %q", tt.hp, got, tt.wantProxy)
+			}
+		}
+	}
+
+	if tcph, ok := sc.FindServiceTCP("svc:web", 5432); !ok || tcph.TCPForward() != "localhost:5432" {
+		t.Errorf("FindServiceTCP(svc:web, 5432) = %v, %v; want localhost:5432 forwarder", tcph.TCPForward(), ok)
+	}
+	if _, ok := sc.FindServiceTCP("svc:web", 22); ok {
+		t.Errorf("FindServiceTCP(svc:web, 22) found a handler")
+	}
+	if _, ok := sc.FindServiceTCP("svc:db", 5432); ok {
+		t.Errorf("FindServiceTCP(svc:db, 5432) found a handler")
+	}
+
+	var hps []HostPort
+	sc.RangeOverWebs(func(hp HostPort, _ WebServerConfigView) bool {
+		hps = append(hps, hp)
+		return true
+	})
+	slices.Sort(hps)
+	if want := []HostPort{"foo.test.ts.net:443", "web.test.ts.net:443"}; !slices.Equal(hps, want) {
+		t.Errorf("RangeOverWebs visited %q, want %q", hps, want)
+	}
+}
+
 func TestExpandProxyTargetDev(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -182,3 +267,739 @@ func TestExpandProxyTargetDev(t *testing.T) {
 		})
 	}
 }
+
+func TestServeConfigHash(t *testing.T) {
+	sc := &ServeConfig{
+		TCP: map[uint16]*TCPPortHandler{443: {HTTPS: true}},
+		Web: map[HostPort]*WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3000"},
+			}},
+		},
+	}
+	h1 := sc.Hash()
+	if len(h1) != 64 {
+		t.Fatalf("Hash = %q; want 64 hex chars", h1)
+	}
+
+	// A clone, or a change to a non-serialized field, is a no-op.
+	sc2 := sc.Clone()
+	sc2.ETag = "something"
+	if h2 := sc2.Hash(); h2 != h1 {
+		t.Errorf("hash changed on no-op: %q -> %q", h1, h2)
+	}
+
+	// A real change must change the hash.
+	sc2.SetWebHandler(&HTTPHandler{Proxy: "http://127.0.0.1:3001"}, "foo.test.ts.net", 443, "/api", true)
+	if h2 := sc2.Hash(); h2 == h1 {
+		t.Errorf("hash unchanged after adding a handler: %q", h2)
+	}
+
+	var nilSC *ServeConfig
+	if nilSC.Hash() == new(ServeConfig).Hash() {
+		t.Errorf("nil and empty configs hash the same")
+	}
+}
+
+func TestParseHTTPMethods(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "GET", want: []string{"GET"}},
+		{in: "GET,HEAD", want: []string{"GET", "HEAD"}},
+		{in: "get, head ,Options", want: []string{"GET", "HEAD", "OPTIONS"}},
+		{in: "GET,HEAD,GET", want: []string{"GET", "HEAD"}},
+		{in: "", wantErr: true},
+		{in: "GET,", wantErr: true},
+		{in: "GET,,HEAD", wantErr: true},
+		{in: "FETCH", wantErr: true},
+		{in: "GET HEAD", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseHTTPMethods(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseHTTPMethods(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseHTTPMethods(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPHandlerAllowMethods(t *testing.T) {
+	// By default, all methods are allowed.
+	def := (&HTTPHandler{Path: "/srv"}).View()
+	for _, m := range httpMethods {
+		if !def.AllowsMethod(m) {
+			t.Errorf("default handler does not allow %s", m)
+		}
+	}
+
+	h := &HTTPHandler{Path: "/srv", AllowMethods: []string{"GET", "HEAD"}}
+	for m, want := range map[string]bool{"GET": true, "HEAD": true, "POST": false, "DELETE": false} {
+		if got := h.View().AllowsMethod(m); got != want {
+			t.Errorf("AllowsMethod(%q) = %v; want %v", m, got, want)
+		}
+	}
+
+	// The allowed methods survive a JSON round trip and cloning, and the
+	// clone doesn't alias the original.
+	sc := &ServeConfig{Web: map[HostPort]*WebServerConfig{
+		"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{"/": h}},
+	}}
+	j, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ServeConfig
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, sc) {
+		t.Errorf("JSON round trip = %+v; want %+v", got, sc)
+	}
+	c := sc.Clone()
+	if !reflect.DeepEqual(c, sc) {
+		t.Errorf("Clone = %+v; want %+v", c, sc)
+	}
+	c.Web["foo.test.ts.net:443"].Handlers["/"].AllowMethods[0] = "POST"
+	if h.AllowMethods[0] != "GET" {
+		t.Errorf("Clone aliases AllowMethods of the original")
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "100.64.0.0/10", want: "100.64.0.0/10"},
+		{in: "192.168.10.7/24", want: "192.168.10.0/24"},
+		{in: "fd7a:115c:a1e0::/48", want: "fd7a:115c:a1e0::/48"},
+		{in: "10.0.0.1/32", want: "10.0.0.1/32"},
+		{in: "10.0.0.1", wantErr: true},
+		{in: "10.0.0.0/33", wantErr: true},
+		{in: "office", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCIDR(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCIDR(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ParseCIDR(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPHandlerAllowCIDRs(t *testing.T) {
+	if !(&HTTPHandler{Path: "/srv"}).View().AllowsSource(netip.MustParseAddr("1.2.3.4")) {
+		t.Error("default handler doesn't allow all sources")
+	}
+
+	h := &HTTPHandler{Path: "/srv", AllowCIDRs: []netip.Prefix{
+		netip.MustParsePrefix("192.168.10.0/24"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+	}}
+	for ip, want := range map[string]bool{
+		"192.168.10.20":        true,
+		"::ffff:192.168.10.20": true,
+		"192.168.11.20":        false,
+		"fd7a:115c:a1e0::1":    true,
+		"fd7a:115c:a1e1::1":    false,
+		"100.101.102.103":      false,
+	} {
+		if got := h.View().AllowsSource(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("AllowsSource(%s) = %v; want %v", ip, got, want)
+		}
+	}
+
+	// The prefixes survive a JSON round trip and cloning.
+	sc := &ServeConfig{Web: map[HostPort]*WebServerConfig{
+		"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{"/": h}},
+	}}
+	j, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"AllowCIDRs":["192.168.10.0/24","fd7a:115c:a1e0::/48"]`) {
+		t.Errorf("JSON = %s; want AllowCIDRs as strings", j)
+	}
+	var got ServeConfig
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, sc) {
+		t.Errorf("JSON round trip = %+v; want %+v", got, sc)
+	}
+	c := sc.Clone()
+	c.Web["foo.test.ts.net:443"].Handlers["/"].AllowCIDRs[0] = netip.MustParsePrefix("0.0.0.0/0")
+	if h.AllowCIDRs[0].Bits() != 24 {
+		t.Errorf("Clone aliases AllowCIDRs of the original")
+	}
+}
+
+func TestCheckCacheControl(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{in: "max-age=3600"},
+		{in: "no-store"},
+		{in: "public, max-age=3600, immutable"},
+		{in: "public,max-age=0"},
+		{in: `private="Set-Cookie"`},
+		{in: "", wantErr: true},
+		{in: "max-age=3600\r\nX-Evil: 1", wantErr: true},
+		{in: "max-age=3600\nX-Evil: 1", wantErr: true},
+		{in: "max-age=3600\x00", wantErr: true},
+		{in: "max-age=\u00e9", wantErr: true},
+		{in: "max-age=", wantErr: true},
+		{in: "max age=3600", wantErr: true},
+		{in: "public,,max-age=3600", wantErr: true},
+		{in: "public,", wantErr: true},
+		{in: `private="unterminated`, wantErr: true},
+		{in: "max-age=36;00", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := CheckCacheControl(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckCacheControl(%q) = %v; wantErr %v", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckRequestIDHeader(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{in: "X-Request-Id"},
+		{in: "x-correlation-id"},
+		{in: "Traceparent"},
+		{in: "", wantErr: true},
+		{in: "X Request Id", wantErr: true},
+		{in: "X-Request-Id\r\nX-Evil: 1", wantErr: true},
+		{in: "X-Request-Id:", wantErr: true},
+		{in: "host", wantErr: true},
+		{in: "Content-Length", wantErr: true},
+		{in: "Transfer-Encoding", wantErr: true},
+		{in: "X-Forwarded-For", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := CheckRequestIDHeader(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckRequestIDHeader(%q) = %v; wantErr %v", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckLogLevel(t *testing.T) {
+	for _, s := range []string{"", LogLevelError, LogLevelInfo, LogLevelDebug} {
+		if err := CheckLogLevel(s); err != nil {
+			t.Errorf("CheckLogLevel(%q) = %v; want nil", s, err)
+		}
+	}
+	for _, s := range []string{"DEBUG", "warn", "trace", " info"} {
+		if err := CheckLogLevel(s); err == nil {
+			t.Errorf("CheckLogLevel(%q) = nil; want error", s)
+		}
+	}
+
+	// The level survives a JSON round trip.
+	sc := &ServeConfig{Web: map[HostPort]*WebServerConfig{
+		"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+			"/api/": {Proxy: "http://127.0.0.1:8080", LogLevel: LogLevelDebug},
+		}},
+	}}
+	j, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"LogLevel":"debug"`) {
+		t.Errorf("JSON = %s; want it to contain the log level", j)
+	}
+	var got ServeConfig
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, sc) {
+		t.Errorf("JSON round trip = %+v; want %+v", got, sc)
+	}
+}
+
+// testBcryptHash is a bcrypt hash of "hunter2".
+const testBcryptHash = "$2a$04$fYZIPvWXt8M8FKpwgmhDpusdKqzfQiK2smRl9SmaFdDcAO/JlXhV6"
+
+func TestCheckBasicAuthEntry(t *testing.T) {
+	for _, s := range []string{
+		"alice:" + testBcryptHash,
+		"bob:$2y$10$" + strings.Repeat("a", 53), // as written by htpasswd -B
+	} {
+		if err := CheckBasicAuthEntry(s); err != nil {
+			t.Errorf("CheckBasicAuthEntry(%q) = %v; want nil", s, err)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"alice",
+		"alice:hunter2",
+		":" + testBcryptHash,
+		"alice:{SHA}" + strings.Repeat("a", 28),
+		"alice:$apr1$abcdefgh$" + strings.Repeat("a", 22),
+		"alice:$2a$04$short",
+		"alice:$2a$99$" + strings.Repeat("a", 53),
+	} {
+		if err := CheckBasicAuthEntry(s); err == nil {
+			t.Errorf("CheckBasicAuthEntry(%q) = nil; want error", s)
+		}
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{in: "1.2", want: tls.VersionTLS12},
+		{in: "1.3", want: tls.VersionTLS13},
+		{in: "", wantErr: true},
+		{in: "1.0", wantErr: true},
+		{in: "1.1", wantErr: true},
+		{in: "1.4", wantErr: true},
+		{in: "TLS1.3", wantErr: true},
+		{in: " 1.3", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTLSVersion(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTLSVersion(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTLSVersion(%q) = %#x; want %#x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTCPPortHandlerTLSMinVersion(t *testing.T) {
+	// The setting survives a JSON round trip and cloning.
+	sc := &ServeConfig{TCP: map[uint16]*TCPPortHandler{
+		443:  {HTTPS: true, TLSMinVersion: "1.3"},
+		8443: {TCPForward: "127.0.0.1:80", TerminateTLS: "foo.test.ts.net", TLSMinVersion: "1.2"},
+	}}
+	j, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ServeConfig
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, sc) {
+		t.Errorf("JSON round trip = %+v; want %+v", got, sc)
+	}
+	if c := sc.Clone(); !reflect.DeepEqual(c, sc) {
+		t.Errorf("Clone = %+v; want %+v", c, sc)
+	}
+
+	for port, want := range map[uint16]uint16{443: tls.VersionTLS13, 8443: tls.VersionTLS12} {
+		if got := sc.View().TCP().Get(port).MinTLSVersion(); got != want {
+			t.Errorf("TCP[%d].MinTLSVersion() = %#x; want %#x", port, got, want)
+		}
+	}
+	if got := (&TCPPortHandler{HTTPS: true}).View().MinTLSVersion(); got != 0 {
+		t.Errorf("unset MinTLSVersion() = %#x; want 0", got)
+	}
+}
+
+func TestCheckProxyHost(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{in: "backend.internal"},
+		{in: "backend"},
+		{in: "backend.internal:8080"},
+		{in: "10.0.0.1"},
+		{in: "10.0.0.1:80"},
+		{in: "[::1]"},
+		{in: "[::1]:8080"},
+		{in: "", wantErr: true},
+		{in: "::1", wantErr: true},
+		{in: "[10.0.0.1]", wantErr: true},
+		{in: "[backend]", wantErr: true},
+		{in: "backend.internal:0", wantErr: true},
+		{in: "backend.internal:http", wantErr: true},
+		{in: "backend/internal", wantErr: true},
+		{in: "back end", wantErr: true},
+		{in: "backend\r\nX-Evil: 1", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := CheckProxyHost(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckProxyHost(%q) = %v; wantErr %v", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseSNIRoute(t *testing.T) {
+	tests := []struct {
+		in          string
+		wantName    string
+		wantBackend string
+		wantErr     bool
+	}{
+		{in: "svc.example.ts.net=127.0.0.1:8080", wantName: "svc.example.ts.net", wantBackend: "127.0.0.1:8080"},
+		{in: "SVC.example.ts.net=localhost:8080", wantName: "svc.example.ts.net", wantBackend: "localhost:8080"},
+		{in: "svc=[::1]:8080", wantName: "svc", wantBackend: "[::1]:8080"},
+		{in: "svc.example.ts.net", wantErr: true},
+		{in: "=127.0.0.1:8080", wantErr: true},
+		{in: "svc.example.ts.net.=127.0.0.1:8080", wantErr: true},
+		{in: "svc_1.example.ts.net=127.0.0.1:8080", wantErr: true},
+		{in: "svc.example.ts.net=127.0.0.1", wantErr: true},
+		{in: "svc.example.ts.net=127.0.0.1:0", wantErr: true},
+		{in: "svc.example.ts.net=127.0.0.1:65536", wantErr: true},
+	}
+	for _, tt := range tests {
+		name, backend, err := ParseSNIRoute(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSNIRoute(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if name != tt.wantName || backend != tt.wantBackend {
+			t.Errorf("ParseSNIRoute(%q) = %q, %q; want %q, %q", tt.in, name, backend, tt.wantName, tt.wantBackend)
+		}
+	}
+}
+
+func TestTCPPortHandlerBackendForSNI(t *testing.T) {
+	plain := (&TCPPortHandler{TCPForward: "127.0.0.1:80", TerminateTLS: "foo.test.ts.net"}).View()
+	routed := (&TCPPortHandler{
+		TCPForward:   "127.0.0.1:80",
+		TerminateTLS: "foo.test.ts.net",
+		SNIRoutes:    map[string]string{"svc.test.ts.net": "127.0.0.1:8080"},
+	}).View()
+	tests := []struct {
+		h           TCPPortHandlerView
+		sni         string
+		wantBackend string
+		wantOK      bool
+	}{
+		{plain, "foo.test.ts.net", "127.0.0.1:80", true},
+		{plain, "other.test.ts.net", "127.0.0.1:80", true}, // no routes; everything goes to TCPForward
+		{routed, "foo.test.ts.net", "127.0.0.1:80", true},
+		{routed, "svc.test.ts.net", "127.0.0.1:8080", true},
+		{routed, "other.test.ts.net", "", false},
+	}
+	for _, tt := range tests {
+		backend, ok := tt.h.BackendForSNI(tt.sni)
+		if backend != tt.wantBackend || ok != tt.wantOK {
+			t.Errorf("BackendForSNI(%q) = %q, %v; want %q, %v", tt.sni, backend, ok, tt.wantBackend, tt.wantOK)
+		}
+	}
+}
+
+func TestServeConfigCheckValid(t *testing.T) {
+	valid := func() *ServeConfig {
+		return &ServeConfig{
+			TCP: map[uint16]*TCPPortHandler{
+				443:  {HTTPS: true, TLSMinVersion: "1.3"},
+				80:   {HTTP: true},
+				2222: {TCPForward: "127.0.0.1:22", MaxConns: 10, Backlog: 1024},
+				8443: {TCPForward: "localhost:8080", TerminateTLS: "foo.test.ts.net", SNIRoutes: map[string]string{"svc.test.ts.net": "127.0.0.1:8081"}},
+			},
+			Web: map[HostPort]*WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{
+					"/":          {Proxy: "http://127.0.0.1:3000", NoHTTP2: true},
+					"/*":         {Text: "fallback"},
+					"/files/":    {Path: "/srv/files", AllowMethods: []string{"GET", "HEAD"}, RequireTag: "tag:admin", CacheControl: "public, max-age=3600"},
+					"/port":      {Proxy: "3030", AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")}},
+					"/hp":        {Proxy: "localhost:3030", ProxyHost: "backend.internal:8080", LogLevel: LogLevelDebug, BasicAuth: []string{"alice:" + testBcryptHash}},
+					"/tls":       {Proxy: "https+insecure://127.0.0.1:4430", BackendKeepalive: "30s", RequestIDHeader: "X-Request-Id", ConnectTimeout: "5s", ResponseHeaderTimeout: "2m"},
+					"/rpc/":      {Proxy: "http://127.0.0.1:50051", GRPCWeb: true, Canary: "http://127.0.0.1:50052", CanaryPercent: 10},
+					"/site/":     {Archive: "/srv/site.zip", CacheControl: "max-age=60", Compress: true},
+					"/app/":      {Path: "/srv/app", SPAFallback: true, OverlayPaths: []string{"/srv/app-prod"}, ServeDotfiles: true},
+					"/dav/":      {Path: "/srv/dav", WebDAV: true, WebDAVReadOnly: true},
+					"/docs/":     {Archive: "/srv/docs.TAR"},
+					"/healthz":   {AggregateBackends: true},
+					"/proxy.pac": {Path: "/etc/proxy.pac", ContentType: PACContentType},
+				}},
+				"foo.test.ts.net:80": {Handlers: map[string]*HTTPHandler{
+					"/":     {Text: "hi"},
+					"/old/": {RedirectToHTTPS: true},
+				}},
+			},
+			AllowFunnel: map[HostPort]bool{"foo.test.ts.net:443": true},
+			Drain:       "30s",
+			// Maintenance mode with a page is valid too.
+			MaintenanceMode: true,
+			MaintenancePage: "/srv/down.html",
+			Services: map[string]*ServiceConfig{
+				"svc:web": {
+					TCP: map[uint16]*TCPPortHandler{443: {HTTPS: true}},
+					Web: map[HostPort]*WebServerConfig{
+						"web.test.ts.net:443": {Handlers: map[string]*HTTPHandler{"/": {Text: "svc"}}},
+					},
+				},
+			},
+			Foreground: map[string]*ServeConfig{
+				"session": {
+					TCP: map[uint16]*TCPPortHandler{8080: {HTTPS: true}},
+					Web: map[HostPort]*WebServerConfig{
+						"foo.test.ts.net:8080": {Handlers: map[string]*HTTPHandler{"/": {Proxy: "8000"}}},
+					},
+				},
+			},
+		}
+	}
+	if filepath.Separator != '/' {
+		t.Skip("test uses Unix paths")
+	}
+	if err := valid().CheckValid(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+	if err := (*ServeConfig)(nil).CheckValid(); err != nil {
+		t.Fatalf("nil config: %v", err)
+	}
+
+	const hp = "foo.test.ts.net:443"
+	tests := []struct {
+		name    string
+		mutate  func(sc *ServeConfig)
+		wantErr string
+	}{
+		{"tcp-port-zero", func(sc *ServeConfig) { sc.TCP[0] = &TCPPortHandler{HTTPS: true} }, "TCP[0]: invalid port 0"},
+		{"tcp-null", func(sc *ServeConfig) { sc.TCP[9000] = nil }, "TCP[9000]: null handler"},
+		{"tcp-no-mode", func(sc *ServeConfig) { sc.TCP[9000] = &TCPPortHandler{} }, "TCP[9000]: exactly one of"},
+		{"tcp-two-modes", func(sc *ServeConfig) { sc.TCP[443].TCPForward = "127.0.0.1:22" }, "TCP[443]: exactly one of"},
+		{"tcp-bad-forward", func(sc *ServeConfig) { sc.TCP[2222].TCPForward = "127.0.0.1" }, "TCP[2222].TCPForward: invalid address"},
+		{"tcp-bad-forward-port", func(sc *ServeConfig) { sc.TCP[2222].TCPForward = "127.0.0.1:99999" }, "TCP[2222].TCPForward: invalid address"},
+		{"tcp-terminate-without-forward", func(sc *ServeConfig) { sc.TCP[443].TerminateTLS = "foo" }, "TCP[443].TerminateTLS"},
+		{"tls-min-version-plain-http", func(sc *ServeConfig) { sc.TCP[80].TLSMinVersion = "1.2" }, "TCP[80].TLSMinVersion: only valid with HTTPS or TerminateTLS"},
+		{"tls-min-version-passthrough", func(sc *ServeConfig) { sc.TCP[2222].TLSMinVersion = "1.2" }, "TCP[2222].TLSMinVersion: only valid with HTTPS or TerminateTLS"},
+		{"tls-min-version-bad", func(sc *ServeConfig) { sc.TCP[8443].TLSMinVersion = "1.0" }, `TCP[8443].TLSMinVersion: invalid TLS version "1.0"`},
+		{"max-conns-negative", func(sc *ServeConfig) { sc.TCP[2222].MaxConns = -1 }, "TCP[2222].MaxConns: must be positive, not -1"},
+		{"max-conns-not-forward", func(sc *ServeConfig) { sc.TCP[443].MaxConns = 5 }, "TCP[443].MaxConns: only valid with TCPForward"},
+		{"backlog-negative", func(sc *ServeConfig) { sc.TCP[2222].Backlog = -1 }, "TCP[2222].Backlog: -1 is not between 0 and 65535"},
+		{"backlog-too-big", func(sc *ServeConfig) { sc.TCP[2222].Backlog = 100000 }, "TCP[2222].Backlog: 100000 is not between 0 and 65535"},
+		{"backlog-not-forward", func(sc *ServeConfig) { sc.TCP[443].Backlog = 128 }, "TCP[443].Backlog: only valid with TCPForward"},
+		{"sni-without-terminate", func(sc *ServeConfig) { sc.TCP[2222].SNIRoutes = map[string]string{"a.test.ts.net": "127.0.0.1:1"} }, "TCP[2222].SNIRoutes: only valid with TerminateTLS"},
+		{"sni-bad-name", func(sc *ServeConfig) { sc.TCP[8443].SNIRoutes["Svc.test.ts.net"] = "127.0.0.1:1" }, `TCP[8443].SNIRoutes["Svc.test.ts.net"]: invalid SNI name`},
+		{"sni-bad-backend", func(sc *ServeConfig) { sc.TCP[8443].SNIRoutes["svc.test.ts.net"] = "127.0.0.1" }, `TCP[8443].SNIRoutes["svc.test.ts.net"]: invalid address`},
+		{"sni-conflict", func(sc *ServeConfig) { sc.TCP[8443].SNIRoutes["foo.test.ts.net"] = "127.0.0.1:1" }, `TCP[8443].SNIRoutes["foo.test.ts.net"]: conflicts with TerminateTLS`},
+		{"web-bad-hostport", func(sc *ServeConfig) { sc.Web["foo.test.ts.net"] = sc.Web[hp] }, `Web["foo.test.ts.net"]`},
+		{"web-missing-host", func(sc *ServeConfig) { sc.Web[":443"] = sc.Web[hp] }, `Web[":443"]: missing host`},
+		{"web-without-tcp", func(sc *ServeConfig) { delete(sc.TCP, 443) }, `Web["foo.test.ts.net:443"]: TCP[443] must exist`},
+		{"web-on-tcp-forward", func(sc *ServeConfig) {
+			sc.Web["foo.test.ts.net:2222"] = &WebServerConfig{Handlers: map[string]*HTTPHandler{"/": {Text: "x"}}}
+		}, `Web["foo.test.ts.net:2222"]: TCP[2222] must exist`},
+		{"mount-relative", func(sc *ServeConfig) { sc.Web[hp].Handlers["foo"] = &HTTPHandler{Text: "x"} }, `Handlers["foo"]: mount point "foo" must start with /`},
+		{"mount-unclean", func(sc *ServeConfig) { sc.Web[hp].Handlers["/a//b"] = &HTTPHandler{Text: "x"} }, `Handlers["/a//b"]: mount point "/a//b" is not a clean path`},
+		{"mount-wildcard", func(sc *ServeConfig) { sc.Web[hp].Handlers["/a/*"] = &HTTPHandler{Text: "x"} }, `Handlers["/a/*"]: invalid mount point`},
+		{"handler-null", func(sc *ServeConfig) { sc.Web[hp].Handlers["/x"] = nil }, `Handlers["/x"]: null handler`},
+		{"handler-empty", func(sc *ServeConfig) { sc.Web[hp].Handlers["/x"] = &HTTPHandler{} }, `Handlers["/x"]: exactly one of`},
+		{"handler-two-kinds", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].Text = "x" }, `Handlers["/"]: exactly one of`},
+		{"path-relative", func(sc *ServeConfig) { sc.Web[hp].Handlers["/files/"].Path = "srv" }, `Handlers["/files/"].Path: "srv" is not an absolute path`},
+		{"archive-relative", func(sc *ServeConfig) { sc.Web[hp].Handlers["/site/"].Archive = "site.zip" }, `Handlers["/site/"].Archive: "site.zip" is not an absolute path`},
+		{"archive-format", func(sc *ServeConfig) { sc.Web[hp].Handlers["/site/"].Archive = "/srv/site.tar.gz" }, `Handlers["/site/"].Archive: "/srv/site.tar.gz" is not a .zip or .tar file`},
+		{"archive-and-path", func(sc *ServeConfig) { sc.Web[hp].Handlers["/site/"].Path = "/srv/site" }, `Handlers["/site/"]: exactly one of`},
+		{"proxy-scheme", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].Proxy = "ftp://127.0.0.1:21" }, `Handlers["/"].Proxy: invalid target "ftp://127.0.0.1:21": unsupported scheme`},
+		{"proxy-port", func(sc *ServeConfig) { sc.Web[hp].Handlers["/port"].Proxy = "0" }, `Handlers["/port"].Proxy: invalid target "0": invalid port`},
+		{"proxy-url-port", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].Proxy = "http://127.0.0.1:70000" }, `Handlers["/"].Proxy`},
+		{"proxy-pipe-not-windows", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].Proxy = `\\.\pipe\app` }, `Handlers["/"].Proxy: invalid target "\\\\.\\pipe\\app": named pipes are only supported on Windows`},
+		{"nohttp2-without-proxy", func(sc *ServeConfig) { sc.Web[hp].Handlers["/*"].NoHTTP2 = true }, `Handlers["/*"].NoHTTP2`},
+		{"proxy-host-without-proxy", func(sc *ServeConfig) { sc.Web[hp].Handlers["/*"].ProxyHost = "backend" }, `Handlers["/*"].ProxyHost: only valid with Proxy`},
+		{"bad-proxy-host", func(sc *ServeConfig) { sc.Web[hp].Handlers["/hp"].ProxyHost = "a b" }, `Handlers["/hp"].ProxyHost: invalid proxy host "a b"`},
+		{"keepalive-without-proxy", func(sc *ServeConfig) { sc.Web[hp].Handlers["/*"].BackendKeepalive = "30s" }, `Handlers["/*"].BackendKeepalive: only valid with Proxy`},
+		{"bad-keepalive", func(sc *ServeConfig) { sc.Web[hp].Handlers["/tls"].BackendKeepalive = "25h" }, `Handlers["/tls"].BackendKeepalive: invalid backend keepalive "25h"`},
+		{"connect-timeout-without-proxy", func(sc *ServeConfig) { sc.Web[hp].Handlers["/*"].ConnectTimeout = "5s" }, `Handlers["/*"].ConnectTimeout: only valid with Proxy`},
+		{"negative-connect-timeout", func(sc *ServeConfig) { sc.Web[hp].Handlers["/tls"].ConnectTimeout = "-1s" }, `Handlers["/tls"].ConnectTimeout: invalid timeout "-1s": must not be negative`},
+		{"response-header-timeout-without-proxy", func(sc *ServeConfig) { sc.Web[hp].Handlers["/*"].ResponseHeaderTimeout = "5s" }, `Handlers["/*"].ResponseHeaderTimeout: only valid with Proxy`},
+		{"bad-response-header-timeout", func(sc *ServeConfig) { sc.Web[hp].Handlers["/tls"].ResponseHeaderTimeout = "30" }, `Handlers["/tls"].ResponseHeaderTimeout: invalid timeout "30"`},
+		{"grpc-web-without-proxy", func(sc *ServeConfig) { sc.Web[hp].Handlers["/*"].GRPCWeb = true }, `Handlers["/*"].GRPCWeb: only valid with Proxy`},
+		{"grpc-web-nohttp2", func(sc *ServeConfig) { sc.Web[hp].Handlers["/rpc/"].NoHTTP2 = true }, `Handlers["/rpc/"].GRPCWeb: can't be combined with NoHTTP2`},
+		{"grpc-web-bad-scheme", func(sc *ServeConfig) { sc.Web[hp].Handlers["/rpc/"].Proxy = "ftp://127.0.0.1:21" }, `Handlers["/rpc/"].Proxy: invalid target "ftp://127.0.0.1:21": unsupported scheme`},
+		{"bad-method", func(sc *ServeConfig) { sc.Web[hp].Handlers["/files/"].AllowMethods = []string{"get"} }, `Handlers["/files/"].AllowMethods: unknown HTTP method "get"`},
+		{"unmasked-cidr", func(sc *ServeConfig) {
+			sc.Web[hp].Handlers["/"].AllowCIDRs = []netip.Prefix{netip.MustParsePrefix("10.0.0.1/8")}
+		}, `Handlers["/"].AllowCIDRs: invalid prefix 10.0.0.1/8`},
+		{"basic-auth-plaintext", func(sc *ServeConfig) { sc.Web[hp].Handlers["/hp"].BasicAuth = []string{"alice:hunter2"} }, `Handlers["/hp"].BasicAuth: invalid basic auth entry for "alice"`},
+		{"basic-auth-no-user", func(sc *ServeConfig) { sc.Web[hp].Handlers["/hp"].BasicAuth = []string{":" + testBcryptHash} }, `Handlers["/hp"].BasicAuth: invalid basic auth entry`},
+		{"basic-auth-dup-user", func(sc *ServeConfig) {
+			sc.Web[hp].Handlers["/hp"].BasicAuth = []string{"alice:" + testBcryptHash, "alice:" + testBcryptHash}
+		}, `Handlers["/hp"].BasicAuth: duplicate user "alice"`},
+		{"bad-log-level", func(sc *ServeConfig) { sc.Web[hp].Handlers["/hp"].LogLevel = "verbose" }, `Handlers["/hp"].LogLevel: invalid log level "verbose"`},
+		{"bad-tag", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].RequireTag = "admin" }, `Handlers["/"].RequireTag: invalid tag "admin"`},
+		{"cache-control-without-path", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].CacheControl = "no-store" }, `Handlers["/"].CacheControl: only valid with Path`},
+		{"cache-control-injection", func(sc *ServeConfig) {
+			sc.Web[hp].Handlers["/files/"].CacheControl = "no-store\r\nSet-Cookie: x=y"
+		}, `Handlers["/files/"].CacheControl: Cache-Control value must not contain control`},
+		{"content-type-without-path", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].ContentType = "text/plain" }, `Handlers["/"].ContentType: only valid with Path`},
+		{"bad-content-type", func(sc *ServeConfig) { sc.Web[hp].Handlers["/files/"].ContentType = "text/" }, `Handlers["/files/"].ContentType: invalid media type "text/"`},
+		{"request-id-header-without-proxy", func(sc *ServeConfig) { sc.Web[hp].Handlers["/files/"].RequestIDHeader = "X-Request-Id" }, `Handlers["/files/"].RequestIDHeader: only valid with Proxy`},
+		{"bad-request-id-header", func(sc *ServeConfig) { sc.Web[hp].Handlers["/tls"].RequestIDHeader = "X Request Id" }, `Handlers["/tls"].RequestIDHeader: invalid request ID header "X Request Id"`},
+		{"overlay-paths-without-path", func(sc *ServeConfig) { sc.Web[hp].Handlers["/site/"].OverlayPaths = []string{"/srv/extra"} }, `Handlers["/site/"].OverlayPaths: only valid with Path`},
+		{"relative-overlay-path", func(sc *ServeConfig) { sc.Web[hp].Handlers["/files/"].OverlayPaths = []string{"/srv/a", "extra"} }, `Handlers["/files/"].OverlayPaths: "extra" is not an absolute path`},
+		{"canary-without-proxy", func(sc *ServeConfig) { sc.Web[hp].Handlers["/files/"].Canary = "3001" }, `Handlers["/files/"].Canary: only valid with Proxy`},
+		{"bad-canary", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].Canary = "ftp://127.0.0.1:3001" }, `Handlers["/"].Canary: invalid target "ftp://127.0.0.1:3001": unsupported scheme "ftp"`},
+		{"canary-percent-without-canary", func(sc *ServeConfig) { sc.Web[hp].Handlers["/"].CanaryPercent = 10 }, `Handlers["/"].CanaryPercent: only valid with Canary`},
+		{"canary-percent-over-100", func(sc *ServeConfig) { sc.Web[hp].Handlers["/rpc/"].CanaryPercent = 101 }, `Handlers["/rpc/"].CanaryPercent: 101 is not between 0 and 100`},
+		{"canary-percent-negative", func(sc *ServeConfig) { sc.Web[hp].Handlers["/rpc/"].CanaryPercent = -1 }, `Handlers["/rpc/"].CanaryPercent: -1 is not between 0 and 100`},
+		{"compress-text", func(sc *ServeConfig) { sc.Web[hp].Handlers["/*"].Compress = true }, `Handlers["/*"].Compress: only valid with Path, Archive or Proxy`},
+		{"webdav-without-path", func(sc *ServeConfig) { sc.Web[hp].Handlers["/site/"].WebDAV = true }, `Handlers["/site/"].WebDAV: only valid with Path`},
+		{"webdav-spa-fallback", func(sc *ServeConfig) { sc.Web[hp].Handlers["/app/"].WebDAV = true }, `Handlers["/app/"].WebDAV: can't be used with SPAFallback`},
+		{"webdav-content-type", func(sc *ServeConfig) { sc.Web[hp].Handlers["/dav/"].ContentType = "text/plain" }, `Handlers["/dav/"].WebDAV: can't be used with ContentType`},
+		{"webdav-overlay", func(sc *ServeConfig) {
+			sc.Web[hp].Handlers["/dav/"].OverlayPaths = []string{"/srv/more"}
+		}, `Handlers["/dav/"].WebDAV: can't be used with OverlayPaths`},
+		{"webdav-read-only-without-webdav", func(sc *ServeConfig) {
+			sc.Web[hp].Handlers["/dav/"].WebDAV = false
+		}, `Handlers["/dav/"].WebDAVReadOnly: only valid with WebDAV`},
+		{"serve-dotfiles-without-path", func(sc *ServeConfig) { sc.Web[hp].Handlers["/site/"].ServeDotfiles = true }, `Handlers["/site/"].ServeDotfiles: only valid with Path`},
+		{"serve-dotfiles-webdav", func(sc *ServeConfig) { sc.Web[hp].Handlers["/dav/"].ServeDotfiles = true }, `Handlers["/dav/"].ServeDotfiles: can't be used with WebDAV`},
+		{"webdav-writable-funnel", func(sc *ServeConfig) { sc.Web[hp].Handlers["/dav/"].WebDAVReadOnly = false }, `Handlers["/dav/"].WebDAV: must be WebDAVReadOnly with AllowFunnel`},
+		{"spa-fallback-without-path", func(sc *ServeConfig) { sc.Web[hp].Handlers["/site/"].SPAFallback = true }, `Handlers["/site/"].SPAFallback: only valid with Path`},
+		{"redirect-on-https", func(sc *ServeConfig) { sc.Web[hp].Handlers["/r"] = &HTTPHandler{RedirectToHTTPS: true} }, `Handlers["/r"].RedirectToHTTPS: only valid on HTTP ports`},
+		{"redirect-and-text", func(sc *ServeConfig) { sc.Web["foo.test.ts.net:80"].Handlers["/old/"].Text = "x" }, `Handlers["/old/"]: exactly one of`},
+		{"funnel-bad-hostport", func(sc *ServeConfig) { sc.AllowFunnel["foo.test.ts.net:0"] = true }, `AllowFunnel["foo.test.ts.net:0"]: invalid port`},
+		{"service-null", func(sc *ServeConfig) { sc.Services["svc:null"] = nil }, `Services["svc:null"]: null service`},
+		{"service-handler", func(sc *ServeConfig) {
+			sc.Services["svc:web"].Web["web.test.ts.net:443"].Handlers["/"] = &HTTPHandler{}
+		}, `Services["svc:web"].Web["web.test.ts.net:443"].Handlers["/"]: exactly one of`},
+		{"service-web-without-tcp", func(sc *ServeConfig) { delete(sc.Services["svc:web"].TCP, 443) }, `Services["svc:web"].TCP[443] must exist`},
+		{"foreground", func(sc *ServeConfig) { sc.Foreground["session"].TCP[8080].HTTP = true }, `Foreground["session"].TCP[8080]: exactly one of`},
+		{"drain-invalid", func(sc *ServeConfig) { sc.Drain = "soon" }, `Drain: invalid drain duration "soon"`},
+		{"drain-negative", func(sc *ServeConfig) { sc.Drain = "-1s" }, `Drain: invalid drain duration "-1s": must be between`},
+		{"drain-too-long", func(sc *ServeConfig) { sc.Drain = "2h" }, `Drain: invalid drain duration "2h": must be between`},
+		{"maintenance-page-without-mode", func(sc *ServeConfig) { sc.MaintenanceMode = false }, `MaintenancePage: only valid with MaintenanceMode`},
+		{"maintenance-page-relative", func(sc *ServeConfig) { sc.MaintenancePage = "down.html" }, `MaintenancePage: "down.html" is not an absolute path`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := valid()
+			tt.mutate(sc)
+			err := sc.CheckValid()
+			if err == nil {
+				t.Fatalf("got no error; want one containing %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %q; want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseDrain(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"0s", 0, false},
+		{"30s", 30 * time.Second, false},
+		{"1h", time.Hour, false},
+		{"1h0m1s", 0, true},
+		{"-5s", 0, true},
+		{"30", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDrain(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseDrain(%q) = %v, %v; want %v, error=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseBackendKeepalive(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0s", 0, false},
+		{"30s", 30 * time.Second, false},
+		{"24h", 24 * time.Hour, false},
+		{"24h0m1s", 0, true},
+		{"-5s", 0, true},
+		{"30", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBackendKeepalive(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseBackendKeepalive(%q) = %v, %v; want %v, error=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	for in, want := range map[string]time.Duration{
+		"":    DefaultBackendKeepalive,
+		"0s":  DefaultBackendKeepalive,
+		"bad": DefaultBackendKeepalive,
+		"10s": 10 * time.Second,
+	} {
+		h := &HTTPHandler{Proxy: "3000", BackendKeepalive: in}
+		if got := h.View().BackendKeepaliveDuration(); got != want {
+			t.Errorf("BackendKeepaliveDuration with %q = %v; want %v", in, got, want)
+		}
+	}
+}
+
+func TestParseProxyTimeout(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0s", 0, false},
+		{"500ms", 500 * time.Millisecond, false},
+		{"48h", 48 * time.Hour, false},
+		{"-5s", 0, true},
+		{"30", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseProxyTimeout(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseProxyTimeout(%q) = %v, %v; want %v, error=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	h := &HTTPHandler{Proxy: "3000", ConnectTimeout: "5s", ResponseHeaderTimeout: "bad"}
+	if got := h.View().ConnectTimeoutDuration(); got != 5*time.Second {
+		t.Errorf("ConnectTimeoutDuration = %v; want 5s", got)
+	}
+	if got := h.View().ResponseHeaderTimeoutDuration(); got != 0 {
+		t.Errorf("ResponseHeaderTimeoutDuration with invalid value = %v; want 0", got)
+	}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"/srv/site.zip", "zip"},
+		{"/srv/site.ZIP", "zip"},
+		{"/srv/site.tar", "tar"},
+		{"/srv/site.tar.gz", ""},
+		{"/srv/site.tgz", ""},
+		{"/srv/zip", ""},
+		{"/srv/site", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ArchiveFormat(tt.name); got != tt.want {
+			t.Errorf("ArchiveFormat(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
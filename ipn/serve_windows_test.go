@@ -0,0 +1,61 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServeConfigCheckValidNamedPipe(t *testing.T) {
+	const hp = "foo.test.ts.net:443"
+	tests := []struct {
+		proxy   string
+		wantErr string // substring; empty means valid
+	}{
+		{proxy: `\\.\pipe\app`},
+		{proxy: `\\.\PIPE\app`},
+		{proxy: `\\.\pipe\my-app.v2`},
+		{proxy: `\\.\pipe\`, wantErr: "empty pipe name"},
+		{proxy: `\\.\pipe\app\sub`, wantErr: "must not contain a backslash"},
+		{proxy: `\\.\pipe\` + strings.Repeat("a", 248), wantErr: "too long"},
+	}
+	for _, tt := range tests {
+		sc := &ServeConfig{
+			TCP: map[uint16]*TCPPortHandler{443: {HTTPS: true}},
+			Web: map[HostPort]*WebServerConfig{
+				hp: {Handlers: map[string]*HTTPHandler{"/": {Proxy: tt.proxy}}},
+			},
+		}
+		err := sc.CheckValid()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("Proxy %q: unexpected error: %v", tt.proxy, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Proxy %q: got error %v; want one containing %q", tt.proxy, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsNamedPipeProxy(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{`\\.\pipe\app`, true},
+		{`\\.\Pipe\app`, true},
+		{`\\.\pipe\`, true},
+		{`\\.\pip`, false},
+		{"http://127.0.0.1:3000", false},
+		{"3000", false},
+	}
+	for _, tt := range tests {
+		if got := IsNamedPipeProxy(tt.target); got != tt.want {
+			t.Errorf("IsNamedPipeProxy(%q) = %v; want %v", tt.target, got, tt.want)
+		}
+	}
+}
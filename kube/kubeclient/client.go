@@ -15,14 +15,17 @@
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -60,7 +63,22 @@ func readFile(n string) ([]byte, error) {
 // It expects to be run inside a cluster.
 type Client interface {
 	GetSecret(context.Context, string) (*kubeapi.Secret, error)
+	// ListSecrets returns the Secrets in the client's namespace that have
+	// all of the given labels. A nil or empty labels lists all Secrets.
+	ListSecrets(_ context.Context, labels map[string]string) (*kubeapi.SecretList, error)
+	// GetSecretByLabels returns the single Secret in the client's
+	// namespace that has all of the given labels, such as the state
+	// Secret of a particular Pod. It returns an error for which
+	// IsNotFoundErr is true if there's no such Secret, and an error if
+	// there's more than one.
+	GetSecretByLabels(_ context.Context, labels map[string]string) (*kubeapi.Secret, error)
 	UpdateSecret(context.Context, *kubeapi.Secret) error
+	// CompareAndSwapSecret replaces the named Secret with the given one,
+	// but only if the Secret's current resourceVersion is
+	// expectedResourceVersion. It reports false (and no error) if it
+	// isn't, which means that someone else modified the Secret since it
+	// was read.
+	CompareAndSwapSecret(_ context.Context, name, expectedResourceVersion string, s *kubeapi.Secret) (bool, error)
 	CreateSecret(context.Context, *kubeapi.Secret) error
 	// Event attempts to ensure an event with the specified options associated with the Pod in which we are
 	// currently running. This is best effort - if the client is not able to create events, this operation will be a
@@ -68,6 +86,10 @@ type Client interface {
 	// count and timestamp are expected to change), else a new event will be created.
 	Event(_ context.Context, typ, reason, msg string) error
 	StrategicMergePatchSecret(context.Context, string, *kubeapi.Secret, string) error
+	// ApplySecret creates or updates the named Secret using server-side
+	// apply, as fieldManager, taking ownership of the fields set in obj
+	// even if another manager owns them.
+	ApplySecret(_ context.Context, name string, obj *kubeapi.Secret, fieldManager string) error
 	JSONPatchResource(_ context.Context, resourceName string, resourceType string, patches []JSONPatch) error
 	CheckSecretPermissions(context.Context, string) (bool, bool, error)
 	SetDialer(dialer func(context.Context, string, string) (net.Conn, error))
@@ -254,6 +276,63 @@ func (c *client) GetSecret(ctx context.Context, name string) (*kubeapi.Secret, e
 	return s, nil
 }
 
+// ListSecrets lists the secrets that have all of labels in the Kubernetes
+// API, using a label selector.
+func (c *client) ListSecrets(ctx context.Context, labels map[string]string) (*kubeapi.SecretList, error) {
+	surl := c.resourceURL("", TypeSecrets)
+	if sel := labelSelector(labels); sel != "" {
+		surl += "?" + url.Values{"labelSelector": {sel}}.Encode()
+	}
+	sl := &kubeapi.SecretList{}
+	if err := c.kubeAPIRequest(ctx, "GET", surl, nil, sl); err != nil {
+		return nil, err
+	}
+	return sl, nil
+}
+
+// GetSecretByLabels fetches the only secret that has all of labels from the
+// Kubernetes API.
+func (c *client) GetSecretByLabels(ctx context.Context, labels map[string]string) (*kubeapi.Secret, error) {
+	return secretByLabels(ctx, c, labels)
+}
+
+// secretByLabels implements Client.GetSecretByLabels using c.ListSecrets.
+func secretByLabels(ctx context.Context, c Client, labels map[string]string) (*kubeapi.Secret, error) {
+	if len(labels) == 0 {
+		return nil, errors.New("getting secret by labels: no labels")
+	}
+	sl, err := c.ListSecrets(ctx, labels)
+	if err != nil {
+		return nil, err
+	}
+	switch len(sl.Items) {
+	case 0:
+		return nil, &kubeapi.Status{
+			Status:  "Failure",
+			Reason:  "NotFound",
+			Code:    404,
+			Message: fmt.Sprintf("no secret with labels %q", labelSelector(labels)),
+		}
+	case 1:
+		return &sl.Items[0], nil
+	}
+	names := make([]string, len(sl.Items))
+	for i, s := range sl.Items {
+		names[i] = s.Name
+	}
+	return nil, fmt.Errorf("%d secrets with labels %q, want 1: %s", len(names), labelSelector(labels), strings.Join(names, ", "))
+}
+
+// labelSelector returns the Kubernetes label selector that matches objects
+// with all of labels, in a stable order.
+func labelSelector(labels map[string]string) string {
+	var sel []string
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		sel = append(sel, k+"="+labels[k])
+	}
+	return strings.Join(sel, ",")
+}
+
 // CreateSecret creates a secret in the Kubernetes API.
 func (c *client) CreateSecret(ctx context.Context, s *kubeapi.Secret) error {
 	s.Namespace = c.ns
@@ -265,6 +344,27 @@ func (c *client) UpdateSecret(ctx context.Context, s *kubeapi.Secret) error {
 	return c.kubeAPIRequest(ctx, "PUT", c.resourceURL(s.Name, TypeSecrets), s, nil)
 }
 
+// CompareAndSwapSecret replaces the named secret with s in the Kubernetes API
+// if its current resourceVersion is expectedResourceVersion, using the
+// resourceVersion precondition of updates. It returns false and no error if
+// the secret was modified concurrently. On success, s is updated with the
+// stored secret, including its new resourceVersion.
+func (c *client) CompareAndSwapSecret(ctx context.Context, name, expectedResourceVersion string, s *kubeapi.Secret) (bool, error) {
+	if expectedResourceVersion == "" {
+		return false, fmt.Errorf("compare-and-swap of secret %q: empty resourceVersion", name)
+	}
+	s.Name = name
+	s.ResourceVersion = expectedResourceVersion
+	err := c.kubeAPIRequest(ctx, "PUT", c.resourceURL(name, TypeSecrets), s, s)
+	if IsConflictErr(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // JSONPatch is a JSON patch operation.
 // It currently (2024-11-15) only supports "add", "remove" and "replace" operations.
 //
@@ -302,6 +402,29 @@ func (c *client) StrategicMergePatchSecret(ctx context.Context, name string, s *
 	return c.kubeAPIRequest(ctx, "PATCH", surl, s, nil, setHeader("Content-Type", "application/strategic-merge-patch+json"))
 }
 
+// ApplySecret creates or updates a secret in the Kubernetes API using
+// server-side apply. Only the fields set in s are applied; they become owned
+// by fieldManager, which must be non-empty. Conflicts with other field
+// managers are forced, so fieldManager takes over fields that, for example,
+// a user set with kubectl.
+//
+// https://kubernetes.io/docs/reference/using-api/server-side-apply/
+func (c *client) ApplySecret(ctx context.Context, name string, s *kubeapi.Secret, fieldManager string) error {
+	if fieldManager == "" {
+		return fmt.Errorf("server-side apply of secret %q: empty fieldManager", name)
+	}
+	uv := url.Values{
+		"fieldManager": {fieldManager},
+		"force":        {"true"},
+	}
+	s.APIVersion = "v1"
+	s.Kind = "Secret"
+	s.Namespace = c.ns
+	s.Name = name
+	// The apply patch is YAML, of which JSON is a subset.
+	return c.kubeAPIRequest(ctx, "PATCH", c.resourceURL(name, TypeSecrets)+"?"+uv.Encode(), s, nil, setHeader("Content-Type", "application/apply-patch+yaml"))
+}
+
 // Event tries to ensure an Event associated with the Pod in which we are running. It is best effort - the event will be
 // created if the kube client on startup was able to determine the name and UID of this Pod from POD_NAME,POD_UID env
 // vars and if permissions check for event creation succeeded. Events are keyed on opts.Reason- if an Event for the
@@ -404,6 +527,15 @@ func IsNotFoundErr(err error) bool {
 	return false
 }
 
+// IsConflictErr reports whether err is a Kubernetes API 409 Conflict
+// error, as returned when a resourceVersion precondition fails.
+func IsConflictErr(err error) bool {
+	if st, ok := err.(*kubeapi.Status); ok && st.Code == 409 {
+		return true
+	}
+	return false
+}
+
 // setEventPerms checks whether this client will be able to write tailscaled Events to its Pod and updates the state
 // accordingly. If it determines that the client can not write Events, any subsequent calls to client.Event will be a
 // no-op.
@@ -7,6 +7,7 @@
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -104,6 +105,270 @@ func Test_client_Event(t *testing.T) {
 	}
 }
 
+func Test_client_CompareAndSwapSecret(t *testing.T) {
+	newSecret := func() *kubeapi.Secret {
+		return &kubeapi.Secret{Data: map[string][]byte{"key": []byte("new")}}
+	}
+	wantIn := &kubeapi.Secret{
+		ObjectMeta: kubeapi.ObjectMeta{Name: "test-secret", ResourceVersion: "41"},
+		Data:       map[string][]byte{"key": []byte("new")},
+	}
+	const url = "test-apiserver/api/v1/namespaces/test-ns/secrets/test-secret"
+	tests := []struct {
+		name        string
+		arg         args
+		wantSwapped bool
+		wantErr     bool
+		wantVersion string
+	}{
+		{
+			name: "swapped",
+			arg: args{
+				wantsMethod: "PUT",
+				wantsURL:    url,
+				wantsIn:     wantIn,
+				setOut:      []byte(`{"metadata":{"name":"test-secret","resourceVersion":"42"}}`),
+			},
+			wantSwapped: true,
+			wantVersion: "42",
+		},
+		{
+			name: "conflict",
+			arg: args{
+				wantsMethod: "PUT",
+				wantsURL:    url,
+				wantsIn:     wantIn,
+				setErr:      &kubeapi.Status{Code: 409, Reason: "Conflict"},
+			},
+		},
+		{
+			name: "other_error",
+			arg: args{
+				wantsMethod: "PUT",
+				wantsURL:    url,
+				wantsIn:     wantIn,
+				setErr:      &kubeapi.Status{Code: 403, Reason: "Forbidden"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &client{
+				url:            "test-apiserver",
+				ns:             "test-ns",
+				kubeAPIRequest: fakeKubeAPIRequest(t, []args{tt.arg}),
+			}
+			s := newSecret()
+			swapped, err := c.CompareAndSwapSecret(context.Background(), "test-secret", "41", s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompareAndSwapSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if swapped != tt.wantSwapped {
+				t.Errorf("CompareAndSwapSecret() = %v, want %v", swapped, tt.wantSwapped)
+			}
+			if tt.wantVersion != "" && s.ResourceVersion != tt.wantVersion {
+				t.Errorf("resourceVersion after swap = %q, want %q", s.ResourceVersion, tt.wantVersion)
+			}
+		})
+	}
+
+	t.Run("empty_version", func(t *testing.T) {
+		c := &client{url: "test-apiserver", ns: "test-ns", kubeAPIRequest: fakeKubeAPIRequest(t, nil)}
+		if _, err := c.CompareAndSwapSecret(context.Background(), "test-secret", "", newSecret()); err == nil {
+			t.Error("CompareAndSwapSecret with empty resourceVersion succeeded, want error")
+		}
+	})
+}
+
+func TestFakeClientCompareAndSwapSecret(t *testing.T) {
+	fc := &FakeClient{ResourceVersion: "7"}
+	ctx := context.Background()
+
+	s := &kubeapi.Secret{}
+	if ok, err := fc.CompareAndSwapSecret(ctx, "s", "7", s); !ok || err != nil {
+		t.Fatalf("CompareAndSwapSecret at current version = %v, %v; want true, nil", ok, err)
+	}
+	if s.ResourceVersion != "8" || fc.ResourceVersion != "8" {
+		t.Errorf("after swap, secret version = %q, client version = %q; want 8", s.ResourceVersion, fc.ResourceVersion)
+	}
+
+	// The version read before the swap is now stale.
+	if ok, err := fc.CompareAndSwapSecret(ctx, "s", "7", &kubeapi.Secret{}); ok || err != nil {
+		t.Errorf("CompareAndSwapSecret at stale version = %v, %v; want false, nil", ok, err)
+	}
+
+	// Simulate another replica updating the secret.
+	fc.ResourceVersion = "100"
+	if ok, _ := fc.CompareAndSwapSecret(ctx, "s", "8", &kubeapi.Secret{}); ok {
+		t.Error("CompareAndSwapSecret succeeded after a concurrent modification")
+	}
+
+	// An empty version never matches, even if the client's is empty too.
+	if ok, err := fc.CompareAndSwapSecret(ctx, "s", "", &kubeapi.Secret{}); ok || err != nil {
+		t.Errorf("CompareAndSwapSecret at empty version = %v, %v; want false, nil", ok, err)
+	}
+	if ok, err := new(FakeClient).CompareAndSwapSecret(ctx, "s", "", &kubeapi.Secret{}); ok || err != nil {
+		t.Errorf("CompareAndSwapSecret at empty version with empty client version = %v, %v; want false, nil", ok, err)
+	}
+}
+
+func Test_client_ApplySecret(t *testing.T) {
+	c := &client{
+		url: "test-apiserver",
+		ns:  "test-ns",
+		kubeAPIRequest: fakeKubeAPIRequest(t, []args{{
+			wantsMethod: "PATCH",
+			wantsURL:    "test-apiserver/api/v1/namespaces/test-ns/secrets/test-secret?fieldManager=tailscale-operator&force=true",
+			wantsIn: &kubeapi.Secret{
+				TypeMeta:   kubeapi.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+				ObjectMeta: kubeapi.ObjectMeta{Name: "test-secret", Namespace: "test-ns"},
+				Data:       map[string][]byte{"key": []byte("value")},
+			},
+			wantsContentType: "application/apply-patch+yaml",
+		}}),
+	}
+	s := &kubeapi.Secret{Data: map[string][]byte{"key": []byte("value")}}
+	if err := c.ApplySecret(context.Background(), "test-secret", s, "tailscale-operator"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ApplySecret(context.Background(), "test-secret", s, ""); err == nil {
+		t.Error("ApplySecret with empty fieldManager succeeded, want error")
+	}
+}
+
+func TestFakeClientApplySecret(t *testing.T) {
+	var gotName, gotManager string
+	fc := &FakeClient{ApplySecretImpl: func(_ context.Context, name string, _ *kubeapi.Secret, fieldManager string) error {
+		gotName, gotManager = name, fieldManager
+		return nil
+	}}
+	var c Client = fc
+	if err := c.ApplySecret(context.Background(), "s", &kubeapi.Secret{}, "tailscale-operator"); err != nil {
+		t.Fatal(err)
+	}
+	if gotName != "s" || gotManager != "tailscale-operator" {
+		t.Errorf("ApplySecretImpl got name %q, fieldManager %q; want %q, %q", gotName, gotManager, "s", "tailscale-operator")
+	}
+}
+
+func Test_client_GetSecretByLabels(t *testing.T) {
+	labels := map[string]string{"tailscale.com/pod": "proxy-0", "app": "proxy"}
+	const wantURL = "test-apiserver/api/v1/namespaces/test-ns/secrets?labelSelector=app%3Dproxy%2Ctailscale.com%2Fpod%3Dproxy-0"
+	tests := []struct {
+		name     string
+		list     string // JSON SecretList returned by the API server
+		wantName string
+		wantErr  func(error) bool
+	}{
+		{
+			name:     "found-one",
+			list:     `{"items":[{"metadata":{"name":"proxy-0-state"}}]}`,
+			wantName: "proxy-0-state",
+		},
+		{
+			name:    "found-none",
+			list:    `{"items":[]}`,
+			wantErr: IsNotFoundErr,
+		},
+		{
+			name: "found-many",
+			list: `{"items":[{"metadata":{"name":"a"}},{"metadata":{"name":"b"}}]}`,
+			wantErr: func(err error) bool {
+				return err != nil && !IsNotFoundErr(err) && strings.Contains(err.Error(), "a, b")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &client{
+				url: "test-apiserver",
+				ns:  "test-ns",
+				kubeAPIRequest: fakeKubeAPIRequest(t, []args{{
+					wantsMethod: "GET",
+					wantsURL:    wantURL,
+					setOut:      []byte(tt.list),
+				}}),
+			}
+			s, err := c.GetSecretByLabels(context.Background(), labels)
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Errorf("GetSecretByLabels error = %v; not the expected error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Name != tt.wantName {
+				t.Errorf("GetSecretByLabels = secret %q; want %q", s.Name, tt.wantName)
+			}
+		})
+	}
+
+	c := &client{url: "test-apiserver", ns: "test-ns", kubeAPIRequest: fakeKubeAPIRequest(t, nil)}
+	if _, err := c.GetSecretByLabels(context.Background(), nil); err == nil {
+		t.Error("GetSecretByLabels with no labels succeeded, want error")
+	}
+}
+
+func Test_client_ListSecrets(t *testing.T) {
+	c := &client{
+		url: "test-apiserver",
+		ns:  "test-ns",
+		kubeAPIRequest: fakeKubeAPIRequest(t, []args{{
+			wantsMethod: "GET",
+			wantsURL:    "test-apiserver/api/v1/namespaces/test-ns/secrets",
+			setOut:      []byte(`{"items":[{"metadata":{"name":"a"}},{"metadata":{"name":"b"}}]}`),
+		}}),
+	}
+	sl, err := c.ListSecrets(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sl.Items) != 2 || sl.Items[0].Name != "a" || sl.Items[1].Name != "b" {
+		t.Errorf("ListSecrets = %+v; want secrets a and b", sl.Items)
+	}
+}
+
+func TestFakeClientGetSecretByLabels(t *testing.T) {
+	secrets := []kubeapi.Secret{
+		{ObjectMeta: kubeapi.ObjectMeta{Name: "proxy-0-state", Labels: map[string]string{"app": "proxy", "pod": "proxy-0"}}},
+		{ObjectMeta: kubeapi.ObjectMeta{Name: "proxy-1-state", Labels: map[string]string{"app": "proxy", "pod": "proxy-1"}}},
+	}
+	fc := &FakeClient{ListSecretsImpl: func(_ context.Context, labels map[string]string) (*kubeapi.SecretList, error) {
+		sl := &kubeapi.SecretList{}
+		for _, s := range secrets {
+			match := true
+			for k, v := range labels {
+				if s.Labels[k] != v {
+					match = false
+				}
+			}
+			if match {
+				sl.Items = append(sl.Items, s)
+			}
+		}
+		return sl, nil
+	}}
+	var c Client = fc
+	ctx := context.Background()
+
+	s, err := c.GetSecretByLabels(ctx, map[string]string{"pod": "proxy-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "proxy-1-state" {
+		t.Errorf("GetSecretByLabels(pod=proxy-1) = %q; want %q", s.Name, "proxy-1-state")
+	}
+	if _, err := c.GetSecretByLabels(ctx, map[string]string{"pod": "proxy-2"}); !IsNotFoundErr(err) {
+		t.Errorf("GetSecretByLabels(pod=proxy-2) error = %v; want not found", err)
+	}
+	if _, err := c.GetSecretByLabels(ctx, map[string]string{"app": "proxy"}); err == nil || IsNotFoundErr(err) {
+		t.Errorf("GetSecretByLabels(app=proxy) error = %v; want multiple secrets error", err)
+	}
+}
+
 // args is a set of values for testing a single call to client.kubeAPIRequest.
 type args struct {
 	// wantsMethod is the expected value of 'method' arg.
@@ -112,6 +377,9 @@ type args struct {
 	wantsURL string
 	// wantsIn is the expected value of 'in' arg.
 	wantsIn any
+	// wantsContentType, if non-empty, is the Content-Type header that the
+	// 'opts' args are expected to set.
+	wantsContentType string
 	// setOut can be set to a byte slice representing valid JSON. If set 'out' arg will get set to the unmarshalled
 	// JSON object.
 	setOut []byte
@@ -139,6 +407,15 @@ func fakeKubeAPIRequest(t *testing.T, argSets []args) kubeAPIRequestFunc {
 		if d := cmp.Diff(gotIn, a.wantsIn); d != "" {
 			t.Errorf("[%d] unexpected payload (-want + got):\n%s", count, d)
 		}
+		if a.wantsContentType != "" {
+			req := &http.Request{Header: make(http.Header)}
+			for _, opt := range opts {
+				opt(req)
+			}
+			if got := req.Header.Get("Content-Type"); got != a.wantsContentType {
+				t.Errorf("[%d] got Content-Type %q, wants %q", count, got, a.wantsContentType)
+			}
+		}
 		if len(a.setOut) != 0 {
 			if err := json.Unmarshal(a.setOut, gotOut); err != nil {
 				t.Fatalf("[%d] error unmarshalling output: %v", count, err)
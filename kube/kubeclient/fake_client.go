@@ -6,6 +6,8 @@
 import (
 	"context"
 	"net"
+	"strconv"
+	"sync"
 
 	"tailscale.com/kube/kubeapi"
 )
@@ -15,6 +17,20 @@
 type FakeClient struct {
 	GetSecretImpl              func(context.Context, string) (*kubeapi.Secret, error)
 	CheckSecretPermissionsImpl func(ctx context.Context, name string) (bool, bool, error)
+	// ApplySecretImpl, if non-nil, is called by ApplySecret.
+	ApplySecretImpl func(ctx context.Context, name string, s *kubeapi.Secret, fieldManager string) error
+	// ListSecretsImpl, if non-nil, is called by ListSecrets, and so by
+	// GetSecretByLabels. If nil, no secrets are listed.
+	ListSecretsImpl func(ctx context.Context, labels map[string]string) (*kubeapi.SecretList, error)
+
+	// ResourceVersion is the resourceVersion that CompareAndSwapSecret
+	// treats as current. Calls that expect a different or empty version,
+	// or any version while it's empty, report a conflict. Successful calls
+	// replace it with a new, numeric version. Tests can set it to simulate
+	// concurrent modifications.
+	ResourceVersion string
+
+	mu sync.Mutex // guards ResourceVersion during CompareAndSwapSecret
 }
 
 func (fc *FakeClient) CheckSecretPermissions(ctx context.Context, name string) (bool, bool, error) {
@@ -23,12 +39,27 @@ func (fc *FakeClient) CheckSecretPermissions(ctx context.Context, name string) (
 func (fc *FakeClient) GetSecret(ctx context.Context, name string) (*kubeapi.Secret, error) {
 	return fc.GetSecretImpl(ctx, name)
 }
+func (fc *FakeClient) ListSecrets(ctx context.Context, labels map[string]string) (*kubeapi.SecretList, error) {
+	if fc.ListSecretsImpl == nil {
+		return &kubeapi.SecretList{}, nil
+	}
+	return fc.ListSecretsImpl(ctx, labels)
+}
+func (fc *FakeClient) GetSecretByLabels(ctx context.Context, labels map[string]string) (*kubeapi.Secret, error) {
+	return secretByLabels(ctx, fc, labels)
+}
 func (fc *FakeClient) SetURL(_ string) {}
 func (fc *FakeClient) SetDialer(dialer func(ctx context.Context, network, addr string) (net.Conn, error)) {
 }
 func (fc *FakeClient) StrategicMergePatchSecret(context.Context, string, *kubeapi.Secret, string) error {
 	return nil
 }
+func (fc *FakeClient) ApplySecret(ctx context.Context, name string, s *kubeapi.Secret, fieldManager string) error {
+	if fc.ApplySecretImpl == nil {
+		return nil
+	}
+	return fc.ApplySecretImpl(ctx, name, s, fieldManager)
+}
 func (fc *FakeClient) Event(context.Context, string, string, string) error {
 	return nil
 }
@@ -37,4 +68,16 @@ func (fc *FakeClient) JSONPatchResource(context.Context, string, string, []JSONP
 	return nil
 }
 func (fc *FakeClient) UpdateSecret(context.Context, *kubeapi.Secret) error { return nil }
+func (fc *FakeClient) CompareAndSwapSecret(_ context.Context, name, expectedResourceVersion string, s *kubeapi.Secret) (bool, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if expectedResourceVersion == "" || expectedResourceVersion != fc.ResourceVersion {
+		return false, nil
+	}
+	n, _ := strconv.Atoi(fc.ResourceVersion)
+	fc.ResourceVersion = strconv.Itoa(n + 1)
+	s.Name = name
+	s.ResourceVersion = fc.ResourceVersion
+	return true, nil
+}
 func (fc *FakeClient) CreateSecret(context.Context, *kubeapi.Secret) error { return nil }
@@ -190,7 +190,7 @@ type Logger struct {
 	url            string
 	lowMem         bool
 	skipClientTime bool
-	netMonitor     *netmon.Monitor
+	netMonitor     netmon.Observer // or nil
 	buffer         Buffer
 	drainWake      chan struct{}        // signal to speed up drain
 	drainBuf       []byte               // owned by drainPending for reuse
@@ -238,6 +238,11 @@ func (l *Logger) SetVerbosityLevel(level int) {
 // It should not be changed concurrently with log writes and should
 // only be set once.
 func (l *Logger) SetNetMon(lm *netmon.Monitor) {
+	if lm == nil {
+		// Don't store a non-nil Observer holding a nil *Monitor.
+		l.netMonitor = nil
+		return
+	}
 	l.netMonitor = lm
 }
 
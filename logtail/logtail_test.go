@@ -16,6 +16,8 @@
 
 	"github.com/go-json-experiment/json/jsontext"
 	"tailscale.com/envknob"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/netmon/netmontest"
 	"tailscale.com/tstest"
 	"tailscale.com/tstime"
 	"tailscale.com/util/must"
@@ -554,3 +556,32 @@ func BenchmarkWriteJSON(b *testing.B) {
 		must.Get(l.Write(testdataJSONLog))
 	}
 }
+
+func TestAwaitInternetUp(t *testing.T) {
+	fake := netmontest.NewFakeMonitor(&netmon.State{})
+	l := &Logger{stderr: io.Discard, netMonitor: fake}
+	if l.internetUp() {
+		t.Fatal("internetUp = true with no interfaces up")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.awaitInternetUp(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("awaitInternetUp returned while the network was down")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	fake.SetState(&netmon.State{HaveV4: true})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("awaitInternetUp didn't return after the network came up")
+	}
+	if !l.internetUp() {
+		t.Error("internetUp = false after the network came up")
+	}
+}
@@ -161,3 +161,37 @@ func (h *Histogram) PromExport(w io.Writer, name string) {
 	fmt.Fprintf(w, "%s_sum %v\n", name, &h.sum)
 	fmt.Fprintf(w, "%s_count %v\n", name, &h.count)
 }
+
+// WritePromHelp writes the Prometheus "# HELP" line for the named metric to
+// w, escaping backslashes and newlines in help as the exposition format
+// requires. It writes nothing if help is empty.
+func WritePromHelp(w io.Writer, name, help string) {
+	if help == "" {
+		return
+	}
+	io.WriteString(w, "# HELP ")
+	io.WriteString(w, name)
+	io.WriteString(w, " ")
+	WritePromHelpText(w, help)
+	io.WriteString(w, "\n")
+}
+
+// WritePromHelpText writes help to w, escaped as the text of a Prometheus
+// "# HELP" line, for use in other comment lines that are escaped the same
+// way.
+func WritePromHelpText(w io.Writer, help string) {
+	for {
+		i := strings.IndexAny(help, "\\\n")
+		if i == -1 {
+			break
+		}
+		io.WriteString(w, help[:i])
+		if help[i] == '\\' {
+			io.WriteString(w, `\\`)
+		} else {
+			io.WriteString(w, `\n`)
+		}
+		help = help[i+1:]
+	}
+	io.WriteString(w, help)
+}
@@ -111,13 +111,7 @@ func (v *MultiLabelMap[T]) WritePrometheus(w io.Writer, name string) {
 		io.WriteString(w, v.Type)
 		io.WriteString(w, "\n")
 	}
-	if v.Help != "" {
-		io.WriteString(w, "# HELP ")
-		io.WriteString(w, name)
-		io.WriteString(w, " ")
-		io.WriteString(w, v.Help)
-		io.WriteString(w, "\n")
-	}
+	WritePromHelp(w, name, v.Help)
 	v.mu.RLock()
 	defer v.mu.RUnlock()
 
@@ -283,6 +277,24 @@ func (v *MultiLabelMap[T]) Do(f func(KeyValue[T])) {
 	}
 }
 
+// DoLabeled is like Do, but passes f each entry's Prometheus-formatted label
+// string, such as `{reason="acl"}`, instead of its key. Unlike Do, it can be
+// used without knowing T.
+func (v *MultiLabelMap[T]) DoLabeled(f func(labels string, val expvar.Var)) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, e := range v.sorted {
+		f(e.labels, e.val)
+	}
+}
+
+// Len returns the number of entries (distinct label sets) in the map.
+func (v *MultiLabelMap[T]) Len() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return len(v.sorted)
+}
+
 // ResetAllForTest resets all values for metrics to zero.
 // Should only be used in tests.
 func (v *MultiLabelMap[T]) ResetAllForTest() {
@@ -114,6 +114,29 @@ type LabelTypes struct {
 	}
 }
 
+func TestMultiLabelMapHelpEscaping(t *testing.T) {
+	m := new(MultiLabelMap[L2])
+	m.Type = "counter"
+	m.Help = "first line\nsecond \\ line"
+	m.Add(L2{"a", "b"}, 1)
+	var buf bytes.Buffer
+	m.WritePrometheus(&buf, "metricname")
+	const want = `# TYPE metricname counter
+# HELP metricname first line\nsecond \\ line
+metricname{foo="a",bar="b"} 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	writeAllocs := testing.AllocsPerRun(1000, func() {
+		m.WritePrometheus(io.Discard, "test")
+	})
+	if writeAllocs > 0 {
+		t.Errorf("writeAllocs = %v; want 0", writeAllocs)
+	}
+}
+
 func BenchmarkMultiLabelWriteAllocs(b *testing.B) {
 	b.ReportAllocs()
 
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netmon
+
+import "time"
+
+// SetBurstWindow sets how long the Monitor gathers network changes into a
+// single ChangeDelta before notifying the callbacks. With a non-zero
+// window, the first change starts a burst, and once the window has passed
+// the callbacks are notified once, with a delta from the state before the
+// burst to the current state (see ChangeDelta.merge). Its Major and
+// MajorReasons describe that net change.
+//
+// Unlike with Pause, a burst that ends up back at the state it started
+// from is still delivered, with ChurnedButNetNoChange set, for callers
+// that care whether anything changed and reverted.
+//
+// The default window is zero, delivering each change as it's seen.
+// Setting it to zero delivers any burst in progress right away.
+func (m *Monitor) SetBurstWindow(d time.Duration) {
+	if m.static {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.burstWindow = d
+	if d <= 0 {
+		m.endBurstLocked()
+	}
+}
+
+// addToBurstLocked merges d into the current burst, starting one that ends
+// after m.burstWindow if there's none.
+//
+// m.mu must be held.
+func (m *Monitor) addToBurstLocked(d *ChangeDelta) {
+	if m.burstD != nil {
+		*d = m.burstD.merge(*d)
+		m.burstD = d
+		return
+	}
+	m.burstD = d
+	var t *time.Timer
+	t = time.AfterFunc(m.burstWindow, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.burstTimer == t && !m.closed {
+			m.endBurstLocked()
+		}
+	})
+	m.burstTimer = t
+}
+
+// endBurstLocked ends the current burst, if any, and notifies the callbacks
+// of its merged changes. If notifications are paused, the burst's changes
+// are kept for Resume instead.
+//
+// m.mu must be held.
+func (m *Monitor) endBurstLocked() {
+	if m.burstTimer != nil {
+		m.burstTimer.Stop()
+		m.burstTimer = nil
+	}
+	d := m.burstD
+	m.burstD = nil
+	if d == nil {
+		return
+	}
+	m.setMajorReasons(d)
+	if m.paused {
+		if m.pausedD != nil {
+			*d = d.merge(*m.pausedD)
+		}
+		m.pausedD = d
+		return
+	}
+	m.notifyLocked(d)
+}
@@ -0,0 +1,28 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// On Android and iOS, /etc/resolv.conf doesn't reflect the resolvers
+// that apps use (or can't be read), so they're not reported there.
+
+//go:build (linux && !android) || (darwin && !ios) || freebsd || openbsd
+
+package netmon
+
+import (
+	"net/netip"
+	"os"
+)
+
+func init() {
+	getDNSResolvers = getResolvConfNameservers
+}
+
+// getResolvConfNameservers returns the nameservers in /etc/resolv.conf.
+// On macOS, the file is generated from the system's DNS configuration.
+func getResolvConfNameservers() []netip.Addr {
+	b, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	return parseResolvConfNameservers(b)
+}
@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netmon
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
+)
+
+// FlapConfig configures how a Monitor detects flapping interfaces: ones that
+// are repeatedly added and removed, such as by a bad cable or marginal Wi-Fi.
+// Each round of rebinding for those can hurt connectivity more than it helps.
+type FlapConfig struct {
+	// Threshold is the number of interface events (see InterfaceEvent) for
+	// a single interface within Window above which the interface is
+	// considered flapping. Zero disables flap detection.
+	Threshold int
+
+	// Window is the period over which interface events are counted.
+	Window time.Duration
+
+	// Cooldown, if non-zero, is how long interface events for a flapping
+	// interface are withheld from the interface event callbacks once the
+	// flapping is detected. If zero, flapping is only logged and counted.
+	// Network changes that only add or remove such interfaces are withheld
+	// from the change callbacks too.
+	//
+	// The last withheld event for an interface is delivered along with the
+	// first network change after the cooldown ends, if it differs from the
+	// last event delivered for that interface, so that callbacks end up with
+	// the interface's current state. Likewise, that change's ChangeDelta
+	// goes from the New state of the last one delivered.
+	Cooldown time.Duration
+}
+
+// DefaultFlapConfig is the FlapConfig of a new Monitor. It reports flapping
+// but doesn't damp it.
+var DefaultFlapConfig = FlapConfig{
+	Threshold: 6,
+	Window:    time.Minute,
+}
+
+var (
+	metricIfaceFlap       = clientmetric.NewCounter("netmon_iface_flap")
+	metricIfaceFlapDamped = clientmetric.NewCounter("netmon_iface_flap_damped_events")
+)
+
+// ifaceFlaps is the flap detection state of one interface.
+type ifaceFlaps struct {
+	events      []time.Time     // times of the interface's events in the window
+	flapping    bool            // whether the interface was last seen flapping
+	dampedUntil time.Time       // end of the cooldown, or zero if not damped
+	pending     *InterfaceEvent // last event withheld during the cooldown, or nil
+	sent        bool            // whether an event for the interface was delivered
+	lastAdded   bool            // the Added field of the last event delivered
+}
+
+// SetFlapConfig replaces the Monitor's flap detection settings, which are
+// DefaultFlapConfig by default. It may be called at any time; the counts of
+// recent events are kept.
+func (m *Monitor) SetFlapConfig(c FlapConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flapConf = &c
+}
+
+// flapConfigLocked returns the Monitor's flap detection settings.
+//
+// m.mu must be held.
+func (m *Monitor) flapConfigLocked() FlapConfig {
+	if m.flapConf == nil {
+		return DefaultFlapConfig
+	}
+	return *m.flapConf
+}
+
+// dampFlappingLocked records evs, the interface events of a network change,
+// for flap detection, and returns those that should be delivered to the
+// interface event callbacks: the withheld events of interfaces whose
+// cooldown has ended, followed by those in evs that aren't being damped.
+//
+// m.mu must be held.
+func (m *Monitor) dampFlappingLocked(evs []InterfaceEvent) []InterfaceEvent {
+	c := m.flapConfigLocked()
+	if c.Threshold <= 0 {
+		m.flaps = nil
+		return evs
+	}
+	now := m.now()
+
+	var ret []InterfaceEvent
+	changed := make(map[string]bool, len(evs))
+	for _, ev := range evs {
+		changed[ev.Name] = true
+	}
+	for _, name := range slices.Sorted(maps.Keys(m.flaps)) {
+		f := m.flaps[name]
+		if f.pending == nil || changed[name] || now.Before(f.dampedUntil) {
+			continue
+		}
+		if !f.sent || f.pending.Added != f.lastAdded {
+			ret = append(ret, *f.pending)
+			f.sent, f.lastAdded = true, f.pending.Added
+		}
+		f.pending = nil
+	}
+
+	for _, ev := range evs {
+		f := m.flaps[ev.Name]
+		if f == nil {
+			f = new(ifaceFlaps)
+			mak.Set(&m.flaps, ev.Name, f)
+		}
+		i := 0
+		for i < len(f.events) && now.Sub(f.events[i]) >= c.Window {
+			i++
+		}
+		f.events = append(f.events[i:], now)
+
+		if now.Before(f.dampedUntil) {
+			metricIfaceFlapDamped.Add(1)
+			f.pending = &ev
+			continue
+		}
+		f.pending = nil // superseded by ev
+		switch flapping := len(f.events) > c.Threshold; {
+		case !flapping:
+			f.flapping = false
+		case !f.flapping:
+			f.flapping = true
+			metricIfaceFlap.Add(1)
+			m.logf("interface %q is flapping (%d changes in %v)", ev.Name, len(f.events), c.Window)
+			if c.Cooldown > 0 {
+				f.dampedUntil = now.Add(c.Cooldown)
+			}
+		case c.Cooldown > 0:
+			// Still flapping after the cooldown; damp it again.
+			f.dampedUntil = now.Add(c.Cooldown)
+		}
+		ret = append(ret, ev)
+		f.sent, f.lastAdded = true, ev.Added
+	}
+
+	// Forget interfaces that have been quiet for a whole window.
+	for name, f := range m.flaps {
+		if f.pending == nil && len(f.events) > 0 && now.Sub(f.events[len(f.events)-1]) >= c.Window {
+			delete(m.flaps, name)
+		}
+	}
+	return ret
+}
+
+// isDampedChangeLocked reports whether d, a network change whose interface
+// events are evs, should be withheld from the change callbacks: it has
+// events, dampFlappingLocked withheld all of them, and adding or removing
+// those interfaces is all that makes it major.
+//
+// m.mu must be held.
+func (m *Monitor) isDampedChangeLocked(d *ChangeDelta, evs []InterfaceEvent) bool {
+	if len(evs) == 0 || d.TimeJumped {
+		return false
+	}
+	for _, r := range d.MajorReasons {
+		if r != "interface-added" && r != "interface-removed" {
+			return false
+		}
+	}
+	now := m.now()
+	for _, ev := range evs {
+		f := m.flaps[ev.Name]
+		if f == nil || f.pending == nil || !now.Before(f.dampedUntil) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netmon
+
+// InterfaceMetadata is what a MetadataProvider knows about a network
+// interface beyond what Go's net package reports.
+type InterfaceMetadata struct {
+	// Type is the type of the interface, or InterfaceTypeUnknown to leave
+	// it to ClassifyInterface.
+	Type InterfaceType
+
+	// Expensive is whether traffic on the interface costs the user, such
+	// as on a cellular link or a metered Wi-Fi hotspot.
+	Expensive bool
+
+	// Signal is the strength of the interface's radio signal, from 1
+	// (weakest) to 100 (strongest), or 0 if unknown or not applicable.
+	Signal int
+}
+
+// MetadataProvider supplies InterfaceMetadata from platform code, such as
+// cgo or syscall code that asks the OS about its interfaces' types and
+// costs, which can't be done portably in pure Go.
+type MetadataProvider interface {
+	// InterfaceMetadata returns what the provider knows about iface, or
+	// the zero value if it knows nothing.
+	//
+	// It's called for each interface whenever the State is computed, so
+	// it should be quick, and it must be safe for concurrent use.
+	InterfaceMetadata(iface Interface) InterfaceMetadata
+}
+
+// noopMetadataProvider is the default MetadataProvider. It knows nothing.
+type noopMetadataProvider struct{}
+
+func (noopMetadataProvider) InterfaceMetadata(Interface) InterfaceMetadata {
+	return InterfaceMetadata{}
+}
+
+var metadataProvider MetadataProvider = noopMetadataProvider{}
+
+// RegisterMetadataProvider sets the MetadataProvider that GetState consults
+// for each interface. A nil p restores the default, which knows nothing.
+//
+// It's meant to be called once, early, by platform code.
+func RegisterMetadataProvider(p MetadataProvider) {
+	if p == nil {
+		p = noopMetadataProvider{}
+	}
+	metadataProvider = p
+}
+
+// classifyWithMetadata returns ni with its Type, Expensive and Signal
+// fields set from the registered MetadataProvider, falling back to
+// ClassifyInterface for the type.
+func classifyWithMetadata(ni Interface) Interface {
+	md := metadataProvider.InterfaceMetadata(ni)
+	ni.Type = md.Type
+	if ni.Type == InterfaceTypeUnknown {
+		ni.Type = ClassifyInterface(ni)
+	}
+	ni.Expensive = md.Expensive
+	ni.Signal = md.Signal
+	return ni
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netmon
+
+import (
+	"net"
+	"testing"
+
+	"tailscale.com/tstest"
+)
+
+// fakeMetadataProvider labels the interfaces named in expensive as
+// expensive cellular links with the given signal strength.
+type fakeMetadataProvider struct {
+	expensive map[string]bool
+	signal    int
+}
+
+func (p fakeMetadataProvider) InterfaceMetadata(iface Interface) InterfaceMetadata {
+	if !p.expensive[iface.Name] {
+		return InterfaceMetadata{}
+	}
+	return InterfaceMetadata{Type: InterfaceTypeCellular, Expensive: true, Signal: p.signal}
+}
+
+func TestMetadataProvider(t *testing.T) {
+	// Include the real default route interface, if any, so GetState's
+	// IsExpensive can be checked too.
+	dr, _ := DefaultRoute()
+	names := []string{"wlan0", "modem0"}
+	if dr.InterfaceName != "" {
+		names = append(names, dr.InterfaceName)
+	}
+	tstest.Replace(t, &altNetInterfaces, func() ([]Interface, error) {
+		var ifs []Interface
+		for i, name := range names {
+			ifs = append(ifs, Interface{
+				Interface: &net.Interface{Index: 100 + i, Name: name, Flags: net.FlagUp},
+				AltAddrs:  []net.Addr{},
+			})
+		}
+		return ifs, nil
+	})
+	t.Cleanup(func() { RegisterMetadataProvider(nil) })
+
+	// The default provider knows nothing.
+	s, err := GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Interface["modem0"]; got.Type != InterfaceTypeUnknown || got.Expensive || got.Signal != 0 {
+		t.Errorf("modem0 without provider = type %v, expensive %v, signal %d; want unknown, false, 0", got.Type, got.Expensive, got.Signal)
+	}
+	if s.IsExpensive {
+		t.Error("IsExpensive set without provider")
+	}
+
+	expensive := map[string]bool{"modem0": true, dr.InterfaceName: true}
+	RegisterMetadataProvider(fakeMetadataProvider{expensive: expensive, signal: 42})
+	s2, err := GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s2.Interface["modem0"]; got.Type != InterfaceTypeCellular || !got.Expensive || got.Signal != 42 {
+		t.Errorf("modem0 = type %v, expensive %v, signal %d; want cellular, true, 42", got.Type, got.Expensive, got.Signal)
+	}
+	if got := s2.Interface["wlan0"]; got.Type != InterfaceTypeWiFi || got.Expensive {
+		t.Errorf("wlan0 = type %v, expensive %v; want wifi from its name, false", got.Type, got.Expensive)
+	}
+	if dr.InterfaceName != "" && !s2.IsExpensive {
+		t.Errorf("IsExpensive = false with default route interface %q reported expensive", dr.InterfaceName)
+	}
+	if s.Equal(s2) {
+		t.Error("states differing in interface metadata are Equal")
+	}
+
+	// Signal alone doesn't make states differ.
+	RegisterMetadataProvider(fakeMetadataProvider{expensive: expensive, signal: 7})
+	s3, err := GetState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s2.Equal(s3) {
+		t.Error("states differing only in Signal aren't Equal")
+	}
+}
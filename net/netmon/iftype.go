@@ -0,0 +1,179 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netmon
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// InterfaceType is a best-effort classification of the kind of link a
+// network interface is on.
+type InterfaceType uint8
+
+const (
+	InterfaceTypeUnknown InterfaceType = iota
+	InterfaceTypeLoopback
+	InterfaceTypeEthernet
+	InterfaceTypeWiFi
+	InterfaceTypeCellular
+	InterfaceTypeTunnel
+)
+
+func (t InterfaceType) String() string {
+	switch t {
+	case InterfaceTypeLoopback:
+		return "loopback"
+	case InterfaceTypeEthernet:
+		return "ethernet"
+	case InterfaceTypeWiFi:
+		return "wifi"
+	case InterfaceTypeCellular:
+		return "cellular"
+	case InterfaceTypeTunnel:
+		return "tunnel"
+	}
+	return "unknown"
+}
+
+// interfaceTypeHint, if non-nil, is a platform-specific function that
+// returns the type the OS reports for the named interface, or
+// InterfaceTypeUnknown if it doesn't know.
+var interfaceTypeHint func(name string) InterfaceType
+
+// interfaceNameTypes maps lower-case interface name prefixes to the type of
+// interface that conventionally has that name. More specific prefixes come
+// first.
+var interfaceNameTypes = []struct {
+	prefix string
+	typ    InterfaceType
+}{
+	// Cellular modems: Linux (wwan0, wwp0s20u4), Android (rmnet_data0,
+	// ccmni0, and the v4-rmnet_data0 CLAT interface) and iOS (pdp_ip0).
+	{"wwan", InterfaceTypeCellular},
+	{"wwp", InterfaceTypeCellular},
+	{"rmnet", InterfaceTypeCellular},
+	{"rev_rmnet", InterfaceTypeCellular},
+	{"v4-rmnet", InterfaceTypeCellular},
+	{"ccmni", InterfaceTypeCellular},
+	{"pdp_ip", InterfaceTypeCellular},
+	{"cellular", InterfaceTypeCellular},         // Windows
+	{"mobile broadband", InterfaceTypeCellular}, // Windows
+
+	// Wi-Fi: Linux (wlan0, wlp3s0, wlo1, wlx00c0ca...) and Windows.
+	{"wlan", InterfaceTypeWiFi},
+	{"wlp", InterfaceTypeWiFi},
+	{"wlo", InterfaceTypeWiFi},
+	{"wlx", InterfaceTypeWiFi},
+	{"wifi", InterfaceTypeWiFi},
+	{"wi-fi", InterfaceTypeWiFi},
+
+	// Wired: Linux (eth0, enp3s0, eno1, ens18, enx00e04c...) and Windows.
+	// On macOS, en0 may also be Wi-Fi; without an OS hint we can't tell.
+	{"eth", InterfaceTypeEthernet},
+	{"en", InterfaceTypeEthernet},
+}
+
+// ClassifyInterfaceName guesses the type of an interface from its name
+// alone, using the naming conventions of the common operating systems.
+// It returns InterfaceTypeUnknown if the name doesn't follow any of them.
+func ClassifyInterfaceName(name string) InterfaceType {
+	name = strings.ToLower(name)
+	if name == "lo" || strings.HasPrefix(name, "lo0") || strings.HasPrefix(name, "loopback") {
+		return InterfaceTypeLoopback
+	}
+	if strings.HasPrefix(name, "tailscale") {
+		return InterfaceTypeTunnel
+	}
+	for _, p := range otherVPNInterfacePrefixes {
+		if strings.HasPrefix(name, p) {
+			return InterfaceTypeTunnel
+		}
+	}
+	for _, nt := range interfaceNameTypes {
+		if strings.HasPrefix(name, nt.prefix) {
+			return nt.typ
+		}
+	}
+	return InterfaceTypeUnknown
+}
+
+// classifyInterfaceDesc guesses the type of an interface from its
+// description (its adapter name on Windows), or returns
+// InterfaceTypeUnknown.
+func classifyInterfaceDesc(desc string) InterfaceType {
+	desc = strings.ToLower(desc)
+	has := func(subs ...string) bool {
+		return slices.ContainsFunc(subs, func(s string) bool { return strings.Contains(desc, s) })
+	}
+	switch {
+	case desc == "":
+		return InterfaceTypeUnknown
+	case has("wintun", "wireguard", "tap-windows", "tailscale"):
+		return InterfaceTypeTunnel
+	case has("mobile broadband", "cellular", "wwan"):
+		return InterfaceTypeCellular
+	case has("wi-fi", "wireless", "802.11", "wlan"):
+		return InterfaceTypeWiFi
+	case has("ethernet", "gbe"):
+		return InterfaceTypeEthernet
+	}
+	return InterfaceTypeUnknown
+}
+
+// ClassifyInterface returns the best-effort type of iface. It prefers what
+// the OS reports, where supported, and otherwise guesses from the
+// interface's description and name.
+func ClassifyInterface(iface Interface) InterfaceType {
+	if iface.Interface == nil {
+		return InterfaceTypeUnknown
+	}
+	if iface.IsLoopback() {
+		return InterfaceTypeLoopback
+	}
+	if interfaceTypeHint != nil {
+		if t := interfaceTypeHint(iface.Name); t != InterfaceTypeUnknown {
+			return t
+		}
+	}
+	if t := classifyInterfaceDesc(iface.Desc); t != InterfaceTypeUnknown {
+		return t
+	}
+	return ClassifyInterfaceName(iface.Name)
+}
+
+// DefaultRouteInterfaceType returns the type of the interface with the
+// default route, or InterfaceTypeUnknown if it's not known.
+func (s *State) DefaultRouteInterfaceType() InterfaceType {
+	if s == nil || s.DefaultRouteInterface == "" {
+		return InterfaceTypeUnknown
+	}
+	return s.Interface[s.DefaultRouteInterface].Type
+}
+
+// InterfaceTypeChange describes an interface whose type changed.
+type InterfaceTypeChange struct {
+	Name     string
+	Old, New InterfaceType
+}
+
+// InterfaceTypeChanges returns the interfaces present in both d.Old and
+// d.New whose Type differs between them, sorted by name. It returns nil if
+// d.Old is nil.
+func (d *ChangeDelta) InterfaceTypeChanges() []InterfaceTypeChange {
+	if d.Old == nil || d.New == nil {
+		return nil
+	}
+	var changes []InterfaceTypeChange
+	for name, i := range d.Old.Interface {
+		i2, ok := d.New.Interface[name]
+		if !ok || i.Type == i2.Type {
+			continue
+		}
+		changes = append(changes, InterfaceTypeChange{Name: name, Old: i.Type, New: i2.Type})
+	}
+	slices.SortFunc(changes, func(a, b InterfaceTypeChange) int { return cmp.Compare(a.Name, b.Name) })
+	return changes
+}
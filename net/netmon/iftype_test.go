@@ -0,0 +1,126 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netmon
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tstest"
+)
+
+func TestClassifyInterfaceName(t *testing.T) {
+	tests := []struct {
+		name string
+		want InterfaceType
+	}{
+		{"lo", InterfaceTypeLoopback},
+		{"lo0", InterfaceTypeLoopback},
+		{"Loopback Pseudo-Interface 1", InterfaceTypeLoopback},
+		{"eth0", InterfaceTypeEthernet},
+		{"enp3s0", InterfaceTypeEthernet},
+		{"eno1", InterfaceTypeEthernet},
+		{"ens18", InterfaceTypeEthernet},
+		{"en0", InterfaceTypeEthernet},
+		{"Ethernet 2", InterfaceTypeEthernet},
+		{"wlan0", InterfaceTypeWiFi},
+		{"wlp2s0", InterfaceTypeWiFi},
+		{"wlx00c0ca123456", InterfaceTypeWiFi},
+		{"Wi-Fi", InterfaceTypeWiFi},
+		{"wwan0", InterfaceTypeCellular},
+		{"wwp0s20u4i6", InterfaceTypeCellular},
+		{"rmnet_data0", InterfaceTypeCellular},
+		{"v4-rmnet_data0", InterfaceTypeCellular},
+		{"ccmni1", InterfaceTypeCellular},
+		{"pdp_ip0", InterfaceTypeCellular},
+		{"Cellular", InterfaceTypeCellular},
+		{"tailscale0", InterfaceTypeTunnel},
+		{"utun3", InterfaceTypeTunnel},
+		{"tun0", InterfaceTypeTunnel},
+		{"wg0", InterfaceTypeTunnel},
+		{"docker0", InterfaceTypeUnknown},
+		{"bridge0", InterfaceTypeUnknown},
+		{"", InterfaceTypeUnknown},
+	}
+	for _, tt := range tests {
+		if got := ClassifyInterfaceName(tt.name); got != tt.want {
+			t.Errorf("ClassifyInterfaceName(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyInterface(t *testing.T) {
+	tstest.Replace(t, &interfaceTypeHint, func(name string) InterfaceType {
+		if name == "hinted" {
+			return InterfaceTypeCellular
+		}
+		return InterfaceTypeUnknown
+	})
+	tests := []struct {
+		name  string
+		iface Interface
+		want  InterfaceType
+	}{
+		{"nil", Interface{}, InterfaceTypeUnknown},
+		{"loopback-flag", Interface{Interface: &net.Interface{Name: "foo", Flags: net.FlagLoopback}}, InterfaceTypeLoopback},
+		{"hint", Interface{Interface: &net.Interface{Name: "hinted"}}, InterfaceTypeCellular},
+		{"hint-beats-name", Interface{Interface: &net.Interface{Name: "hinted"}, Desc: "Intel(R) Wi-Fi 6 AX201"}, InterfaceTypeCellular},
+		{"desc-wifi", Interface{Interface: &net.Interface{Name: "Local Area Connection"}, Desc: "Intel(R) Wi-Fi 6 AX201 160MHz"}, InterfaceTypeWiFi},
+		{"desc-cellular", Interface{Interface: &net.Interface{Name: "Local Area Connection"}, Desc: "Generic Mobile Broadband Adapter"}, InterfaceTypeCellular},
+		{"desc-tunnel", Interface{Interface: &net.Interface{Name: "Local Area Connection"}, Desc: "WireGuard Tunnel"}, InterfaceTypeTunnel},
+		{"desc-ethernet", Interface{Interface: &net.Interface{Name: "Local Area Connection"}, Desc: "Realtek PCIe GbE Family Controller"}, InterfaceTypeEthernet},
+		{"name", Interface{Interface: &net.Interface{Name: "wlan0"}}, InterfaceTypeWiFi},
+		{"unknown", Interface{Interface: &net.Interface{Name: "Local Area Connection"}}, InterfaceTypeUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyInterface(tt.iface); got != tt.want {
+				t.Errorf("ClassifyInterface = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterfaceTypeChanges(t *testing.T) {
+	st := func(types map[string]InterfaceType) *State {
+		s := &State{Interface: map[string]Interface{}}
+		for name, typ := range types {
+			s.Interface[name] = Interface{Interface: &net.Interface{Name: name}, Type: typ}
+		}
+		return s
+	}
+	old := st(map[string]InterfaceType{
+		"en0":   InterfaceTypeEthernet,
+		"en1":   InterfaceTypeUnknown,
+		"wlan0": InterfaceTypeWiFi,
+		"gone0": InterfaceTypeWiFi,
+	})
+	cur := st(map[string]InterfaceType{
+		"en0":   InterfaceTypeWiFi,
+		"en1":   InterfaceTypeEthernet,
+		"wlan0": InterfaceTypeWiFi,
+		"new0":  InterfaceTypeCellular,
+	})
+
+	d := &ChangeDelta{Old: old, New: cur}
+	want := []InterfaceTypeChange{
+		{Name: "en0", Old: InterfaceTypeEthernet, New: InterfaceTypeWiFi},
+		{Name: "en1", Old: InterfaceTypeUnknown, New: InterfaceTypeEthernet},
+	}
+	if got := d.InterfaceTypeChanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("InterfaceTypeChanges = %v; want %v", got, want)
+	}
+	if got := (&ChangeDelta{New: cur}).InterfaceTypeChanges(); got != nil {
+		t.Errorf("InterfaceTypeChanges with nil Old = %v; want nil", got)
+	}
+	if old.Equal(st(map[string]InterfaceType{"en0": InterfaceTypeWiFi, "en1": InterfaceTypeUnknown, "wlan0": InterfaceTypeWiFi, "gone0": InterfaceTypeWiFi})) {
+		t.Error("states differing only in an interface's Type are Equal")
+	}
+
+	cur.DefaultRouteInterface = "en0"
+	if got := cur.DefaultRouteInterfaceType(); got != InterfaceTypeWiFi {
+		t.Errorf("DefaultRouteInterfaceType = %v; want %v", got, InterfaceTypeWiFi)
+	}
+}
@@ -15,6 +15,7 @@
 	"net"
 	"net/netip"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 
@@ -28,6 +29,7 @@
 
 func init() {
 	likelyHomeRouterIP = likelyHomeRouterIPLinux
+	interfaceTypeHint = interfaceTypeLinux
 }
 
 var procNetRouteErr atomic.Bool
@@ -253,3 +255,35 @@ func defaultRouteInterfaceProcNet() (string, error) {
 	}
 	return rc, err
 }
+
+var sysClassNetPath = "/sys/class/net"
+
+// interfaceTypeLinux returns the type of the named interface according to
+// sysfs, or InterfaceTypeUnknown.
+func interfaceTypeLinux(name string) InterfaceType {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return InterfaceTypeUnknown
+	}
+	dir := filepath.Join(sysClassNetPath, name)
+	if _, err := os.Stat(filepath.Join(dir, "wireless")); err == nil {
+		return InterfaceTypeWiFi
+	}
+	if _, err := os.Stat(filepath.Join(dir, "phy80211")); err == nil {
+		return InterfaceTypeWiFi
+	}
+	if uevent, err := os.ReadFile(filepath.Join(dir, "uevent")); err == nil {
+		for _, line := range strings.Split(string(uevent), "\n") {
+			switch strings.TrimSpace(line) {
+			case "DEVTYPE=wlan":
+				return InterfaceTypeWiFi
+			case "DEVTYPE=wwan":
+				return InterfaceTypeCellular
+			}
+		}
+	}
+	// ARPHRD_NONE (65534) is used by layer 3 tun devices.
+	if typ, err := os.ReadFile(filepath.Join(dir, "type")); err == nil && strings.TrimSpace(string(typ)) == "65534" {
+		return InterfaceTypeTunnel
+	}
+	return InterfaceTypeUnknown
+}
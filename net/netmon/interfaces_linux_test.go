@@ -114,3 +114,45 @@ func TestRouteLinuxNetlink(t *testing.T) {
 	}
 	t.Logf("Got: %+v", d)
 }
+
+func TestInterfaceTypeLinux(t *testing.T) {
+	dir := t.TempDir()
+	tstest.Replace(t, &sysClassNetPath, dir)
+	write := func(iface, file, content string) {
+		t.Helper()
+		p := filepath.Join(dir, iface, file)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if content == "" {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("wlan0", "wireless", "")
+	write("wlan0", "type", "1\n")
+	write("wifi1", "uevent", "DEVTYPE=wlan\nINTERFACE=wifi1\nIFINDEX=3\n")
+	write("modem0", "uevent", "DEVTYPE=wwan\nINTERFACE=modem0\n")
+	write("vpn0", "type", "65534\n")
+	write("eth0", "type", "1\n")
+
+	tests := map[string]InterfaceType{
+		"wlan0":  InterfaceTypeWiFi,
+		"wifi1":  InterfaceTypeWiFi,
+		"modem0": InterfaceTypeCellular,
+		"vpn0":   InterfaceTypeTunnel,
+		"eth0":   InterfaceTypeUnknown, // left to the name heuristics
+		"none0":  InterfaceTypeUnknown,
+		"..":     InterfaceTypeUnknown,
+	}
+	for name, want := range tests {
+		if got := interfaceTypeLinux(name); got != want {
+			t.Errorf("interfaceTypeLinux(%q) = %v; want %v", name, got, want)
+		}
+	}
+}
@@ -7,6 +7,8 @@
 	"encoding/json"
 	"net"
 	"net/netip"
+	"reflect"
+	"slices"
 	"testing"
 
 	"tailscale.com/tstest"
@@ -273,6 +275,21 @@ func TestStateString(t *testing.T) {
 			},
 			want: `interfaces.State{defaultRoute=foo (a foo thing) ifs={foo:[]} v4=false v6=false}`,
 		},
+		{
+			name: "default_type",
+			s: &State{
+				DefaultRouteInterface: "wlan0",
+				Interface: map[string]Interface{
+					"wlan0": {
+						Type: InterfaceTypeWiFi,
+						Interface: &net.Interface{
+							Flags: net.FlagUp,
+						},
+					},
+				},
+			},
+			want: `interfaces.State{defaultRoute=wlan0 type=wifi ifs={wlan0:[]} v4=false v6=false}`,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -370,6 +387,19 @@ func TestEqual(t *testing.T) {
 			want: false,
 		},
 
+		{
+			name: "dns-resolvers-changed",
+			s1: &State{
+				DefaultRouteInterface: "foo",
+				DNSResolvers:          []netip.Addr{netip.MustParseAddr("192.168.1.1")},
+			},
+			s2: &State{
+				DefaultRouteInterface: "foo",
+				DNSResolvers:          []netip.Addr{netip.MustParseAddr("192.168.1.1"), netip.MustParseAddr("192.168.1.2")},
+			},
+			want: false,
+		},
+
 		// See tailscale/corp#19124
 		{
 			name: "interface-removed",
@@ -398,6 +428,136 @@ func TestEqual(t *testing.T) {
 			if got := tt.s2.Equal(tt.s1); got != tt.want {
 				t.Errorf("Equal = %v; want %v", got, tt.want)
 			}
+			if (tt.s1 == nil) != (tt.s2 == nil) {
+				return // Diff treats nil as empty
+			}
+			if got := tt.s1.Diff(tt.s2).IsZero(); got != tt.want {
+				t.Errorf("Diff(...).IsZero() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateDiff(t *testing.T) {
+	iface := func(name string, index int, flags net.Flags) Interface {
+		return Interface{Interface: &net.Interface{Name: name, Index: index, MTU: 1500, Flags: flags}}
+	}
+	pfxs := func(addrs ...string) (ret []netip.Prefix) {
+		for _, addr := range addrs {
+			ret = append(ret, netip.MustParsePrefix(addr))
+		}
+		return ret
+	}
+	up := net.FlagUp | net.FlagBroadcast | net.FlagMulticast
+
+	// Before and after turning on another VPN: it adds its interface and
+	// takes over the default route and DNS, and Wi-Fi gets a new address.
+	before := &State{
+		Interface: map[string]Interface{
+			"eth0":  iface("eth0", 1, up),
+			"wlan0": iface("wlan0", 2, up),
+			"usb0":  iface("usb0", 3, up),
+		},
+		InterfaceIPs: map[string][]netip.Prefix{
+			"eth0":  pfxs("10.0.0.2/24"),
+			"wlan0": pfxs("192.168.1.5/24", "fe80::1/64"),
+			"usb0":  pfxs("172.16.0.2/24"),
+		},
+		HaveV4:                true,
+		DefaultRouteInterface: "wlan0",
+		DNSResolvers:          []netip.Addr{netip.MustParseAddr("192.168.1.1")},
+	}
+	after := &State{
+		Interface: map[string]Interface{
+			"eth0":  iface("eth0", 1, up&^net.FlagUp),
+			"wlan0": iface("wlan0", 2, up),
+			"wg0":   iface("wg0", 4, net.FlagUp|net.FlagPointToPoint),
+		},
+		InterfaceIPs: map[string][]netip.Prefix{
+			"eth0":  pfxs("10.0.0.2/24"),
+			"wlan0": pfxs("192.168.1.6/24", "fe80::1/64"),
+			"wg0":   pfxs("10.8.0.2/32"),
+		},
+		HaveV4:                true,
+		DefaultRouteInterface: "wg0",
+		DNSResolvers:          []netip.Addr{netip.MustParseAddr("10.8.0.1")},
+		HasOtherVPN:           true,
+	}
+	want := StateDiff{
+		Added:   []string{"wg0"},
+		Removed: []string{"usb0"},
+		Modified: []InterfaceDiff{
+			{Name: "eth0", Changed: true, FlagsChanged: net.FlagUp},
+			{Name: "wlan0", AddrsAdded: pfxs("192.168.1.6/24"), AddrsRemoved: pfxs("192.168.1.5/24")},
+		},
+		Fields: []string{"DefaultRouteInterface", "DNSResolvers", "HasOtherVPN"},
+	}
+	if got := before.Diff(after); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff:\n got %+v\nwant %+v", got, want)
+	}
+
+	// The other way around, added and removed swap.
+	back := after.Diff(before)
+	if !slices.Equal(back.Added, []string{"usb0"}) || !slices.Equal(back.Removed, []string{"wg0"}) {
+		t.Errorf("reverse Diff: Added %q, Removed %q; want [usb0], [wg0]", back.Added, back.Removed)
+	}
+	if len(back.Modified) != 2 || !slices.Equal(back.Modified[1].AddrsAdded, pfxs("192.168.1.5/24")) {
+		t.Errorf("reverse Diff: Modified = %+v", back.Modified)
+	}
+
+	if d := before.Diff(before); !d.IsZero() {
+		t.Errorf("Diff of a state with itself = %+v; want zero", d)
+	}
+	var nilState *State
+	if got, want := nilState.Diff(&State{InterfaceIPs: map[string][]netip.Prefix{"eth0": pfxs("10.0.0.2/24")}}), (StateDiff{Added: []string{"eth0"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff from nil = %+v; want %+v", got, want)
+	}
+}
+
+func TestParseResolvConfNameservers(t *testing.T) {
+	const resolvConf = `# Generated by NetworkManager
+search example.com
+nameserver 192.168.1.1
+nameserver   fe80::1%eth0
+nameserver bogus
+options edns0
+nameserver
+ nameserver 8.8.8.8
+`
+	got := parseResolvConfNameservers([]byte(resolvConf))
+	want := []netip.Addr{
+		netip.MustParseAddr("192.168.1.1"),
+		netip.MustParseAddr("fe80::1%eth0"),
+		netip.MustParseAddr("8.8.8.8"),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestCleanDNSResolvers(t *testing.T) {
+	addrs := func(ss ...string) (ret []netip.Addr) {
+		for _, s := range ss {
+			ret = append(ret, netip.MustParseAddr(s))
+		}
+		return ret
+	}
+	tests := []struct {
+		name string
+		in   []netip.Addr
+		want []netip.Addr
+	}{
+		{"nil", nil, nil},
+		{"sorted", addrs("8.8.8.8", "1.1.1.1", "2606:4700:4700::1111"), addrs("1.1.1.1", "8.8.8.8", "2606:4700:4700::1111")},
+		{"dups", addrs("1.1.1.1", "::ffff:1.1.1.1", "1.1.1.1"), addrs("1.1.1.1")},
+		{"tailscale", addrs("100.100.100.100", "fd7a:115c:a1e0::53", "192.168.1.1"), addrs("192.168.1.1")},
+		{"only-tailscale", addrs("100.100.100.100"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanDNSResolvers(tt.in); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
 		})
 	}
 }
@@ -23,6 +23,7 @@
 func init() {
 	likelyHomeRouterIP = likelyHomeRouterIPWindows
 	getPAC = getPACWindows
+	getDNSResolvers = getDNSResolversWindows
 }
 
 func likelyHomeRouterIPWindows() (ret netip.Addr, _ netip.Addr, ok bool) {
@@ -127,6 +128,26 @@ func NonTailscaleInterfaces() (map[winipcfg.LUID]*winipcfg.IPAdapterAddresses, e
 	return getInterfaces(windows.AF_UNSPEC, winipcfg.GAAFlagIncludeAllInterfaces, notTailscaleInterface)
 }
 
+// getDNSResolversWindows returns the DNS servers of the non-Tailscale
+// interfaces that are up.
+func getDNSResolversWindows() []netip.Addr {
+	ifs, err := getInterfaces(windows.AF_UNSPEC, winipcfg.GAAFlagDefault, func(iface *winipcfg.IPAdapterAddresses) bool {
+		return iface.OperStatus == winipcfg.IfOperStatusUp && notTailscaleInterface(iface)
+	})
+	if err != nil {
+		return nil
+	}
+	var ret []netip.Addr
+	for _, iface := range ifs {
+		for dns := iface.FirstDNSServerAddress; dns != nil; dns = dns.Next {
+			if a, ok := netip.AddrFromSlice(dns.Address.IP()); ok {
+				ret = append(ret, a)
+			}
+		}
+	}
+	return ret
+}
+
 // getInterfaces returns a map of interfaces keyed by their LUID for
 // all interfaces matching the provided match predicate.
 //
@@ -7,14 +7,18 @@
 package netmon
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"net/netip"
 	"runtime"
+	"slices"
 	"sync"
 	"time"
 
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/opt"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/set"
 )
@@ -48,21 +52,40 @@ type osMon interface {
 	IsInterestingInterface(iface string) bool
 }
 
+// Observer is the subset of Monitor's methods that consumers use to follow
+// the network state. Code that only needs these can accept an Observer
+// instead of a *Monitor, so that tests can substitute a fake, such as
+// netmontest.FakeMonitor.
+type Observer interface {
+	InterfaceState() *State
+	InterfaceForAddr(dst netip.Addr) (ifName string, ok bool)
+	GatewayAndSelfIP() (gw, myIP netip.Addr, ok bool)
+	RegisterChangeCallback(ChangeFunc) (unregister func())
+	RegisterCoalescedChangeCallback(ChangeFunc) (unregister func())
+	RegisterRuleDeleteCallback(RuleDeleteCallback) (unregister func())
+	RegisterInterfaceEventCallback(InterfaceEventFunc) (unregister func())
+}
+
+var _ Observer = (*Monitor)(nil)
+
 // Monitor represents a monitoring instance.
 type Monitor struct {
 	logf   logger.Logf
 	om     osMon         // nil means not supported on this platform
 	change chan bool     // send false to wake poller, true to also force ChangeDeltas be sent
 	stop   chan struct{} // closed on Stop
+	done   chan struct{} // closed once Close has stopped all goroutines
 	static bool          // static Monitor that doesn't actually monitor
 
 	// Things that must be set early, before use,
 	// and not change at runtime.
-	tsIfName string // tailscale interface name, if known/set ("tailscale0", "utun3", ...)
+	tsIfName   string         // tailscale interface name, if known/set ("tailscale0", "utun3", ...)
+	isOtherVPN IsOtherVPNFunc // if non-nil, overrides DefaultIsOtherVPN
 
 	mu         sync.Mutex // guards all following fields
-	cbs        set.HandleSet[ChangeFunc]
+	cbs        set.HandleSet[*changeCallback]
 	ruleDelCB  set.HandleSet[RuleDeleteCallback]
+	ifEventCB  set.HandleSet[InterfaceEventFunc]
 	ifState    *State
 	gwValid    bool       // whether gw and gwSelfIP are valid
 	gw         netip.Addr // our gateway's IP
@@ -72,7 +95,21 @@ type Monitor struct {
 	goroutines sync.WaitGroup
 	wallTimer  *time.Timer // nil until Started; re-armed AfterFunc per tick
 	lastWall   time.Time
-	timeJumped bool // whether we need to send a changed=true after a big time jump
+	timeJumped bool         // whether we need to send a changed=true after a big time jump
+	paused     bool         // whether notifications are suppressed; see Pause
+	pausedD    *ChangeDelta // changes suppressed while paused, merged; or nil
+	flapConf   *FlapConfig  // nil means DefaultFlapConfig; see SetFlapConfig
+	notifyInit bool         // whether Start sends the initial state; see SetNotifyInitialState
+	timeJump   opt.Bool     // whether to watch for time jumps, if set; see SetMonitorTimeJump
+	flaps      map[string]*ifaceFlaps
+	dampedD    *ChangeDelta // changes withheld for flapping interfaces, merged; or nil
+
+	// Burst coalescing; see SetBurstWindow.
+	burstWindow time.Duration // zero means changes are delivered right away
+	burstD      *ChangeDelta  // changes in the current burst, merged; or nil
+	burstTimer  *time.Timer   // ends the current burst; or nil
+
+	nowFunc func() time.Time // for tests; nil means wallTime
 }
 
 // ChangeFunc is a callback function registered with Monitor that's called when the
@@ -82,10 +119,12 @@ type Monitor struct {
 // ChangeDelta describes the difference between two network states.
 type ChangeDelta struct {
 	// Monitor is the network monitor that sent this delta.
+	// It's nil if the delta came from another Observer.
 	Monitor *Monitor
 
 	// Old is the old interface state, if known.
-	// It's nil if the old state is unknown.
+	// It's nil if the old state is unknown, as it is for the initial
+	// state sent by Start (see SetNotifyInitialState).
 	// Do not mutate it.
 	Old *State
 
@@ -102,11 +141,49 @@ type ChangeDelta struct {
 	// and New (or add methods to ChangeDelta) instead of using Major.
 	Major bool
 
+	// MajorReasons lists why Major is true; it's empty if Major is false.
+	// Each reason is one of:
+	//
+	//   - "state-unknown": Old or New is nil
+	//   - "have-v4", "have-v6": whether there's IPv4 or IPv6 connectivity
+	//     changed
+	//   - "is-expensive": whether the network is expensive changed
+	//   - "default-route-interface": the default route interface changed
+	//   - "http-proxy", "pac": the HTTP proxy or PAC URL changed
+	//   - "interface-added", "interface-removed": an interesting
+	//     interface appeared or went away
+	//   - "interface-changed": an interesting interface's properties,
+	//     such as its flags, changed
+	//   - "interface-addrs-changed": an interesting interface's
+	//     routable addresses changed
+	//   - "time-jumped": TimeJumped is true
+	//
+	// It's meant for debugging and tuning when rebinds happen.
+	MajorReasons []string
+
 	// TimeJumped is whether there was a big jump in wall time since the last
 	// time we checked. This is a hint that a mobile sleeping device might have
 	// come out of sleep.
 	TimeJumped bool
 
+	// HasOtherVPN is whether New contains a VPN or tunnel interface other
+	// than Tailscale's. It's the same as New.HasOtherVPN.
+	HasOtherVPN bool
+
+	// DNSConfigChanged is whether the system's DNS resolvers differ
+	// between Old and New (see State.DNSResolvers), which can happen
+	// without any interface changing, such as when a network's DHCP
+	// server hands out new resolvers. It's the same as
+	// New.DNSConfigChangedFrom(Old).
+	DNSConfigChanged bool
+
+	// ChurnedButNetNoChange is whether the delta merges several network
+	// changes, such as those of a burst (see SetBurstWindow), that ended up
+	// back at the state they started from: something changed and reverted,
+	// such as an interface flapping down and up again, so Old and New are
+	// equal even though the network was disrupted in between.
+	ChurnedButNetNoChange bool
+
 	// TODO(bradfitz): add some lazy cached fields here as needed with methods
 	// on *ChangeDelta to let callers ask specific questions
 }
@@ -120,6 +197,7 @@ func New(logf logger.Logf) (*Monitor, error) {
 		logf:     logf,
 		change:   make(chan bool, 1),
 		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
 		lastWall: wallTime(),
 	}
 	st, err := m.interfaceStateUncached()
@@ -160,8 +238,62 @@ func (m *Monitor) InterfaceState() *State {
 	return m.ifState
 }
 
+// InterfaceForAddr reports the name of the local interface that traffic
+// to dst would most likely be sent from, according to the most recently
+// observed network state. It doesn't make any syscalls and is only a
+// heuristic; see State.InterfaceForAddr.
+func (m *Monitor) InterfaceForAddr(dst netip.Addr) (ifName string, ok bool) {
+	return m.InterfaceState().InterfaceForAddr(dst)
+}
+
+// IsInterfaceUp reports whether the interface named name is up, according
+// to the most recently observed network state. It doesn't make any
+// syscalls. It returns false for interfaces that aren't known.
+func (m *Monitor) IsInterfaceUp(name string) bool {
+	st := m.InterfaceState()
+	if st == nil {
+		return false
+	}
+	i, ok := st.Interface[name]
+	return ok && i.IsUp()
+}
+
+// RoutableInterfaceIPs returns the routable addresses, with their
+// prefix lengths, of the machine's interesting interfaces that are up,
+// other than the Tailscale interface, according to the most recently
+// observed network state. Link-local, loopback and multicast addresses
+// aren't routable; see isRoutableIP. The result is sorted and contains
+// no duplicates.
+func (m *Monitor) RoutableInterfaceIPs() []netip.Prefix {
+	st := m.InterfaceState()
+	if st == nil {
+		return nil
+	}
+	var ret []netip.Prefix
+	for name, i := range st.Interface {
+		ips := st.InterfaceIPs[name]
+		if name == m.tsIfName || isTailscaleInterface(name, ips) || !i.IsUp() || !m.isInterestingInterface(i, ips) {
+			continue
+		}
+		for _, p := range ips {
+			if isRoutableIP(p.Addr()) {
+				ret = append(ret, p)
+			}
+		}
+	}
+	slices.SortFunc(ret, func(a, b netip.Prefix) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Bits(), b.Bits()))
+	})
+	return slices.Compact(ret)
+}
+
 func (m *Monitor) interfaceStateUncached() (*State, error) {
-	return GetState()
+	st, err := GetState()
+	if err != nil {
+		return nil, err
+	}
+	st.HasOtherVPN = m.hasOtherVPN(st)
+	return st, nil
 }
 
 // SetTailscaleInterfaceName sets the name of the Tailscale interface. For
@@ -173,6 +305,16 @@ func (m *Monitor) SetTailscaleInterfaceName(ifName string) {
 	m.tsIfName = ifName
 }
 
+// TailscaleInterfaceName returns the name of the Tailscale interface set by
+// SetTailscaleInterfaceName, or the empty string if it's not known or m is
+// nil.
+func (m *Monitor) TailscaleInterfaceName() string {
+	if m == nil {
+		return ""
+	}
+	return m.tsIfName
+}
+
 // GatewayAndSelfIP returns the current network's default gateway, and
 // the machine's default IP for that gateway.
 //
@@ -203,14 +345,31 @@ func (m *Monitor) GatewayAndSelfIP() (gw, myIP netip.Addr, ok bool) {
 
 // RegisterChangeCallback adds callback to the set of parties to be
 // notified (in their own goroutine) when the network state changes.
+// Each call gets its own copy of the ChangeDelta; calls may run
+// concurrently with each other.
 // To remove this callback, call unregister (or close the monitor).
 func (m *Monitor) RegisterChangeCallback(callback ChangeFunc) (unregister func()) {
+	return m.registerChangeCallback(&changeCallback{fn: callback})
+}
+
+// RegisterCoalescedChangeCallback is like RegisterChangeCallback, but
+// calls to callback are serialized: at most one runs at a time. Changes
+// that happen while callback is running are merged into a single pending
+// ChangeDelta (see ChangeDelta.merge) that is delivered once it returns.
+//
+// It's meant for callbacks that may be slow, so that rapid network
+// flapping doesn't pile up goroutines waiting on them.
+func (m *Monitor) RegisterCoalescedChangeCallback(callback ChangeFunc) (unregister func()) {
+	return m.registerChangeCallback(&changeCallback{fn: callback, coalesce: true})
+}
+
+func (m *Monitor) registerChangeCallback(cb *changeCallback) (unregister func()) {
 	if m.static {
 		return func() {}
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	handle := m.cbs.Add(callback)
+	handle := m.cbs.Add(cb)
 	return func() {
 		m.mu.Lock()
 		defer m.mu.Unlock()
@@ -241,6 +400,77 @@ func (m *Monitor) RegisterRuleDeleteCallback(callback RuleDeleteCallback) (unreg
 	}
 }
 
+// InterfaceEvent describes a network interface appearing or disappearing.
+type InterfaceEvent struct {
+	// Name is the interface's name.
+	Name string
+
+	// Added is whether the interface appeared. If false, it disappeared.
+	Added bool
+
+	// IPs are the interface's addresses: its new addresses if it was
+	// added, or its last known addresses if it was removed.
+	IPs []netip.Prefix
+}
+
+// InterfaceEventFunc is a callback function registered with Monitor that's
+// called when a network interface is added or removed.
+type InterfaceEventFunc func(InterfaceEvent)
+
+// RegisterInterfaceEventCallback adds callback to the set of parties to be
+// notified when an interface that Monitor considers interesting is added or
+// removed. Changes to the Tailscale interface are not reported.
+//
+// The events for a single network change are delivered in order (removals
+// first, then additions, each sorted by name) in their own goroutine.
+// To remove this callback, call unregister (or close the monitor).
+func (m *Monitor) RegisterInterfaceEventCallback(callback InterfaceEventFunc) (unregister func()) {
+	if m.static {
+		return func() {}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	handle := m.ifEventCB.Add(callback)
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.ifEventCB, handle)
+	}
+}
+
+// SetNotifyInitialState sets whether Start sends the change callbacks
+// registered by then a ChangeDelta with a nil Old and the current state as
+// New, so they can learn the initial network state the same way as they
+// learn of changes to it. It's off by default and must be called before
+// Start.
+func (m *Monitor) SetNotifyInitialState(v bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifyInit = v
+}
+
+// SetMonitorTimeJump sets whether the monitor watches for big jumps in wall
+// time, as when the machine wakes from sleep, and reports them as major
+// changes, overriding the default of doing so on all platforms but Android
+// and iOS. Turning it off suits hosts whose clocks jump for other reasons,
+// such as VMs that get paused or have their clocks stepped, where the
+// reported changes would only cause spurious wake handling. It must be
+// called before Start.
+func (m *Monitor) SetMonitorTimeJump(v bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeJump = opt.NewBool(v)
+}
+
+// monitorTimeJumpLocked reports whether m watches for jumps in wall time;
+// see SetMonitorTimeJump.
+func (m *Monitor) monitorTimeJumpLocked() bool {
+	if v, ok := m.timeJump.Get(); ok {
+		return v
+	}
+	return shouldMonitorTimeJump
+}
+
 // Start starts the monitor.
 // A monitor can only be started & closed once.
 func (m *Monitor) Start() {
@@ -254,7 +484,24 @@ func (m *Monitor) Start() {
 	}
 	m.started = true
 
-	if shouldMonitorTimeJump {
+	if m.notifyInit && m.ifState != nil {
+		d := &ChangeDelta{
+			Monitor:     m,
+			New:         m.ifState,
+			Major:       true,
+			HasOtherVPN: m.ifState.HasOtherVPN,
+		}
+		if m.paused {
+			if m.pausedD != nil {
+				*d = m.pausedD.merge(*d)
+			}
+			m.pausedD = d
+		} else {
+			m.notifyLocked(d)
+		}
+	}
+
+	if m.monitorTimeJumpLocked() {
 		m.wallTimer = time.AfterFunc(pollWallTimeInterval, m.pollWallTime)
 	}
 
@@ -266,7 +513,12 @@ func (m *Monitor) Start() {
 	go m.debounce()
 }
 
-// Close closes the monitor.
+// Close closes the monitor and waits for the goroutines started by Start
+// to exit. It's safe to call more than once; later calls wait too, but
+// only the first returns an error.
+//
+// Change callbacks that are already running, each in their own goroutine,
+// aren't waited for.
 func (m *Monitor) Close() error {
 	if m.static {
 		return nil
@@ -274,6 +526,7 @@ func (m *Monitor) Close() error {
 	m.mu.Lock()
 	if m.closed {
 		m.mu.Unlock()
+		<-m.done
 		return nil
 	}
 	m.closed = true
@@ -282,6 +535,10 @@ func (m *Monitor) Close() error {
 	if m.wallTimer != nil {
 		m.wallTimer.Stop()
 	}
+	if m.burstTimer != nil {
+		m.burstTimer.Stop()
+		m.burstTimer = nil
+	}
 
 	var err error
 	if m.om != nil {
@@ -294,9 +551,22 @@ func (m *Monitor) Close() error {
 	if started {
 		m.goroutines.Wait()
 	}
+	close(m.done)
 	return err
 }
 
+// Wait blocks until the monitor has been closed and the goroutines
+// started by Start have exited. Unlike Close, it doesn't itself close the
+// monitor, so it's useful to wait for a Close done elsewhere, such as by
+// the owner of a Monitor shared with a test. It returns immediately for
+// monitors from NewStatic.
+func (m *Monitor) Wait() {
+	if m.static {
+		return
+	}
+	<-m.done
+}
+
 // InjectEvent forces the monitor to pretend there was a network
 // change and re-check the state of the network. Any registered
 // ChangeFunc callbacks will be called within the event coalescing
@@ -376,7 +646,7 @@ func (m *Monitor) notifyRuleDeleted(rdm ipRuleDeletedMessage) {
 // considered when checking for network state changes.
 // The ips parameter should be the IPs of the provided interface.
 func (m *Monitor) isInterestingInterface(i Interface, ips []netip.Prefix) bool {
-	if !m.om.IsInterestingInterface(i.Name) {
+	if m.om != nil && !m.om.IsInterestingInterface(i.Name) {
 		return false
 	}
 
@@ -414,8 +684,21 @@ func (m *Monitor) debounce() {
 	metricChange         = clientmetric.NewCounter("netmon_link_change")
 	metricChangeTimeJump = clientmetric.NewCounter("netmon_link_change_timejump")
 	metricChangeMajor    = clientmetric.NewCounter("netmon_link_change_major")
+
+	metricSecsSinceChange = clientmetric.NewGaugeFunc("netmon_secs_since_link_change", secondsSinceLastChange)
 )
 
+// lastChange is when handlePotentialChange last processed a change that
+// wasn't equal to the previous state, in any Monitor. It's the process
+// start time (roughly) until then.
+var lastChange = mono.Now()
+
+// secondsSinceLastChange returns the number of whole seconds since
+// lastChange, for the netmon_secs_since_link_change metric.
+func secondsSinceLastChange() int64 {
+	return int64(mono.Since(lastChange.LoadAtomic()) / time.Second)
+}
+
 // handlePotentialChange considers whether newState is different enough to wake
 // up callers and updates the monitor's state if so.
 //
@@ -424,29 +707,44 @@ func (m *Monitor) handlePotentialChange(newState *State, forceCallbacks bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	oldState := m.ifState
-	timeJumped := shouldMonitorTimeJump && m.checkWallTimeAdvanceLocked()
-	if !timeJumped && !forceCallbacks && oldState.Equal(newState) {
+	timeJumped := m.monitorTimeJumpLocked() && m.checkWallTimeAdvanceLocked()
+	equal := oldState.Equal(newState)
+	if !timeJumped && !forceCallbacks && equal {
 		// Exactly equal. Nothing to do.
 		metricChangeEq.Add(1)
 		return
 	}
+	if !equal {
+		lastChange.StoreAtomic(mono.Now())
+	}
 
 	delta := &ChangeDelta{
-		Monitor:    m,
-		Old:        oldState,
-		New:        newState,
-		TimeJumped: timeJumped,
+		Monitor:          m,
+		Old:              oldState,
+		New:              newState,
+		TimeJumped:       timeJumped,
+		HasOtherVPN:      newState.HasOtherVPN,
+		DNSConfigChanged: newState.DNSConfigChangedFrom(oldState),
 	}
 
-	delta.Major = m.IsMajorChangeFrom(oldState, newState)
+	delta.MajorReasons = m.MajorChangeReasons(oldState, newState)
+	delta.Major = len(delta.MajorReasons) > 0
+	// Keep minor changes too, so that the next delta, HasOtherVPN and
+	// lastChange are relative to the current state rather than that of
+	// the last major change.
+	m.ifState = newState
 	if delta.Major {
 		m.gwValid = false
-		m.ifState = newState
 
-		if s1, s2 := oldState.String(), delta.New.String(); s1 == s2 {
-			m.logf("[unexpected] network state changed, but stringification didn't: %v", s1)
-			m.logf("[unexpected] old: %s", jsonSummary(oldState))
-			m.logf("[unexpected] new: %s", jsonSummary(newState))
+		// oldState is nil if it couldn't be read when the Monitor was
+		// created, such as by NewStatic, so any new state is a change
+		// from it, with nothing to compare.
+		if oldState != nil {
+			if s1, s2 := oldState.String(), delta.New.String(); s1 == s2 {
+				m.logf("[unexpected] network state changed, but stringification didn't: %v", s1)
+				m.logf("[unexpected] old: %s", jsonSummary(oldState))
+				m.logf("[unexpected] new: %s", jsonSummary(newState))
+			}
 		}
 	}
 	// See if we have a queued or new time jump signal.
@@ -457,6 +755,7 @@ func (m *Monitor) handlePotentialChange(newState *State, forceCallbacks bool) {
 			m.logf("time jumped (probably wake from sleep); synthesizing major change event")
 			delta.Major = true
 		}
+		delta.MajorReasons = append(delta.MajorReasons, "time-jumped")
 	}
 	metricChange.Add(1)
 	if delta.Major {
@@ -465,9 +764,208 @@ func (m *Monitor) handlePotentialChange(newState *State, forceCallbacks bool) {
 	if delta.TimeJumped {
 		metricChangeTimeJump.Add(1)
 	}
-	for _, cb := range m.cbs {
-		go cb(delta)
+	if m.paused {
+		if m.pausedD != nil {
+			*delta = m.pausedD.merge(*delta)
+		}
+		m.pausedD = delta
+		return
+	}
+	if m.burstWindow > 0 {
+		m.addToBurstLocked(delta)
+		return
+	}
+	m.notifyLocked(delta)
+}
+
+// notifyLocked delivers delta to the registered change and interface event
+// callbacks, except for what's withheld while damping flapping interfaces
+// (see FlapConfig).
+//
+// m.mu must be held.
+func (m *Monitor) notifyLocked(delta *ChangeDelta) {
+	var evs []InterfaceEvent
+	damped := false
+	if len(m.ifEventCB) > 0 || m.flapConfigLocked().Threshold > 0 {
+		all := m.interfaceEvents(delta.Old, delta.New)
+		evs = m.dampFlappingLocked(all)
+		damped = m.isDampedChangeLocked(delta, all)
+	}
+	if m.dampedD != nil {
+		*delta = m.dampedD.merge(*delta)
+		m.dampedD = nil
+		m.setMajorReasons(delta)
+	}
+	if damped {
+		m.dampedD = delta
+	} else {
+		for _, cb := range m.cbs {
+			cb.notify(*delta)
+		}
+	}
+	if len(evs) > 0 && len(m.ifEventCB) > 0 {
+		for _, cb := range m.ifEventCB {
+			go func() {
+				for _, ev := range evs {
+					cb(ev)
+				}
+			}()
+		}
+	}
+}
+
+// setMajorReasons sets d.MajorReasons, and d.Major accordingly, for the net
+// change from d.Old to d.New. It's for merged deltas, whose reasons may
+// include ones for changes that were since undone.
+func (m *Monitor) setMajorReasons(d *ChangeDelta) {
+	d.MajorReasons = m.MajorChangeReasons(d.Old, d.New)
+	if d.TimeJumped {
+		d.MajorReasons = append(d.MajorReasons, "time-jumped")
+	}
+	d.Major = len(d.MajorReasons) > 0
+}
+
+// Pause suppresses the delivery of change notifications, including
+// interface events, until Resume is called. The Monitor keeps tracking the
+// network state while paused.
+//
+// It's meant to be used around operations known to cause spurious network
+// changes, such as Tailscale reconfiguring its own interface. Calls to Pause
+// don't nest: a single Resume undoes any number of Pause calls.
+func (m *Monitor) Pause() {
+	if m.static {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paused = true
+}
+
+// Resume resumes the delivery of change notifications after Pause.
+//
+// If the network changed while paused, the callbacks are notified once,
+// with a single ChangeDelta from the state before the first suppressed
+// change to the current state (see ChangeDelta.merge). Nothing is delivered
+// if the state ended up back where it started and wall time didn't jump.
+// With a burst window (see SetBurstWindow), that delta goes into the
+// current burst, or starts one, like any other change.
+func (m *Monitor) Resume() {
+	if m.static {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.paused {
+		return
+	}
+	m.paused = false
+	d := m.pausedD
+	m.pausedD = nil
+	if d == nil || (!d.TimeJumped && d.Old.Equal(d.New)) {
+		return
+	}
+	if m.burstWindow > 0 {
+		m.addToBurstLocked(d)
+		return
+	}
+	m.setMajorReasons(d)
+	m.notifyLocked(d)
+}
+
+// interfaceEvents returns the interesting interfaces that were removed in
+// s2 relative to s1, followed by those that were added, each sorted by name.
+// It ignores the Tailscale interface, like IsMajorChangeFrom. If s1 is nil,
+// there's nothing to compare against and it returns nil.
+func (m *Monitor) interfaceEvents(s1, s2 *State) []InterfaceEvent {
+	if s1 == nil || s2 == nil {
+		return nil
+	}
+	var removed, added []InterfaceEvent
+	diff := func(from, to *State, isAdd bool, evs *[]InterfaceEvent) {
+		for name, i := range from.Interface {
+			if name == m.tsIfName {
+				continue
+			}
+			if _, ok := to.Interface[name]; ok {
+				continue
+			}
+			ips := from.InterfaceIPs[name]
+			if !m.isInterestingInterface(i, ips) {
+				continue
+			}
+			*evs = append(*evs, InterfaceEvent{Name: name, Added: isAdd, IPs: ips})
+		}
+		slices.SortFunc(*evs, func(a, b InterfaceEvent) int { return cmp.Compare(a.Name, b.Name) })
+	}
+	diff(s1, s2, false, &removed)
+	diff(s2, s1, true, &added)
+	return append(removed, added...)
+}
+
+// changeCallback is a ChangeFunc registered with a Monitor, along with the
+// state needed to serialize calls to it, if requested.
+type changeCallback struct {
+	fn       ChangeFunc
+	coalesce bool // whether calls to fn are serialized and coalesced
+
+	mu      sync.Mutex   // guards the following; only used if coalesce
+	running bool         // whether a goroutine is currently calling fn
+	pending *ChangeDelta // delta to deliver once fn returns, or nil
+}
+
+// notify arranges for cb.fn to be called with d in its own goroutine.
+func (cb *changeCallback) notify(d ChangeDelta) {
+	if !cb.coalesce {
+		go cb.fn(&d)
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.running {
+		if cb.pending != nil {
+			d = cb.pending.merge(d)
+		}
+		cb.pending = &d
+		return
 	}
+	cb.running = true
+	go cb.run(&d)
+}
+
+// run calls cb.fn with d, and then with any deltas that became pending in
+// the meantime, until there are none left.
+func (cb *changeCallback) run(d *ChangeDelta) {
+	for d != nil {
+		cb.fn(d)
+
+		cb.mu.Lock()
+		d, cb.pending = cb.pending, nil
+		cb.running = d != nil
+		cb.mu.Unlock()
+	}
+}
+
+// merge returns a ChangeDelta covering both d and the subsequent delta
+// next: it goes from d.Old to next.New and is Major or TimeJumped if
+// either delta was, for the reasons of both. Its DNSConfigChanged compares
+// d.Old and next.New, and it's ChurnedButNetNoChange if either delta
+// changed or churned the state but d.Old and next.New are equal.
+func (d ChangeDelta) merge(next ChangeDelta) ChangeDelta {
+	churned := d.ChurnedButNetNoChange || next.ChurnedButNetNoChange ||
+		!d.Old.Equal(d.New) || !next.Old.Equal(next.New)
+	next.Old = d.Old
+	next.ChurnedButNetNoChange = churned && next.Old.Equal(next.New)
+	next.Major = d.Major || next.Major
+	reasons := slices.Clone(d.MajorReasons)
+	for _, r := range next.MajorReasons {
+		if !slices.Contains(reasons, r) {
+			reasons = append(reasons, r)
+		}
+	}
+	next.MajorReasons = reasons
+	next.TimeJumped = d.TimeJumped || next.TimeJumped
+	next.DNSConfigChanged = next.New.DNSConfigChangedFrom(next.Old)
+	return next
 }
 
 // IsMajorChangeFrom reports whether the transition from s1 to s2 is
@@ -476,19 +974,37 @@ func (m *Monitor) handlePotentialChange(newState *State, forceCallbacks bool) {
 //
 // TODO(bradiftz): tigten this definition.
 func (m *Monitor) IsMajorChangeFrom(s1, s2 *State) bool {
+	return len(m.MajorChangeReasons(s1, s2)) > 0
+}
+
+// MajorChangeReasons returns why the transition from s1 to s2 is a major
+// change (see IsMajorChangeFrom), as the ChangeDelta.MajorReasons that
+// apply, in a fixed order. It returns nil if the change isn't major.
+func (m *Monitor) MajorChangeReasons(s1, s2 *State) []string {
 	if s1 == nil && s2 == nil {
-		return false
+		return nil
 	}
 	if s1 == nil || s2 == nil {
-		return true
+		return []string{"state-unknown"}
 	}
-	if s1.HaveV6 != s2.HaveV6 ||
-		s1.HaveV4 != s2.HaveV4 ||
-		s1.IsExpensive != s2.IsExpensive ||
-		s1.DefaultRouteInterface != s2.DefaultRouteInterface ||
-		s1.HTTPProxy != s2.HTTPProxy ||
-		s1.PAC != s2.PAC {
-		return true
+	found := make(set.Set[string])
+	if s1.HaveV6 != s2.HaveV6 {
+		found.Add("have-v6")
+	}
+	if s1.HaveV4 != s2.HaveV4 {
+		found.Add("have-v4")
+	}
+	if s1.IsExpensive != s2.IsExpensive {
+		found.Add("is-expensive")
+	}
+	if s1.DefaultRouteInterface != s2.DefaultRouteInterface {
+		found.Add("default-route-interface")
+	}
+	if s1.HTTPProxy != s2.HTTPProxy {
+		found.Add("http-proxy")
+	}
+	if s1.PAC != s2.PAC {
+		found.Add("pac")
 	}
 	for iname, i := range s1.Interface {
 		if iname == m.tsIfName {
@@ -501,14 +1017,14 @@ func (m *Monitor) IsMajorChangeFrom(s1, s2 *State) bool {
 		}
 		i2, ok := s2.Interface[iname]
 		if !ok {
-			return true
+			found.Add("interface-removed")
+			continue
 		}
-		ips2, ok := s2.InterfaceIPs[iname]
-		if !ok {
-			return true
+		if !i.Equal(i2) {
+			found.Add("interface-changed")
 		}
-		if !i.Equal(i2) || !prefixesMajorEqual(ips, ips2) {
-			return true
+		if ips2, ok := s2.InterfaceIPs[iname]; !ok || !prefixesMajorEqual(ips, ips2) {
+			found.Add("interface-addrs-changed")
 		}
 	}
 	// Iterate over s2 in case there is a field in s2 that doesn't exist in s1
@@ -523,17 +1039,45 @@ func (m *Monitor) IsMajorChangeFrom(s1, s2 *State) bool {
 		}
 		i1, ok := s1.Interface[iname]
 		if !ok {
-			return true
+			found.Add("interface-added")
+			continue
 		}
-		ips1, ok := s1.InterfaceIPs[iname]
-		if !ok {
-			return true
+		if !i.Equal(i1) {
+			found.Add("interface-changed")
 		}
-		if !i.Equal(i1) || !prefixesMajorEqual(ips, ips1) {
-			return true
+		if ips1, ok := s1.InterfaceIPs[iname]; !ok || !prefixesMajorEqual(ips, ips1) {
+			found.Add("interface-addrs-changed")
 		}
 	}
-	return false
+	var reasons []string
+	for _, r := range majorChangeReasons {
+		if found.Contains(r) {
+			reasons = append(reasons, r)
+		}
+	}
+	return reasons
+}
+
+// majorChangeReasons is the order in which MajorChangeReasons returns the
+// reasons it finds.
+var majorChangeReasons = []string{
+	"have-v6",
+	"have-v4",
+	"is-expensive",
+	"default-route-interface",
+	"http-proxy",
+	"pac",
+	"interface-added",
+	"interface-removed",
+	"interface-changed",
+	"interface-addrs-changed",
+}
+
+// isRoutableIP reports whether a is an interface address that matters to
+// the network state, rather than a boring link-local, loopback or
+// multicast address.
+func isRoutableIP(a netip.Addr) bool {
+	return !a.IsLinkLocalUnicast() && !a.IsLoopback() && !a.IsMulticast()
 }
 
 // prefixesMajorEqual reports whether a and b are equal after ignoring
@@ -542,13 +1086,8 @@ func prefixesMajorEqual(a, b []netip.Prefix) bool {
 	// trim returns a subslice of p with link local unicast,
 	// loopback, and multicast prefixes removed from the front.
 	trim := func(p []netip.Prefix) []netip.Prefix {
-		for len(p) > 0 {
-			a := p[0].Addr()
-			if a.IsLinkLocalUnicast() || a.IsLoopback() || a.IsMulticast() {
-				p = p[1:]
-				continue
-			}
-			break
+		for len(p) > 0 && !isRoutableIP(p[0].Addr()) {
+			p = p[1:]
 		}
 		return p
 	}
@@ -579,6 +1118,14 @@ func wallTime() time.Time {
 	return time.Now().Round(0)
 }
 
+// now returns the current wall time, from m.nowFunc if set.
+func (m *Monitor) now() time.Time {
+	if m.nowFunc != nil {
+		return m.nowFunc()
+	}
+	return wallTime()
+}
+
 func (m *Monitor) pollWallTime() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -592,7 +1139,8 @@ func (m *Monitor) pollWallTime() {
 }
 
 // shouldMonitorTimeJump is whether we keep a regular periodic timer running in
-// the background watching for jumps in wall time.
+// the background watching for jumps in wall time, unless overridden with
+// SetMonitorTimeJump.
 //
 // We don't do this on mobile platforms for battery reasons, and because these
 // platforms don't really sleep in the same way.
@@ -602,10 +1150,10 @@ func (m *Monitor) pollWallTime() {
 // pollWallTimeInterval, indicating we probably just came out of sleep. Once a
 // time jump is detected it must be reset by calling resetTimeJumpedLocked.
 func (m *Monitor) checkWallTimeAdvanceLocked() bool {
-	if !shouldMonitorTimeJump {
+	if !m.monitorTimeJumpLocked() {
 		panic("unreachable") // if callers are correct
 	}
-	now := wallTime()
+	now := m.now()
 	if now.Sub(m.lastWall) > pollWallTimeInterval*3/2 {
 		m.timeJumped = true // it is reset by debounce.
 	}
@@ -5,12 +5,17 @@
 
 import (
 	"flag"
+	"fmt"
 	"net"
 	"net/netip"
+	"runtime"
+	"slices"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"tailscale.com/tstest"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/util/mak"
 )
 
@@ -58,6 +63,415 @@ func TestMonitorInjectEvent(t *testing.T) {
 	}
 }
 
+func TestMonitorGoroutinesExit(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	for range 3 {
+		mon, err := New(t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mon.Start()
+		mon.InjectEvent()
+
+		waited := make(chan struct{})
+		go func() {
+			mon.Wait()
+			close(waited)
+		}()
+		select {
+		case <-waited:
+			t.Fatal("Wait returned before Close")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		if err := mon.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-waited:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Wait didn't return after Close")
+		}
+		if err := mon.Close(); err != nil { // second Close waits too
+			t.Fatal(err)
+		}
+	}
+
+	// A monitor that's never started has no goroutines to wait for.
+	mon, err := New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.Close()
+	mon.Wait()
+
+	NewStatic().Wait()
+}
+
+func TestMonitorCallbacksUnderFlapping(t *testing.T) {
+	mon, err := New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	// Plain callbacks each get their own copy of the delta, so they can
+	// all scribble on it without racing.
+	var plainCalls atomic.Int32
+	for range 2 {
+		mon.RegisterChangeCallback(func(d *ChangeDelta) {
+			d.Major = !d.Major
+			plainCalls.Add(1)
+		})
+	}
+
+	// A slow coalesced callback must never run concurrently with itself
+	// and must eventually see the latest state.
+	release := make(chan struct{})
+	var (
+		running  atomic.Int32
+		overlaps atomic.Int32
+		calls    atomic.Int32
+		last     atomic.Pointer[ChangeDelta]
+	)
+	mon.RegisterCoalescedChangeCallback(func(d *ChangeDelta) {
+		if running.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		defer running.Add(-1)
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		last.Store(d)
+	})
+
+	const changes = 100
+	var final *State
+	for i := range changes {
+		final = &State{DefaultRouteInterface: fmt.Sprintf("eth%d", i)}
+		mon.handlePotentialChange(final, true)
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if d := last.Load(); d != nil && d.New == final && plainCalls.Load() == 2*changes {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout; coalesced calls=%d, plain calls=%d", calls.Load(), plainCalls.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := overlaps.Load(); n > 0 {
+		t.Errorf("coalesced callback ran concurrently %d times", n)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("coalesced callback ran %d times; want 2 (first change, then the rest merged)", n)
+	}
+	if d := last.Load(); d.Old == nil || d.Old.DefaultRouteInterface != "eth0" || !d.Major {
+		t.Errorf("merged delta = %+v; want Old from the first pending change and Major set", d)
+	}
+}
+
+func TestMonitorNotifyInitialState(t *testing.T) {
+	for _, notify := range []bool{false, true} {
+		t.Run(fmt.Sprint(notify), func(t *testing.T) {
+			mon, err := New(t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mon.Close()
+			mon.SetNotifyInitialState(notify)
+
+			deltas := make(chan *ChangeDelta, 10)
+			mon.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+			st := mon.InterfaceState()
+			mon.Start()
+			mon.Start() // no-op; mustn't send the initial state again
+
+			if notify {
+				select {
+				case d := <-deltas:
+					if d.Old != nil || d.New != st || !d.Major || d.Monitor != mon {
+						t.Errorf("initial delta = {Old: %v, New: %v, Major: %v}; want {nil, initial state, true}", d.Old, d.New, d.Major)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("timeout waiting for initial state")
+				}
+			}
+			select {
+			case d := <-deltas:
+				// Tolerate real network changes, but not a second
+				// initial state.
+				if d.Old == nil {
+					t.Errorf("unexpected initial delta: %+v", d)
+				}
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestMonitorPause(t *testing.T) {
+	mon, err := New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	deltas := make(chan *ChangeDelta, 10)
+	mon.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+	expectNone := func() {
+		t.Helper()
+		select {
+		case d := <-deltas:
+			t.Fatalf("unexpected callback: %+v", d)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	orig := mon.InterfaceState()
+	mon.Pause()
+	var final *State
+	for i := range 5 {
+		final = &State{DefaultRouteInterface: fmt.Sprintf("eth%d", i)}
+		mon.handlePotentialChange(final, false)
+	}
+	expectNone()
+	if got := mon.InterfaceState(); got != final {
+		t.Errorf("state not tracked while paused: got %v; want %v", got, final)
+	}
+
+	mon.Resume()
+	select {
+	case d := <-deltas:
+		if d.Old != orig || d.New != final || !d.Major {
+			t.Errorf("resumed delta = %+v; want Old=%v, New=%v, Major", d, orig, final)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for callback after Resume")
+	}
+	expectNone()
+
+	// A change that's undone while paused isn't delivered at all.
+	mon.Pause()
+	mon.handlePotentialChange(&State{DefaultRouteInterface: "wlan0"}, false)
+	mon.handlePotentialChange(final, false)
+	mon.Resume()
+	expectNone()
+
+	// Once resumed, changes are delivered as usual.
+	mon.handlePotentialChange(&State{DefaultRouteInterface: "wlan0"}, false)
+	select {
+	case <-deltas:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for callback")
+	}
+}
+
+func TestMonitorPauseMajorReasons(t *testing.T) {
+	now := time.Unix(1000, 0)
+	st := &State{DefaultRouteInterface: "eth0"}
+	m := &Monitor{
+		logf:     t.Logf,
+		om:       &testOSMon{},
+		lastWall: now,
+		ifState:  st,
+		nowFunc:  func() time.Time { return now },
+	}
+	m.SetMonitorTimeJump(true)
+	deltas := make(chan *ChangeDelta, 10)
+	m.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+	next := func(what string) *ChangeDelta {
+		t.Helper()
+		select {
+		case d := <-deltas:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timeout waiting for callback", what)
+		}
+		return nil
+	}
+
+	// The default route changes and changes back while paused, and the
+	// wall time jumps: only the jump is a reason for the change.
+	m.Pause()
+	now = now.Add(30 * time.Second)
+	m.handlePotentialChange(&State{DefaultRouteInterface: "wlan0"}, false)
+	m.handlePotentialChange(st, false)
+	m.Resume()
+	d := next("changed back")
+	if !d.Major || !slices.Equal(d.MajorReasons, []string{"time-jumped"}) {
+		t.Errorf("changed back: Major=%v MajorReasons=%q; want true, [time-jumped]", d.Major, d.MajorReasons)
+	}
+
+	// The default route changes and changes back, but the network
+	// became expensive in between: only that is a reason.
+	m.Pause()
+	m.handlePotentialChange(&State{DefaultRouteInterface: "wlan0"}, false)
+	m.handlePotentialChange(&State{DefaultRouteInterface: "eth0", IsExpensive: true}, false)
+	m.Resume()
+	d = next("expensive")
+	if !d.Major || !slices.Equal(d.MajorReasons, []string{"is-expensive"}) {
+		t.Errorf("expensive: Major=%v MajorReasons=%q; want true, [is-expensive]", d.Major, d.MajorReasons)
+	}
+}
+
+func TestMonitorTimeJump(t *testing.T) {
+	if !shouldMonitorTimeJump {
+		t.Skip("time jumps aren't monitored on " + runtime.GOOS)
+	}
+	now := time.Unix(1000, 0)
+	st := &State{DefaultRouteInterface: "eth0"}
+	m := &Monitor{
+		logf:     t.Logf,
+		om:       &testOSMon{},
+		lastWall: now,
+		ifState:  st,
+		nowFunc:  func() time.Time { return now },
+	}
+	deltas := make(chan *ChangeDelta, 10)
+	m.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+	expectNone := func() {
+		t.Helper()
+		select {
+		case d := <-deltas:
+			t.Fatalf("unexpected callback: %+v", d)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Without a jump, an unchanged state isn't reported.
+	now = now.Add(pollWallTimeInterval)
+	m.handlePotentialChange(st, false)
+	expectNone()
+
+	// A 30s jump (more than 1.5 poll intervals) is reported even though
+	// the state didn't change, and it's a major change.
+	now = now.Add(30 * time.Second)
+	m.handlePotentialChange(st, false)
+	select {
+	case d := <-deltas:
+		if !d.TimeJumped || !d.Major || !slices.Equal(d.MajorReasons, []string{"time-jumped"}) {
+			t.Errorf("delta = %+v; want TimeJumped and Major, for reason time-jumped", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for callback")
+	}
+
+	// The jump is only reported once.
+	now = now.Add(time.Second)
+	m.handlePotentialChange(st, false)
+	expectNone()
+}
+
+func TestSetMonitorTimeJump(t *testing.T) {
+	now := time.Unix(1000, 0)
+	st := &State{DefaultRouteInterface: "eth0"}
+	newMonitor := func(monitorTimeJump bool) *Monitor {
+		m := &Monitor{
+			logf:     t.Logf,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+			lastWall: now,
+			ifState:  st,
+			nowFunc:  func() time.Time { return now },
+		}
+		m.SetMonitorTimeJump(monitorTimeJump)
+		return m
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		m := newMonitor(false)
+		deltas := make(chan *ChangeDelta, 10)
+		m.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+		m.Start()
+		defer m.Close()
+		m.mu.Lock()
+		wallTimer := m.wallTimer
+		m.mu.Unlock()
+		if wallTimer != nil {
+			t.Error("Start armed the wall time poller")
+		}
+
+		// A 30s jump isn't reported: the state didn't change.
+		now = now.Add(30 * time.Second)
+		m.handlePotentialChange(st, false)
+		select {
+		case d := <-deltas:
+			t.Fatalf("unexpected callback: %+v", d)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		// Real changes still are, without TimeJumped.
+		now = now.Add(30 * time.Second)
+		st2 := &State{DefaultRouteInterface: "wlan0"}
+		m.handlePotentialChange(st2, false)
+		select {
+		case d := <-deltas:
+			if d.TimeJumped || slices.Contains(d.MajorReasons, "time-jumped") {
+				t.Errorf("delta = %+v; want no time jump", d)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for callback")
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		// Enabling overrides the default even on platforms where time
+		// jumps aren't monitored.
+		m := newMonitor(true)
+		deltas := make(chan *ChangeDelta, 10)
+		m.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+		m.Start()
+		defer m.Close()
+		m.mu.Lock()
+		wallTimer := m.wallTimer
+		m.mu.Unlock()
+		if wallTimer == nil {
+			t.Error("Start didn't arm the wall time poller")
+		}
+
+		now = now.Add(30 * time.Second)
+		m.handlePotentialChange(st, false)
+		select {
+		case d := <-deltas:
+			if !d.TimeJumped {
+				t.Errorf("delta = %+v; want TimeJumped", d)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for callback")
+		}
+	})
+}
+
+func TestMonitorNilInitialState(t *testing.T) {
+	// As left by NewStatic if the initial state couldn't be read.
+	m := &Monitor{
+		logf:     t.Logf,
+		om:       &testOSMon{},
+		lastWall: wallTime(),
+	}
+	deltas := make(chan *ChangeDelta, 10)
+	m.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+
+	st := &State{DefaultRouteInterface: "eth0"}
+	m.handlePotentialChange(st, false)
+	select {
+	case d := <-deltas:
+		if d.Old != nil || d.New != st || !d.Major || !slices.Equal(d.MajorReasons, []string{"state-unknown"}) {
+			t.Errorf("delta = %+v; want Old=nil, New=%v, Major for reason state-unknown", d, st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for callback")
+	}
+	if got := m.InterfaceState(); got != st {
+		t.Errorf("InterfaceState = %v; want %v", got, st)
+	}
+}
+
 var (
 	monitor         = flag.String("monitor", "", `go into monitor mode like 'route monitor'; test never terminates. Value can be either "raw" or "callback"`)
 	monitorDuration = flag.Duration("monitor-duration", 0, "if non-zero, how long to run TestMonitorMode. Zero means forever.")
@@ -116,18 +530,20 @@ func TestMonitorMode(t *testing.T) {
 // tests (*State).IsMajorChangeFrom
 func TestIsMajorChangeFrom(t *testing.T) {
 	tests := []struct {
-		name   string
-		s1, s2 *State
-		want   bool
+		name    string
+		s1, s2  *State
+		want    bool
+		reasons []string
 	}{
 		{
 			name: "eq_nil",
 			want: false,
 		},
 		{
-			name: "nil_mix",
-			s2:   new(State),
-			want: true,
+			name:    "nil_mix",
+			s2:      new(State),
+			want:    true,
+			reasons: []string{"state-unknown"},
 		},
 		{
 			name: "eq",
@@ -159,7 +575,8 @@ func TestIsMajorChangeFrom(t *testing.T) {
 					"foo": {netip.MustParsePrefix("10.0.1.2/16")},
 				},
 			},
-			want: true,
+			want:    true,
+			reasons: []string{"default-route-interface"},
 		},
 		{
 			name: "some-interesting-ip-changed",
@@ -175,7 +592,65 @@ func TestIsMajorChangeFrom(t *testing.T) {
 					"foo": {netip.MustParsePrefix("10.0.1.3/16")},
 				},
 			},
-			want: true,
+			want:    true,
+			reasons: []string{"interface-addrs-changed"},
+		},
+		{
+			name: "link-local-ip-changed",
+			s1: &State{
+				DefaultRouteInterface: "foo",
+				InterfaceIPs: map[string][]netip.Prefix{
+					"foo": {netip.MustParsePrefix("10.0.1.2/16"), netip.MustParsePrefix("fe80::1/64")},
+				},
+			},
+			s2: &State{
+				DefaultRouteInterface: "foo",
+				InterfaceIPs: map[string][]netip.Prefix{
+					"foo": {netip.MustParsePrefix("10.0.1.2/16"), netip.MustParsePrefix("fe80::2/64")},
+				},
+			},
+			want: false,
+		},
+		{
+			name: "interface-added-and-removed",
+			s1: &State{
+				DefaultRouteInterface: "foo",
+				InterfaceIPs: map[string][]netip.Prefix{
+					"foo": {netip.MustParsePrefix("10.0.1.2/16")},
+					"bar": {netip.MustParsePrefix("10.0.2.2/16")},
+				},
+			},
+			s2: &State{
+				DefaultRouteInterface: "foo",
+				InterfaceIPs: map[string][]netip.Prefix{
+					"foo": {netip.MustParsePrefix("10.0.1.2/16")},
+					"baz": {netip.MustParsePrefix("10.0.3.2/16")},
+				},
+			},
+			want:    true,
+			reasons: []string{"interface-added", "interface-removed"},
+		},
+		{
+			name: "several",
+			s1: &State{
+				HaveV4:                true,
+				DefaultRouteInterface: "foo",
+				InterfaceIPs: map[string][]netip.Prefix{
+					"foo": {netip.MustParsePrefix("10.0.1.2/16")},
+				},
+			},
+			s2: &State{
+				HaveV4:                true,
+				HaveV6:                true,
+				IsExpensive:           true,
+				DefaultRouteInterface: "foo",
+				PAC:                   "http://wpad/wpad.dat",
+				InterfaceIPs: map[string][]netip.Prefix{
+					"foo": {netip.MustParsePrefix("10.0.1.2/16"), netip.MustParsePrefix("2001:db8::2/64")},
+				},
+			},
+			want:    true,
+			reasons: []string{"have-v6", "is-expensive", "pac", "interface-addrs-changed"},
 		},
 		{
 			name: "ipv6-ula-addressed-appeared",
@@ -196,7 +671,8 @@ func TestIsMajorChangeFrom(t *testing.T) {
 					},
 				},
 			},
-			want: true, // TODO(bradfitz): want false (ignore the IPv6 ULA address on foo)
+			want:    true, // TODO(bradfitz): want false (ignore the IPv6 ULA address on foo)
+			reasons: []string{"interface-addrs-changed"},
 		},
 	}
 	for _, tt := range tests {
@@ -222,6 +698,9 @@ func TestIsMajorChangeFrom(t *testing.T) {
 			if got := m.IsMajorChangeFrom(tt.s1, tt.s2); got != tt.want {
 				t.Errorf("IsMajorChange = %v; want %v", got, tt.want)
 			}
+			if got := m.MajorChangeReasons(tt.s1, tt.s2); !slices.Equal(got, tt.reasons) {
+				t.Errorf("MajorChangeReasons = %q; want %q", got, tt.reasons)
+			}
 		})
 	}
 }
@@ -237,3 +716,645 @@ func (m *testOSMon) IsInterestingInterface(name string) bool {
 	}
 	return m.Interesting(name)
 }
+
+func TestHasOtherVPN(t *testing.T) {
+	up := func(name string, idx int) Interface {
+		return Interface{Interface: &net.Interface{
+			Name:  name,
+			Index: idx,
+			Flags: net.FlagUp,
+		}}
+	}
+	newState := func(ifs ...Interface) *State {
+		s := &State{}
+		for _, iface := range ifs {
+			mak.Set(&s.Interface, iface.Name, iface)
+		}
+		return s
+	}
+	pfxs := func(ss ...string) []netip.Prefix {
+		var ret []netip.Prefix
+		for _, s := range ss {
+			ret = append(ret, netip.MustParsePrefix(s))
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name     string
+		tsIfName string
+		state    *State
+		ips      map[string][]netip.Prefix
+		override IsOtherVPNFunc
+		want     bool
+	}{
+		{
+			name:  "nil",
+			state: nil,
+			want:  false,
+		},
+		{
+			name:  "no-vpn",
+			state: newState(up("eth0", 1)),
+			ips:   map[string][]netip.Prefix{"eth0": pfxs("192.168.1.2/24")},
+			want:  false,
+		},
+		{
+			name:  "wireguard",
+			state: newState(up("eth0", 1), up("wg0", 2)),
+			ips: map[string][]netip.Prefix{
+				"eth0": pfxs("192.168.1.2/24"),
+				"wg0":  pfxs("10.8.0.2/24"),
+			},
+			want: true,
+		},
+		{
+			name:  "wireguard-down",
+			state: newState(up("eth0", 1), Interface{Interface: &net.Interface{Name: "wg0", Index: 2}}),
+			ips: map[string][]netip.Prefix{
+				"eth0": pfxs("192.168.1.2/24"),
+				"wg0":  pfxs("10.8.0.2/24"),
+			},
+			want: false,
+		},
+		{
+			name:  "utun-link-local-only",
+			state: newState(up("en0", 1), up("utun0", 2)),
+			ips: map[string][]netip.Prefix{
+				"en0":   pfxs("192.168.1.2/24"),
+				"utun0": pfxs("fe80::1/64"),
+			},
+			want: false,
+		},
+		{
+			name:     "tailscale-tun-excluded",
+			tsIfName: "tun0",
+			state:    newState(up("eth0", 1), up("tun0", 2)),
+			ips: map[string][]netip.Prefix{
+				"eth0": pfxs("192.168.1.2/24"),
+				"tun0": pfxs("100.64.1.2/32"),
+			},
+			want: false,
+		},
+		{
+			name:     "tailscale-and-wireguard",
+			tsIfName: "tailscale0",
+			state:    newState(up("eth0", 1), up("tailscale0", 2), up("wg0", 3)),
+			ips: map[string][]netip.Prefix{
+				"eth0":       pfxs("192.168.1.2/24"),
+				"tailscale0": pfxs("100.64.1.2/32"),
+				"wg0":        pfxs("10.8.0.2/24"),
+			},
+			want: true,
+		},
+		{
+			name:  "override",
+			state: newState(up("eth0", 1), up("wg0", 2)),
+			ips: map[string][]netip.Prefix{
+				"eth0": pfxs("192.168.1.2/24"),
+				"wg0":  pfxs("10.8.0.2/24"),
+			},
+			override: func(iface Interface, _ []netip.Prefix) bool { return iface.Name == "eth0" },
+			want:     true,
+		},
+		{
+			name:  "override-none",
+			state: newState(up("eth0", 1), up("wg0", 2)),
+			ips: map[string][]netip.Prefix{
+				"eth0": pfxs("192.168.1.2/24"),
+				"wg0":  pfxs("10.8.0.2/24"),
+			},
+			override: func(Interface, []netip.Prefix) bool { return false },
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.state != nil {
+				tt.state.InterfaceIPs = tt.ips
+			}
+			m := &Monitor{static: true, ifState: tt.state}
+			m.SetTailscaleInterfaceName(tt.tsIfName)
+			m.SetIsOtherVPNFunc(tt.override)
+			if got := m.hasOtherVPN(tt.state); got != tt.want {
+				t.Errorf("hasOtherVPN = %v; want %v", got, tt.want)
+			}
+			if got := m.HasOtherVPN(); got != tt.want {
+				t.Errorf("HasOtherVPN = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterfaceForAddr(t *testing.T) {
+	iface := func(name string, flags net.Flags) Interface {
+		return Interface{Interface: &net.Interface{Name: name, Flags: flags}}
+	}
+	st := &State{
+		Interface: map[string]Interface{
+			"lo":        iface("lo", net.FlagUp|net.FlagLoopback),
+			"eth0":      iface("eth0", net.FlagUp),
+			"eth1":      iface("eth1", net.FlagUp),
+			"docker0":   iface("docker0", net.FlagUp),
+			"wlan0":     iface("wlan0", 0), // down
+			"tailscale": iface("tailscale", net.FlagUp),
+		},
+		InterfaceIPs: map[string][]netip.Prefix{
+			"lo":        {netip.MustParsePrefix("127.0.0.1/8"), netip.MustParsePrefix("::1/128")},
+			"eth0":      {netip.MustParsePrefix("192.168.1.10/24"), netip.MustParsePrefix("2001:db8::10/64")},
+			"eth1":      {netip.MustParsePrefix("10.0.0.5/8")},
+			"docker0":   {netip.MustParsePrefix("10.1.0.1/16")},
+			"wlan0":     {netip.MustParsePrefix("172.16.0.2/12")},
+			"tailscale": {netip.MustParsePrefix("100.64.0.1/32")},
+		},
+		DefaultRouteInterface: "eth0",
+	}
+
+	tests := []struct {
+		name   string
+		state  *State
+		dst    string
+		want   string
+		wantOK bool
+	}{
+		{name: "on-link", state: st, dst: "192.168.1.99", want: "eth0", wantOK: true},
+		{name: "on-link-v4-mapped", state: st, dst: "::ffff:192.168.1.99", want: "eth0", wantOK: true},
+		{name: "on-link-v6", state: st, dst: "2001:db8::99", want: "eth0", wantOK: true},
+		{name: "most-specific", state: st, dst: "10.1.2.3", want: "docker0", wantOK: true},
+		{name: "less-specific", state: st, dst: "10.2.3.4", want: "eth1", wantOK: true},
+		{name: "loopback", state: st, dst: "127.0.0.1", want: "lo", wantOK: true},
+		{name: "own-ip", state: st, dst: "100.64.0.1", want: "tailscale", wantOK: true},
+		{name: "down-iface-uses-default", state: st, dst: "172.16.5.5", want: "eth0", wantOK: true},
+		{name: "default-route", state: st, dst: "8.8.8.8", want: "eth0", wantOK: true},
+		{name: "default-route-v6", state: st, dst: "2606:4700::1", want: "eth0", wantOK: true},
+		{
+			name: "default-lacks-family",
+			state: &State{
+				Interface:             map[string]Interface{"eth0": iface("eth0", net.FlagUp)},
+				InterfaceIPs:          map[string][]netip.Prefix{"eth0": {netip.MustParsePrefix("192.168.1.10/24")}},
+				DefaultRouteInterface: "eth0",
+			},
+			dst: "2606:4700::1",
+		},
+		{
+			name: "tie-prefers-default",
+			state: &State{
+				Interface: map[string]Interface{
+					"a": iface("a", net.FlagUp),
+					"b": iface("b", net.FlagUp),
+				},
+				InterfaceIPs: map[string][]netip.Prefix{
+					"a": {netip.MustParsePrefix("10.0.0.1/24")},
+					"b": {netip.MustParsePrefix("10.0.0.2/24")},
+				},
+				DefaultRouteInterface: "b",
+			},
+			dst:    "10.0.0.3",
+			want:   "b",
+			wantOK: true,
+		},
+		{
+			name: "no-default",
+			state: &State{
+				Interface:    map[string]Interface{"eth0": iface("eth0", net.FlagUp)},
+				InterfaceIPs: map[string][]netip.Prefix{"eth0": {netip.MustParsePrefix("192.168.1.10/24")}},
+			},
+			dst: "8.8.8.8",
+		},
+		{name: "nil-state", dst: "8.8.8.8"},
+		{name: "invalid-addr", state: st},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst netip.Addr
+			if tt.dst != "" {
+				dst = netip.MustParseAddr(tt.dst)
+			}
+			m := &Monitor{ifState: tt.state}
+			got, ok := m.InterfaceForAddr(dst)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("InterfaceForAddr(%v) = %q, %v; want %q, %v", dst, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRoutableInterfaceIPs(t *testing.T) {
+	iface := func(name string, flags net.Flags) Interface {
+		return Interface{Interface: &net.Interface{Name: name, Flags: flags}}
+	}
+	pfxs := func(ss ...string) []netip.Prefix {
+		var ret []netip.Prefix
+		for _, s := range ss {
+			ret = append(ret, netip.MustParsePrefix(s))
+		}
+		return ret
+	}
+	st := &State{
+		Interface: map[string]Interface{
+			"lo":         iface("lo", net.FlagUp|net.FlagLoopback),
+			"eth0":       iface("eth0", net.FlagUp),
+			"eth1":       iface("eth1", net.FlagUp),
+			"wlan0":      iface("wlan0", 0), // down
+			"tailscale0": iface("tailscale0", net.FlagUp),
+			"tun7":       iface("tun7", net.FlagUp),
+		},
+		InterfaceIPs: map[string][]netip.Prefix{
+			"lo":         pfxs("127.0.0.1/8", "::1/128"),
+			"eth0":       pfxs("fe80::1/64", "192.168.1.10/24", "2001:db8::10/64", "169.254.10.1/16"),
+			"eth1":       pfxs("10.0.0.5/8", "ff02::1/128", "192.168.1.10/24"),
+			"wlan0":      pfxs("172.16.0.2/12"),
+			"tailscale0": pfxs("100.64.0.1/32", "fd7a:115c:a1e0::1/128"),
+			"tun7":       pfxs("100.64.0.2/32"),
+		},
+	}
+
+	m := &Monitor{ifState: st, tsIfName: "tun7"}
+	want := pfxs("10.0.0.5/8", "192.168.1.10/24", "2001:db8::10/64")
+	if got := m.RoutableInterfaceIPs(); !slices.Equal(got, want) {
+		t.Errorf("RoutableInterfaceIPs = %v; want %v", got, want)
+	}
+
+	if got := (&Monitor{}).RoutableInterfaceIPs(); got != nil {
+		t.Errorf("RoutableInterfaceIPs with no state = %v; want nil", got)
+	}
+}
+
+func TestIsInterfaceUp(t *testing.T) {
+	iface := func(name string, flags net.Flags) Interface {
+		return Interface{Interface: &net.Interface{Name: name, Flags: flags}}
+	}
+	m := &Monitor{ifState: &State{
+		Interface: map[string]Interface{
+			"bond0": iface("bond0", net.FlagUp|net.FlagBroadcast),
+			"eth1":  iface("eth1", net.FlagBroadcast), // down
+		},
+	}}
+	for name, want := range map[string]bool{
+		"bond0": true,
+		"eth1":  false,
+		"eth2":  false, // unknown
+		"":      false,
+	} {
+		if got := m.IsInterfaceUp(name); got != want {
+			t.Errorf("IsInterfaceUp(%q) = %v; want %v", name, got, want)
+		}
+	}
+
+	if (&Monitor{}).IsInterfaceUp("bond0") {
+		t.Error("IsInterfaceUp with no state = true; want false")
+	}
+}
+
+func TestDNSConfigChanged(t *testing.T) {
+	newState := func(defaultRoute string, resolvers ...string) *State {
+		s := &State{DefaultRouteInterface: defaultRoute}
+		for i, name := range []string{"eth0", "wlan0"} {
+			mak.Set(&s.Interface, name, Interface{Interface: &net.Interface{Name: name, Index: i + 1, Flags: net.FlagUp}})
+			mak.Set(&s.InterfaceIPs, name, []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i), 1}), 24)})
+		}
+		for _, r := range resolvers {
+			s.DNSResolvers = append(s.DNSResolvers, netip.MustParseAddr(r))
+		}
+		return s
+	}
+
+	m := &Monitor{
+		logf:     t.Logf,
+		om:       &testOSMon{},
+		lastWall: wallTime(),
+		ifState:  newState("eth0", "192.168.1.1"),
+	}
+	deltas := make(chan *ChangeDelta, 10)
+	m.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+
+	steps := []struct {
+		name      string
+		state     *State
+		wantDNS   bool
+		wantMajor bool
+	}{
+		{"resolver-added", newState("eth0", "1.1.1.1", "192.168.1.1"), true, false},
+		{"resolver-replaced", newState("eth0", "10.0.0.1"), true, false},
+		{"resolvers-removed", newState("eth0"), true, false},
+		{"route-changed", newState("wlan0", "192.168.1.1"), true, true},
+		{"route-changed-back", newState("eth0", "192.168.1.1"), false, true},
+	}
+	for _, st := range steps {
+		m.handlePotentialChange(st.state, false)
+		select {
+		case d := <-deltas:
+			if d.DNSConfigChanged != st.wantDNS || d.Major != st.wantMajor {
+				t.Errorf("%s: DNSConfigChanged = %v, Major = %v; want %v, %v", st.name, d.DNSConfigChanged, d.Major, st.wantDNS, st.wantMajor)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timeout waiting for callback", st.name)
+		}
+	}
+}
+
+func TestInterfaceEvents(t *testing.T) {
+	newState := func(names ...string) *State {
+		s := &State{}
+		for i, name := range names {
+			mak.Set(&s.Interface, name, Interface{Interface: &net.Interface{
+				Name:  name,
+				Index: i + 1,
+				Flags: net.FlagUp,
+			}})
+			mak.Set(&s.InterfaceIPs, name, []netip.Prefix{
+				netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i), 1}), 24),
+			})
+		}
+		return s
+	}
+
+	m := &Monitor{
+		logf:     t.Logf,
+		om:       &testOSMon{},
+		lastWall: wallTime(),
+		tsIfName: "tailscale0",
+		ifState:  newState("eth0", "wlan0", "tailscale0"),
+	}
+	evc := make(chan InterfaceEvent, 10)
+	unregister := m.RegisterInterfaceEventCallback(func(ev InterfaceEvent) { evc <- ev })
+	defer unregister()
+
+	type ev struct {
+		name  string
+		added bool
+	}
+	steps := []struct {
+		name  string
+		state *State
+		want  []ev
+	}{
+		{"add", newState("eth0", "wlan0", "docker0"), []ev{{"docker0", true}}}, // tailscale0 removal is ignored
+		{"remove", newState("eth0", "docker0"), []ev{{"wlan0", false}}},
+		{"add-and-remove", newState("eth0", "usb0", "usb1"), []ev{{"docker0", false}, {"usb0", true}, {"usb1", true}}},
+		{"no-change", newState("eth0", "usb0", "usb1"), nil},
+	}
+	for _, st := range steps {
+		m.handlePotentialChange(st.state, true)
+		var got []ev
+		for range st.want {
+			select {
+			case e := <-evc:
+				if e.Added && !slices.Equal(e.IPs, st.state.InterfaceIPs[e.Name]) {
+					t.Errorf("%s: %s IPs = %v; want %v", st.name, e.Name, e.IPs, st.state.InterfaceIPs[e.Name])
+				}
+				if !e.Added && len(e.IPs) == 0 {
+					t.Errorf("%s: removed %s has no last known IPs", st.name, e.Name)
+				}
+				got = append(got, ev{e.Name, e.Added})
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timeout; got %v, want %v", st.name, got, st.want)
+			}
+		}
+		if !slices.Equal(got, st.want) {
+			t.Errorf("%s: got events %v; want %v", st.name, got, st.want)
+		}
+	}
+	select {
+	case e := <-evc:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestFlapDamping(t *testing.T) {
+	newState := func(names ...string) *State {
+		s := &State{}
+		for i, name := range names {
+			mak.Set(&s.Interface, name, Interface{Interface: &net.Interface{
+				Name:  name,
+				Index: i + 1,
+				Flags: net.FlagUp,
+			}})
+			mak.Set(&s.InterfaceIPs, name, []netip.Prefix{
+				netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i), 1}), 24),
+			})
+		}
+		return s
+	}
+
+	up, down := newState("eth0", "wlan0"), newState("eth0")
+	now := time.Unix(1000, 0)
+	m := &Monitor{
+		logf:     t.Logf,
+		om:       &testOSMon{},
+		lastWall: wallTime(),
+		ifState:  down,
+		nowFunc:  func() time.Time { return now },
+	}
+	m.SetFlapConfig(FlapConfig{Threshold: 3, Window: time.Minute, Cooldown: 30 * time.Second})
+	evc := make(chan InterfaceEvent, 10)
+	m.RegisterInterfaceEventCallback(func(ev InterfaceEvent) { evc <- ev })
+	deltas := make(chan *ChangeDelta, 10)
+	m.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+
+	type ev struct {
+		name  string
+		added bool
+	}
+	flapsBefore := metricIfaceFlap.Value()
+	steps := []struct {
+		name  string
+		after time.Duration
+		state *State
+		want  []ev
+		// wantOld, if non-nil, is the Old state of the ChangeDelta
+		// the step is delivered as; if nil, it's withheld.
+		wantOld *State
+	}{
+		{"up-1", time.Second, up, []ev{{"wlan0", true}}, down},
+		{"down-1", time.Second, down, []ev{{"wlan0", false}}, up},
+		{"up-2", time.Second, up, []ev{{"wlan0", true}}, down},
+		{"down-2", time.Second, down, []ev{{"wlan0", false}}, up}, // 4th change: flapping, damped from now on
+		{"up-damped", time.Second, up, nil, nil},
+		{"down-damped", time.Second, down, nil, nil},
+		{"up-damped-again", time.Second, up, nil, nil},
+		// After the cooldown, the next change delivers the withheld
+		// state of wlan0 along with its own events, and change
+		// callbacks see it as a change from the last state they saw.
+		{"after-cooldown", time.Minute, newState("eth0", "wlan0", "usb0"), []ev{{"wlan0", true}, {"usb0", true}}, down},
+	}
+	for _, st := range steps {
+		now = now.Add(st.after)
+		m.handlePotentialChange(st.state, true)
+		var got []ev
+		for range st.want {
+			select {
+			case e := <-evc:
+				got = append(got, ev{e.Name, e.Added})
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timeout; got %v, want %v", st.name, got, st.want)
+			}
+		}
+		select {
+		case e := <-evc:
+			t.Fatalf("%s: unexpected event %+v", st.name, e)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if !slices.Equal(got, st.want) {
+			t.Errorf("%s: got events %v; want %v", st.name, got, st.want)
+		}
+		select {
+		case d := <-deltas:
+			if st.wantOld == nil {
+				t.Errorf("%s: unexpected delta %+v", st.name, d)
+			} else if d.Old != st.wantOld || d.New != st.state {
+				t.Errorf("%s: delta from %v to %v; want from %v to %v", st.name, d.Old, d.New, st.wantOld, st.state)
+			}
+		case <-time.After(10 * time.Millisecond):
+			if st.wantOld != nil {
+				t.Errorf("%s: no delta delivered", st.name)
+			}
+		}
+	}
+	if got := metricIfaceFlap.Value() - flapsBefore; got != 1 {
+		t.Errorf("flap metric increased by %d; want 1", got)
+	}
+}
+
+func TestBurstWindow(t *testing.T) {
+	newState := func(names ...string) *State {
+		s := &State{}
+		for i, name := range names {
+			mak.Set(&s.Interface, name, Interface{Interface: &net.Interface{
+				Name:  name,
+				Index: i + 1,
+				Flags: net.FlagUp,
+			}})
+			mak.Set(&s.InterfaceIPs, name, []netip.Prefix{
+				netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i), 1}), 24),
+			})
+		}
+		return s
+	}
+
+	orig := newState("eth0", "wlan0")
+	m := &Monitor{
+		logf:     t.Logf,
+		om:       &testOSMon{},
+		lastWall: wallTime(),
+		ifState:  orig,
+	}
+	m.SetFlapConfig(FlapConfig{}) // no flap detection
+	m.SetBurstWindow(20 * time.Millisecond)
+	deltas := make(chan *ChangeDelta, 10)
+	m.RegisterChangeCallback(func(d *ChangeDelta) { deltas <- d })
+	evc := make(chan InterfaceEvent, 10)
+	m.RegisterInterfaceEventCallback(func(ev InterfaceEvent) { evc <- ev })
+	next := func(what string) *ChangeDelta {
+		t.Helper()
+		select {
+		case d := <-deltas:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timeout waiting for delta", what)
+		}
+		return nil
+	}
+	expectNone := func(what string) {
+		t.Helper()
+		select {
+		case d := <-deltas:
+			t.Fatalf("%s: unexpected delta %+v", what, d)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// wlan0 flaps down and back up within the window: a single delta
+	// with no net change, and no interface events.
+	m.handlePotentialChange(newState("eth0"), false)
+	up := newState("eth0", "wlan0")
+	m.handlePotentialChange(up, false)
+	d := next("flap")
+	if d.Old != orig || d.New != up {
+		t.Errorf("flap: delta from %v to %v; want from %v to %v", d.Old, d.New, orig, up)
+	}
+	if !d.ChurnedButNetNoChange || d.Major || len(d.MajorReasons) > 0 {
+		t.Errorf("flap: ChurnedButNetNoChange=%v Major=%v MajorReasons=%q; want true, false, none",
+			d.ChurnedButNetNoChange, d.Major, d.MajorReasons)
+	}
+	expectNone("flap")
+	select {
+	case ev := <-evc:
+		t.Errorf("flap: unexpected interface event %+v", ev)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// A burst that doesn't revert is a normal change from before it.
+	m.handlePotentialChange(newState("eth0"), false)
+	m.handlePotentialChange(newState("eth0", "wlan0"), false)
+	down := newState("eth0")
+	m.handlePotentialChange(down, false)
+	d = next("net change")
+	if d.Old != up || d.New != down {
+		t.Errorf("net change: delta from %v to %v; want from %v to %v", d.Old, d.New, up, down)
+	}
+	if d.ChurnedButNetNoChange || !d.Major || !slices.Equal(d.MajorReasons, []string{"interface-removed"}) {
+		t.Errorf("net change: ChurnedButNetNoChange=%v Major=%v MajorReasons=%q; want false, true, [interface-removed]",
+			d.ChurnedButNetNoChange, d.Major, d.MajorReasons)
+	}
+	expectNone("net change")
+
+	// Without a window, each change is delivered as it's seen.
+	m.SetBurstWindow(0)
+	m.handlePotentialChange(newState("eth0", "wlan0"), false)
+	m.handlePotentialChange(newState("eth0"), false)
+	for i := range 2 {
+		if d := next("no window"); d.ChurnedButNetNoChange || !d.Major {
+			t.Errorf("no window: delta %d: ChurnedButNetNoChange=%v Major=%v; want false, true", i, d.ChurnedButNetNoChange, d.Major)
+		}
+	}
+	expectNone("no window")
+
+	// What changed while paused joins a burst on Resume, so a change
+	// right after it that reverts it is merged with it.
+	m.SetBurstWindow(20 * time.Millisecond)
+	m.Pause()
+	m.handlePotentialChange(newState("eth0", "wlan0"), false)
+	m.Resume()
+	m.handlePotentialChange(newState("eth0"), false)
+	if d := next("resume"); !d.ChurnedButNetNoChange || d.Major {
+		t.Errorf("resume: ChurnedButNetNoChange=%v Major=%v; want true, false", d.ChurnedButNetNoChange, d.Major)
+	}
+	expectNone("resume")
+
+	// Turning the window off delivers a burst in progress right away.
+	m.SetBurstWindow(time.Hour)
+	m.handlePotentialChange(newState("eth0", "wlan0"), false)
+	expectNone("burst in progress")
+	m.SetBurstWindow(0)
+	if d := next("window turned off"); !d.Major {
+		t.Errorf("window turned off: delta isn't Major: %+v", d)
+	}
+}
+
+func TestMetricSecsSinceChange(t *testing.T) {
+	st := &State{DefaultRouteInterface: "eth0"}
+	m := &Monitor{
+		logf:    t.Logf,
+		om:      &testOSMon{},
+		ifState: st,
+	}
+	hourAgo := mono.Now().Add(-time.Hour)
+	lastChange.StoreAtomic(hourAgo)
+	t.Cleanup(func() { lastChange.StoreAtomic(mono.Now()) })
+	if got := metricSecsSinceChange.Value(); got < 3600 {
+		t.Fatalf("before change: got %d; want at least 3600", got)
+	}
+
+	// An equal state isn't a change, even if callbacks are forced.
+	m.handlePotentialChange(st, true)
+	if got := metricSecsSinceChange.Value(); got < 3600 {
+		t.Errorf("after equal state: got %d; want at least 3600", got)
+	}
+
+	m.handlePotentialChange(&State{DefaultRouteInterface: "wlan0"}, false)
+	if got := metricSecsSinceChange.Value(); got > 1 {
+		t.Errorf("after change: got %d; want near 0", got)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package netmontest contains a fake netmon.Observer for tests.
+package netmontest
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"tailscale.com/net/netmon"
+	"tailscale.com/util/mak"
+)
+
+var _ netmon.Observer = (*FakeMonitor)(nil)
+
+// FakeMonitor is a netmon.Observer whose network state is set by tests
+// rather than read from the OS.
+//
+// Unlike a netmon.Monitor, it calls its callbacks synchronously, in the
+// goroutine that changed the state, so that tests don't need to wait for
+// them. Callbacks may read the FakeMonitor's state, but must not change it.
+// The ChangeDeltas it sends have a nil Monitor field.
+//
+// The zero value is not valid; use NewFakeMonitor.
+type FakeMonitor struct {
+	// changeMu serializes state changes and the callbacks they make, so
+	// callbacks see changes in order and coalesced callbacks are never
+	// called concurrently.
+	changeMu sync.Mutex
+
+	mu         sync.Mutex // guards the following
+	state      *netmon.State
+	gw, selfIP netip.Addr
+	lastID     int                       // of the most recently registered callback
+	cbs        map[int]netmon.ChangeFunc // by registration ID
+	ruleDelCB  map[int]netmon.RuleDeleteCallback
+	ifEventCB  map[int]netmon.InterfaceEventFunc
+}
+
+// NewFakeMonitor returns a FakeMonitor whose initial state is st, which
+// must not be nil. The caller must not modify st afterwards.
+func NewFakeMonitor(st *netmon.State) *FakeMonitor {
+	if st == nil {
+		panic("NewFakeMonitor: nil State")
+	}
+	return &FakeMonitor{state: st}
+}
+
+// InterfaceState returns the state most recently set with NewFakeMonitor
+// or SetState.
+func (m *FakeMonitor) InterfaceState() *netmon.State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// InterfaceForAddr implements netmon.Observer using the current state.
+func (m *FakeMonitor) InterfaceForAddr(dst netip.Addr) (ifName string, ok bool) {
+	return m.InterfaceState().InterfaceForAddr(dst)
+}
+
+// GatewayAndSelfIP returns the addresses set with SetGatewayAndSelfIP.
+// It reports !ok until both are set.
+func (m *FakeMonitor) GatewayAndSelfIP() (gw, myIP netip.Addr, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.gw.IsValid() || !m.selfIP.IsValid() {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	return m.gw, m.selfIP, true
+}
+
+// SetGatewayAndSelfIP sets the addresses that GatewayAndSelfIP returns.
+// Invalid addresses make it report !ok.
+func (m *FakeMonitor) SetGatewayAndSelfIP(gw, selfIP netip.Addr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gw, m.selfIP = gw, selfIP
+}
+
+// RegisterChangeCallback implements netmon.Observer.
+func (m *FakeMonitor) RegisterChangeCallback(cb netmon.ChangeFunc) (unregister func()) {
+	return register(m, &m.cbs, cb)
+}
+
+// RegisterCoalescedChangeCallback implements netmon.Observer. As
+// FakeMonitor delivers changes synchronously and one at a time, it's the
+// same as RegisterChangeCallback.
+func (m *FakeMonitor) RegisterCoalescedChangeCallback(cb netmon.ChangeFunc) (unregister func()) {
+	return register(m, &m.cbs, cb)
+}
+
+// RegisterRuleDeleteCallback implements netmon.Observer. The callbacks are
+// called by DeleteRule.
+func (m *FakeMonitor) RegisterRuleDeleteCallback(cb netmon.RuleDeleteCallback) (unregister func()) {
+	return register(m, &m.ruleDelCB, cb)
+}
+
+// RegisterInterfaceEventCallback implements netmon.Observer. The callbacks
+// are called by SetState for the interfaces it adds and removes.
+func (m *FakeMonitor) RegisterInterfaceEventCallback(cb netmon.InterfaceEventFunc) (unregister func()) {
+	return register(m, &m.ifEventCB, cb)
+}
+
+// register adds cb to the callbacks in *cbs, returning a func to remove it.
+func register[T any](m *FakeMonitor, cbs *map[int]T, cb T) (unregister func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastID++
+	id := m.lastID
+	mak.Set(cbs, id, cb)
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(*cbs, id)
+	}
+}
+
+// SetState replaces the current state with st, which must not be nil,
+// and notifies the change callbacks with the resulting ChangeDelta, as
+// Inject does. The caller must not modify st afterwards.
+//
+// Nothing is sent if st is equal to the current state.
+func (m *FakeMonitor) SetState(st *netmon.State) {
+	if st == nil {
+		panic("SetState: nil State")
+	}
+	m.changeMu.Lock()
+	defer m.changeMu.Unlock()
+	old := m.InterfaceState()
+	if old.Equal(st) {
+		return
+	}
+	reasons := new(netmon.Monitor).MajorChangeReasons(old, st)
+	m.injectLocked(&netmon.ChangeDelta{
+		Old:              old,
+		New:              st,
+		Major:            len(reasons) > 0,
+		MajorReasons:     reasons,
+		HasOtherVPN:      st.HasOtherVPN,
+		DNSConfigChanged: st.DNSConfigChangedFrom(old),
+	})
+}
+
+// Inject makes d.New, which must not be nil, the current state and
+// notifies the change callbacks with d as is, followed by the interface
+// event callbacks for any interfaces added or removed relative to d.Old.
+// It's for tests that need to control all of the ChangeDelta's fields,
+// such as TimeJumped; most tests should use SetState.
+func (m *FakeMonitor) Inject(d *netmon.ChangeDelta) {
+	if d == nil || d.New == nil {
+		panic("Inject: nil ChangeDelta or New State")
+	}
+	m.changeMu.Lock()
+	defer m.changeMu.Unlock()
+	m.injectLocked(d)
+}
+
+// injectLocked implements Inject. m.changeMu must be held.
+func (m *FakeMonitor) injectLocked(d *netmon.ChangeDelta) {
+	m.mu.Lock()
+	m.state = d.New
+	cbs := collect(m.cbs)
+	ifEventCBs := collect(m.ifEventCB)
+	m.mu.Unlock()
+
+	for _, cb := range cbs {
+		dc := *d
+		cb(&dc)
+	}
+	evs := interfaceEvents(d.Old, d.New)
+	for _, cb := range ifEventCBs {
+		for _, ev := range evs {
+			cb(ev)
+		}
+	}
+}
+
+// DeleteRule calls the rule delete callbacks as if the Linux ip rule with
+// the given table and priority had been deleted.
+func (m *FakeMonitor) DeleteRule(table uint8, priority uint32) {
+	m.changeMu.Lock()
+	defer m.changeMu.Unlock()
+	m.mu.Lock()
+	cbs := collect(m.ruleDelCB)
+	m.mu.Unlock()
+	for _, cb := range cbs {
+		cb(table, priority)
+	}
+}
+
+// collect returns the callbacks in cbs, in the order they were registered.
+func collect[T any](cbs map[int]T) []T {
+	ret := make([]T, 0, len(cbs))
+	for _, id := range slices.Sorted(maps.Keys(cbs)) {
+		ret = append(ret, cbs[id])
+	}
+	return ret
+}
+
+// interfaceEvents returns the interfaces removed in s2 relative to s1,
+// followed by those added, each sorted by name, like netmon.Monitor
+// reports them. It returns nil if s1 is nil.
+func interfaceEvents(s1, s2 *netmon.State) []netmon.InterfaceEvent {
+	if s1 == nil {
+		return nil
+	}
+	var evs []netmon.InterfaceEvent
+	for _, name := range slices.Sorted(maps.Keys(s1.Interface)) {
+		if _, ok := s2.Interface[name]; !ok {
+			evs = append(evs, netmon.InterfaceEvent{Name: name, IPs: s1.InterfaceIPs[name]})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s2.Interface)) {
+		if _, ok := s1.Interface[name]; !ok {
+			evs = append(evs, netmon.InterfaceEvent{Name: name, Added: true, IPs: s2.InterfaceIPs[name]})
+		}
+	}
+	return evs
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netmontest
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"tailscale.com/net/netmon"
+)
+
+func TestFakeMonitor(t *testing.T) {
+	eth0 := netmon.Interface{Interface: &net.Interface{Index: 2, Name: "eth0", Flags: net.FlagUp}}
+	wlan0 := netmon.Interface{Interface: &net.Interface{Index: 3, Name: "wlan0", Flags: net.FlagUp}}
+	st1 := &netmon.State{
+		Interface:             map[string]netmon.Interface{"eth0": eth0},
+		InterfaceIPs:          map[string][]netip.Prefix{"eth0": {netip.MustParsePrefix("192.168.0.2/24")}},
+		HaveV4:                true,
+		DefaultRouteInterface: "eth0",
+	}
+	st2 := &netmon.State{
+		Interface:             map[string]netmon.Interface{"wlan0": wlan0},
+		InterfaceIPs:          map[string][]netip.Prefix{"wlan0": {netip.MustParsePrefix("10.0.0.2/24")}},
+		HaveV4:                true,
+		DefaultRouteInterface: "wlan0",
+	}
+
+	m := NewFakeMonitor(st1)
+	var got []string
+	var deltas []*netmon.ChangeDelta
+	m.RegisterChangeCallback(func(d *netmon.ChangeDelta) {
+		got = append(got, "first")
+		deltas = append(deltas, d)
+	})
+	unregister := m.RegisterCoalescedChangeCallback(func(*netmon.ChangeDelta) { got = append(got, "second") })
+	var evs []netmon.InterfaceEvent
+	m.RegisterInterfaceEventCallback(func(ev netmon.InterfaceEvent) { evs = append(evs, ev) })
+
+	m.SetState(st1) // no change
+	if len(got) != 0 {
+		t.Fatalf("callbacks called for unchanged state: %q", got)
+	}
+
+	m.SetState(st2)
+	if want := []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("callbacks = %q; want %q", got, want)
+	}
+	if d := deltas[0]; d.Old != st1 || d.New != st2 || !d.Major {
+		t.Errorf("delta = {Old: %v, New: %v, Major: %v}; want st1 to st2, major", d.Old, d.New, d.Major)
+	}
+	if m.InterfaceState() != st2 {
+		t.Error("InterfaceState didn't change")
+	}
+	wantEvs := []netmon.InterfaceEvent{
+		{Name: "eth0", IPs: st1.InterfaceIPs["eth0"]},
+		{Name: "wlan0", Added: true, IPs: st2.InterfaceIPs["wlan0"]},
+	}
+	if !reflect.DeepEqual(evs, wantEvs) {
+		t.Errorf("interface events = %+v; want %+v", evs, wantEvs)
+	}
+
+	got = nil
+	unregister()
+	m.Inject(&netmon.ChangeDelta{Old: st2, New: st2, TimeJumped: true})
+	if want := []string{"first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after unregister, callbacks = %q; want %q", got, want)
+	}
+	if !deltas[1].TimeJumped {
+		t.Error("injected delta not delivered as is")
+	}
+
+	if _, _, ok := m.GatewayAndSelfIP(); ok {
+		t.Error("GatewayAndSelfIP ok before being set")
+	}
+	gw, self := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	m.SetGatewayAndSelfIP(gw, self)
+	if gotGW, gotSelf, ok := m.GatewayAndSelfIP(); !ok || gotGW != gw || gotSelf != self {
+		t.Errorf("GatewayAndSelfIP = %v, %v, %v; want %v, %v, true", gotGW, gotSelf, ok, gw, self)
+	}
+
+	var rule [2]uint32
+	m.RegisterRuleDeleteCallback(func(table uint8, priority uint32) { rule = [2]uint32{uint32(table), priority} })
+	m.DeleteRule(52, 5270)
+	if rule != [2]uint32{52, 5270} {
+		t.Errorf("rule delete callback got %v", rule)
+	}
+}
@@ -6,6 +6,7 @@
 import (
 	"bytes"
 	"fmt"
+	"maps"
 	"net"
 	"net/http"
 	"net/netip"
@@ -19,6 +20,7 @@
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tshttpproxy"
+	"tailscale.com/util/set"
 )
 
 // LoginEndpointForProxyDetermination is the URL used for testing
@@ -131,6 +133,17 @@ type Interface struct {
 	*net.Interface
 	AltAddrs []net.Addr // if non-nil, returned by Addrs
 	Desc     string     // extra description (used on Windows)
+
+	// Type is the best-effort type of the interface, as reported by the
+	// registered MetadataProvider or else returned by ClassifyInterface.
+	// It's populated by GetState.
+	Type InterfaceType
+
+	// Expensive and Signal are as reported by the registered
+	// MetadataProvider; see InterfaceMetadata. They're populated by
+	// GetState.
+	Expensive bool
+	Signal    int
 }
 
 func (i Interface) IsLoopback() bool { return isLoopback(i.Interface) }
@@ -230,7 +243,9 @@ type State struct {
 
 	// IsExpensive is whether the current network interface is
 	// considered "expensive", which currently means LTE/etc
-	// instead of Wifi. This field is not populated by GetState.
+	// instead of Wifi. GetState only sets it if the registered
+	// MetadataProvider reports the default route interface as expensive;
+	// callers may set it from other sources.
 	IsExpensive bool
 
 	// DefaultRouteInterface is the interface name for the
@@ -247,6 +262,20 @@ type State struct {
 
 	// PAC is the URL to the Proxy Autoconfig URL, if applicable.
 	PAC string
+
+	// DNSResolvers are the addresses of the system's DNS resolvers,
+	// sorted and without duplicates. Tailscale's own resolver (see
+	// tsaddr.TailscaleServiceIP) is left out, as it's not a property of
+	// the network.
+	//
+	// It is not yet populated on all OSes.
+	DNSResolvers []netip.Addr
+
+	// HasOtherVPN is whether some interface other than Tailscale's looks
+	// like it belongs to another VPN or tunnel. This field is not populated
+	// by GetState; it's set by Monitor, which knows the Tailscale interface
+	// name. See Monitor.SetIsOtherVPNFunc.
+	HasOtherVPN bool
 }
 
 func (s *State) String() string {
@@ -257,6 +286,9 @@ func (s *State) String() string {
 			fmt.Fprintf(&sb, "(%s) ", iface.Desc)
 		}
 	}
+	if t := s.DefaultRouteInterfaceType(); t != InterfaceTypeUnknown {
+		fmt.Fprintf(&sb, "type=%v ", t)
+	}
 	sb.WriteString("ifs={")
 	var ifs []string
 	for k := range s.Interface {
@@ -322,6 +354,9 @@ func (s *State) String() string {
 	if s.PAC != "" {
 		fmt.Fprintf(&sb, " pac=%s", s.PAC)
 	}
+	if s.HasOtherVPN {
+		sb.WriteString(" othervpn")
+	}
 	fmt.Fprintf(&sb, " v4=%v v6=%v}", s.HaveV4, s.HaveV6)
 	return sb.String()
 }
@@ -339,7 +374,9 @@ func (s *State) Equal(s2 *State) bool {
 		s.IsExpensive != s2.IsExpensive ||
 		s.DefaultRouteInterface != s2.DefaultRouteInterface ||
 		s.HTTPProxy != s2.HTTPProxy ||
-		s.PAC != s2.PAC {
+		s.PAC != s2.PAC ||
+		s.HasOtherVPN != s2.HasOtherVPN ||
+		!slices.Equal(s.DNSResolvers, s2.DNSResolvers) {
 		return false
 	}
 	// If s2 has more interfaces than s, it's not equal.
@@ -366,6 +403,132 @@ func (s *State) Equal(s2 *State) bool {
 	return true
 }
 
+// StateDiff describes how one State differs from another. See State.Diff.
+type StateDiff struct {
+	// Added and Removed are the names of the interfaces that are only in
+	// the new state or only in the old one, respectively, sorted.
+	Added   []string
+	Removed []string
+
+	// Modified are the interfaces in both states that differ, sorted by
+	// name.
+	Modified []InterfaceDiff
+
+	// Fields are the names of the other State fields that differ, such as
+	// "HaveV4" or "DefaultRouteInterface", in the order they're declared.
+	Fields []string
+}
+
+// IsZero reports whether d describes no difference at all, as it does for
+// two States that are Equal.
+func (d StateDiff) IsZero() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0 && len(d.Fields) == 0
+}
+
+// InterfaceDiff describes how an interface differs between two States.
+type InterfaceDiff struct {
+	Name string
+
+	// Changed is whether the interface itself differs, as reported by
+	// Interface.Equal, such as in its flags, MTU or description.
+	Changed bool
+
+	// FlagsChanged are the interface flags that were set or cleared.
+	FlagsChanged net.Flags
+
+	// AddrsAdded and AddrsRemoved are the interface's addresses (see
+	// State.InterfaceIPs) that are only in the new state or only in the
+	// old one, respectively.
+	AddrsAdded   []netip.Prefix
+	AddrsRemoved []netip.Prefix
+}
+
+// Diff returns how s2 differs from s, taking s as the old state and s2 as
+// the new one. It compares the same things as Equal, so the result IsZero
+// exactly when s.Equal(s2), except that a nil State is treated as an empty
+// one rather than as unknown.
+//
+// An interface counts as present in a State if it's in either its
+// Interface or its InterfaceIPs map.
+func (s *State) Diff(s2 *State) StateDiff {
+	if s == nil {
+		s = new(State)
+	}
+	if s2 == nil {
+		s2 = new(State)
+	}
+	var d StateDiff
+	for _, f := range []struct {
+		name  string
+		equal bool
+	}{
+		{"HaveV6", s.HaveV6 == s2.HaveV6},
+		{"HaveV4", s.HaveV4 == s2.HaveV4},
+		{"IsExpensive", s.IsExpensive == s2.IsExpensive},
+		{"DefaultRouteInterface", s.DefaultRouteInterface == s2.DefaultRouteInterface},
+		{"HTTPProxy", s.HTTPProxy == s2.HTTPProxy},
+		{"PAC", s.PAC == s2.PAC},
+		{"DNSResolvers", slices.Equal(s.DNSResolvers, s2.DNSResolvers)},
+		{"HasOtherVPN", s.HasOtherVPN == s2.HasOtherVPN},
+	} {
+		if !f.equal {
+			d.Fields = append(d.Fields, f.name)
+		}
+	}
+
+	has := func(st *State, name string) bool {
+		_, ok1 := st.Interface[name]
+		_, ok2 := st.InterfaceIPs[name]
+		return ok1 || ok2
+	}
+	names := make(set.Set[string])
+	for _, st := range []*State{s, s2} {
+		for name := range st.Interface {
+			names.Add(name)
+		}
+		for name := range st.InterfaceIPs {
+			names.Add(name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		in1, in2 := has(s, name), has(s2, name)
+		switch {
+		case !in1:
+			d.Added = append(d.Added, name)
+			continue
+		case !in2:
+			d.Removed = append(d.Removed, name)
+			continue
+		}
+		i1, i2 := s.Interface[name], s2.Interface[name]
+		id := InterfaceDiff{
+			Name:         name,
+			Changed:      !i1.Equal(i2),
+			AddrsAdded:   prefixesNotIn(s2.InterfaceIPs[name], s.InterfaceIPs[name]),
+			AddrsRemoved: prefixesNotIn(s.InterfaceIPs[name], s2.InterfaceIPs[name]),
+		}
+		if i1.Interface != nil && i2.Interface != nil {
+			id.FlagsChanged = i1.Flags ^ i2.Flags
+		}
+		// Equal also compares the order of the addresses.
+		if id.Changed || !slices.Equal(s.InterfaceIPs[name], s2.InterfaceIPs[name]) {
+			d.Modified = append(d.Modified, id)
+		}
+	}
+	return d
+}
+
+// prefixesNotIn returns the prefixes in a that aren't in b.
+func prefixesNotIn(a, b []netip.Prefix) []netip.Prefix {
+	var ret []netip.Prefix
+	for _, p := range a {
+		if !slices.Contains(b, p) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
 // HasIP reports whether any interface has the provided IP address.
 func (s *State) HasIP(ip netip.Addr) bool {
 	if s == nil {
@@ -381,11 +544,63 @@ func (s *State) HasIP(ip netip.Addr) bool {
 	return false
 }
 
+// InterfaceForAddr reports the name of the interface that traffic to dst
+// would most likely be sent from, based only on s.
+//
+// It's a best-effort guess, as s has no routing table: if dst is on the
+// subnet of an up interface, that interface is used (the most specific
+// subnet wins), and otherwise the default route interface is used if it
+// has an address of dst's family.
+func (s *State) InterfaceForAddr(dst netip.Addr) (ifName string, ok bool) {
+	if s == nil || !dst.IsValid() {
+		return "", false
+	}
+	dst = dst.Unmap()
+	up := func(name string) bool {
+		iface, ok := s.Interface[name]
+		return ok && iface.Interface != nil && iface.IsUp()
+	}
+	bestBits := -1
+	for name, pfxs := range s.InterfaceIPs {
+		if !up(name) {
+			continue
+		}
+		for _, pfx := range pfxs {
+			if !pfx.Contains(dst) || pfx.Bits() < bestBits {
+				continue
+			}
+			// On a tie, prefer the default route interface, and then the
+			// lowest name, so the result doesn't depend on map order.
+			if pfx.Bits() == bestBits && (ifName == s.DefaultRouteInterface ||
+				name != s.DefaultRouteInterface && name > ifName) {
+				continue
+			}
+			ifName, bestBits = name, pfx.Bits()
+		}
+	}
+	if bestBits >= 0 {
+		return ifName, true
+	}
+
+	def := s.DefaultRouteInterface
+	if def == "" || !up(def) {
+		return "", false
+	}
+	for _, pfx := range s.InterfaceIPs[def] {
+		if pfx.Addr().Is4() == dst.Is4() {
+			return def, true
+		}
+	}
+	return "", false
+}
+
 func (a Interface) Equal(b Interface) bool {
 	if (a.Interface == nil) != (b.Interface == nil) {
 		return false
 	}
-	if !(a.Desc == b.Desc && netAddrsEqual(a.AltAddrs, b.AltAddrs)) {
+	// Signal is left out: it changes all the time without the
+	// interface changing in any way that matters.
+	if !(a.Desc == b.Desc && a.Type == b.Type && a.Expensive == b.Expensive && netAddrsEqual(a.AltAddrs, b.AltAddrs)) {
 		return false
 	}
 	if a.Interface != nil && !(a.Index == b.Index &&
@@ -400,6 +615,13 @@ func (a Interface) Equal(b Interface) bool {
 
 func (s *State) HasPAC() bool { return s != nil && s.PAC != "" }
 
+// DNSConfigChangedFrom reports whether the system's DNS resolvers in s
+// differ from those in old. It reports false if either is nil, as
+// there's nothing to compare.
+func (s *State) DNSConfigChangedFrom(old *State) bool {
+	return s != nil && old != nil && !slices.Equal(s.DNSResolvers, old.DNSResolvers)
+}
+
 // AnyInterfaceUp reports whether any interface seems like it has Internet access.
 func (s *State) AnyInterfaceUp() bool {
 	if runtime.GOOS == "js" || runtime.GOOS == "tamago" {
@@ -446,9 +668,50 @@ func isTailscaleInterface(name string, ips []netip.Prefix) bool {
 // getPAC, if non-nil, returns the current PAC file URL.
 var getPAC func() string
 
+// getDNSResolvers, if non-nil, returns the addresses of the system's DNS
+// resolvers, in any order. They're cleaned up by cleanDNSResolvers.
+var getDNSResolvers func() []netip.Addr
+
+// cleanDNSResolvers returns addrs as a State.DNSResolvers value: unmapped,
+// sorted, without duplicates or Tailscale's own resolver. It modifies
+// addrs in place.
+func cleanDNSResolvers(addrs []netip.Addr) []netip.Addr {
+	for i, a := range addrs {
+		addrs[i] = a.Unmap()
+	}
+	addrs = slices.DeleteFunc(addrs, func(a netip.Addr) bool {
+		return !a.IsValid() || a == tsaddr.TailscaleServiceIP() || a == tsaddr.TailscaleServiceIPv6()
+	})
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	addrs = slices.Compact(addrs)
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs
+}
+
+// parseResolvConfNameservers returns the addresses of the nameservers in
+// b, the contents of a resolv.conf file. Lines it doesn't understand are
+// skipped.
+func parseResolvConfNameservers(b []byte) []netip.Addr {
+	var ret []netip.Addr
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "nameserver" {
+			continue
+		}
+		if a, err := netip.ParseAddr(f[1]); err == nil {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
 // GetState returns the state of all the current machine's network interfaces.
 //
-// It does not set the returned State.IsExpensive. The caller can populate that.
+// It only sets the returned State.IsExpensive if the registered
+// MetadataProvider reports the default route's interface as expensive. The
+// caller can populate it otherwise.
 //
 // Deprecated: use netmon.Monitor.InterfaceState instead.
 func GetState() (*State, error) {
@@ -458,6 +721,7 @@ func GetState() (*State, error) {
 	}
 	if err := ForeachInterface(func(ni Interface, pfxs []netip.Prefix) {
 		ifUp := ni.IsUp()
+		ni = classifyWithMetadata(ni)
 		s.Interface[ni.Name] = ni
 		s.InterfaceIPs[ni.Name] = append(s.InterfaceIPs[ni.Name], pfxs...)
 		if !ifUp || isTailscaleInterface(ni.Name, pfxs) {
@@ -481,9 +745,13 @@ func GetState() (*State, error) {
 	if desc := dr.InterfaceDesc; desc != "" {
 		if iface, ok := s.Interface[dr.InterfaceName]; ok {
 			iface.Desc = desc
+			iface = classifyWithMetadata(iface)
 			s.Interface[dr.InterfaceName] = iface
 		}
 	}
+	if iface, ok := s.Interface[dr.InterfaceName]; ok && iface.Expensive {
+		s.IsExpensive = true
+	}
 
 	if s.AnyInterfaceUp() {
 		req, err := http.NewRequest("GET", LoginEndpointForProxyDetermination, nil)
@@ -497,6 +765,9 @@ func GetState() (*State, error) {
 			s.PAC = getPAC()
 		}
 	}
+	if getDNSResolvers != nil {
+		s.DNSResolvers = cleanDNSResolvers(getDNSResolvers())
+	}
 
 	return s, nil
 }
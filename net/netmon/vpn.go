@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netmon
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// otherVPNInterfacePrefixes are the interface name prefixes that are commonly
+// used by VPN and tunnel software.
+var otherVPNInterfacePrefixes = []string{
+	"tun",
+	"tap",
+	"ppp",
+	"wg",
+	"utun",
+	"ipsec",
+	"gpd", // GlobalProtect
+}
+
+// IsOtherVPNFunc reports whether the provided interface, with its addresses,
+// looks like it belongs to a VPN or tunnel other than Tailscale.
+type IsOtherVPNFunc func(iface Interface, ips []netip.Prefix) bool
+
+// DefaultIsOtherVPN is the default heuristic used by Monitor to decide whether
+// an interface belongs to another VPN. It matches up interfaces whose names
+// look like tunnel devices and that have at least one address that isn't
+// link-local or loopback.
+//
+// The caller is responsible for excluding the Tailscale interface itself.
+func DefaultIsOtherVPN(iface Interface, ips []netip.Prefix) bool {
+	if iface.Interface == nil || !iface.IsUp() || iface.IsLoopback() {
+		return false
+	}
+	name := strings.ToLower(iface.Name)
+	matched := false
+	for _, p := range otherVPNInterfacePrefixes {
+		if strings.HasPrefix(name, p) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	// macOS creates several utun devices for system services that only
+	// have link-local addresses; don't count those.
+	for _, pfx := range ips {
+		a := pfx.Addr()
+		if !a.IsLinkLocalUnicast() && !a.IsLoopback() && !a.IsMulticast() {
+			return true
+		}
+	}
+	return false
+}
+
+// SetIsOtherVPNFunc overrides the heuristic used to compute
+// State.HasOtherVPN. A nil fn restores DefaultIsOtherVPN.
+//
+// This must be called only early in tailscaled startup before the monitor is
+// used.
+func (m *Monitor) SetIsOtherVPNFunc(fn IsOtherVPNFunc) {
+	m.isOtherVPN = fn
+}
+
+// hasOtherVPN reports whether st contains an interface, other than the
+// Tailscale interface, that looks like it belongs to another VPN.
+func (m *Monitor) hasOtherVPN(st *State) bool {
+	if st == nil {
+		return false
+	}
+	isOtherVPN := m.isOtherVPN
+	if isOtherVPN == nil {
+		isOtherVPN = DefaultIsOtherVPN
+	}
+	for name, iface := range st.Interface {
+		ips := st.InterfaceIPs[name]
+		if name == m.tsIfName || isTailscaleInterface(name, ips) {
+			continue
+		}
+		if isOtherVPN(iface, ips) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasOtherVPN reports whether the most recent network state contains a VPN or
+// tunnel interface other than Tailscale's. It's a heuristic intended to help
+// diagnose routing conflicts with other VPN software.
+func (m *Monitor) HasOtherVPN() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Recompute rather than using ifState.HasOtherVPN, as the first state
+	// may have been gathered before SetTailscaleInterfaceName was called.
+	return m.hasOtherVPN(m.ifState)
+}
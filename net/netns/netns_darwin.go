@@ -21,6 +21,7 @@
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
 )
 
 func control(logf logger.Logf, netMon *netmon.Monitor) func(network, address string, c syscall.RawConn) error {
@@ -53,6 +54,11 @@ func controlLogf(logf logger.Logf, netMon *netmon.Monitor, network, address stri
 		// callee logged
 		return nil
 	}
+	if err := checkInterfaceFamily(logf, netMon, idx, address); err != nil {
+		// Fail the dial rather than leave the socket unbound, which
+		// could route it over the Tailscale interface and loop.
+		return err
+	}
 
 	return bindConnToInterface(c, network, address, idx, logf)
 }
@@ -106,7 +112,7 @@ func getInterfaceIndex(logf logger.Logf, netMon *netmon.Monitor, address string)
 
 	// Verify that we didn't just choose the Tailscale interface;
 	// if so, we fall back to binding from the default.
-	tsif, err2 := tailscaleInterface()
+	tsif, err2 := tailscaleInterface(netMon)
 	if err2 == nil && tsif != nil && tsif.Index == idx {
 		logf("[unexpected] netns: interfaceIndexFor returned Tailscale interface")
 		return defaultIdx()
@@ -115,19 +121,110 @@ func getInterfaceIndex(logf logger.Logf, netMon *netmon.Monitor, address string)
 	return idx, err
 }
 
+// checkInterfaceFamily returns an error if the interface with index idx
+// has no address in the family of address, according to netMon. It
+// returns nil if that can't be determined.
+func checkInterfaceFamily(logf logger.Logf, netMon *netmon.Monitor, idx int, address string) error {
+	if netMon == nil {
+		return nil
+	}
+	dst, err := parseAddress(address)
+	if err != nil {
+		return nil
+	}
+	state := netMon.InterfaceState()
+	if state == nil {
+		return nil
+	}
+	for name, iface := range state.Interface {
+		if iface.Index == idx {
+			return checkBindFamily(logf, name, state.InterfaceIPs[name], dst)
+		}
+	}
+	return nil
+}
+
+var metricBindFamilyMismatch = clientmetric.NewCounter("netns_bind_family_mismatch")
+
+// checkBindFamily returns an error if ifaceIPs, the addresses of the
+// interface ifName that a connection to dst is about to be bound to,
+// don't include one that can reach dst. Binding to such an interface,
+// such as an IPv4-only one for an IPv6 dst, only makes the dial fail
+// later with a less useful error, so callers should fail the dial with
+// the returned error instead. They must not leave the socket unbound, as
+// it could then be routed over the Tailscale interface.
+func checkBindFamily(logf logger.Logf, ifName string, ifaceIPs []netip.Prefix, dst netip.Addr) error {
+	if ifaceHasAddrFamily(ifaceIPs, dst) {
+		return nil
+	}
+	metricBindFamilyMismatch.Add(1)
+	fam := "IPv4"
+	if dst.Is6() && !dst.Is4In6() {
+		fam = "IPv6"
+	}
+	err := fmt.Errorf("interface %q has no %s address to reach %v", ifName, fam, dst)
+	logf("netns: refusing to bind: %v", err)
+	return err
+}
+
+// ifaceHasAddrFamily reports whether ifaceIPs includes an address that
+// can be used as the source address for traffic to dst: any IPv4
+// address if dst is IPv4, or a non-link-local IPv6 address if dst is
+// IPv6 (any IPv6 address will do if dst itself is link-local).
+func ifaceHasAddrFamily(ifaceIPs []netip.Prefix, dst netip.Addr) bool {
+	dst = dst.Unmap()
+	for _, pfx := range ifaceIPs {
+		ip := pfx.Addr()
+		if ip.IsLoopback() {
+			continue
+		}
+		if dst.Is4() {
+			if ip.Is4() {
+				return true
+			}
+			continue
+		}
+		if ip.Is6() && (!ip.IsLinkLocalUnicast() || dst.IsLinkLocalUnicast()) {
+			return true
+		}
+	}
+	return false
+}
+
 // tailscaleInterface returns the current machine's Tailscale interface, if any.
 // If none is found, (nil, nil) is returned.
 // A non-nil error is only returned on a problem listing the system interfaces.
-func tailscaleInterface() (*net.Interface, error) {
+//
+// If netMon knows the Tailscale interface's name, the interface with that
+// name is returned; see findTailscaleInterface.
+func tailscaleInterface(netMon *netmon.Monitor) (*net.Interface, error) {
 	ifs, err := net.Interfaces()
 	if err != nil {
 		return nil, err
 	}
-	for _, iface := range ifs {
+	return findTailscaleInterface(ifs, netMon.TailscaleInterfaceName(), (*net.Interface).Addrs), nil
+}
+
+// findTailscaleInterface returns the Tailscale interface among ifs, or nil
+// if there's none. It's the one named tsIfName, if tsIfName is non-empty
+// and one of ifs has that name. Otherwise, as the name isn't known, it's
+// the first utun interface that has a Tailscale IP according to ifAddrs,
+// which can pick the wrong one when several utun interfaces have such an
+// address.
+func findTailscaleInterface(ifs []net.Interface, tsIfName string, ifAddrs func(*net.Interface) ([]net.Addr, error)) *net.Interface {
+	if tsIfName != "" {
+		for i := range ifs {
+			if ifs[i].Name == tsIfName {
+				return &ifs[i]
+			}
+		}
+	}
+	for i := range ifs {
+		iface := &ifs[i]
 		if !strings.HasPrefix(iface.Name, "utun") {
 			continue
 		}
-		addrs, err := iface.Addrs()
+		addrs, err := ifAddrs(iface)
 		if err != nil {
 			continue
 		}
@@ -135,12 +232,12 @@ func tailscaleInterface() (*net.Interface, error) {
 			if ipnet, ok := a.(*net.IPNet); ok {
 				nip, ok := netip.AddrFromSlice(ipnet.IP)
 				if ok && tsaddr.IsTailscaleIP(nip.Unmap()) {
-					return &iface, nil
+					return iface
 				}
 			}
 		}
 	}
-	return nil, nil
+	return nil
 }
 
 // interfaceIndexFor returns the interface index that we should bind to in
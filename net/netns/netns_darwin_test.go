@@ -4,6 +4,8 @@
 package netns
 
 import (
+	"net"
+	"net/netip"
 	"testing"
 
 	"tailscale.com/net/netmon"
@@ -55,7 +57,7 @@ func TestGetInterfaceIndex(t *testing.T) {
 	}
 
 	t.Run("NoTailscale", func(t *testing.T) {
-		tsif, err := tailscaleInterface()
+		tsif, err := tailscaleInterface(nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -82,3 +84,106 @@ func TestGetInterfaceIndex(t *testing.T) {
 		}
 	})
 }
+
+func TestFindTailscaleInterface(t *testing.T) {
+	ifs := []net.Interface{
+		{Index: 1, Name: "en0"},
+		{Index: 5, Name: "utun2"}, // decoy: another VPN with a CGNAT address
+		{Index: 7, Name: "utun4"},
+		{Index: 9, Name: "utun6"},
+	}
+	ipNet := func(s string) *net.IPNet {
+		p := netip.MustParsePrefix(s)
+		return &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())}
+	}
+	addrs := map[string][]net.Addr{
+		"en0":   {ipNet("192.168.1.10/24")},
+		"utun2": {ipNet("100.96.0.3/32")},
+		"utun4": {ipNet("100.101.102.103/32"), ipNet("fd7a:115c:a1e0::1/128")},
+		"utun6": {ipNet("fe80::1/64")},
+	}
+	ifAddrs := func(iface *net.Interface) ([]net.Addr, error) {
+		return addrs[iface.Name], nil
+	}
+
+	tests := []struct {
+		name     string
+		tsIfName string
+		want     string // empty means none
+	}{
+		{"no-name-first-with-ts-ip", "", "utun2"},
+		{"name-skips-decoy", "utun4", "utun4"},
+		{"name-without-ts-ip", "utun6", "utun6"},
+		{"unknown-name-falls-back", "utun9", "utun2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findTailscaleInterface(ifs, tt.tsIfName, ifAddrs)
+			var gotName string
+			if got != nil {
+				gotName = got.Name
+			}
+			if gotName != tt.want {
+				t.Errorf("findTailscaleInterface(%q) = %q; want %q", tt.tsIfName, gotName, tt.want)
+			}
+		})
+	}
+
+	if got := findTailscaleInterface(ifs[:1], "", ifAddrs); got != nil {
+		t.Errorf("without utun interfaces, got %q; want none", got.Name)
+	}
+}
+
+func TestIfaceHasAddrFamily(t *testing.T) {
+	pfxs := func(s ...string) (ret []netip.Prefix) {
+		for _, s := range s {
+			ret = append(ret, netip.MustParsePrefix(s))
+		}
+		return ret
+	}
+	v4Only := pfxs("192.168.1.10/24", "fe80::1/64")
+	dualStack := pfxs("192.168.1.10/24", "fe80::1/64", "2001:db8::10/64")
+	v6Only := pfxs("2001:db8::10/64")
+
+	tests := []struct {
+		name string
+		ips  []netip.Prefix
+		dst  string
+		want bool
+	}{
+		{"v4-only to v4", v4Only, "8.8.8.8", true},
+		{"v4-only to v6", v4Only, "2001:4860:4860::8888", false},
+		{"v4-only to v6 link-local", v4Only, "fe80::2", true},
+		{"v4-only to v4-mapped v6", v4Only, "::ffff:8.8.8.8", true},
+		{"dual-stack to v4", dualStack, "8.8.8.8", true},
+		{"dual-stack to v6", dualStack, "2001:4860:4860::8888", true},
+		{"v6-only to v4", v6Only, "8.8.8.8", false},
+		{"v6-only to v6", v6Only, "2001:4860:4860::8888", true},
+		{"loopback only", pfxs("127.0.0.1/8", "::1/128"), "8.8.8.8", false},
+		{"no addresses", nil, "8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ifaceHasAddrFamily(tt.ips, netip.MustParseAddr(tt.dst)); got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBindFamily(t *testing.T) {
+	v4Only := []netip.Prefix{netip.MustParsePrefix("192.168.1.10/24")}
+	before := metricBindFamilyMismatch.Value()
+
+	if err := checkBindFamily(t.Logf, "en0", v4Only, netip.MustParseAddr("8.8.8.8")); err != nil {
+		t.Errorf("v4 dst: unexpected error: %v", err)
+	}
+	err := checkBindFamily(t.Logf, "en0", v4Only, netip.MustParseAddr("2001:4860:4860::8888"))
+	const want = `interface "en0" has no IPv6 address to reach 2001:4860:4860::8888`
+	if err == nil || err.Error() != want {
+		t.Errorf("v6 dst: got error %v; want %q", err, want)
+	}
+	if got := metricBindFamilyMismatch.Value() - before; got != 1 {
+		t.Errorf("metric increased by %d; want 1", got)
+	}
+}
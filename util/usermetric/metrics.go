@@ -37,7 +37,8 @@ type DropLabels struct {
 	Reason DropReason
 }
 
-// initOnce initializes the common metrics.
+// initOnce initializes the common metrics. r must not be a staging
+// Registry; see commonRegistry.
 func (r *Registry) initOnce() {
 	r.m.initOnce.Do(func() {
 		r.m.droppedPacketsInbound = NewMultiLabelMapWithRegistry[DropLabels](
@@ -55,15 +56,27 @@ func (r *Registry) initOnce() {
 	})
 }
 
+// commonRegistry returns the Registry that owns r's common metrics: r
+// itself, or for a staging Registry (see Registry.Register), the Registry
+// it commits to.
+func (r *Registry) commonRegistry() *Registry {
+	for r.parent != nil {
+		r = r.parent
+	}
+	return r
+}
+
 // DroppedPacketsOutbound returns the outbound dropped packet metric, creating it
 // if necessary.
 func (r *Registry) DroppedPacketsOutbound() *metrics.MultiLabelMap[DropLabels] {
+	r = r.commonRegistry()
 	r.initOnce()
 	return r.m.droppedPacketsOutbound
 }
 
 // DroppedPacketsInbound returns the inbound dropped packet metric.
 func (r *Registry) DroppedPacketsInbound() *metrics.MultiLabelMap[DropLabels] {
+	r = r.commonRegistry()
 	r.initOnce()
 	return r.m.droppedPacketsInbound
 }
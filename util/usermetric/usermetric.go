@@ -9,11 +9,15 @@
 	"expvar"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"tailscale.com/metrics"
 	"tailscale.com/tsweb/varz"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/set"
 )
 
@@ -23,6 +27,72 @@ type Registry struct {
 
 	// m contains common metrics owned by the registry.
 	m Metrics
+
+	// parent, if non-nil, means this is a staging Registry that Register
+	// commits to parent. Common metrics are taken from parent directly.
+	parent *Registry
+
+	mu         sync.Mutex
+	deprecated map[string]string // metric name => note; see Deprecate
+}
+
+// Register calls f with a staging Registry and, if f succeeds, adds all the
+// metrics that f registered with it to r at once. If f returns an error or
+// panics (as NewMultiLabelMapWithRegistry does for invalid label types),
+// none of them are added and the error, or the panic as an error, is
+// returned. This makes registering a group of related metrics
+// all-or-nothing.
+//
+// The common metrics, such as DroppedPacketsInbound, aren't staged: asking
+// the staging Registry for them registers them with r immediately, as
+// they're shared by all subsystems anyway.
+func (r *Registry) Register(f func(reg *Registry) error) (err error) {
+	staged := &Registry{parent: r}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("usermetric: registration panicked: %v", p)
+		}
+	}()
+	if err := f(staged); err != nil {
+		return err
+	}
+	staged.vars.Do(func(kv expvar.KeyValue) {
+		r.vars.Set(kv.Key, kv.Value)
+	})
+	for name, note := range staged.deprecated {
+		r.Deprecate(name, note)
+	}
+	return nil
+}
+
+// Deprecate marks the metric called name as deprecated, with a note for
+// those who use it, such as "use tailscaled_foo_total instead". The
+// Handler writes the note in a "# DEPRECATED <name>: <note>" comment line
+// before the metric, for scrapers and dashboards to warn about; otherwise
+// the metric is served as before. It can be called before or after the
+// metric is registered. Like help texts, notes must be valid UTF-8.
+func (r *Registry) Deprecate(name, note string) {
+	note = normalizeHelp(note)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mak.Set(&r.deprecated, name, note)
+}
+
+// deprecatedVar is a metric marked with Registry.Deprecate, as served by
+// Registry.Handler.
+type deprecatedVar struct {
+	expvar.Var // a varz.PrometheusWriter
+	note       string
+}
+
+// WritePrometheus implements varz.PrometheusWriter.
+func (v deprecatedVar) WritePrometheus(w io.Writer, name string) {
+	io.WriteString(w, "# DEPRECATED ")
+	io.WriteString(w, name)
+	io.WriteString(w, ": ")
+	metrics.WritePromHelpText(w, v.note) // escaped like help text
+	io.WriteString(w, "\n")
+	v.Var.(varz.PrometheusWriter).WritePrometheus(w, name)
 }
 
 // NewMultiLabelMapWithRegistry creates and register a new
@@ -35,7 +105,7 @@ type Registry struct {
 func NewMultiLabelMapWithRegistry[T comparable](m *Registry, name string, promType, helpText string) *metrics.MultiLabelMap[T] {
 	ml := &metrics.MultiLabelMap[T]{
 		Type: promType,
-		Help: helpText,
+		Help: normalizeHelp(helpText),
 	}
 	var zero T
 	_ = metrics.LabelString(zero) // panic early if T is invalid
@@ -43,6 +113,18 @@ func NewMultiLabelMapWithRegistry[T comparable](m *Registry, name string, promTy
 	return ml
 }
 
+// normalizeHelp returns help with surrounding whitespace removed. It panics
+// if help isn't valid UTF-8, which the Prometheus exposition format
+// requires; help texts are expected to be constants, so this catches
+// mistakes at registration rather than as malformed scrape output.
+// Backslashes and newlines are allowed and escaped when written.
+func normalizeHelp(help string) string {
+	if !utf8.ValidString(help) {
+		panic(fmt.Sprintf("usermetric: help text %q is not valid UTF-8", help))
+	}
+	return strings.TrimSpace(help)
+}
+
 // Gauge is a gauge metric with no labels.
 type Gauge struct {
 	m    *expvar.Float
@@ -51,7 +133,7 @@ type Gauge struct {
 
 // NewGauge creates and register a new gauge metric with the given name and help text.
 func (r *Registry) NewGauge(name, help string) *Gauge {
-	g := &Gauge{&expvar.Float{}, help}
+	g := &Gauge{&expvar.Float{}, normalizeHelp(help)}
 	r.vars.Set(name, g)
 	return g
 }
@@ -79,22 +161,96 @@ func (g *Gauge) WritePrometheus(w io.Writer, name string) {
 	io.WriteString(w, "# TYPE ")
 	io.WriteString(w, name)
 	io.WriteString(w, " gauge\n")
-	if g.help != "" {
-		io.WriteString(w, "# HELP ")
-		io.WriteString(w, name)
-		io.WriteString(w, " ")
-		io.WriteString(w, g.help)
-		io.WriteString(w, "\n")
-	}
+	metrics.WritePromHelp(w, name, g.help)
 
 	io.WriteString(w, name)
 	fmt.Fprintf(w, " %v\n", g.m.Value())
 }
 
+// IntGauge is a gauge metric with no labels and an integer value, which
+// may be negative.
+type IntGauge struct {
+	m    *expvar.Int
+	help string
+}
+
+// NewIntGauge creates and registers a new integer gauge metric with the
+// given name and help text.
+func (r *Registry) NewIntGauge(name, help string) *IntGauge {
+	g := &IntGauge{&expvar.Int{}, normalizeHelp(help)}
+	r.vars.Set(name, g)
+	return g
+}
+
+// Set sets the gauge to the given value.
+func (g *IntGauge) Set(v int64) {
+	if g == nil {
+		return
+	}
+	g.m.Set(v)
+}
+
+// Add adds delta, which may be negative, to the gauge.
+func (g *IntGauge) Add(delta int64) {
+	if g == nil {
+		return
+	}
+	g.m.Add(delta)
+}
+
+// Value returns the gauge's current value.
+func (g *IntGauge) Value() int64 {
+	if g == nil {
+		return 0
+	}
+	return g.m.Value()
+}
+
+// String returns the string of the underlying expvar.Int.
+// This satisfies the expvar.Var interface.
+func (g *IntGauge) String() string {
+	if g == nil {
+		return ""
+	}
+	return g.m.String()
+}
+
+// WritePrometheus writes the gauge metric in Prometheus format to the given writer.
+// This satisfies the varz.PrometheusWriter interface.
+func (g *IntGauge) WritePrometheus(w io.Writer, name string) {
+	io.WriteString(w, "# TYPE ")
+	io.WriteString(w, name)
+	io.WriteString(w, " gauge\n")
+	metrics.WritePromHelp(w, name, g.help)
+
+	io.WriteString(w, name)
+	fmt.Fprintf(w, " %d\n", g.m.Value())
+}
+
 // Handler returns a varz.Handler that serves the userfacing expvar contained
 // in this package.
+//
+// If the request has a "prefix" query parameter, only metrics whose names
+// start with it are served.
 func (r *Registry) Handler(w http.ResponseWriter, req *http.Request) {
-	varz.ExpvarDoHandler(r.vars.Do)(w, req)
+	prefix := req.URL.Query().Get("prefix")
+	r.mu.Lock()
+	deprecated := maps.Clone(r.deprecated)
+	r.mu.Unlock()
+	do := func(f func(expvar.KeyValue)) {
+		r.vars.Do(func(kv expvar.KeyValue) {
+			if !strings.HasPrefix(kv.Key, prefix) {
+				return
+			}
+			if note, ok := deprecated[kv.Key]; ok {
+				if _, ok := kv.Value.(varz.PrometheusWriter); ok {
+					kv.Value = deprecatedVar{kv.Value, note}
+				}
+			}
+			f(kv)
+		})
+	}
+	varz.ExpvarDoHandler(do)(w, req)
 }
 
 // String returns the string representation of all the metrics and their
@@ -117,3 +273,101 @@ func (r *Registry) MetricNames() []string {
 
 	return ret.Slice()
 }
+
+// LabelCardinality returns the number of distinct label sets in each
+// MultiLabelMap in the registry, keyed by metric name. Metrics without
+// labels aren't included.
+//
+// It's meant for spotting runaway label cardinality, which otherwise only
+// shows up as ever slower scrapes.
+func (r *Registry) LabelCardinality() map[string]int {
+	ret := make(map[string]int)
+	r.vars.Do(func(kv expvar.KeyValue) {
+		if m, ok := kv.Value.(interface{ Len() int }); ok {
+			ret[kv.Key] = m.Len()
+		}
+	})
+	return ret
+}
+
+// Snapshot is the values of a Registry's metrics at one point in time, as
+// returned by Registry.Snapshot. It's keyed by metric name or, for each
+// label set of a metric with labels, by the metric name followed by the
+// Prometheus-formatted labels, such as
+// `tailscaled_inbound_dropped_packets_total{reason="acl"}`.
+type Snapshot map[string]float64
+
+// Snapshot returns the current values of the metrics in the registry.
+// Metrics whose values aren't numbers are left out.
+//
+// It is primarily intended for tests that check how an operation changes
+// metrics, using Diff, without parsing the Handler's output.
+func (r *Registry) Snapshot() Snapshot {
+	ret := make(Snapshot)
+	r.vars.Do(func(kv expvar.KeyValue) {
+		if m, ok := kv.Value.(interface {
+			DoLabeled(func(string, expvar.Var))
+		}); ok {
+			m.DoLabeled(func(labels string, v expvar.Var) {
+				if f, ok := varValue(v); ok {
+					ret[kv.Key+labels] = f
+				}
+			})
+			return
+		}
+		if f, ok := varValue(kv.Value); ok {
+			ret[kv.Key] = f
+		}
+	})
+	return ret
+}
+
+// varValue returns the numeric value of v, if it has one.
+func varValue(v expvar.Var) (_ float64, ok bool) {
+	switch v := v.(type) {
+	case *expvar.Int:
+		return float64(v.Value()), true
+	case *expvar.Float:
+		return v.Value(), true
+	case *Gauge:
+		return v.m.Value(), true
+	case *IntGauge:
+		return float64(v.m.Value()), true
+	}
+	return 0, false
+}
+
+// Diff returns how much each metric changed between the snapshots before
+// and after, for the metrics that did. A metric missing from one of the
+// snapshots, such as a label set that was first used in between, counts
+// as zero there.
+func Diff(before, after Snapshot) map[string]float64 {
+	ret := make(map[string]float64)
+	for k, v := range after {
+		if d := v - before[k]; d != 0 {
+			ret[k] = d
+		}
+	}
+	for k, v := range before {
+		if _, ok := after[k]; !ok && v != 0 {
+			ret[k] = -v
+		}
+	}
+	return ret
+}
+
+// Reset removes all metrics from the registry, including the common
+// metrics, and their deprecation notes, leaving it as if it had just been
+// created. Metrics obtained before the reset keep working but are no
+// longer exported.
+//
+// It is primarily intended for tests that share a Registry and need a
+// clean slate between runs. It must not be called concurrently with
+// other uses of the registry.
+func (r *Registry) Reset() {
+	r.vars.Init()
+	r.m = Metrics{}
+	r.mu.Lock()
+	r.deprecated = nil
+	r.mu.Unlock()
+}
@@ -5,7 +5,14 @@
 
 import (
 	"bytes"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"tailscale.com/util/set"
 )
 
 func TestGauge(t *testing.T) {
@@ -24,3 +31,310 @@ func TestGauge(t *testing.T) {
 	}
 
 }
+
+func TestGaugeHelpEscaping(t *testing.T) {
+	var reg Registry
+	g := reg.NewGauge("test_gauge", "  Bytes read from C:\\data\nper second\n")
+	g.Set(1)
+
+	var buf bytes.Buffer
+	g.WritePrometheus(&buf, "test_gauge")
+	const want = `# TYPE test_gauge gauge
+# HELP test_gauge Bytes read from C:\\data\nper second
+test_gauge 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	ml := NewMultiLabelMapWithRegistry[struct{ Dir string }](&reg, "test_map", "counter", "a\\b\nc ")
+	ml.Add(struct{ Dir string }{"in"}, 1)
+	buf.Reset()
+	ml.WritePrometheus(&buf, "test_map")
+	if got, want := buf.String(), "# HELP test_map a\\\\b\\nc\n"; !strings.Contains(got, want) {
+		t.Errorf("got %q; want it to contain %q", got, want)
+	}
+}
+
+func TestIntGauge(t *testing.T) {
+	var reg Registry
+	g := reg.NewIntGauge("test_queue_delta", "Change in queue length")
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		reg.Handler(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	g.Set(3)
+	const want3 = `# TYPE test_queue_delta gauge
+# HELP test_queue_delta Change in queue length
+test_queue_delta 3
+`
+	if got := scrape(); got != want3 {
+		t.Errorf("after Set: got %q; want %q", got, want3)
+	}
+
+	g.Add(-10)
+	if got, want := scrape(), "test_queue_delta -7\n"; !strings.Contains(got, want) {
+		t.Errorf("after Add: got %q; want it to contain %q", got, want)
+	}
+	if got := g.Value(); got != -7 {
+		t.Errorf("Value = %d; want -7", got)
+	}
+	if got := reg.Snapshot()["test_queue_delta"]; got != -7 {
+		t.Errorf("Snapshot value = %v; want -7", got)
+	}
+
+	var nilGauge *IntGauge
+	nilGauge.Set(1)
+	nilGauge.Add(1)
+	if v := nilGauge.Value(); v != 0 {
+		t.Errorf("nil IntGauge Value = %d; want 0", v)
+	}
+}
+
+func TestNewGaugeInvalidHelp(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewGauge with invalid UTF-8 help didn't panic")
+		}
+	}()
+	var reg Registry
+	reg.NewGauge("test_gauge", "bad \xff help")
+}
+
+func TestReset(t *testing.T) {
+	var reg Registry
+	reg.NewGauge("test_gauge", "This is a test gauge").Set(1)
+	reg.DroppedPacketsInbound()
+	if got := len(reg.MetricNames()); got != 3 {
+		t.Fatalf("got %d metrics before reset; want 3", got)
+	}
+
+	reg.Reset()
+	if got := reg.String(); got != "" {
+		t.Errorf("String after reset = %q; want empty", got)
+	}
+	if got := reg.MetricNames(); len(got) != 0 {
+		t.Errorf("MetricNames after reset = %q; want empty", got)
+	}
+
+	// The common metrics are recreated on demand after a reset.
+	if reg.DroppedPacketsOutbound() == nil {
+		t.Fatal("DroppedPacketsOutbound is nil after reset")
+	}
+	if got := len(reg.MetricNames()); got != 2 {
+		t.Errorf("got %d metrics after re-registering; want 2", got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var reg Registry
+	errBoom := errors.New("boom")
+	err := reg.Register(func(reg *Registry) error {
+		reg.NewGauge("first_gauge", "Registered before the error")
+		return errBoom
+	})
+	if err != errBoom {
+		t.Fatalf("Register = %v; want %v", err, errBoom)
+	}
+	if got := reg.MetricNames(); len(got) != 0 {
+		t.Errorf("after failed Register, MetricNames = %q; want empty", got)
+	}
+
+	// A panic partway through is returned as an error and also rolls back.
+	err = reg.Register(func(reg *Registry) error {
+		reg.NewGauge("first_gauge", "Registered before the panic")
+		NewMultiLabelMapWithRegistry[int](reg, "bad_labels", "counter", "Labels aren't a struct")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Register with a panicking func succeeded")
+	}
+	if got := reg.MetricNames(); len(got) != 0 {
+		t.Errorf("after panicking Register, MetricNames = %q; want empty", got)
+	}
+
+	var g *Gauge
+	err = reg.Register(func(reg *Registry) error {
+		g = reg.NewGauge("first_gauge", "First gauge")
+		reg.NewGauge("second_gauge", "Second gauge")
+		reg.DroppedPacketsInbound()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := set.Of("first_gauge", "second_gauge",
+		"tailscaled_inbound_dropped_packets_total", "tailscaled_outbound_dropped_packets_total")
+	if got := set.SetOf(reg.MetricNames()); !maps.Equal(got, want) {
+		t.Errorf("MetricNames = %v; want %v", got, want)
+	}
+	if reg.DroppedPacketsInbound() == nil {
+		t.Error("DroppedPacketsInbound is nil")
+	}
+	g.Set(5)
+	if got := reg.String(); !strings.Contains(got, "first_gauge: 5") {
+		t.Errorf("String = %q; want it to contain first_gauge: 5", got)
+	}
+}
+
+func TestHandlerPrefix(t *testing.T) {
+	var reg Registry
+	reg.NewGauge("serve_requests", "Serve requests").Set(1)
+	reg.NewGauge("serve_errors", "Serve errors").Set(2)
+	reg.NewGauge("other_gauge", "Something else").Set(3)
+
+	scrape := func(target string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		reg.Handler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", target, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	all := scrape("/metrics")
+	for _, name := range []string{"serve_requests 1", "serve_errors 2", "other_gauge 3"} {
+		if !strings.Contains(all, name) {
+			t.Errorf("unfiltered scrape missing %q; got:\n%s", name, all)
+		}
+	}
+
+	filtered := scrape("/metrics?prefix=serve_")
+	for _, name := range []string{"serve_requests 1", "serve_errors 2"} {
+		if !strings.Contains(filtered, name) {
+			t.Errorf("filtered scrape missing %q; got:\n%s", name, filtered)
+		}
+	}
+	if strings.Contains(filtered, "other_gauge") {
+		t.Errorf("filtered scrape includes other_gauge; got:\n%s", filtered)
+	}
+
+	if got := scrape("/metrics?prefix=nope_"); got != "" {
+		t.Errorf("scrape with unmatched prefix = %q; want empty", got)
+	}
+}
+
+func TestDeprecate(t *testing.T) {
+	var reg Registry
+	reg.NewGauge("test_old_bytes", "Bytes, the old way").Set(1)
+	reg.NewGauge("test_new_bytes", "Bytes, the new way").Set(1)
+	reg.Deprecate("test_old_bytes", "use test_new_bytes")
+	type dirLabel struct{ Dir string }
+	ml := NewMultiLabelMapWithRegistry[dirLabel](&reg, "test_old_packets", "counter", "Packets")
+	ml.Add(dirLabel{"in"}, 1)
+	if err := reg.Register(func(reg *Registry) error {
+		reg.Deprecate("test_old_packets", "use test_new_packets\nwith a Dir label")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reg.Register(func(reg *Registry) error {
+		reg.Deprecate("test_new_bytes", "not committed")
+		return errors.New("boom")
+	})
+
+	scrape := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		reg.Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	got := scrape()
+	for _, want := range []string{
+		"# DEPRECATED test_old_bytes: use test_new_bytes\n# TYPE test_old_bytes gauge\n",
+		"# DEPRECATED test_old_packets: use test_new_packets\\nwith a Dir label\n# TYPE test_old_packets counter\n",
+		"test_old_bytes 1\n",
+		`test_old_packets{dir="in"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("scrape missing %q; got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "# DEPRECATED test_new_bytes") {
+		t.Errorf("failed Register deprecated test_new_bytes; got:\n%s", got)
+	}
+
+	reg.Reset()
+	reg.NewGauge("test_old_bytes", "Bytes, the old way").Set(1)
+	if got := scrape(); strings.Contains(got, "DEPRECATED") {
+		t.Errorf("deprecation survived Reset; got:\n%s", got)
+	}
+}
+
+func TestLabelCardinality(t *testing.T) {
+	var reg Registry
+	type peerLabels struct {
+		Peer string
+		Kind string
+	}
+	m := NewMultiLabelMapWithRegistry[peerLabels](&reg, "test_peer_bytes", "counter", "Bytes per peer")
+	NewMultiLabelMapWithRegistry[peerLabels](&reg, "test_empty", "counter", "Nothing here")
+	reg.NewGauge("test_gauge", "A gauge").Set(1)
+
+	for _, peer := range []string{"a", "b", "c"} {
+		m.Add(peerLabels{peer, "rx"}, 1)
+		m.Add(peerLabels{peer, "tx"}, 1)
+	}
+	m.Add(peerLabels{"a", "rx"}, 1) // existing label set
+
+	got := reg.LabelCardinality()
+	want := map[string]int{"test_peer_bytes": 6, "test_empty": 0}
+	if !maps.Equal(got, want) {
+		t.Errorf("LabelCardinality = %v; want %v", got, want)
+	}
+
+	m.Delete(peerLabels{"c", "tx"})
+	if got := reg.LabelCardinality()["test_peer_bytes"]; got != 5 {
+		t.Errorf("after Delete, cardinality = %d; want 5", got)
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	var reg Registry
+	type peerLabels struct {
+		Peer string
+	}
+	m := NewMultiLabelMapWithRegistry[peerLabels](&reg, "test_peer_bytes", "counter", "Bytes per peer")
+	g := reg.NewGauge("test_gauge", "A gauge")
+	g.Set(5)
+	m.Add(peerLabels{"a"}, 10)
+	m.Add(peerLabels{"b"}, 1)
+	drops := reg.DroppedPacketsInbound()
+
+	before := reg.Snapshot()
+	want := Snapshot{
+		"test_gauge":                5,
+		`test_peer_bytes{peer="a"}`: 10,
+		`test_peer_bytes{peer="b"}`: 1,
+	}
+	if !maps.Equal(before, want) {
+		t.Errorf("Snapshot = %v; want %v", before, want)
+	}
+
+	m.Add(peerLabels{"a"}, 3)
+	m.Add(peerLabels{"c"}, 2) // new label set
+	m.Add(peerLabels{"b"}, 0)
+	g.Set(4.5)
+	drops.Add(DropLabels{Reason: ReasonACL}, 1)
+
+	got := Diff(before, reg.Snapshot())
+	wantDiff := map[string]float64{
+		`test_peer_bytes{peer="a"}`: 3,
+		`test_peer_bytes{peer="c"}`: 2,
+		"test_gauge":                -0.5,
+		`tailscaled_inbound_dropped_packets_total{reason="acl"}`: 1,
+	}
+	if !maps.Equal(got, wantDiff) {
+		t.Errorf("Diff = %v; want %v", got, wantDiff)
+	}
+
+	// Metrics that go away count as having dropped to zero.
+	m.Delete(peerLabels{"b"})
+	if got, want := Diff(before, reg.Snapshot())[`test_peer_bytes{peer="b"}`], -1.0; got != want {
+		t.Errorf("Diff for deleted label set = %v; want %v", got, want)
+	}
+}
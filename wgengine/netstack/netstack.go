@@ -990,6 +990,10 @@ func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
 			return true
 		}
 	}
+	// Handle TCP connections to the VIP Services that the node serves.
+	if ns.lb != nil && p.IPProto == ipproto.TCP && !isLocal && ns.lb.ShouldInterceptVIPServiceTCPPort(p.Dst) {
+		return true
+	}
 	if p.IPVersion == 6 && !isLocal && viaRange.Contains(dstIP) {
 		return ns.lb != nil && ns.lb.ShouldHandleViaIP(dstIP)
 	}